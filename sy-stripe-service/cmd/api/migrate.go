@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"sy-stripe-service/internal/config"
+	"sy-stripe-service/internal/database"
+)
+
+const migrateUsage = `usage: api [-migrations-dir DIR] migrate <command>
+
+commands:
+  up        apply all pending migrations
+  down [N]  roll back the last N applied migrations (default 1)
+  status    list migrations and whether they are applied
+  redo      roll back and re-apply the last applied migration`
+
+// runMigrate implements the "migrate" subcommand.
+func runMigrate(migrations fs.FS, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", migrateUsage)
+	}
+
+	cfg, err := config.LoadDatabaseConfig()
+	if err != nil {
+		return err
+	}
+	db, err := database.NewDB(cfg.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	m, err := db.Migrator(migrations)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s)\n", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("down: N must be a positive number")
+			}
+		}
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back %d migration(s)\n", n)
+	case "redo":
+		if err := m.Redo(ctx); err != nil {
+			return err
+		}
+		fmt.Println("Redid the last migration")
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, s := range statuses {
+			state, appliedAt := "pending", ""
+			if s.Applied {
+				state = "applied"
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Modified {
+				state = "modified"
+			}
+			if s.Missing {
+				state = "missing"
+			}
+			fmt.Fprintf(w, "%03d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], migrateUsage)
+	}
+	return nil
+}
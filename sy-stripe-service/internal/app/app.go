@@ -0,0 +1,225 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"sy-stripe-service/internal/app/handlers"
+	"sy-stripe-service/internal/app/middleware"
+	"sy-stripe-service/internal/app/services"
+	"sy-stripe-service/internal/config"
+	"sy-stripe-service/internal/database"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Deps holds the external dependencies of the service.
+// A nil DB (or one without a connection) selects the in-memory repositories,
+// a nil Gateway talks to Stripe with cfg.StripeSecretKey, a nil Notifier only logs notifications
+// and a nil Clock uses time.Now.
+type Deps struct {
+	DB       *database.DB
+	Gateway  services.BillingGateway
+	Notifier services.Notifier
+	// Clock is the current time the dunning, catalog cache, usage and trial services work with.
+	Clock func() time.Time
+}
+
+// App is the assembled service: the HTTP API and the background workers it relies on.
+type App struct {
+	Handler http.Handler
+	// Workers are started by Run next to the HTTP server.
+	Workers []Worker
+}
+
+// New builds every repository, service, handler and middleware and returns the HTTP handler
+// serving the whole API.
+func New(cfg *config.Config, deps Deps) http.Handler {
+	return Build(cfg, deps).Handler
+}
+
+// Build assembles the service like New and also returns its background workers.
+func Build(cfg *config.Config, deps Deps) *App {
+	gateway := deps.Gateway
+	if gateway == nil {
+		gateway = services.NewStripeGateway(cfg.StripeSecretKey)
+	}
+	notifier := deps.Notifier
+	if notifier == nil {
+		notifier = services.LogNotifier{}
+	}
+	db := deps.DB
+	if db == nil {
+		db = &database.DB{}
+	}
+	clock := deps.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+
+	// Initialize repositories and services
+	var userRepo database.UserRepository
+	var subRepo database.SubscriptionRepository
+	var eventRepo database.StripeEventRepository
+	var invoiceRepo database.InvoiceRepository
+	var dunningRepo database.DunningRepository
+	var usageRepo database.UsageRepository
+	var uow database.UnitOfWork
+	switch db.Dialect() {
+	case database.DialectPostgres:
+		userRepo = database.NewPostgresUserRepository(db.Postgres)
+		subRepo = database.NewPostgresSubscriptionRepository(db.Postgres)
+		eventRepo = database.NewPostgresStripeEventRepository(db.Postgres)
+		invoiceRepo = database.NewPostgresInvoiceRepository(db.Postgres)
+		dunningRepo = database.NewPostgresDunningRepository(db.Postgres)
+		usageRepo = database.NewPostgresUsageRepository(db.Postgres)
+		uow = database.NewPostgresUnitOfWork(db.Postgres)
+	case database.DialectSQLite:
+		userRepo = database.NewSQLiteUserRepository(db.SQLite)
+		subRepo = database.NewSQLiteSubscriptionRepository(db.SQLite)
+		eventRepo = database.NewSQLiteStripeEventRepository(db.SQLite)
+		invoiceRepo = database.NewSQLiteInvoiceRepository(db.SQLite)
+		dunningRepo = database.NewSQLiteDunningRepository(db.SQLite)
+		usageRepo = database.NewSQLiteUsageRepository(db.SQLite)
+		uow = database.NewSQLiteUnitOfWork(db.SQLite)
+	default:
+		users := database.NewInMemoryUserRepository()
+		subs := database.NewInMemorySubscriptionRepository()
+		users.JoinSubscriptions(subs)
+		userRepo, subRepo = users, subs
+		eventRepo = database.NewInMemoryStripeEventRepository()
+		invoiceRepo = database.NewInMemoryInvoiceRepository()
+		dunningRepo = database.NewInMemoryDunningRepository()
+		usageRepo = database.NewInMemoryUsageRepository()
+		uow = database.NewInMemoryUnitOfWork(users, subs)
+	}
+	userService := services.NewUserService(userRepo)
+	subService := services.NewSubscriptionService(userRepo, subRepo, uow, gateway)
+	customerService := services.NewCustomerService(userRepo, subService, uow, gateway)
+	portalService := services.NewBillingPortalService(userService, gateway, cfg.AppPortalReturnURL)
+	paymentMethodService := services.NewPaymentMethodService(userService, gateway)
+	productService := services.NewProductService(gateway, cfg.ProductCacheTTL, cfg.ProductCacheStaleTTL)
+	eventService := services.NewStripeEventService(eventRepo)
+	invoiceService := services.NewInvoiceService(invoiceRepo, userRepo, gateway)
+	dunningService := services.NewDunningService(dunningRepo, userRepo, subService, notifier, cfg.DunningSteps)
+	usageService := services.NewUsageService(usageRepo, subService, productService, gateway)
+	trialService := services.NewTrialService(subService, userRepo, notifier, cfg.TrialReminderLead)
+	productService.Now, dunningService.Now, usageService.Now, trialService.Now = clock, clock, clock, clock
+
+	healthHandler := handlers.NewHealthHandler()
+	userHandler := handlers.NewUserHandler(userService, subService, productService, invoiceService, dunningService)
+	customerHandler := handlers.NewCustomerHandler(customerService)
+	invoiceHandler := handlers.NewInvoiceHandler(invoiceService, userService)
+	portalHandler := handlers.NewBillingPortalHandler(portalService)
+	paymentMethodHandler := handlers.NewPaymentMethodHandler(paymentMethodService)
+	subscriptionHandler := handlers.NewSubscriptionHandler(subService)
+	usageHandler := handlers.NewUsageHandler(usageService, subService)
+	stripeHandlers := handlers.NewStripeHandlers(gateway, userService, subService)
+	productHandler := handlers.NewProductHandler(productService)
+	checkoutHandler := handlers.NewCheckoutHandler(subService, userService, cfg.AppSuccessURL, cfg.AppCancelURL)
+	webhookHandler := handlers.NewWebhookHandler(cfg.StripeWebhookSecret, eventService, userService, subService, invoiceService, dunningService, productService, trialService)
+
+	r := gin.Default()
+	r.Use(middleware.CORS(middleware.CORSConfig{
+		AllowedOrigins:   cfg.CORSAllowedOrigins,
+		AllowedMethods:   cfg.CORSAllowedMethods,
+		AllowedHeaders:   cfg.CORSAllowedHeaders,
+		ExposedHeaders:   cfg.CORSExposedHeaders,
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           cfg.CORSMaxAge,
+	}))
+
+	r.GET("/health", healthHandler.HealthCheckHandler)
+
+	// Webhooks authenticate through the Stripe signature instead of the API credentials.
+	r.POST("/api/v1/webhooks/stripe", webhookHandler.HandleStripeWebhook)
+	// The catalog is public: the landing page shows it to visitors.
+	r.GET("/api/v1/products", productHandler.GetProductsHandler)
+
+	auths := authenticators(cfg)
+	// Visitors may start a guest checkout and read it back; checking out as an existing customer
+	// requires credentials (see CheckoutHandler).
+	checkout := r.Group("/api/v1", middleware.OptionalAuth(auths...))
+	{
+		checkout.POST("/checkout-session", checkoutHandler.CreateCheckoutSessionHandler)
+		checkout.GET("/checkout-session/:id", checkoutHandler.GetCheckoutSessionHandler)
+	}
+
+	v1 := r.Group("/api/v1", middleware.Auth(auths...))
+	admin := middleware.RequireAdmin()
+	{
+		v1.POST("/customers/create", admin, stripeHandlers.CreateCustomerHandler)
+		v1.GET("/customers", admin, userHandler.ListUsersHandler)
+		v1.GET("/customers/:id/details", userHandler.GetCustomerDetailsHandler)
+		v1.PATCH("/customers/:id", customerHandler.UpdateCustomerHandler)
+		v1.DELETE("/customers/:id", admin, customerHandler.DeleteCustomerHandler)
+		v1.POST("/customers/:id/portal-session", portalHandler.CreatePortalSessionHandler)
+		v1.POST("/customers/:id/payment-methods/setup-intent", paymentMethodHandler.CreateSetupIntentHandler)
+		v1.GET("/customers/:id/payment-methods", paymentMethodHandler.ListPaymentMethodsHandler)
+		v1.POST("/customers/:id/payment-methods/:pm/default", paymentMethodHandler.SetDefaultPaymentMethodHandler)
+		v1.DELETE("/customers/:id/payment-methods/:pm", paymentMethodHandler.DetachPaymentMethodHandler)
+		v1.GET("/customers/:id/invoices", invoiceHandler.ListInvoicesHandler)
+		v1.POST("/customers/:id/invoices/sync", admin, invoiceHandler.SyncInvoicesHandler)
+
+		v1.POST("/subscriptions/create", admin, stripeHandlers.CreateSubscriptionHandler)
+		v1.GET("/subscriptions/:id", subscriptionHandler.GetSubscriptionHandler)
+		v1.POST("/subscriptions/:id/cancel", subscriptionHandler.CancelSubscriptionHandler)
+		v1.POST("/subscriptions/:id/reactivate", subscriptionHandler.ReactivateSubscriptionHandler)
+		v1.POST("/subscriptions/:id/update-plan", subscriptionHandler.UpdatePlanHandler)
+		v1.POST("/subscriptions/:id/usage", admin, usageHandler.RecordUsageHandler)
+		v1.GET("/subscriptions/:id/usage", usageHandler.GetUsageSummaryHandler)
+	}
+
+	a := &App{Handler: r}
+	if cfg.DunningInterval > 0 {
+		a.Workers = append(a.Workers, Worker{Name: "dunning", Interval: cfg.DunningInterval, Job: func(ctx context.Context) error {
+			_, err := dunningService.ProcessDue(ctx)
+			return err
+		}})
+	}
+	if cfg.UsageFlushInterval > 0 {
+		a.Workers = append(a.Workers, Worker{Name: "usage", Interval: cfg.UsageFlushInterval, Job: func(ctx context.Context) error {
+			_, err := usageService.FlushUsage(ctx)
+			return err
+		}})
+	}
+	if cfg.TrialReminderInterval > 0 {
+		a.Workers = append(a.Workers, Worker{Name: "trials", Interval: cfg.TrialReminderInterval, Job: func(ctx context.Context) error {
+			_, err := trialService.NotifyTrialsEnding(ctx)
+			return err
+		}})
+	}
+	return a
+}
+
+// authenticators builds the configured authentication methods, tried in order.
+func authenticators(cfg *config.Config) []middleware.Authenticator {
+	if cfg.AuthDisabled {
+		log.Println("WARNING: authentication is disabled, every request is treated as an admin")
+		return []middleware.Authenticator{middleware.AllowAll{}}
+	}
+	var auths []middleware.Authenticator
+	if len(cfg.AuthAdminAPIKeys) > 0 {
+		auths = append(auths, middleware.NewAPIKeyAuthenticator(cfg.AuthAdminAPIKeys))
+	}
+	jwtCfg := middleware.JWTConfig{
+		HS256Secret: []byte(cfg.AuthJWTHS256Secret),
+		Issuer:      cfg.AuthJWTIssuer,
+		Audience:    cfg.AuthJWTAudience,
+	}
+	if cfg.AuthJWTRS256PublicKey != "" {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(cfg.AuthJWTRS256PublicKey))
+		if err != nil {
+			log.Printf("WARNING: ignoring invalid RS256 public key: %v", err)
+		} else {
+			jwtCfg.RS256PublicKey = key
+		}
+	}
+	if len(jwtCfg.HS256Secret) > 0 || jwtCfg.RS256PublicKey != nil {
+		auths = append(auths, middleware.NewJWTAuthenticator(jwtCfg))
+	}
+	return auths
+}
@@ -0,0 +1,1981 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sy-stripe-service/internal/app/services"
+	"sy-stripe-service/internal/config"
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+const (
+	testWebhookSecret = "whsec_test_secret"
+	testAdminKey      = "test-admin-key"
+	testJWTSecret     = "test-jwt-secret"
+)
+
+// testApp is the full router from New wired to a fake Stripe API.
+type testApp struct {
+	t      *testing.T
+	router http.Handler
+	stripe *fakeStripe
+	price  *stripe.Price
+	// token is sent as bearer credential; it defaults to the admin API key.
+	token string
+	// rsaKey signs RS256 tokens accepted by the app.
+	rsaKey *rsa.PrivateKey
+	// workers are the background jobs of the app, run on demand by runWorker.
+	workers []Worker
+	// clock is the time the app's services see; notifications records what they sent.
+	clock         *testClock
+	notifications *recordingNotifier
+	// db is the app's database; it has no connection on the in-memory backend.
+	db *database.DB
+}
+
+// testClock is a settable clock handed to the app as Deps.Clock.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// recordingNotifier keeps the notifications sent by the app.
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []services.Notification
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification services.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+// types returns the types of the notifications sent so far.
+func (n *recordingNotifier) types() []services.NotificationType {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var types []services.NotificationType
+	for _, notification := range n.sent {
+		types = append(types, notification.Type)
+	}
+	return types
+}
+
+// newTestApp builds the router against the given database URL.
+// An empty URL uses the in-memory repositories.
+func newTestApp(t *testing.T, databaseURL string) *testApp {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	fake := newFakeStripe(t)
+	product := fake.AddProduct(&stripe.Product{Name: "Pro", Active: true})
+	price := fake.AddPrice(&stripe.Price{
+		Product:    product,
+		Active:     true,
+		Nickname:   "Pro monthly",
+		Currency:   stripe.CurrencyEUR,
+		UnitAmount: 1500,
+		Recurring:  &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: 1},
+	})
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode RSA public key: %v", err)
+	}
+
+	cfg := &config.Config{
+		DatabaseURL:           databaseURL,
+		StripeSecretKey:       "sk_test_fake",
+		StripeWebhookSecret:   testWebhookSecret,
+		AppSuccessURL:         "http://localhost:3000/success",
+		AppCancelURL:          "http://localhost:3000/cancel",
+		AppPortalReturnURL:    "http://localhost:3000/account",
+		AuthAdminAPIKeys:      []string{testAdminKey},
+		AuthJWTHS256Secret:    testJWTSecret,
+		AuthJWTRS256PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})),
+		CORSAllowedOrigins:    []string{"http://localhost:3000", "https://*.example.com"},
+		CORSAllowedMethods:    []string{"GET", "POST", "OPTIONS"},
+		CORSAllowedHeaders:    []string{"Content-Type", "Authorization"},
+		CORSExposedHeaders:    []string{"ETag"},
+		CORSAllowCredentials:  true,
+		CORSMaxAge:            10 * time.Minute,
+		ProductCacheTTL:       time.Minute,
+		ProductCacheStaleTTL:  time.Hour,
+		TrialReminderLead:     72 * time.Hour,
+		DunningInterval:       time.Minute,
+		UsageFlushInterval:    time.Minute,
+		TrialReminderInterval: time.Minute,
+		DunningSteps: []models.DunningStep{
+			{Action: models.DunningActionNotify},
+			{Action: models.DunningActionRestrict, After: 72 * time.Hour},
+			{Action: models.DunningActionCancel, After: 168 * time.Hour},
+		},
+	}
+	db := &database.DB{}
+	if databaseURL != "" {
+		db, err = database.NewDB(databaseURL)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		t.Cleanup(db.Close)
+		if err := Migrate(db, MigrationsFS("")); err != nil {
+			t.Fatalf("Failed to apply migrations: %v", err)
+		}
+	}
+	notifier := &recordingNotifier{}
+	clock := &testClock{now: time.Now()}
+	a := Build(cfg, Deps{DB: db, Notifier: notifier, Clock: clock.Now})
+	return &testApp{t: t, router: a.Handler, stripe: fake, price: price, token: testAdminKey, rsaKey: rsaKey, workers: a.Workers, clock: clock, notifications: notifier, db: db}
+}
+
+// forEachBackend runs test against a fresh app on every repository backend: in-memory and SQLite.
+func forEachBackend(t *testing.T, test func(t *testing.T, app *testApp)) {
+	t.Helper()
+	backends := []struct {
+		name        string
+		databaseURL string
+	}{
+		{"inmemory", ""},
+		{"sqlite", "file:" + strings.ReplaceAll(t.Name(), "/", "_") + "?mode=memory&cache=shared"},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, newTestApp(t, backend.databaseURL))
+		})
+	}
+}
+
+// runWorker runs one iteration of the named background worker.
+func (a *testApp) runWorker(name string) error {
+	a.t.Helper()
+	for _, w := range a.workers {
+		if w.Name == name {
+			return w.Job(context.Background())
+		}
+	}
+	a.t.Fatalf("No worker named %q", name)
+	return nil
+}
+
+// as returns a copy of the app that authenticates with token.
+func (a *testApp) as(token string) *testApp {
+	c := *a
+	c.token = token
+	return &c
+}
+
+// userToken returns a signed JWT for userID using the given method (HS256 or RS256).
+func (a *testApp) userToken(method jwt.SigningMethod, userID string, expiresIn time.Duration) string {
+	a.t.Helper()
+	token := jwt.NewWithClaims(method, jwt.RegisteredClaims{
+		Subject:   userID,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+	})
+	var key interface{} = []byte(testJWTSecret)
+	if method == jwt.SigningMethodRS256 {
+		key = a.rsaKey
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		a.t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// do sends a JSON request to the router and decodes the JSON response into out.
+func (a *testApp) do(method, path string, body interface{}, out interface{}) int {
+	a.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			a.t.Fatalf("Failed to encode request body: %v", err)
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			a.t.Fatalf("%s %s: failed to parse response %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// deliverWebhook posts a signed Stripe event to the webhook endpoint.
+func (a *testApp) deliverWebhook(eventID, eventType string, object interface{}, created time.Time, secret string) (int, map[string]interface{}) {
+	a.t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":      eventID,
+		"object":  "event",
+		"type":    eventType,
+		"created": created.Unix(),
+		"data":    map[string]interface{}{"object": object},
+	})
+	if err != nil {
+		a.t.Fatalf("Failed to encode event: %v", err)
+	}
+	now := time.Now()
+	signature := fmt.Sprintf("t=%d,v1=%x", now.Unix(), webhook.ComputeSignature(now, payload, secret))
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/stripe", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signature)
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	var resp map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		a.t.Fatalf("Failed to parse webhook response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+type userResponse struct {
+	ID               string `json:"id"`
+	Email            string `json:"email"`
+	StripeCustomerID string `json:"stripe_customer_id"`
+}
+
+type userListResponse struct {
+	Data       []userResponse `json:"data"`
+	HasMore    bool           `json:"has_more"`
+	NextCursor string         `json:"next_cursor"`
+}
+
+type subscriptionResponse struct {
+	ID                   string `json:"id"`
+	UserID               string `json:"user_id"`
+	StripeSubscriptionID string `json:"stripe_subscription_id"`
+	StripePriceID        string `json:"stripe_price_id"`
+	Status               string `json:"status"`
+	CancelAtPeriodEnd    bool   `json:"cancel_at_period_end"`
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	forEachBackend(t, testSubscriptionLifecycle)
+}
+
+func testSubscriptionLifecycle(t *testing.T, app *testApp) {
+	// Health check
+	var health map[string]interface{}
+	if code := app.do(http.MethodGet, "/health", nil, &health); code != http.StatusOK || health["status"] != "ok" {
+		t.Fatalf("Expected healthy service, got %d %v", code, health)
+	}
+
+	// Customer creation
+	var created struct {
+		User           userResponse    `json:"user"`
+		StripeCustomer stripe.Customer `json:"stripe_customer"`
+	}
+	code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, &created)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	if created.StripeCustomer.ID == "" || created.User.StripeCustomerID != created.StripeCustomer.ID {
+		t.Fatalf("Expected user linked to the Stripe customer, got %+v", created)
+	}
+	user := created.User
+
+	var users userListResponse
+	if code := app.do(http.MethodGet, "/api/v1/customers", nil, &users); code != http.StatusOK || len(users.Data) != 1 || users.HasMore {
+		t.Fatalf("Expected one customer in list, got %d %+v", code, users)
+	}
+
+	code = app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, nil)
+	if code != http.StatusConflict {
+		t.Errorf("Expected status code %d for duplicate email, got %d", http.StatusConflict, code)
+	}
+
+	// Checkout session creation
+	var checkout struct {
+		SessionURL string `json:"sessionUrl"`
+	}
+	code = app.do(http.MethodPost, "/api/v1/checkout-session", map[string]string{
+		"priceId":    app.price.ID,
+		"userId":     user.ID,
+		"customerId": user.StripeCustomerID,
+	}, &checkout)
+	if code != http.StatusOK || checkout.SessionURL == "" {
+		t.Fatalf("Expected checkout session URL, got %d %+v", code, checkout)
+	}
+	sessionID := checkout.SessionURL[strings.LastIndex(checkout.SessionURL, "/")+1:]
+
+	// An open session has nothing to persist yet.
+	var pending struct {
+		Subscription *subscriptionResponse `json:"subscription"`
+	}
+	if code := app.do(http.MethodGet, "/api/v1/checkout-session/"+sessionID, nil, &pending); code != http.StatusOK || pending.Subscription != nil {
+		t.Fatalf("Expected no subscription for an open session, got %d %+v", code, pending.Subscription)
+	}
+
+	// The customer pays; retrieving the session persists the subscription.
+	if _, err := app.stripe.CompleteCheckoutSession(sessionID, user.Email, "Ada"); err != nil {
+		t.Fatalf("Failed to complete checkout session: %v", err)
+	}
+	var completed struct {
+		User         userResponse          `json:"user"`
+		Subscription *subscriptionResponse `json:"subscription"`
+	}
+	if code := app.do(http.MethodGet, "/api/v1/checkout-session/"+sessionID, nil, &completed); code != http.StatusOK {
+		t.Fatalf("Expected status code %d retrieving session, got %d", http.StatusOK, code)
+	}
+	if completed.User.ID != user.ID {
+		t.Errorf("Expected session to resolve user %s, got %s", user.ID, completed.User.ID)
+	}
+	sub := completed.Subscription
+	if sub == nil || sub.Status != "active" || sub.StripePriceID != app.price.ID || sub.UserID != user.ID {
+		t.Fatalf("Expected active subscription on %s for user %s, got %+v", app.price.ID, user.ID, sub)
+	}
+
+	// Details lookup
+	var details struct {
+		Subscription *subscriptionResponse  `json:"subscription"`
+		Plan         map[string]interface{} `json:"plan"`
+	}
+	if code := app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/details", nil, &details); code != http.StatusOK {
+		t.Fatalf("Expected status code %d for details, got %d", http.StatusOK, code)
+	}
+	if details.Subscription == nil || details.Subscription.ID != sub.ID {
+		t.Errorf("Expected details to include subscription %s, got %+v", sub.ID, details.Subscription)
+	}
+	if details.Plan == nil || details.Plan["amount"] != float64(1500) || details.Plan["interval"] != "month" {
+		t.Errorf("Expected plan of 1500/month, got %v", details.Plan)
+	}
+
+	// Subscribed users change plans through update-plan; a second checkout leaves the plan untouched.
+	var conflict struct {
+		Error string `json:"error"`
+	}
+	code = app.do(http.MethodPost, "/api/v1/checkout-session", map[string]string{"priceId": app.price.ID, "userId": user.ID}, &conflict)
+	if code != http.StatusConflict || !strings.Contains(conflict.Error, "/subscriptions/"+sub.ID+"/update-plan") {
+		t.Errorf("Expected status code %d pointing to update-plan, got %d %q", http.StatusConflict, code, conflict.Error)
+	}
+	if s, _ := app.stripe.GetSubscription(context.Background(), sub.StripeSubscriptionID); s.Status != stripe.SubscriptionStatusActive {
+		t.Errorf("Expected the subscription to stay active, got %s", s.Status)
+	}
+
+	// Webhook delivery
+	stripeSub, err := app.stripe.GetSubscription(context.Background(), sub.StripeSubscriptionID)
+	if err != nil {
+		t.Fatalf("Failed to load fake subscription: %v", err)
+	}
+	pastDue := *stripeSub
+	pastDue.Status = stripe.SubscriptionStatusPastDue
+	eventTime := time.Now().Add(time.Minute)
+
+	if code, _ := app.deliverWebhook("evt_bad", "customer.subscription.updated", &pastDue, eventTime, "whsec_wrong"); code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a bad signature, got %d", http.StatusBadRequest, code)
+	}
+	code, resp := app.deliverWebhook("evt_1", "customer.subscription.updated", &pastDue, eventTime, testWebhookSecret)
+	if code != http.StatusOK || resp["status"] != "processed" {
+		t.Fatalf("Expected processed webhook, got %d %v", code, resp)
+	}
+	code, resp = app.deliverWebhook("evt_1", "customer.subscription.updated", &pastDue, eventTime, testWebhookSecret)
+	if code != http.StatusOK || resp["duplicate"] != true {
+		t.Errorf("Expected redelivery to be acknowledged as duplicate, got %d %v", code, resp)
+	}
+	stale := *stripeSub
+	code, resp = app.deliverWebhook("evt_0", "customer.subscription.updated", &stale, eventTime.Add(-time.Hour), testWebhookSecret)
+	if code != http.StatusOK || resp["status"] != "skipped" {
+		t.Errorf("Expected out-of-order event to be skipped, got %d %v", code, resp)
+	}
+	var current subscriptionResponse
+	if code := app.do(http.MethodGet, "/api/v1/subscriptions/"+sub.ID, nil, &current); code != http.StatusOK || current.Status != "past_due" {
+		t.Fatalf("Expected webhook to mark subscription past_due, got %d %+v", code, current)
+	}
+
+	// Cancellation; the mode may also be sent in the body.
+	var canceled struct {
+		Status string `json:"status"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+sub.ID+"/cancel", map[string]string{"mode": "period_end"}, &canceled); code != http.StatusOK || canceled.Status != "cancel_at_period_end" {
+		t.Fatalf("Expected cancellation at period end, got %d %+v", code, canceled)
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+sub.ID+"/reactivate", nil, nil); code != http.StatusOK {
+		t.Fatalf("Expected reactivation, got %d", code)
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+sub.ID+"/cancel", nil, &canceled); code != http.StatusOK || canceled.Status != "canceled" {
+		t.Fatalf("Expected immediate cancellation, got %d %+v", code, canceled)
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+sub.ID+"/cancel", nil, nil); code != http.StatusConflict {
+		t.Errorf("Expected status code %d canceling a canceled subscription, got %d", http.StatusConflict, code)
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/sub_missing/cancel", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d canceling an unknown subscription, got %d", http.StatusNotFound, code)
+	}
+	if code := app.do(http.MethodGet, "/api/v1/subscriptions/"+sub.ID, nil, &current); code != http.StatusOK || current.Status != "canceled" {
+		t.Errorf("Expected stored subscription to be canceled, got %d %+v", code, current)
+	}
+	if s, _ := app.stripe.GetSubscription(context.Background(), sub.StripeSubscriptionID); s.Status != stripe.SubscriptionStatusCanceled {
+		t.Errorf("Expected Stripe subscription to be canceled, got %s", s.Status)
+	}
+	if code := app.do(http.MethodPost, "/api/v1/checkout-session", map[string]string{"priceId": app.price.ID, "userId": user.ID}, nil); code != http.StatusOK {
+		t.Errorf("Expected status code %d subscribing again after cancellation, got %d", http.StatusOK, code)
+	}
+}
+
+func TestCancelSubscriptionWithoutStripeID(t *testing.T) {
+	app := newTestApp(t, "file:TestCancelSubscriptionWithoutStripeID?mode=memory&cache=shared")
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "local@example.com", "name": "Local"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+
+	// Rows without a Stripe subscription can only be canceled locally.
+	now := time.Now().UTC().Truncate(time.Second)
+	local := &models.Subscription{
+		ID:                 uuid.New(),
+		UserID:             uuid.MustParse(created.User.ID),
+		StripePriceID:      app.price.ID,
+		Status:             "active",
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0),
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+	if _, err := database.NewSQLiteSubscriptionRepository(app.db.SQLite).CreateSubscription(context.Background(), local); err != nil {
+		t.Fatalf("Failed to insert subscription: %v", err)
+	}
+
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+local.ID.String()+"/cancel", nil, nil); code != http.StatusOK {
+		t.Fatalf("Expected status code %d canceling, got %d", http.StatusOK, code)
+	}
+	var current subscriptionResponse
+	if code := app.do(http.MethodGet, "/api/v1/subscriptions/"+local.ID.String(), nil, &current); code != http.StatusOK || current.Status != "canceled" {
+		t.Errorf("Expected the local subscription to be canceled, got %d %+v", code, current)
+	}
+}
+
+func TestLegacyHandler(t *testing.T) {
+	app := newTestApp(t, "")
+	app.router = NewLegacyHandler(app.router)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "Hello, Go Stripe Backend!" {
+		t.Errorf("Expected legacy greeting, got %d %q", w.Code, w.Body.String())
+	}
+
+	// The legacy server returned the bare Stripe customer and did not require a name.
+	var customer stripe.Customer
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "grace@example.com"}, &customer); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	if customer.ID == "" || customer.Email != "grace@example.com" {
+		t.Fatalf("Expected bare Stripe customer, got %+v", customer)
+	}
+
+	var sub stripe.Subscription
+	code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customerId": customer.ID, "priceId": app.price.ID}, &sub)
+	if code != http.StatusOK || sub.ID == "" || sub.Status != stripe.SubscriptionStatusActive {
+		t.Fatalf("Expected bare active Stripe subscription, got %d %+v", code, sub)
+	}
+
+	// The subscription is recorded locally and visible through the current API.
+	var users userListResponse
+	app.do(http.MethodGet, "/api/v1/customers", nil, &users)
+	if len(users.Data) != 1 {
+		t.Fatalf("Expected one customer, got %+v", users)
+	}
+	var details struct {
+		Subscription *subscriptionResponse `json:"subscription"`
+	}
+	app.do(http.MethodGet, "/api/v1/customers/"+users.Data[0].ID+"/details", nil, &details)
+	if details.Subscription == nil || details.Subscription.StripeSubscriptionID != sub.ID {
+		t.Errorf("Expected details to include subscription %s, got %+v", sub.ID, details.Subscription)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/subscriptions/create", strings.NewReader(`{"customerId":"cus_x"}`))
+	w = httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Customer ID and Price ID are required") {
+		t.Errorf("Expected plain-text validation error, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestWebhookPayloadSize(t *testing.T) {
+	app := newTestApp(t, "")
+	// Events well above Stripe's 64 KB example, like invoices with many lines, are accepted.
+	product := map[string]interface{}{"id": "prod_big", "object": "product", "description": strings.Repeat("x", 200<<10)}
+	if code, resp := app.deliverWebhook("evt_big", "product.updated", product, time.Now(), testWebhookSecret); code != http.StatusOK || resp["status"] != "processed" {
+		t.Errorf("Expected a 200 KB event to be processed, got %d %v", code, resp)
+	}
+	// Payloads beyond the limit are rejected as too large instead of failing the signature check.
+	product["description"] = strings.Repeat("x", 2<<20)
+	if code, resp := app.deliverWebhook("evt_huge", "product.updated", product, time.Now(), testWebhookSecret); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code %d for a 2 MB event, got %d %v", http.StatusRequestEntityTooLarge, code, resp)
+	}
+}
+
+func TestConcurrentWebhookDelivery(t *testing.T) {
+	forEachBackend(t, testConcurrentWebhookDelivery)
+}
+
+func testConcurrentWebhookDelivery(t *testing.T, app *testApp) {
+	// The invoice only names its subscription, so processing it has to fetch it from Stripe.
+	invoice := map[string]interface{}{"object": "invoice", "subscription": "sub_unknown"}
+	entered, release := app.stripe.holdNext("GET subscriptions/:id")
+	first := make(chan int)
+	go func() {
+		code, _ := app.deliverWebhook("evt_concurrent", "invoice.upcoming", invoice, time.Now(), testWebhookSecret)
+		first <- code
+	}()
+	<-entered
+
+	// A retry while the first delivery is still running must not process the event a second time.
+	code, resp := app.deliverWebhook("evt_concurrent", "invoice.upcoming", invoice, time.Now(), testWebhookSecret)
+	release()
+	if code != http.StatusConflict {
+		t.Errorf("Expected status code %d while the event is being processed, got %d %v", http.StatusConflict, code, resp)
+	}
+	if code := <-first; code != http.StatusInternalServerError {
+		t.Errorf("Expected the first delivery to fail for an unknown subscription, got %d", code)
+	}
+	if calls := app.stripe.callCount("GET subscriptions/:id"); calls != 1 {
+		t.Errorf("Expected one subscription fetch, got %d", calls)
+	}
+
+	// Once the first delivery released the event, a failed event is claimed again.
+	if code, resp := app.deliverWebhook("evt_concurrent", "invoice.upcoming", invoice, time.Now(), testWebhookSecret); code != http.StatusInternalServerError {
+		t.Errorf("Expected the failed event to be processed again, got %d %v", code, resp)
+	}
+	if calls := app.stripe.callCount("GET subscriptions/:id"); calls != 2 {
+		t.Errorf("Expected the retry to fetch the subscription again, got %d calls", calls)
+	}
+}
+
+func TestCustomerListing(t *testing.T) {
+	forEachBackend(t, testCustomerListing)
+}
+
+func testCustomerListing(t *testing.T, app *testApp) {
+	// Uppercase sorts before lowercase: emails are compared bytewise on every backend.
+	emails := []string{"carol@example.com", "Bob@example.com", "alice@example.org", "dave@example.com", "erin@example.org"}
+	for _, email := range emails {
+		var created struct {
+			StripeCustomer stripe.Customer `json:"stripe_customer"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": email, "name": "Customer " + email}, &created); code != http.StatusOK {
+			t.Fatalf("Expected status code %d creating %s, got %d", http.StatusOK, email, code)
+		}
+		if email == "dave@example.com" || email == "alice@example.org" {
+			code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": created.StripeCustomer.ID, "price_id": app.price.ID}, nil)
+			if code != http.StatusOK {
+				t.Fatalf("Expected status code %d subscribing %s, got %d", http.StatusOK, email, code)
+			}
+		}
+	}
+
+	// list walks all pages of a query and returns the emails in order.
+	list := func(query string, limit int) []string {
+		t.Helper()
+		var got []string
+		after := ""
+		for pages := 0; ; pages++ {
+			if pages > len(emails) {
+				t.Fatalf("Pagination of %q does not terminate", query)
+			}
+			var page userListResponse
+			path := fmt.Sprintf("/api/v1/customers?limit=%d&after=%s&%s", limit, after, query)
+			if code := app.do(http.MethodGet, path, nil, &page); code != http.StatusOK {
+				t.Fatalf("GET %s: status %d", path, code)
+			}
+			if len(page.Data) > limit {
+				t.Fatalf("GET %s returned %d users, limit %d", path, len(page.Data), limit)
+			}
+			for _, u := range page.Data {
+				got = append(got, u.Email)
+			}
+			if !page.HasMore {
+				return got
+			}
+			after = page.NextCursor
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"sort=email", []string{"Bob@example.com", "alice@example.org", "carol@example.com", "dave@example.com", "erin@example.org"}},
+		{"sort=-email", []string{"erin@example.org", "dave@example.com", "carol@example.com", "alice@example.org", "Bob@example.com"}},
+		{"sort=created_at", emails},
+		{"", []string{"erin@example.org", "dave@example.com", "alice@example.org", "Bob@example.com", "carol@example.com"}},
+		{"sort=email&email=EXAMPLE.ORG", []string{"alice@example.org", "erin@example.org"}},
+		{"sort=email&name=customer%20b", []string{"Bob@example.com"}},
+		{"sort=email&status=active", []string{"alice@example.org", "dave@example.com"}},
+		{"sort=email&status=canceled", nil},
+		{"sort=email&email=%25", nil},
+		{"created_from=2000-01-01&created_to=2001-01-01", nil},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 50} {
+			if got := list(tt.query, limit); !slices.Equal(got, tt.want) {
+				t.Errorf("GET /customers?%s with limit %d = %v, want %v", tt.query, limit, got, tt.want)
+			}
+		}
+	}
+
+	var page userListResponse
+	app.do(http.MethodGet, "/api/v1/customers?limit=2&sort=email", nil, &page)
+	for _, path := range []string{
+		"/api/v1/customers?limit=0",
+		"/api/v1/customers?limit=201",
+		"/api/v1/customers?sort=name",
+		"/api/v1/customers?created_from=yesterday",
+		"/api/v1/customers?after=not-a-cursor",
+		// A cursor only continues the sort order it was issued for.
+		"/api/v1/customers?sort=created_at&after=" + page.NextCursor,
+	} {
+		if code := app.do(http.MethodGet, path, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected status code %d, got %d", path, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func TestCustomerUpdateAndDelete(t *testing.T) {
+	forEachBackend(t, testCustomerUpdateAndDelete)
+}
+
+func testCustomerUpdateAndDelete(t *testing.T, app *testApp) {
+	create := func(email string) userResponse {
+		t.Helper()
+		var created struct {
+			User userResponse `json:"user"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": email, "name": "Customer"}, &created); code != http.StatusOK {
+			t.Fatalf("Expected status code %d creating %s, got %d", http.StatusOK, email, code)
+		}
+		return created.User
+	}
+	ada, bob := create("ada@example.com"), create("bob@example.com")
+
+	// Update name and email locally and on the Stripe customer.
+	var updated userResponse
+	code := app.as(app.userToken(jwt.SigningMethodHS256, ada.ID, time.Hour)).do(http.MethodPatch, "/api/v1/customers/"+ada.ID, map[string]string{"email": "ada@lovelace.dev", "name": "Ada Lovelace"}, &updated)
+	if code != http.StatusOK || updated.Email != "ada@lovelace.dev" {
+		t.Fatalf("Expected updated customer, got %d %+v", code, updated)
+	}
+	customer, err := app.stripe.GetCustomer(context.Background(), ada.StripeCustomerID)
+	if err != nil || customer.Email != "ada@lovelace.dev" || customer.Name != "Ada Lovelace" {
+		t.Fatalf("Expected Stripe customer to be updated, got %+v %v", customer, err)
+	}
+
+	for _, tt := range []struct {
+		body map[string]string
+		want int
+	}{
+		{map[string]string{"email": "bob@example.com"}, http.StatusConflict},
+		{map[string]string{"email": "not-an-email"}, http.StatusBadRequest},
+		{map[string]string{"name": " "}, http.StatusBadRequest},
+		{map[string]string{}, http.StatusBadRequest},
+	} {
+		if code := app.do(http.MethodPatch, "/api/v1/customers/"+ada.ID, tt.body, nil); code != tt.want {
+			t.Errorf("PATCH %v: expected status code %d, got %d", tt.body, tt.want, code)
+		}
+	}
+	if customer, _ := app.stripe.GetCustomer(context.Background(), ada.StripeCustomerID); customer.Email != "ada@lovelace.dev" {
+		t.Errorf("Expected rejected updates to leave Stripe unchanged, got %s", customer.Email)
+	}
+	// Stripe is updated first; when it fails the local row is not touched.
+	app.stripe.failNext("POST customers/:id", 1)
+	if code := app.do(http.MethodPatch, "/api/v1/customers/"+ada.ID, map[string]string{"name": "Countess"}, nil); code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d when Stripe fails, got %d", http.StatusInternalServerError, code)
+	}
+	var kept struct {
+		User struct {
+			Name string `json:"name"`
+		} `json:"user"`
+	}
+	if app.do(http.MethodGet, "/api/v1/customers/"+ada.ID+"/details", nil, &kept); kept.User.Name != "Ada Lovelace" {
+		t.Errorf("Expected the failed update to keep the local name, got %+v", kept.User)
+	}
+	if code := app.as(app.userToken(jwt.SigningMethodHS256, bob.ID, time.Hour)).do(http.MethodPatch, "/api/v1/customers/"+ada.ID, map[string]string{"name": "Mallory"}, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d updating another customer, got %d", http.StatusForbidden, code)
+	}
+
+	// Deletion cancels the subscription, deletes the Stripe customer and hides the user.
+	var sub struct {
+		Subscription stripe.Subscription  `json:"stripe_subscription"`
+		Local        subscriptionResponse `json:"subscription"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": ada.StripeCustomerID, "price_id": app.price.ID}, &sub); code != http.StatusOK {
+		t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+	}
+	if code := app.as(app.userToken(jwt.SigningMethodHS256, ada.ID, time.Hour)).do(http.MethodDelete, "/api/v1/customers/"+ada.ID, nil, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for a customer deleting itself, got %d", http.StatusForbidden, code)
+	}
+	var deleted struct {
+		Deleted               bool     `json:"deleted"`
+		CanceledSubscriptions []string `json:"canceled_subscriptions"`
+		StripeCustomerDeleted bool     `json:"stripe_customer_deleted"`
+	}
+	code = app.do(http.MethodDelete, "/api/v1/customers/"+ada.ID+"?delete_stripe_customer=true", nil, &deleted)
+	if code != http.StatusOK || !deleted.Deleted || !deleted.StripeCustomerDeleted || !slices.Equal(deleted.CanceledSubscriptions, []string{sub.Subscription.ID}) {
+		t.Fatalf("Expected customer deletion, got %d %+v", code, deleted)
+	}
+	if stripeSub, _ := app.stripe.GetSubscription(context.Background(), sub.Subscription.ID); stripeSub.Status != stripe.SubscriptionStatusCanceled {
+		t.Errorf("Expected Stripe subscription to be canceled, got %s", stripeSub.Status)
+	}
+	var local subscriptionResponse
+	if app.do(http.MethodGet, "/api/v1/subscriptions/"+sub.Local.ID, nil, &local); local.Status != "canceled" {
+		t.Errorf("Expected local subscription to be canceled, got %+v", local)
+	}
+	if customer, _ := app.stripe.GetCustomer(context.Background(), ada.StripeCustomerID); !customer.Deleted {
+		t.Errorf("Expected Stripe customer to be deleted")
+	}
+	if code := app.do(http.MethodGet, "/api/v1/customers/"+ada.ID+"/details", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for deleted customer details, got %d", http.StatusNotFound, code)
+	}
+	var users userListResponse
+	if app.do(http.MethodGet, "/api/v1/customers", nil, &users); len(users.Data) != 1 || users.Data[0].ID != bob.ID {
+		t.Errorf("Expected only the remaining customer in the list, got %+v", users.Data)
+	}
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		if code := app.do(method, "/api/v1/customers/"+ada.ID, map[string]string{"name": "Ada"}, nil); code != http.StatusNotFound {
+			t.Errorf("%s of a deleted customer: expected status code %d, got %d", method, http.StatusNotFound, code)
+		}
+	}
+
+	// The deleted customer's email is free again.
+	again := create("ada@lovelace.dev")
+	if again.ID == ada.ID {
+		t.Errorf("Expected a new user for the re-created customer, got %s", again.ID)
+	}
+	if code := app.do(http.MethodPatch, "/api/v1/customers/"+bob.ID, map[string]string{"email": "ada@lovelace.dev"}, nil); code != http.StatusConflict {
+		t.Errorf("Expected status code %d taking the email of the re-created customer, got %d", http.StatusConflict, code)
+	}
+
+	// Every open subscription is canceled, however many pages Stripe lists them on.
+	carol := create("carol@example.com")
+	var open []string
+	for range 12 {
+		if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": carol.StripeCustomerID, "price_id": app.price.ID}, &sub); code != http.StatusOK {
+			t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+		}
+		open = append(open, sub.Subscription.ID)
+	}
+	code = app.do(http.MethodDelete, "/api/v1/customers/"+carol.ID, nil, &deleted)
+	if code != http.StatusOK || len(deleted.CanceledSubscriptions) != len(open) {
+		t.Fatalf("Expected %d canceled subscriptions, got %d %+v", len(open), code, deleted)
+	}
+	for _, id := range open {
+		if stripeSub, _ := app.stripe.GetSubscription(context.Background(), id); stripeSub.Status != stripe.SubscriptionStatusCanceled {
+			t.Errorf("Expected subscription %s to be canceled, got %s", id, stripeSub.Status)
+		}
+	}
+
+	// Without the flag the Stripe customer is kept.
+	code = app.do(http.MethodDelete, "/api/v1/customers/"+bob.ID, nil, &deleted)
+	if code != http.StatusOK || deleted.StripeCustomerDeleted || len(deleted.CanceledSubscriptions) != 0 {
+		t.Fatalf("Expected customer deletion without Stripe, got %d %+v", code, deleted)
+	}
+	if customer, _ := app.stripe.GetCustomer(context.Background(), bob.StripeCustomerID); customer.Deleted {
+		t.Errorf("Expected Stripe customer to be kept")
+	}
+}
+
+type invoiceResponse struct {
+	StripeInvoiceID string    `json:"stripe_invoice_id"`
+	Status          string    `json:"status"`
+	AmountDue       int64     `json:"amount_due"`
+	AmountPaid      int64     `json:"amount_paid"`
+	InvoicePDF      string    `json:"invoice_pdf"`
+	PeriodStart     time.Time `json:"period_start"`
+}
+
+type invoiceListResponse struct {
+	Data       []invoiceResponse `json:"data"`
+	HasMore    bool              `json:"has_more"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+func TestInvoices(t *testing.T) {
+	forEachBackend(t, testInvoices)
+}
+
+func testInvoices(t *testing.T, app *testApp) {
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	user := created.User
+	var sub struct {
+		Subscription stripe.Subscription `json:"stripe_subscription"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": user.StripeCustomerID, "price_id": app.price.ID}, &sub); code != http.StatusOK {
+		t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+	}
+
+	type details struct {
+		LastInvoice     *invoiceResponse `json:"last_invoice"`
+		UpcomingInvoice *struct {
+			AmountDue int64  `json:"amount_due"`
+			Currency  string `json:"currency"`
+		} `json:"upcoming_invoice"`
+	}
+	var before details
+	app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/details", nil, &before)
+	if before.LastInvoice != nil || before.UpcomingInvoice == nil || before.UpcomingInvoice.AmountDue != 1500 || before.UpcomingInvoice.Currency != "eur" {
+		t.Fatalf("Expected no last invoice and an upcoming invoice of 1500 eur, got %+v", before)
+	}
+
+	// Three invoices one month apart; the newest is still open.
+	issued := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+	var invoices []*stripe.Invoice
+	for i := 0; i < 3; i++ {
+		inv := app.stripe.AddInvoice(&stripe.Invoice{
+			Customer:     &stripe.Customer{ID: user.StripeCustomerID},
+			Subscription: &stripe.Subscription{ID: sub.Subscription.ID},
+			Status:       stripe.InvoiceStatusPaid,
+			Currency:     stripe.CurrencyEUR,
+			AmountDue:    1500,
+			AmountPaid:   1500,
+			InvoicePDF:   fmt.Sprintf("https://pay.stripe.test/invoice/%d/pdf", i),
+			Created:      issued.AddDate(0, i-2, 0).Unix(),
+			Lines: &stripe.InvoiceLineList{Data: []*stripe.InvoiceLine{{
+				Period: &stripe.Period{Start: issued.AddDate(0, i-2, 0).Unix(), End: issued.AddDate(0, i-1, 0).Unix()},
+			}}},
+		})
+		invoices = append(invoices, inv)
+	}
+	invoices[2].Status, invoices[2].AmountPaid = stripe.InvoiceStatusOpen, 0
+
+	// Listing only reads stored invoices; an explicit sync fetches them from Stripe.
+	list := func(path string) ([]string, invoiceListResponse) {
+		t.Helper()
+		var page invoiceListResponse
+		if code := app.do(http.MethodGet, path, nil, &page); code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, code)
+		}
+		var ids []string
+		for _, inv := range page.Data {
+			ids = append(ids, inv.StripeInvoiceID)
+		}
+		return ids, page
+	}
+	if ids, _ := list("/api/v1/customers/" + user.ID + "/invoices"); len(ids) != 0 || app.stripe.callCount("GET invoices") != 0 {
+		t.Fatalf("Expected no invoices and no Stripe call before a sync, got %v and %d calls", ids, app.stripe.callCount("GET invoices"))
+	}
+	var synced struct {
+		Synced int `json:"synced"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/"+user.ID+"/invoices/sync", nil, &synced); code != http.StatusOK || synced.Synced != 3 {
+		t.Fatalf("Expected three synced invoices, got %d %+v", code, synced)
+	}
+	first, page := list("/api/v1/customers/" + user.ID + "/invoices?limit=2")
+	if !slices.Equal(first, []string{invoices[2].ID, invoices[1].ID}) || !page.HasMore {
+		t.Fatalf("Expected the two newest invoices and more, got %v %+v", first, page)
+	}
+	second, page := list("/api/v1/customers/" + user.ID + "/invoices?limit=2&after=" + page.NextCursor)
+	if !slices.Equal(second, []string{invoices[0].ID}) || page.HasMore {
+		t.Fatalf("Expected the oldest invoice on the last page, got %v %+v", second, page)
+	}
+
+	// Webhooks update the stored invoice; out-of-order events are skipped.
+	paid := *invoices[2]
+	paid.Status, paid.AmountPaid = stripe.InvoiceStatusPaid, 1500
+	eventTime := time.Now().Add(time.Minute)
+	if code, resp := app.deliverWebhook("evt_paid", "invoice.paid", &paid, eventTime, testWebhookSecret); code != http.StatusOK || resp["status"] != "processed" {
+		t.Fatalf("Expected processed invoice webhook, got %d %v", code, resp)
+	}
+	if code, resp := app.deliverWebhook("evt_finalized", "invoice.finalized", invoices[2], eventTime.Add(-time.Second), testWebhookSecret); code != http.StatusOK || resp["status"] != "skipped" {
+		t.Errorf("Expected out-of-order invoice webhook to be skipped, got %d %v", code, resp)
+	}
+	var after details
+	app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/details", nil, &after)
+	if after.LastInvoice == nil || after.LastInvoice.StripeInvoiceID != invoices[2].ID || after.LastInvoice.Status != "paid" || after.LastInvoice.AmountPaid != 1500 {
+		t.Fatalf("Expected the paid newest invoice in the details, got %+v", after.LastInvoice)
+	}
+	if !after.LastInvoice.PeriodStart.Equal(time.Unix(invoices[2].Lines.Data[0].Period.Start, 0)) || after.LastInvoice.InvoicePDF != invoices[2].InvoicePDF {
+		t.Errorf("Expected the invoice period and PDF to be stored, got %+v", after.LastInvoice)
+	}
+
+	if code := app.do(http.MethodPost, "/api/v1/customers/"+user.ID+"/invoices/sync", nil, &synced); code != http.StatusOK || synced.Synced != 3 {
+		t.Errorf("Expected three synced invoices, got %d %+v", code, synced)
+	}
+	if code := app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/invoices?after=not-a-cursor", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a bad cursor, got %d", http.StatusBadRequest, code)
+	}
+	other := app.as(app.userToken(jwt.SigningMethodHS256, "00000000-0000-0000-0000-000000000000", time.Hour))
+	if code := other.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/invoices", nil, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d listing another customer's invoices, got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestInvoiceSyncFetchesEveryPage(t *testing.T) {
+	app := newTestApp(t, "")
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "many@example.com", "name": "Many"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	// Stripe returns at most 100 invoices per page.
+	for i := 0; i < 150; i++ {
+		app.stripe.AddInvoice(&stripe.Invoice{
+			Customer: &stripe.Customer{ID: created.User.StripeCustomerID},
+			Status:   stripe.InvoiceStatusPaid,
+			Currency: stripe.CurrencyEUR,
+			Created:  time.Now().Add(-time.Duration(i) * time.Hour).Unix(),
+		})
+	}
+	var synced struct {
+		Synced int `json:"synced"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/"+created.User.ID+"/invoices/sync", nil, &synced); code != http.StatusOK || synced.Synced != 150 {
+		t.Fatalf("Expected 150 synced invoices, got %d %+v", code, synced)
+	}
+	if calls := app.stripe.callCount("GET invoices"); calls != 2 {
+		t.Errorf("Expected two pages of invoices, got %d requests", calls)
+	}
+	var page invoiceListResponse
+	if code := app.do(http.MethodGet, "/api/v1/customers/"+created.User.ID+"/invoices?limit=100", nil, &page); code != http.StatusOK || len(page.Data) != 100 || !page.HasMore {
+		t.Errorf("Expected a full page of stored invoices and more, got %d %d %v", code, len(page.Data), page.HasMore)
+	}
+}
+
+func TestDunning(t *testing.T) {
+	forEachBackend(t, testDunning)
+}
+
+func testDunning(t *testing.T, app *testApp) {
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	user := created.User
+	var sub struct {
+		Subscription stripe.Subscription `json:"stripe_subscription"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": user.StripeCustomerID, "price_id": app.price.ID}, &sub); code != http.StatusOK {
+		t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+	}
+
+	start := time.Now().Truncate(time.Second)
+	app.clock.Set(start)
+	invoice := func(id string, attempt int64, nextAttempt time.Time) *stripe.Invoice {
+		return &stripe.Invoice{
+			ID:                 id,
+			Customer:           &stripe.Customer{ID: user.StripeCustomerID},
+			Subscription:       &stripe.Subscription{ID: sub.Subscription.ID},
+			Status:             stripe.InvoiceStatusOpen,
+			Currency:           stripe.CurrencyEUR,
+			AmountDue:          1500,
+			AttemptCount:       attempt,
+			NextPaymentAttempt: nextAttempt.Unix(),
+			Created:            start.Unix(),
+		}
+	}
+	deliver := func(eventID, eventType string, inv *stripe.Invoice, created time.Time, want string) {
+		t.Helper()
+		if code, resp := app.deliverWebhook(eventID, eventType, inv, created, testWebhookSecret); code != http.StatusOK || resp["status"] != want {
+			t.Fatalf("Expected %s to be %s, got %d %v", eventID, want, code, resp)
+		}
+	}
+	state := func() *models.DunningState {
+		t.Helper()
+		var details struct {
+			DunningState *models.DunningState `json:"dunning_state"`
+		}
+		if code := app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/details", nil, &details); code != http.StatusOK {
+			t.Fatalf("Expected status code %d for details, got %d", http.StatusOK, code)
+		}
+		return details.DunningState
+	}
+	// process runs the dunning worker and checks how many steps of the cycle are done afterwards.
+	process := func(wantSteps int) {
+		t.Helper()
+		if err := app.runWorker("dunning"); err != nil {
+			t.Fatalf("Expected the dunning worker to succeed at %s, got %v", app.clock.Now().Sub(start), err)
+		}
+		if s := state(); s == nil || s.StepsDone != wantSteps {
+			t.Fatalf("Expected %d dunning steps to be done at %s, got %+v", wantSteps, app.clock.Now().Sub(start), s)
+		}
+	}
+
+	if s := state(); s != nil {
+		t.Fatalf("Expected no dunning state before a failed payment, got %+v", s)
+	}
+
+	// The first failure opens the dunning cycle; retries update it.
+	deliver("evt_failed_1", "invoice.payment_failed", invoice("in_1", 1, start.Add(72*time.Hour)), start, "processed")
+	s := state()
+	if s == nil || s.Status != models.DunningStatusPastDue || s.AttemptCount != 1 || s.StripeInvoiceID != "in_1" {
+		t.Fatalf("Expected a past_due dunning state after one attempt, got %+v", s)
+	}
+	if s.NextRetryAt == nil || !s.NextRetryAt.Equal(start.Add(72*time.Hour)) || s.GracePeriodEndsAt == nil || !s.GracePeriodEndsAt.Equal(start.Add(72*time.Hour)) {
+		t.Errorf("Expected the next retry and the grace period to end in 72h, got %+v", s)
+	}
+	process(1)
+	process(1)
+	if types := app.notifications.types(); !slices.Equal(types, []services.NotificationType{services.NotificationPaymentFailed}) {
+		t.Fatalf("Expected one payment failed notification, got %v", types)
+	}
+	deliver("evt_failed_2", "invoice.payment_failed", invoice("in_1", 2, start.Add(120*time.Hour)), start.Add(72*time.Hour), "processed")
+	deliver("evt_failed_stale", "invoice.payment_failed", invoice("in_1", 1, start.Add(72*time.Hour)), start.Add(time.Hour), "skipped")
+	if s := state(); s.AttemptCount != 2 || s.StepsDone != 1 || !s.FirstFailedAt.Equal(start) {
+		t.Fatalf("Expected the second attempt in the same cycle, got %+v", s)
+	}
+
+	// The grace period ends; paying the invoice recovers the subscription.
+	app.clock.Set(start.Add(72 * time.Hour))
+	process(2)
+	if s := state(); s.Status != models.DunningStatusRestricted {
+		t.Fatalf("Expected the subscription to be restricted, got %+v", s)
+	}
+	paid := invoice("in_1", 3, time.Time{})
+	paid.Status, paid.AmountPaid, paid.NextPaymentAttempt = stripe.InvoiceStatusPaid, 1500, 0
+	deliver("evt_paid", "invoice.paid", paid, start.Add(80*time.Hour), "processed")
+	if s := state(); s.Status != models.DunningStatusRecovered || s.ResolvedAt == nil || s.NextStepAt != nil {
+		t.Fatalf("Expected the dunning state to be recovered, got %+v", s)
+	}
+	if types := app.notifications.types(); !slices.Equal(types, []services.NotificationType{services.NotificationPaymentFailed, services.NotificationPaymentRecovered}) {
+		t.Fatalf("Expected a recovery notification, got %v", types)
+	}
+	app.clock.Set(start.Add(200 * time.Hour))
+	process(2)
+
+	// A new failure starts a fresh cycle, which ends by canceling the subscription.
+	failedAt := start.Add(300 * time.Hour)
+	deliver("evt_failed_3", "invoice.payment_failed", invoice("in_2", 1, time.Time{}), failedAt, "processed")
+	if s := state(); s.Status != models.DunningStatusPastDue || s.StepsDone != 0 || !s.FirstFailedAt.Equal(failedAt) || s.StripeInvoiceID != "in_2" {
+		t.Fatalf("Expected a new dunning cycle, got %+v", s)
+	}
+	app.clock.Set(failedAt.Add(168 * time.Hour))
+	process(1)
+	process(2)
+	process(3)
+	process(3)
+	if s := state(); s.Status != models.DunningStatusCanceled || s.StepsDone != 3 || s.ResolvedAt == nil {
+		t.Fatalf("Expected the dunning cycle to cancel the subscription, got %+v", s)
+	}
+	stripeSub, err := app.stripe.GetSubscription(context.Background(), sub.Subscription.ID)
+	if err != nil || stripeSub.Status != stripe.SubscriptionStatusCanceled {
+		t.Errorf("Expected the Stripe subscription to be canceled, got %+v (%v)", stripeSub, err)
+	}
+}
+
+func TestProductCatalog(t *testing.T) {
+	app := newTestApp(t, "")
+	pro := app.price.Product
+	setup := app.stripe.AddProduct(&stripe.Product{
+		Name:     "Onboarding",
+		Active:   true,
+		Metadata: map[string]string{"features": "Kick-off call; Data import ;", "tier": "addon"},
+	})
+	setupFee := app.stripe.AddPrice(&stripe.Price{
+		Product:     setup,
+		Active:      true,
+		LookupKey:   "setup_fee",
+		Currency:    stripe.CurrencyEUR,
+		UnitAmount:  4900,
+		TaxBehavior: stripe.PriceTaxBehaviorExclusive,
+	})
+	usage := app.stripe.AddPrice(&stripe.Price{
+		Product:       pro,
+		Active:        true,
+		Currency:      stripe.CurrencyEUR,
+		BillingScheme: stripe.PriceBillingSchemeTiered,
+		TiersMode:     stripe.PriceTiersModeGraduated,
+		Tiers:         []*stripe.PriceTier{{UpTo: 1000, UnitAmount: 10}, {FlatAmount: 100, UnitAmount: 5}},
+		Recurring: &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringIntervalMonth,
+			IntervalCount: 1,
+			UsageType:     stripe.PriceRecurringUsageTypeMetered,
+		},
+		Created: app.price.Created - 60,
+	})
+	yearly := app.stripe.AddPrice(&stripe.Price{
+		Product:         pro,
+		Active:          true,
+		Currency:        stripe.CurrencyUSD,
+		CurrencyOptions: map[string]*stripe.PriceCurrencyOptions{"eur": {UnitAmount: 14000}},
+		UnitAmount:      16000,
+		Recurring: &stripe.PriceRecurring{
+			Interval:        stripe.PriceRecurringIntervalMonth,
+			IntervalCount:   12,
+			TrialPeriodDays: 14,
+			UsageType:       stripe.PriceRecurringUsageTypeLicensed,
+		},
+		Created: app.price.Created + 60,
+	})
+	app.stripe.AddPrice(&stripe.Price{Product: pro, Active: false, Currency: stripe.CurrencyEUR, UnitAmount: 999})
+
+	list := func(query string) map[string]models.ProductResponse {
+		t.Helper()
+		var products []models.ProductResponse
+		if code := app.do(http.MethodGet, "/api/v1/products"+query, nil, &products); code != http.StatusOK {
+			t.Fatalf("GET /api/v1/products%s: status %d", query, code)
+		}
+		byID := map[string]models.ProductResponse{}
+		for _, p := range products {
+			byID[p.ID] = p
+		}
+		return byID
+	}
+	priceIDs := func(p models.ProductResponse) []string {
+		var ids []string
+		for _, price := range p.Prices {
+			ids = append(ids, price.ID)
+		}
+		return ids
+	}
+
+	all := list("")
+	if ids := priceIDs(all[pro.ID]); !slices.Equal(ids, []string{usage.ID, app.price.ID, yearly.ID}) {
+		t.Fatalf("Expected the active prices oldest first, got %v", ids)
+	}
+	if p := all[setup.ID]; !slices.Equal(p.Features, []string{"Kick-off call", "Data import"}) || p.Metadata["tier"] != "addon" {
+		t.Errorf("Expected the product features and metadata, got %+v", p)
+	}
+	fee := all[setup.ID].Prices[0]
+	if fee.Type != "one_time" || fee.LookupKey != "setup_fee" || fee.TaxBehavior != "exclusive" || fee.UnitAmount != 4900 || fee.Interval != "" {
+		t.Errorf("Expected the one-time setup fee, got %+v", fee)
+	}
+	metered := all[pro.ID].Prices[0]
+	if metered.UsageType != "metered" || metered.BillingScheme != "tiered" || metered.TiersMode != "graduated" || len(metered.Tiers) != 2 {
+		t.Fatalf("Expected the graduated metered price, got %+v", metered)
+	}
+	if metered.Tiers[0].UpTo == nil || *metered.Tiers[0].UpTo != 1000 || metered.Tiers[1].UpTo != nil || metered.Tiers[1].FlatAmount != 100 {
+		t.Errorf("Expected a bounded and an unbounded tier, got %+v", metered.Tiers)
+	}
+	annual := all[pro.ID].Prices[2]
+	if annual.IntervalCount != 12 || annual.TrialPeriodDays != 14 || annual.CurrencyOptions["eur"].UnitAmount != 14000 {
+		t.Errorf("Expected the interval count, trial and currency options, got %+v", annual)
+	}
+
+	if products := list("?type=one_time"); len(products) != 1 || !slices.Equal(priceIDs(products[setup.ID]), []string{setupFee.ID}) {
+		t.Errorf("Expected only the setup fee for type=one_time, got %+v", products)
+	}
+	if products := list("?type=recurring&currency=USD"); len(products) != 1 || !slices.Equal(priceIDs(products[pro.ID]), []string{yearly.ID}) {
+		t.Errorf("Expected only the USD price, got %+v", products)
+	}
+	if products := list("?currency=eur&type=recurring"); !slices.Equal(priceIDs(products[pro.ID]), []string{usage.ID, app.price.ID, yearly.ID}) {
+		t.Errorf("Expected the EUR prices including currency options, got %+v", products)
+	}
+	for _, query := range []string{"?type=metered", "?currency=euro"} {
+		if code := app.do(http.MethodGet, "/api/v1/products"+query, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, query, code)
+		}
+	}
+}
+
+func TestProductCatalogCache(t *testing.T) {
+	app := newTestApp(t, "")
+	get := func(ifNoneMatch string) (int, string, []models.ProductResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/products", nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminKey)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		app.router.ServeHTTP(w, req)
+		var products []models.ProductResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &products); err != nil {
+				t.Fatalf("Failed to parse products %q: %v", w.Body.String(), err)
+			}
+		} else if w.Body.Len() > 0 {
+			t.Errorf("Expected no body with status %d, got %q", w.Code, w.Body.String())
+		}
+		return w.Code, w.Header().Get("ETag"), products
+	}
+	prices := func(products []models.ProductResponse) int {
+		n := 0
+		for _, p := range products {
+			n += len(p.Prices)
+		}
+		return n
+	}
+
+	// Concurrent requests share one fetch; later ones are served from the cache.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get("")
+		}()
+	}
+	wg.Wait()
+	code, etag, products := get("")
+	if code != http.StatusOK || etag == "" || prices(products) != 1 {
+		t.Fatalf("Expected the catalog with one price and an ETag, got %d %q %+v", code, etag, products)
+	}
+	if calls := app.stripe.callCount("GET products"); calls != 1 {
+		t.Errorf("Expected one product listing for 11 requests, got %d", calls)
+	}
+	if code, got, _ := get(etag); code != http.StatusNotModified || got != etag {
+		t.Errorf("Expected %d with the same ETag for a matching If-None-Match, got %d %q", http.StatusNotModified, code, got)
+	}
+	if code, _, _ := get(`"other", W/` + etag); code != http.StatusNotModified {
+		t.Errorf("Expected a weak match in a list of ETags to be not modified, got %d", code)
+	}
+
+	// Product and price webhooks invalidate the cache.
+	app.stripe.AddPrice(&stripe.Price{
+		Product:    app.price.Product,
+		Active:     true,
+		Currency:   stripe.CurrencyEUR,
+		UnitAmount: 15000,
+		Recurring:  &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalYear, IntervalCount: 1},
+	})
+	if _, _, products := get(""); prices(products) != 1 {
+		t.Fatalf("Expected the cached catalog before the webhook, got %+v", products)
+	}
+	if code, resp := app.deliverWebhook("evt_price", "price.created", map[string]string{"id": "price_new", "object": "price"}, time.Now(), testWebhookSecret); code != http.StatusOK || resp["status"] != "processed" {
+		t.Fatalf("Expected the price webhook to be processed, got %d %v", code, resp)
+	}
+	code, newETag, products := get(etag)
+	if code != http.StatusOK || newETag == etag || prices(products) != 2 {
+		t.Fatalf("Expected the refetched catalog with a new ETag, got %d %q %+v", code, newETag, products)
+	}
+
+	// An expired catalog is still served while it is refreshed in the background.
+	app.stripe.AddPrice(&stripe.Price{
+		Product:    app.price.Product,
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 1700,
+		Recurring:  &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: 1},
+	})
+	app.clock.Advance(2 * time.Minute)
+	if code, got, _ := get(newETag); code != http.StatusNotModified || got != newETag {
+		t.Fatalf("Expected the stale catalog to be served, got %d %q", code, got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, products := get(""); prices(products) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the background refresh to replace the stale catalog")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := app.stripe.callCount("GET products"); calls != 3 {
+		t.Errorf("Expected three product listings, got %d", calls)
+	}
+
+	// Past the stale window the request waits for fresh data.
+	app.stripe.AddProduct(&stripe.Product{Name: "Team", Active: true})
+	app.clock.Advance(2 * time.Hour)
+	if _, _, products := get(""); len(products) != 2 {
+		t.Errorf("Expected the expired catalog to be refetched, got %+v", products)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	forEachBackend(t, testUsage)
+}
+
+func testUsage(t *testing.T, app *testApp) {
+	metered := app.stripe.AddPrice(&stripe.Price{
+		Product:  app.price.Product,
+		Active:   true,
+		Nickname: "API calls",
+		Currency: stripe.CurrencyEUR,
+		Recurring: &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringIntervalMonth,
+			IntervalCount: 1,
+			UsageType:     stripe.PriceRecurringUsageTypeMetered,
+		},
+	})
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	subscribe := func(priceID string) (string, *stripe.Subscription) {
+		t.Helper()
+		var sub struct {
+			Stripe stripe.Subscription `json:"stripe_subscription"`
+			Local  struct {
+				ID string `json:"id"`
+			} `json:"subscription"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": created.User.StripeCustomerID, "price_id": priceID}, &sub); code != http.StatusOK {
+			t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+		}
+		return sub.Local.ID, &sub.Stripe
+	}
+	subID, stripeSub := subscribe(metered.ID)
+	path := "/api/v1/subscriptions/" + subID + "/usage"
+	record := func(body map[string]interface{}, want int) models.UsageRecord {
+		t.Helper()
+		var rec models.UsageRecord
+		if code := app.do(http.MethodPost, path, body, &rec); code != want {
+			t.Fatalf("Expected status code %d recording %v, got %d", want, body, code)
+		}
+		return rec
+	}
+	summary := func() models.UsageSummary {
+		t.Helper()
+		var s models.UsageSummary
+		if code := app.do(http.MethodGet, path, nil, &s); code != http.StatusOK {
+			t.Fatalf("Expected status code %d for the usage summary, got %d", http.StatusOK, code)
+		}
+		return s
+	}
+	const route = "POST subscription_items/:id/usage_records"
+	// flush runs the usage worker and checks the number of usage record requests Stripe got so far.
+	flush := func(wantErr bool, wantCalls int) {
+		t.Helper()
+		if err := app.runWorker("usage"); (err != nil) != wantErr {
+			t.Fatalf("Expected the usage worker to fail: %t, got %v", wantErr, err)
+		}
+		if calls := app.stripe.callCount(route); calls != wantCalls {
+			t.Fatalf("Expected %d usage record requests to Stripe, got %d", wantCalls, calls)
+		}
+	}
+
+	priceFetches := app.stripe.callCount("GET prices/:id")
+	first := record(map[string]interface{}{"quantity": 5, "idempotency_key": "batch-1"}, http.StatusAccepted)
+	if first.Status != models.UsageRecordStatusPending || first.Quantity != 5 {
+		t.Fatalf("Expected a pending record of 5 units, got %+v", first)
+	}
+	if again := record(map[string]interface{}{"quantity": 5, "idempotency_key": "batch-1"}, http.StatusOK); again.ID != first.ID {
+		t.Errorf("Expected a repeated request to return record %s, got %s", first.ID, again.ID)
+	}
+	record(map[string]interface{}{"quantity": 7, "idempotency_key": "batch-1"}, http.StatusConflict)
+	record(map[string]interface{}{"quantity": 3}, http.StatusAccepted)
+	record(map[string]interface{}{"quantity": -1}, http.StatusBadRequest)
+	record(map[string]interface{}{"quantity": 1, "timestamp": time.Now().Add(time.Hour)}, http.StatusBadRequest)
+	record(map[string]interface{}{"quantity": 1, "timestamp": time.Now().Add(-24 * time.Hour)}, http.StatusBadRequest)
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/00000000-0000-0000-0000-000000000000/usage", map[string]interface{}{"quantity": 1}, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an unknown subscription, got %d", http.StatusNotFound, code)
+	}
+	if s := summary(); s.TotalQuantity != 8 || s.PendingQuantity != 8 || s.Records != 2 {
+		t.Fatalf("Expected 8 pending units in 2 records, got %+v", s)
+	}
+	if calls := app.stripe.callCount("GET prices/:id") - priceFetches; calls != 1 {
+		t.Errorf("Expected the price to be fetched once and then served from the cache, got %d requests", calls)
+	}
+
+	// A failed report is retried after a backoff under the same Stripe idempotency key.
+	app.stripe.failNext(route, 1)
+	flush(true, 2)
+	flush(false, 2)
+	app.clock.Advance(2 * time.Minute)
+	flush(false, 3)
+	flush(false, 3)
+	reported := app.stripe.UsageRecords(stripeSub.Items.Data[0].ID)
+	if len(reported) != 2 || reported[0].Quantity+reported[1].Quantity != 8 {
+		t.Fatalf("Expected 8 units in 2 usage records at Stripe, got %+v", reported)
+	}
+	if s := summary(); s.ReportedQuantity != 8 || s.PendingQuantity != 0 {
+		t.Errorf("Expected all 8 units to be reported, got %+v", s)
+	}
+
+	// Usage of a subscription without a metered price is rejected when it is recorded.
+	licensedID, _ := subscribe(app.price.ID)
+	var rejected struct {
+		Error string `json:"error"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+licensedID+"/usage", map[string]interface{}{"quantity": 2}, &rejected); code != http.StatusBadRequest || !strings.Contains(rejected.Error, "not metered") {
+		t.Errorf("Expected status code %d for a licensed price, got %d %q", http.StatusBadRequest, code, rejected.Error)
+	}
+
+	// Buffered usage of a subscription that left its metered price cannot be reported and is marked failed.
+	record(map[string]interface{}{"quantity": 2}, http.StatusAccepted)
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/"+subID+"/update-plan", map[string]interface{}{"priceId": app.price.ID, "prorationBehavior": "none"}, nil); code != http.StatusOK {
+		t.Fatalf("Expected status code %d changing to the licensed price, got %d", http.StatusOK, code)
+	}
+	record(map[string]interface{}{"quantity": 1}, http.StatusBadRequest)
+	flush(true, 3)
+	flush(false, 3)
+	if s := summary(); s.FailedQuantity != 2 || s.ReportedQuantity != 8 {
+		t.Errorf("Expected 2 failed and 8 reported units, got %+v", s)
+	}
+
+	other := app.as(app.userToken(jwt.SigningMethodHS256, "00000000-0000-0000-0000-000000000000", time.Hour))
+	if code := other.do(http.MethodGet, path, nil, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d reading another customer's usage, got %d", http.StatusForbidden, code)
+	}
+	if code := other.do(http.MethodPost, path, map[string]interface{}{"quantity": 1}, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d recording usage as a customer, got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestPromotionCodes(t *testing.T) {
+	forEachBackend(t, testPromotionCodes)
+}
+
+func testPromotionCodes(t *testing.T, app *testApp) {
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	user := created.User
+	spring := &stripe.Coupon{ID: "SPRING", Name: "Spring sale", PercentOff: 20, Duration: stripe.CouponDurationRepeating, DurationInMonths: 3, Valid: true}
+	app.stripe.AddPromotionCode(&stripe.PromotionCode{Code: "SPRING20", Active: true, Coupon: spring})
+	app.stripe.AddPromotionCode(&stripe.PromotionCode{Code: "OLD10", Active: true, Coupon: spring, ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+	app.stripe.AddPromotionCode(&stripe.PromotionCode{Code: "VIP", Active: true, Coupon: spring, Customer: &stripe.Customer{ID: "cus_other"}})
+	app.stripe.AddPromotionCode(&stripe.PromotionCode{Code: "BIG", Active: true, Coupon: spring, Restrictions: &stripe.PromotionCodeRestrictions{MinimumAmount: 5000, MinimumAmountCurrency: stripe.CurrencyEUR}})
+	app.stripe.AddPromotionCode(&stripe.PromotionCode{Code: "WELCOME", Active: true, Coupon: spring, Restrictions: &stripe.PromotionCodeRestrictions{FirstTimeTransaction: true}})
+	app.stripe.AddPromotionCode(&stripe.PromotionCode{Code: "FIVEOFF", Active: true, Coupon: &stripe.Coupon{ID: "FIVE", AmountOff: 500, Currency: stripe.CurrencyUSD, Duration: stripe.CouponDurationForever, Valid: true}})
+
+	checkout := func(body map[string]interface{}, want int, wantError string) string {
+		t.Helper()
+		body["priceId"], body["userId"], body["customerId"] = app.price.ID, user.ID, user.StripeCustomerID
+		var resp struct {
+			SessionURL string `json:"sessionUrl"`
+			Error      string `json:"error"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/checkout-session", body, &resp); code != want || !strings.Contains(resp.Error, wantError) {
+			t.Fatalf("Expected status code %d and error %q for %v, got %d %q", want, wantError, body, code, resp.Error)
+		}
+		return resp.SessionURL[strings.LastIndex(resp.SessionURL, "/")+1:]
+	}
+
+	checkout(map[string]interface{}{"promotionCode": "NOPE"}, http.StatusBadRequest, "does not exist")
+	checkout(map[string]interface{}{"promotionCode": "OLD10"}, http.StatusBadRequest, "expired")
+	checkout(map[string]interface{}{"promotionCode": "VIP"}, http.StatusBadRequest, "another customer")
+	checkout(map[string]interface{}{"promotionCode": "BIG"}, http.StatusBadRequest, "minimum amount")
+	checkout(map[string]interface{}{"promotionCode": "FIVEOFF"}, http.StatusBadRequest, "prices in eur")
+	checkout(map[string]interface{}{"promotionCode": "SPRING20", "allowPromotionCodes": true}, http.StatusBadRequest, "cannot be combined")
+
+	sessionID := checkout(map[string]interface{}{"allowPromotionCodes": true}, http.StatusOK, "")
+	if sess, err := app.stripe.GetCheckoutSession(context.Background(), sessionID); err != nil || !sess.AllowPromotionCodes {
+		t.Errorf("Expected the session to allow promotion codes, got %+v (%v)", sess, err)
+	}
+
+	// Codes are matched case-insensitively; the discount is stored with the subscription.
+	sessionID = checkout(map[string]interface{}{"promotionCode": "spring20"}, http.StatusOK, "")
+	if _, err := app.stripe.CompleteCheckoutSession(sessionID, user.Email, "Ada"); err != nil {
+		t.Fatalf("Failed to complete checkout session: %v", err)
+	}
+	if code := app.do(http.MethodGet, "/api/v1/checkout-session/"+sessionID, nil, nil); code != http.StatusOK {
+		t.Fatalf("Expected status code %d retrieving session, got %d", http.StatusOK, code)
+	}
+	var details struct {
+		Discount     *models.SubscriptionDiscount `json:"discount"`
+		Subscription struct {
+			Discount *models.SubscriptionDiscount `json:"discount"`
+		} `json:"subscription"`
+	}
+	if code := app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/details", nil, &details); code != http.StatusOK {
+		t.Fatalf("Expected status code %d for details, got %d", http.StatusOK, code)
+	}
+	d := details.Discount
+	if d == nil || d.CouponID != "SPRING" || d.CouponName != "Spring sale" || d.PercentOff != 20 || d.Duration != "repeating" || d.PromotionCodeID == "" || d.EndsAt == nil {
+		t.Fatalf("Expected the spring discount in the details, got %+v", d)
+	}
+	if details.Subscription.Discount == nil || details.Subscription.Discount.CouponID != "SPRING" {
+		t.Errorf("Expected the discount on the subscription, got %+v", details.Subscription.Discount)
+	}
+
+	// Now that the customer has subscribed, first-time codes no longer apply.
+	checkout(map[string]interface{}{"promotionCode": "WELCOME"}, http.StatusBadRequest, "first-time customers")
+}
+
+func TestTrials(t *testing.T) {
+	forEachBackend(t, testTrials)
+}
+
+func testTrials(t *testing.T, app *testApp) {
+	create := func(email string) userResponse {
+		t.Helper()
+		var created struct {
+			User userResponse `json:"user"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": email, "name": "Customer"}, &created); code != http.StatusOK {
+			t.Fatalf("Expected status code %d creating %s, got %d", http.StatusOK, email, code)
+		}
+		return created.User
+	}
+	ada, bob, cy := create("ada@example.com"), create("bob@example.com"), create("cy@example.com")
+	now := time.Now()
+	expectTrial := func(what string, sub *models.Subscription, days int) {
+		t.Helper()
+		if days == 0 {
+			if sub == nil || sub.Status != models.SubscriptionStatusActive || sub.TrialEnd != nil {
+				t.Fatalf("Expected %s to be active without a trial, got %+v", what, sub)
+			}
+			return
+		}
+		want := now.AddDate(0, 0, days)
+		if sub == nil || sub.Status != models.SubscriptionStatusTrialing || sub.TrialStart == nil || sub.TrialEnd == nil || sub.TrialEnd.Sub(want).Abs() > time.Minute {
+			t.Fatalf("Expected %s to be trialing until %s, got %+v", what, want, sub)
+		}
+	}
+
+	// Admins can set the trial of a subscription.
+	for _, days := range []int{-1, 731} {
+		body := map[string]interface{}{"customer_id": ada.StripeCustomerID, "price_id": app.price.ID, "trial_period_days": days}
+		if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", body, nil); code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for a %d day trial, got %d", http.StatusBadRequest, days, code)
+		}
+	}
+	var created struct {
+		Subscription *models.Subscription `json:"subscription"`
+	}
+	body := map[string]interface{}{"customer_id": ada.StripeCustomerID, "price_id": app.price.ID, "trial_period_days": 14}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", body, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+	}
+	expectTrial("the created subscription", created.Subscription, 14)
+	adaSub := created.Subscription
+
+	// Checkout uses the trial of the price unless the request overrides it.
+	trialPrice := app.stripe.AddPrice(&stripe.Price{
+		Product:    app.price.Product,
+		Active:     true,
+		Currency:   stripe.CurrencyEUR,
+		UnitAmount: 1500,
+		Recurring:  &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: 1, TrialPeriodDays: 7},
+	})
+	checkout := func(user userResponse, body map[string]interface{}, want int) *models.Subscription {
+		t.Helper()
+		body["priceId"], body["userId"], body["customerId"] = trialPrice.ID, user.ID, user.StripeCustomerID
+		var resp struct {
+			SessionURL string `json:"sessionUrl"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/checkout-session", body, &resp); code != want {
+			t.Fatalf("Expected status code %d for checkout %v, got %d", want, body, code)
+		}
+		if want != http.StatusOK {
+			return nil
+		}
+		sessionID := resp.SessionURL[strings.LastIndex(resp.SessionURL, "/")+1:]
+		if _, err := app.stripe.CompleteCheckoutSession(sessionID, user.Email, "Customer"); err != nil {
+			t.Fatalf("Failed to complete checkout session: %v", err)
+		}
+		if code := app.do(http.MethodGet, "/api/v1/checkout-session/"+sessionID, nil, nil); code != http.StatusOK {
+			t.Fatalf("Expected status code %d retrieving session, got %d", http.StatusOK, code)
+		}
+		var details struct {
+			Subscription *models.Subscription `json:"subscription"`
+		}
+		if code := app.do(http.MethodGet, "/api/v1/customers/"+user.ID+"/details", nil, &details); code != http.StatusOK {
+			t.Fatalf("Expected status code %d for details, got %d", http.StatusOK, code)
+		}
+		return details.Subscription
+	}
+	checkout(bob, map[string]interface{}{"trialPeriodDays": 731}, http.StatusBadRequest)
+	// Only admins choose the trial; customers and guests cannot extend it.
+	overrides := map[string]*testApp{
+		"customer": app.as(app.userToken(jwt.SigningMethodHS256, bob.ID, time.Hour)),
+		"guest":    app.as(""),
+	}
+	for who, caller := range overrides {
+		body := map[string]interface{}{"priceId": trialPrice.ID, "trialPeriodDays": 365}
+		if who == "customer" {
+			body["userId"] = bob.ID
+		}
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if code := caller.do(http.MethodPost, "/api/v1/checkout-session", body, &resp); code != http.StatusForbidden || !strings.Contains(resp.Error, "trialPeriodDays") {
+			t.Errorf("Expected status code %d for a %s trial override, got %d %q", http.StatusForbidden, who, code, resp.Error)
+		}
+	}
+	bobSub := checkout(bob, map[string]interface{}{}, http.StatusOK)
+	expectTrial("the price default trial", bobSub, 7)
+	expectTrial("a checkout without trial", checkout(cy, map[string]interface{}{"trialPeriodDays": 0}, http.StatusOK), 0)
+
+	// Customers who subscribed before do not get the trial of the price again.
+	dan := create("dan@example.com")
+	earlier, err := app.stripe.CreateSubscription(context.Background(), &stripe.SubscriptionParams{
+		Customer: stripe.String(dan.StripeCustomerID),
+		Items:    []*stripe.SubscriptionItemsParams{{Price: stripe.String(app.price.ID)}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create fake subscription: %v", err)
+	}
+	if _, err := app.stripe.CancelSubscription(context.Background(), earlier.ID); err != nil {
+		t.Fatalf("Failed to cancel fake subscription: %v", err)
+	}
+	expectTrial("a returning customer's checkout", checkout(dan, map[string]interface{}{}, http.StatusOK), 0)
+	created.Subscription = nil
+	body = map[string]interface{}{"customer_id": dan.StripeCustomerID, "price_id": trialPrice.ID}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", body, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+	}
+	expectTrial("a returning customer's subscription created by an admin", created.Subscription, 0)
+
+	// The scheduler reminds each trial end once; Ada's trial ends within the lead, Bob's has ended.
+	app.clock.Set(now.AddDate(0, 0, 12))
+	for i := 0; i < 2; i++ {
+		if err := app.runWorker("trials"); err != nil {
+			t.Fatalf("Expected trial reminder run %d to succeed, got %v", i+1, err)
+		}
+		if got := app.notifications.types(); !slices.Equal(got, []services.NotificationType{services.NotificationTrialWillEnd}) {
+			t.Fatalf("Expected run %d to leave one trial reminder, got %v", i+1, got)
+		}
+	}
+
+	// Stripe's reminder does not notify again, but reaches trials the scheduler did not.
+	for i, sub := range []*models.Subscription{adaSub, bobSub} {
+		stripeSub, err := app.stripe.GetSubscription(context.Background(), sub.StripeSubscriptionID)
+		if err != nil {
+			t.Fatalf("Failed to load fake subscription: %v", err)
+		}
+		if code, _ := app.deliverWebhook(fmt.Sprintf("evt_trial_%d", i), "customer.subscription.trial_will_end", stripeSub, time.Now().Add(time.Minute), testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("Expected status code %d for the trial webhook, got %d", http.StatusOK, code)
+		}
+	}
+	want := []services.NotificationType{services.NotificationTrialWillEnd, services.NotificationTrialWillEnd}
+	if got := app.notifications.types(); !slices.Equal(got, want) {
+		t.Errorf("Expected notifications %v, got %v", want, got)
+	}
+}
+
+func TestBillingPortalSession(t *testing.T) {
+	app := newTestApp(t, "")
+	var created struct {
+		User userResponse `json:"user"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": "ada@example.com", "name": "Ada"}, &created); code != http.StatusOK {
+		t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+	}
+	path := "/api/v1/customers/" + created.User.ID + "/portal-session"
+
+	var portal struct {
+		URL string `json:"url"`
+	}
+	code := app.as(app.userToken(jwt.SigningMethodHS256, created.User.ID, time.Hour)).do(http.MethodPost, path, nil, &portal)
+	if code != http.StatusOK || !strings.HasPrefix(portal.URL, "https://billing.stripe.test/") {
+		t.Fatalf("Expected a billing portal URL, got %d %+v", code, portal)
+	}
+	if code := app.do(http.MethodPost, "/api/v1/customers/00000000-0000-0000-0000-000000000000/portal-session", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an unknown customer, got %d", http.StatusNotFound, code)
+	}
+	other := app.as(app.userToken(jwt.SigningMethodHS256, "00000000-0000-0000-0000-000000000000", time.Hour))
+	if code := other.do(http.MethodPost, path, nil, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d opening another customer's portal, got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestPaymentMethods(t *testing.T) {
+	app := newTestApp(t, "")
+	create := func(email string) userResponse {
+		t.Helper()
+		var created struct {
+			User userResponse `json:"user"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": email, "name": "Customer"}, &created); code != http.StatusOK {
+			t.Fatalf("Expected status code %d creating %s, got %d", http.StatusOK, email, code)
+		}
+		return created.User
+	}
+	ada, bob := create("ada@example.com"), create("bob@example.com")
+	path := "/api/v1/customers/" + ada.ID + "/payment-methods"
+	asAda := app.as(app.userToken(jwt.SigningMethodHS256, ada.ID, time.Hour))
+
+	// Cards are collected through SetupIntents confirmed by the client.
+	addCard := func(brand stripe.PaymentMethodCardBrand, last4 string) *stripe.PaymentMethod {
+		t.Helper()
+		var si struct {
+			SetupIntentID string `json:"setup_intent_id"`
+			ClientSecret  string `json:"client_secret"`
+		}
+		if code := asAda.do(http.MethodPost, path+"/setup-intent", nil, &si); code != http.StatusOK || si.ClientSecret == "" {
+			t.Fatalf("Expected a setup intent client secret, got %d %+v", code, si)
+		}
+		pm, err := app.stripe.ConfirmSetupIntent(si.SetupIntentID, &stripe.PaymentMethodCard{Brand: brand, Last4: last4, ExpMonth: 12, ExpYear: 2030})
+		if err != nil {
+			t.Fatalf("Failed to confirm setup intent: %v", err)
+		}
+		return pm
+	}
+	visa, mastercard := addCard(stripe.PaymentMethodCardBrandVisa, "4242"), addCard(stripe.PaymentMethodCardBrandMastercard, "4444")
+
+	// Like a Checkout subscription, this one carries its own default payment method.
+	var sub struct {
+		Subscription stripe.Subscription `json:"stripe_subscription"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": ada.StripeCustomerID, "price_id": app.price.ID}, &sub); code != http.StatusOK {
+		t.Fatalf("Expected status code %d subscribing, got %d", http.StatusOK, code)
+	}
+	if _, err := app.stripe.UpdateSubscription(context.Background(), sub.Subscription.ID, &stripe.SubscriptionParams{DefaultPaymentMethod: stripe.String(visa.ID)}); err != nil {
+		t.Fatalf("Failed to set subscription payment method: %v", err)
+	}
+
+	type card struct {
+		ID        string `json:"id"`
+		Brand     string `json:"brand"`
+		Last4     string `json:"last4"`
+		ExpMonth  int    `json:"exp_month"`
+		ExpYear   int    `json:"exp_year"`
+		IsDefault bool   `json:"is_default"`
+	}
+	list := func() []card {
+		t.Helper()
+		var cards struct {
+			Data []card `json:"data"`
+		}
+		if code := asAda.do(http.MethodGet, path, nil, &cards); code != http.StatusOK {
+			t.Fatalf("Expected status code %d listing payment methods, got %d", http.StatusOK, code)
+		}
+		return cards.Data
+	}
+	want := []card{
+		{ID: mastercard.ID, Brand: "mastercard", Last4: "4444", ExpMonth: 12, ExpYear: 2030},
+		{ID: visa.ID, Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030},
+	}
+	if got := list(); !slices.Equal(got, want) {
+		t.Fatalf("Expected cards %+v, got %+v", want, got)
+	}
+
+	if code := asAda.do(http.MethodPost, path+"/"+mastercard.ID+"/default", nil, nil); code != http.StatusOK {
+		t.Fatalf("Expected status code %d setting the default card, got %d", http.StatusOK, code)
+	}
+	want[0].IsDefault = true
+	if got := list(); !slices.Equal(got, want) {
+		t.Errorf("Expected cards %+v, got %+v", want, got)
+	}
+	if s, _ := app.stripe.GetSubscription(context.Background(), sub.Subscription.ID); s.DefaultPaymentMethod == nil || s.DefaultPaymentMethod.ID != mastercard.ID {
+		t.Errorf("Expected the subscription to renew with %s, got %+v", mastercard.ID, s.DefaultPaymentMethod)
+	}
+
+	// Cards of other customers are not found.
+	bobPath := "/api/v1/customers/" + bob.ID + "/payment-methods/" + visa.ID
+	asBob := app.as(app.userToken(jwt.SigningMethodHS256, bob.ID, time.Hour))
+	if code := asBob.do(http.MethodPost, bobPath+"/default", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d using another customer's card, got %d", http.StatusNotFound, code)
+	}
+	if code := asBob.do(http.MethodDelete, bobPath, nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d detaching another customer's card, got %d", http.StatusNotFound, code)
+	}
+	if code := asBob.do(http.MethodGet, path, nil, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d listing another customer's cards, got %d", http.StatusForbidden, code)
+	}
+
+	if code := asAda.do(http.MethodDelete, path+"/"+mastercard.ID, nil, nil); code != http.StatusOK {
+		t.Fatalf("Expected status code %d detaching a card, got %d", http.StatusOK, code)
+	}
+	if got := list(); !slices.Equal(got, want[1:]) {
+		t.Errorf("Expected cards %+v, got %+v", want[1:], got)
+	}
+	if code := asAda.do(http.MethodDelete, path+"/"+mastercard.ID, nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d detaching a detached card, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	app := newTestApp(t, "")
+
+	// Two customers, each with a subscription.
+	var ids []string
+	subs := map[string]string{}
+	for _, email := range []string{"ada@example.com", "grace@example.com"} {
+		var created struct {
+			User userResponse `json:"user"`
+		}
+		if code := app.do(http.MethodPost, "/api/v1/customers/create", map[string]string{"email": email, "name": email}, &created); code != http.StatusOK {
+			t.Fatalf("Expected status code %d creating customer, got %d", http.StatusOK, code)
+		}
+		var resp struct {
+			Subscription subscriptionResponse `json:"subscription"`
+		}
+		app.do(http.MethodPost, "/api/v1/subscriptions/create", map[string]string{"customer_id": created.User.StripeCustomerID, "price_id": app.price.ID}, &resp)
+		ids = append(ids, created.User.ID)
+		subs[created.User.ID] = resp.Subscription.ID
+	}
+	ada, grace := ids[0], ids[1]
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"no credentials", "", http.MethodGet, "/api/v1/customers/" + ada + "/details", http.StatusUnauthorized},
+		{"unknown bearer", "not-a-key", http.MethodGet, "/api/v1/customers/" + ada + "/details", http.StatusUnauthorized},
+		{"expired token", app.userToken(jwt.SigningMethodHS256, ada, -time.Minute), http.MethodGet, "/api/v1/customers/" + ada + "/details", http.StatusUnauthorized},
+		{"wrongly signed token", app.userToken(jwt.SigningMethodHS256, ada, time.Minute) + "x", http.MethodGet, "/api/v1/customers/" + ada + "/details", http.StatusUnauthorized},
+		{"visitors read the catalog", "", http.MethodGet, "/api/v1/products", http.StatusOK},
+		{"bad credentials on a public endpoint", "not-a-key", http.MethodPost, "/api/v1/checkout-session", http.StatusUnauthorized},
+		{"admin lists customers", testAdminKey, http.MethodGet, "/api/v1/customers", http.StatusOK},
+		{"customer cannot list customers", app.userToken(jwt.SigningMethodHS256, ada, time.Minute), http.MethodGet, "/api/v1/customers", http.StatusForbidden},
+		{"customer reads own details (HS256)", app.userToken(jwt.SigningMethodHS256, ada, time.Minute), http.MethodGet, "/api/v1/customers/" + ada + "/details", http.StatusOK},
+		{"customer reads own details (RS256)", app.userToken(jwt.SigningMethodRS256, ada, time.Minute), http.MethodGet, "/api/v1/customers/" + ada + "/details", http.StatusOK},
+		{"customer cannot read other details", app.userToken(jwt.SigningMethodHS256, ada, time.Minute), http.MethodGet, "/api/v1/customers/" + grace + "/details", http.StatusForbidden},
+		{"customer reads own subscription", app.userToken(jwt.SigningMethodRS256, ada, time.Minute), http.MethodGet, "/api/v1/subscriptions/" + subs[ada], http.StatusOK},
+		{"customer cannot read other subscription", app.userToken(jwt.SigningMethodRS256, ada, time.Minute), http.MethodGet, "/api/v1/subscriptions/" + subs[grace], http.StatusForbidden},
+		{"customer cannot cancel other subscription", app.userToken(jwt.SigningMethodHS256, ada, time.Minute), http.MethodPost, "/api/v1/subscriptions/" + subs[grace] + "/cancel", http.StatusForbidden},
+		{"customer cannot cancel unknown subscription", app.userToken(jwt.SigningMethodHS256, ada, time.Minute), http.MethodPost, "/api/v1/subscriptions/sub_unknown/cancel", http.StatusNotFound},
+		{"customer cancels own subscription", app.userToken(jwt.SigningMethodHS256, grace, time.Minute), http.MethodPost, "/api/v1/subscriptions/" + subs[grace] + "/cancel", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := app.as(tt.token).do(tt.method, tt.path, nil, nil); code != tt.want {
+				t.Errorf("Expected status code %d, got %d", tt.want, code)
+			}
+		})
+	}
+
+	// Checkout on behalf of another user is rejected.
+	body := map[string]string{"priceId": app.price.ID, "userId": grace}
+	if code := app.as(app.userToken(jwt.SigningMethodHS256, ada, time.Minute)).do(http.MethodPost, "/api/v1/checkout-session", body, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for checkout on behalf of another user, got %d", http.StatusForbidden, code)
+	}
+
+	// Visitors may only start guest checkouts, and only read those back.
+	visitor := app.as("")
+	if code := visitor.do(http.MethodPost, "/api/v1/checkout-session", body, nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for a visitor checking out as a user, got %d", http.StatusUnauthorized, code)
+	}
+	var guest struct {
+		SessionURL string `json:"sessionUrl"`
+	}
+	if code := visitor.do(http.MethodPost, "/api/v1/checkout-session", map[string]string{"priceId": app.price.ID}, &guest); code != http.StatusOK {
+		t.Fatalf("Expected status code %d for a guest checkout, got %d", http.StatusOK, code)
+	}
+	guestSession := guest.SessionURL[strings.LastIndex(guest.SessionURL, "/")+1:]
+	if _, err := app.stripe.CompleteCheckoutSession(guestSession, "guest@example.com", "Guest"); err != nil {
+		t.Fatalf("Failed to complete checkout session: %v", err)
+	}
+	var completed struct {
+		User *userResponse `json:"user"`
+	}
+	if code := visitor.do(http.MethodGet, "/api/v1/checkout-session/"+guestSession, nil, &completed); code != http.StatusOK || completed.User == nil || completed.User.Email != "guest@example.com" {
+		t.Errorf("Expected the guest to read back the completed checkout, got %d %+v", code, completed.User)
+	}
+	var own struct {
+		SessionURL string `json:"sessionUrl"`
+	}
+	if code := app.do(http.MethodPost, "/api/v1/checkout-session", map[string]string{"priceId": app.price.ID, "userId": grace}, &own); code != http.StatusOK {
+		t.Fatalf("Expected status code %d for a checkout on behalf of a user, got %d", http.StatusOK, code)
+	}
+	if code := visitor.do(http.MethodGet, "/api/v1/checkout-session/"+own.SessionURL[strings.LastIndex(own.SessionURL, "/")+1:], nil, nil); code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for a visitor reading a user's checkout, got %d", http.StatusForbidden, code)
+	}
+
+	// Webhooks stay reachable without API credentials; they are verified by signature.
+	if code, _ := app.as("").deliverWebhook("evt_auth", "ping", map[string]string{}, time.Now(), testWebhookSecret); code != http.StatusOK {
+		t.Errorf("Expected webhook delivery without credentials to succeed, got %d", code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	app := newTestApp(t, "")
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/v1/customers", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		w := httptest.NewRecorder()
+		app.router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name      string
+		origin    string
+		method    string
+		headers   string
+		want      int
+		wantError string
+	}{
+		{"exact origin", "http://localhost:3000", "POST", "content-type, authorization", http.StatusNoContent, ""},
+		{"wildcard subdomain", "https://billing.example.com", "GET", "", http.StatusNoContent, ""},
+		{"wildcard does not match apex", "https://example.com", "GET", "", http.StatusForbidden, "origin https://example.com is not allowed"},
+		{"wildcard does not match other scheme", "http://billing.example.com", "GET", "", http.StatusForbidden, "is not allowed"},
+		{"unknown origin", "https://evil.test", "GET", "", http.StatusForbidden, "origin https://evil.test is not allowed"},
+		{"method not allowed", "http://localhost:3000", "DELETE", "", http.StatusForbidden, "method DELETE is not allowed"},
+		{"header not allowed", "http://localhost:3000", "POST", "Content-Type, X-Debug", http.StatusForbidden, "X-Debug not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := preflight(tt.origin, tt.method, tt.headers)
+			if w.Code != tt.want {
+				t.Fatalf("Expected status code %d, got %d (%s)", tt.want, w.Code, w.Body.String())
+			}
+			if tt.wantError != "" && !strings.Contains(w.Body.String(), tt.wantError) {
+				t.Errorf("Expected error containing %q, got %s", tt.wantError, w.Body.String())
+			}
+			if tt.want == http.StatusNoContent {
+				if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.origin {
+					t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tt.origin, got)
+				}
+				if w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" {
+					t.Errorf("Expected credentials and max-age headers, got %v", w.Header())
+				}
+			}
+		})
+	}
+
+	// Actual cross-origin requests get the origin echoed and the exposed headers.
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://billing.example.com")
+	w := httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://billing.example.com" || w.Header().Get("Access-Control-Expose-Headers") != "ETag" {
+		t.Errorf("Expected CORS headers on cross-origin request, got %v", w.Header())
+	}
+	req.Header.Set("Origin", "https://evil.test")
+	w = httptest.NewRecorder()
+	app.router.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers for a disallowed origin, got %v", w.Header())
+	}
+}
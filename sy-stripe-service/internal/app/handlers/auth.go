@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"sy-stripe-service/internal/app/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorizeUser aborts the request unless its principal may act for userID.
+func authorizeUser(c *gin.Context, userID string) bool {
+	p, ok := middleware.PrincipalFromContext(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+		return false
+	}
+	if !p.CanAccessUser(userID) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "access to this customer is not allowed"})
+		return false
+	}
+	return true
+}
+
+// isAdmin reports whether the request principal is an admin.
+func isAdmin(c *gin.Context) bool {
+	p, ok := middleware.PrincipalFromContext(c)
+	return ok && p.Admin
+}
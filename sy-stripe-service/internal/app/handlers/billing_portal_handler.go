@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+
+	"sy-stripe-service/internal/app/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BillingPortalHandler struct {
+	service *services.BillingPortalService
+}
+
+func NewBillingPortalHandler(service *services.BillingPortalService) *BillingPortalHandler {
+	return &BillingPortalHandler{service: service}
+}
+
+// POST /api/v1/customers/:id/portal-session
+func (h *BillingPortalHandler) CreatePortalSessionHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	sess, err := h.service.CreateSession(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(customerErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": sess.URL})
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"sy-stripe-service/internal/app/middleware"
 	"sy-stripe-service/internal/app/services"
 )
 
@@ -21,6 +23,12 @@ type CheckoutSessionRequest struct {
 	PriceID    string `json:"priceId" binding:"required"`
 	UserID     string `json:"userId"`
 	CustomerID string `json:"customerId"`
+	// PromotionCode is applied to the subscription; AllowPromotionCodes lets the customer enter one
+	// on the Checkout page instead. At most one of them may be set.
+	PromotionCode       string `json:"promotionCode"`
+	AllowPromotionCodes bool   `json:"allowPromotionCodes"`
+	// TrialPeriodDays overrides the trial of the price; 0 skips it. Only admins may set it.
+	TrialPeriodDays *int64 `json:"trialPeriodDays"`
 }
 
 type CheckoutSessionResponse struct {
@@ -41,6 +49,12 @@ func (h *CheckoutHandler) CreateCheckoutSessionHandler(c *gin.Context) {
 		return
 	}
 
+	req.PromotionCode = strings.TrimSpace(req.PromotionCode)
+	if req.PromotionCode != "" && req.AllowPromotionCodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "promotionCode and allowPromotionCodes cannot be combined"})
+		return
+	}
+
 	var userIDPtr *uuid.UUID
 	if req.UserID != "" {
 		uid, err := uuid.Parse(req.UserID)
@@ -51,6 +65,36 @@ func (h *CheckoutHandler) CreateCheckoutSessionHandler(c *gin.Context) {
 		}
 		userIDPtr = &uid
 	}
+	_, authenticated := middleware.PrincipalFromContext(c)
+	if !authenticated {
+		// Visitors may only start a guest checkout: Stripe collects their details on the Checkout page
+		// and the user is created when the completed session is retrieved.
+		if userIDPtr != nil || req.CustomerID != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "authentication required to check out as an existing customer"})
+			return
+		}
+	} else if !isAdmin(c) {
+		// Customers may only check out for themselves, with their own Stripe customer.
+		if userIDPtr == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "userId required"})
+			return
+		}
+		if !authorizeUser(c, req.UserID) {
+			return
+		}
+		if req.CustomerID != "" {
+			user, err := h.UserService.GetUserByID(c.Request.Context(), req.UserID)
+			if err != nil || user.StripeCustomerID != req.CustomerID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "customerId does not belong to this user"})
+				return
+			}
+		}
+	}
+	// Customers and guests get the trial of the price; a longer one would be free service.
+	if req.TrialPeriodDays != nil && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only admins can set trialPeriodDays"})
+		return
+	}
 	log.Printf("[CreateCheckoutSessionHandler] userID: %v, customerID: %s, priceID: %s", userIDPtr, req.CustomerID, req.PriceID)
 
 	if h.SuccessURL == "" || h.CancelURL == "" {
@@ -77,12 +121,29 @@ func (h *CheckoutHandler) CreateCheckoutSessionHandler(c *gin.Context) {
 	}
 
 	fmt.Println("Stripe Success URL:", successURL)
-	session, err := h.Service.CreateCheckoutSession(req.PriceID, userIDPtr, req.CustomerID, successURL, h.CancelURL)
+	opts := services.CheckoutOptions{PromotionCode: req.PromotionCode, AllowPromotionCodes: req.AllowPromotionCodes, TrialPeriodDays: req.TrialPeriodDays, Guest: !authenticated}
+	session, err := h.Service.CreateCheckoutSession(c.Request.Context(), req.PriceID, userIDPtr, req.CustomerID, successURL, h.CancelURL, opts)
 	if err != nil {
 		log.Printf("[CreateCheckoutSessionHandler] ERROR: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(checkoutErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	log.Printf("[CreateCheckoutSessionHandler] Checkout session created: %s", session.URL)
 	c.JSON(http.StatusOK, CheckoutSessionResponse{SessionURL: session.URL})
 }
+
+// checkoutErrorStatus maps promotion code and trial errors to 400 so that clients can show them to customers,
+// and a checkout by a user who is already subscribed to 409.
+func checkoutErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrPromotionCodeInvalid),
+		errors.Is(err, services.ErrPromotionCodeExpired),
+		errors.Is(err, services.ErrPromotionCodeIneligible),
+		errors.Is(err, services.ErrInvalidTrialPeriod):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrActiveSubscription):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
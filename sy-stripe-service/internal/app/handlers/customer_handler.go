@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"sy-stripe-service/internal/app/services"
+	"sy-stripe-service/internal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CustomerHandler struct {
+	service *services.CustomerService
+}
+
+func NewCustomerHandler(service *services.CustomerService) *CustomerHandler {
+	return &CustomerHandler{service: service}
+}
+
+// UpdateCustomerRequest defines the request body for updating a customer. Omitted fields are unchanged.
+type UpdateCustomerRequest struct {
+	Email *string `json:"email" binding:"omitempty,email"`
+	Name  *string `json:"name"`
+}
+
+// PATCH /api/v1/customers/:id
+func (h *CustomerHandler) UpdateCustomerHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	var req UpdateCustomerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Email == nil && req.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or name is required"})
+		return
+	}
+	user, err := h.service.UpdateCustomer(c.Request.Context(), id, req.Name, req.Email)
+	if err != nil {
+		c.JSON(customerErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// DELETE /api/v1/customers/:id?delete_stripe_customer=true
+func (h *CustomerHandler) DeleteCustomerHandler(c *gin.Context) {
+	deletion, err := h.service.DeleteCustomer(c.Request.Context(), c.Param("id"), c.Query("delete_stripe_customer") == "true")
+	if err != nil {
+		c.JSON(customerErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"deleted":                 true,
+		"canceled_subscriptions":  deletion.CanceledSubscriptions,
+		"stripe_customer_deleted": deletion.StripeCustomerDeleted,
+	})
+}
+
+// customerErrorStatus maps errors of the customer endpoints to HTTP status codes.
+func customerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrCustomerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrInvalidCustomerUpdate):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrDuplicateUser), errors.Is(err, services.ErrNoStripeCustomer):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
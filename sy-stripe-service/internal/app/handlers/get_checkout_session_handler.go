@@ -1,16 +1,18 @@
 package handlers
 
 import (
-	"fmt"
+	"log"
 	"net/http"
+
+	"sy-stripe-service/internal/app/middleware"
+	"sy-stripe-service/internal/app/services"
+
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v72"
-	stripeSession "github.com/stripe/stripe-go/v72/checkout/session"
 )
 
-
-
 // GetCheckoutSessionHandler fetches a Stripe Checkout Session by session_id
+// and persists the resulting user and subscription once the session is complete.
 func (h *CheckoutHandler) GetCheckoutSessionHandler(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
@@ -18,30 +20,44 @@ func (h *CheckoutHandler) GetCheckoutSessionHandler(c *gin.Context) {
 		return
 	}
 
-	// Print first 8 characters of the Stripe key for debug
-	stripeKey := stripe.Key
-	if len(stripeKey) > 8 {
-		fmt.Println("Stripe key prefix:", stripeKey[:8]+"...")
-	} else {
-		fmt.Println("Stripe key prefix:", stripeKey)
-	}
-
-	sess, err := stripeSession.Get(id, nil)
+	sess, err := h.Service.GetCheckoutSession(c.Request.Context(), id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !isAdmin(c) && !h.ownsCheckoutSession(c, sess) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access to this checkout session is not allowed"})
+		return
+	}
+	if sess.Customer == nil || sess.CustomerDetails == nil {
+		c.JSON(http.StatusOK, gin.H{"session": sess, "user": nil, "subscription": nil})
+		return
+	}
 
-	// Upsert user in DB using Stripe customer ID and email from session
-user, userErr := h.UserService.UpsertUserByStripeCustomer(
-    c.Request.Context(),
-    sess.CustomerDetails.Email,
-    sess.CustomerDetails.Name,
-    sess.Customer.ID,
-)
-if userErr != nil {
-    c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to persist user after checkout: " + userErr.Error()})
-    return
+	// Persist the user and the subscription created by the checkout together
+	user, subscription, err := h.Service.CompleteCheckout(c.Request.Context(), sess)
+	if err != nil {
+		log.Printf("[GetCheckoutSessionHandler] ERROR persisting checkout session %s: %v", sess.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to persist checkout: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": sess, "user": user, "subscription": subscription})
 }
-c.JSON(http.StatusOK, gin.H{"session": sess, "user": user})
+
+// ownsCheckoutSession reports whether the request principal started the session
+// or is the local user of its Stripe customer. Visitors may only read guest checkouts,
+// whose unguessable session ID they received in the success URL.
+func (h *CheckoutHandler) ownsCheckoutSession(c *gin.Context, sess *stripe.CheckoutSession) bool {
+	p, ok := middleware.PrincipalFromContext(c)
+	if !ok {
+		return services.IsGuestCheckout(sess)
+	}
+	if sess.Metadata["user_id"] != "" {
+		return p.CanAccessUser(sess.Metadata["user_id"])
+	}
+	if sess.Customer == nil || sess.Customer.ID == "" {
+		return false
+	}
+	user, err := h.UserService.Repo.GetUserByStripeCustomerID(c.Request.Context(), sess.Customer.ID)
+	return err == nil && p.CanAccessUser(user.ID.String())
 }
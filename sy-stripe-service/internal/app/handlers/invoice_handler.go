@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"sy-stripe-service/internal/app/services"
+	"sy-stripe-service/internal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+type InvoiceHandler struct {
+	service     *services.InvoiceService
+	userService *services.UserService
+}
+
+func NewInvoiceHandler(service *services.InvoiceService, userService *services.UserService) *InvoiceHandler {
+	return &InvoiceHandler{service: service, userService: userService}
+}
+
+// ListInvoicesHandler returns one page of a customer's invoices, newest first.
+//
+// Query parameters: limit (1-100, default 20) and after (next_cursor of the previous page).
+// Only stored invoices are listed; they arrive through invoice webhooks and POST .../invoices/sync.
+func (h *InvoiceHandler) ListInvoicesHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	params := database.InvoiceListParams{After: c.Query("after")}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > database.MaxInvoiceListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be a number between 1 and %d", database.MaxInvoiceListLimit)})
+			return
+		}
+		params.Limit = limit
+	}
+	if _, err := h.userService.GetUserByID(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	page, err := h.service.ListInvoices(c.Request.Context(), id, params)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": page.Invoices, "has_more": page.HasMore, "next_cursor": page.NextCursor})
+}
+
+// POST /api/v1/customers/:id/invoices/sync
+func (h *InvoiceHandler) SyncInvoicesHandler(c *gin.Context) {
+	user, err := h.userService.GetUserByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if user.StripeCustomerID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "user has no stripe customer"})
+		return
+	}
+	synced, err := h.service.SyncInvoices(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"synced": synced})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"sy-stripe-service/internal/app/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PaymentMethodHandler struct {
+	service *services.PaymentMethodService
+}
+
+func NewPaymentMethodHandler(service *services.PaymentMethodService) *PaymentMethodHandler {
+	return &PaymentMethodHandler{service: service}
+}
+
+// POST /api/v1/customers/:id/payment-methods/setup-intent
+func (h *PaymentMethodHandler) CreateSetupIntentHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	si, err := h.service.CreateSetupIntent(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(paymentMethodErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"setup_intent_id": si.ID, "client_secret": si.ClientSecret})
+}
+
+// GET /api/v1/customers/:id/payment-methods
+func (h *PaymentMethodHandler) ListPaymentMethodsHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	cards, err := h.service.ListPaymentMethods(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(paymentMethodErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": cards})
+}
+
+// POST /api/v1/customers/:id/payment-methods/:pm/default
+func (h *PaymentMethodHandler) SetDefaultPaymentMethodHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	card, err := h.service.SetDefaultPaymentMethod(c.Request.Context(), id, c.Param("pm"))
+	if err != nil {
+		c.JSON(paymentMethodErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, card)
+}
+
+// DELETE /api/v1/customers/:id/payment-methods/:pm
+func (h *PaymentMethodHandler) DetachPaymentMethodHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
+	if err := h.service.DetachPaymentMethod(c.Request.Context(), id, c.Param("pm")); err != nil {
+		c.JSON(paymentMethodErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"detached": true})
+}
+
+func paymentMethodErrorStatus(err error) int {
+	if errors.Is(err, services.ErrPaymentMethodNotFound) {
+		return http.StatusNotFound
+	}
+	return customerErrorStatus(err)
+}
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 	"sy-stripe-service/internal/app/services"
 	"github.com/gin-gonic/gin"
 )
@@ -14,11 +16,34 @@ func NewProductHandler(service *services.ProductService) *ProductHandler {
 	return &ProductHandler{Service: service}
 }
 
+// GetProductsHandler returns the product catalog with its ETag, or 304 Not Modified when the
+// client's If-None-Match already names it. ?currency= and ?type=one_time|recurring filter the prices.
 func (h *ProductHandler) GetProductsHandler(c *gin.Context) {
-	products, err := h.Service.GetProductsWithPrices()
+	filter := services.PriceFilter{Currency: c.Query("currency"), Type: c.Query("type")}
+	catalog, err := h.Service.GetCatalog(c.Request.Context(), filter)
+	if errors.Is(err, services.ErrInvalidPriceFilter) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, products)
+	c.Header("ETag", catalog.ETag)
+	if etagMatches(c.GetHeader("If-None-Match"), catalog.ETag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, catalog.Products)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing weakly as RFC 9110 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
 }
@@ -2,67 +2,18 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"sy-stripe-service/internal/app/services"
 	"sy-stripe-service/internal/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/product"
-	"github.com/stripe/stripe-go/v72/sub"
 )
 
-// StripeService defines the interface for Stripe operations.
-type StripeService interface {
-	CreateCustomer(email, name string) (*stripe.Customer, error)
-	CreateSubscription(customerID, priceID string) (*stripe.Subscription, error)
-	GetProducts() ([]*stripe.Product, error)
-}
-
-// stripeServiceImpl implements StripeService using the Stripe Go SDK.
-type stripeServiceImpl struct{}
-
-// NewStripeService creates a new StripeService instance.
-func NewStripeService() StripeService {
-	return &stripeServiceImpl{}
-}
-
-// CreateCustomer creates a new Stripe customer.
-func (s *stripeServiceImpl) CreateCustomer(email, name string) (*stripe.Customer, error) {
-	params := &stripe.CustomerParams{
-		Email: stripe.String(email),
-		Name:  stripe.String(name),
-	}
-	return customer.New(params)
-}
-
-// CreateSubscription creates a new Stripe subscription.
-func (s *stripeServiceImpl) CreateSubscription(customerID, priceID string) (*stripe.Subscription, error) {
-	params := &stripe.SubscriptionParams{
-		Customer: stripe.String(customerID),
-		Items: []*stripe.SubscriptionItemsParams{
-			{
-				Price: stripe.String(priceID),
-			},
-		},
-	}
-	return sub.New(params)
-}
-
-// GetProducts retrieves a list of Stripe products.
-func (s *stripeServiceImpl) GetProducts() ([]*stripe.Product, error) {
-	params := &stripe.ProductListParams{}
-	i := product.List(params)
-	var products []*stripe.Product
-	for i.Next() {
-		products = append(products, i.Product())
-	}
-	return products, nil
-}
-
 // CreateCustomerRequest defines the request body for creating a customer.
 type CreateCustomerRequest struct {
 	Email string `json:"email" binding:"required,email"`
@@ -73,13 +24,15 @@ type CreateCustomerRequest struct {
 type CreateSubscriptionRequest struct {
 	CustomerID string `json:"customer_id" binding:"required"`
 	PriceID    string `json:"price_id" binding:"required"`
+	// TrialPeriodDays overrides the trial of the price; 0 skips it.
+	TrialPeriodDays *int64 `json:"trial_period_days"`
 }
 
 
 
 // StripeHandlers holds the service dependencies.
 type StripeHandlers struct {
-	stripeService       StripeService
+	gateway             services.BillingGateway
 	userService         UserService
 	subscriptionService SubscriptionService
 }
@@ -91,13 +44,13 @@ type UserService interface {
 
 // SubscriptionService defines the interface for subscription operations.
 type SubscriptionService interface {
-	CreateSubscription(ctx context.Context, userID string, priceID string) (*models.Subscription, error)
+	CreateSubscription(ctx context.Context, customerID, priceID string, trialPeriodDays *int64) (*stripe.Subscription, *models.Subscription, error)
 }
 
 // NewStripeHandlers creates a new instance of StripeHandlers.
-func NewStripeHandlers(stripeService StripeService, userService UserService, subscriptionService SubscriptionService) *StripeHandlers {
+func NewStripeHandlers(gateway services.BillingGateway, userService UserService, subscriptionService SubscriptionService) *StripeHandlers {
 	return &StripeHandlers{
-		stripeService:       stripeService,
+		gateway:             gateway,
 		userService:         userService,
 		subscriptionService:  subscriptionService,
 	}
@@ -112,7 +65,10 @@ func (h *StripeHandlers) CreateCustomerHandler(c *gin.Context) {
 	}
 
 	// 1. Create customer in Stripe
-	customer, err := h.stripeService.CreateCustomer(req.Email, req.Name)
+	customer, err := h.gateway.CreateCustomer(c.Request.Context(), &stripe.CustomerParams{
+		Email: stripe.String(req.Email),
+		Name:  stripe.String(req.Name),
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create Stripe customer: %v", err)})
 		return
@@ -141,17 +97,13 @@ func (h *StripeHandlers) CreateSubscriptionHandler(c *gin.Context) {
 		return
 	}
 
-	// 1. Create subscription in Stripe
-	subscription, err := h.stripeService.CreateSubscription(req.CustomerID, req.PriceID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create Stripe subscription: %v", err)})
+	subscription, sub, err := h.subscriptionService.CreateSubscription(c.Request.Context(), req.CustomerID, req.PriceID, req.TrialPeriodDays)
+	if errors.Is(err, services.ErrInvalidTrialPeriod) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	// 2. Persist subscription in DB
-	sub, err := h.subscriptionService.CreateSubscription(c.Request.Context(), req.CustomerID, req.PriceID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to persist subscription: %v", err)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create subscription: %v", err)})
 		return
 	}
 
@@ -160,7 +112,7 @@ func (h *StripeHandlers) CreateSubscriptionHandler(c *gin.Context) {
 
 // GetProductsHandler handles retrieving a list of Stripe products.
 func (h *StripeHandlers) GetProductsHandler(c *gin.Context) {
-	products, err := h.stripeService.GetProducts()
+	products, err := h.gateway.ListProducts(c.Request.Context(), &stripe.ProductListParams{})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to retrieve products: %v", err)})
 		return
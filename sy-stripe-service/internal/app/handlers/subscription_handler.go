@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"github.com/gin-gonic/gin"
 	"sy-stripe-service/internal/app/services"
@@ -14,6 +16,20 @@ func NewSubscriptionHandler(service *services.SubscriptionService) *Subscription
 	return &SubscriptionHandler{service: service}
 }
 
+// authorizeSubscription aborts the request unless its principal owns the subscription :id.
+// Admins may also address subscriptions that are only known to Stripe.
+func (h *SubscriptionHandler) authorizeSubscription(c *gin.Context) bool {
+	sub, err := h.service.FindSubscription(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if isAdmin(c) {
+			return true
+		}
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return false
+	}
+	return authorizeUser(c, sub.UserID.String())
+}
+
 // GET /api/v1/subscriptions/:id
 func (h *SubscriptionHandler) GetSubscriptionHandler(c *gin.Context) {
 	id := c.Param("id")
@@ -22,22 +38,130 @@ func (h *SubscriptionHandler) GetSubscriptionHandler(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	if !authorizeUser(c, sub.UserID.String()) {
+		return
+	}
 	c.JSON(http.StatusOK, sub)
 }
 
-// POST /api/v1/subscriptions/:id/cancel
+// Cancellation modes accepted by the cancel endpoint.
+const (
+	cancelModeImmediate = "immediate"
+	cancelModePeriodEnd = "period_end"
+)
+
+// CancelSubscriptionRequest defines the optional request body for canceling a subscription.
+type CancelSubscriptionRequest struct {
+	Mode string `json:"mode"`
+}
+
+// POST /api/v1/subscriptions/:id/cancel?mode=immediate|period_end
 func (h *SubscriptionHandler) CancelSubscriptionHandler(c *gin.Context) {
 	id := c.Param("id")
-	// userID := get from context or auth (assumed present)
-	err := h.service.CancelSubscription(c.Request.Context(), id)
+	if !h.authorizeSubscription(c) {
+		return
+	}
+	mode := c.Query("mode")
+	if mode == "" {
+		// The body is optional; an empty one (io.EOF) keeps the default mode.
+		var req CancelSubscriptionRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		mode = req.Mode
+	}
+	if mode == "" {
+		mode = cancelModeImmediate
+	}
+
+	switch mode {
+	case cancelModeImmediate:
+		err := h.service.CancelSubscription(c.Request.Context(), id)
+		if err != nil {
+			c.JSON(planChangeErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "canceled"})
+	case cancelModePeriodEnd:
+		sub, err := h.service.CancelSubscriptionAtPeriodEnd(c.Request.Context(), id)
+		if err != nil {
+			c.JSON(planChangeErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "cancel_at_period_end", "subscription": sub})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be one of immediate, period_end"})
+	}
+}
+
+// POST /api/v1/subscriptions/:id/reactivate
+func (h *SubscriptionHandler) ReactivateSubscriptionHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !h.authorizeSubscription(c) {
+		return
+	}
+	sub, err := h.service.ReactivateSubscription(c.Request.Context(), id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(planChangeErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "canceled"})
+	// A reactivated subscription may still be in its trial.
+	c.JSON(http.StatusOK, gin.H{"status": sub.Status, "subscription": sub})
+}
+
+// UpdatePlanRequest defines the request body for changing a subscription's plan.
+type UpdatePlanRequest struct {
+	PriceID           string `json:"priceId" binding:"required"`
+	ProrationBehavior string `json:"prorationBehavior"`
+	Preview           bool   `json:"preview"`
 }
 
-// POST /api/v1/subscriptions/:id/update-plan (optional placeholder)
+// POST /api/v1/subscriptions/:id/update-plan
+// With preview=true (body or query) only the upcoming invoice is returned.
 func (h *SubscriptionHandler) UpdatePlanHandler(c *gin.Context) {
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "update-plan not implemented"})
+	id := c.Param("id")
+	if !h.authorizeSubscription(c) {
+		return
+	}
+	var req UpdatePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ProrationBehavior == "" {
+		req.ProrationBehavior = services.ProrationCreateProrations
+	}
+
+	if req.Preview || c.Query("preview") == "true" {
+		preview, err := h.service.PreviewPlanChange(c.Request.Context(), id, req.PriceID, req.ProrationBehavior)
+		if err != nil {
+			c.JSON(planChangeErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"preview": preview})
+		return
+	}
+
+	sub, err := h.service.ChangePlan(c.Request.Context(), id, req.PriceID, req.ProrationBehavior)
+	if err != nil {
+		c.JSON(planChangeErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": sub})
+}
+
+// planChangeErrorStatus maps plan change and cancellation errors to HTTP status codes.
+func planChangeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidProrationBehavior):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrSubscriptionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrSubscriptionInactive), errors.Is(err, services.ErrSamePlan),
+		errors.Is(err, services.ErrSubscriptionNotCancelable), errors.Is(err, services.ErrNoPendingCancellation):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
 }
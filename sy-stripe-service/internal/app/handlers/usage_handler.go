@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"sy-stripe-service/internal/app/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UsageHandler struct {
+	service       *services.UsageService
+	subscriptions *services.SubscriptionService
+}
+
+func NewUsageHandler(service *services.UsageService, subscriptions *services.SubscriptionService) *UsageHandler {
+	return &UsageHandler{service: service, subscriptions: subscriptions}
+}
+
+// RecordUsageRequest defines the request body for reporting metered usage. The idempotency key
+// may also be sent in the Idempotency-Key header.
+type RecordUsageRequest struct {
+	Quantity       int64      `json:"quantity" binding:"required"`
+	Timestamp      *time.Time `json:"timestamp"`
+	IdempotencyKey string     `json:"idempotency_key"`
+}
+
+// POST /api/v1/subscriptions/:id/usage
+func (h *UsageHandler) RecordUsageHandler(c *gin.Context) {
+	var req RecordUsageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key := req.IdempotencyKey
+	if key == "" {
+		key = c.GetHeader("Idempotency-Key")
+	}
+	rec, created, err := h.service.RecordUsage(c.Request.Context(), c.Param("id"), req.Quantity, req.Timestamp, key)
+	if err != nil {
+		c.JSON(usageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if !created {
+		c.JSON(http.StatusOK, rec)
+		return
+	}
+	c.JSON(http.StatusAccepted, rec)
+}
+
+// GET /api/v1/subscriptions/:id/usage
+func (h *UsageHandler) GetUsageSummaryHandler(c *gin.Context) {
+	sub, err := h.subscriptions.FindSubscription(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorizeUser(c, sub.UserID.String()) {
+		return
+	}
+	summary, err := h.service.GetUsageSummary(c.Request.Context(), sub.ID.String())
+	if err != nil {
+		c.JSON(usageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+func usageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidUsage):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrSubscriptionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrSubscriptionInactive), errors.Is(err, services.ErrIdempotencyKeyReused):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -1,17 +1,19 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"sy-stripe-service/internal/app/services"
+	"sy-stripe-service/internal/database"
 	"sy-stripe-service/internal/models"
 
 	"github.com/gin-gonic/gin"
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/sub"
-	"github.com/stripe/stripe-go/v72/price"
 )
 
 
@@ -19,25 +21,87 @@ import (
 type UserHandler struct {
 	Service *services.UserService
 	SubscriptionService *services.SubscriptionService
+	ProductService *services.ProductService
+	InvoiceService *services.InvoiceService
+	DunningService *services.DunningService
 }
 
-func NewUserHandler(service *services.UserService, subscriptionService *services.SubscriptionService) *UserHandler {
-	return &UserHandler{Service: service, SubscriptionService: subscriptionService}
+func NewUserHandler(service *services.UserService, subscriptionService *services.SubscriptionService, productService *services.ProductService, invoiceService *services.InvoiceService, dunningService *services.DunningService) *UserHandler {
+	return &UserHandler{Service: service, SubscriptionService: subscriptionService, ProductService: productService, InvoiceService: invoiceService, DunningService: dunningService}
 }
 
-// GetAllUsersHandler returns all users in the database.
-func (h *UserHandler) GetAllUsersHandler(c *gin.Context) {
-	users, err := h.Service.GetAllUsers(c.Request.Context())
+// ListUsersHandler returns one page of users.
+//
+// Query parameters: limit (1-200, default 50), after (next_cursor of the previous page),
+// email and name (case-insensitive substrings), created_from and created_to (RFC 3339 or
+// YYYY-MM-DD; from is inclusive, to exclusive), status (subscription status) and
+// sort (created_at or email, prefixed with "-" for descending; default -created_at).
+func (h *UserHandler) ListUsersHandler(c *gin.Context) {
+	params, err := userListParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	page, err := h.Service.ListUsers(c.Request.Context(), params)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, users)
+	c.JSON(http.StatusOK, gin.H{"data": page.Users, "has_more": page.HasMore, "next_cursor": page.NextCursor})
+}
+
+// userListParams parses the query parameters of ListUsersHandler.
+func userListParams(c *gin.Context) (database.UserListParams, error) {
+	params := database.UserListParams{
+		After:              c.Query("after"),
+		Email:              strings.TrimSpace(c.Query("email")),
+		Name:               strings.TrimSpace(c.Query("name")),
+		SubscriptionStatus: c.Query("status"),
+		Sort:               database.UserSortCreatedAt,
+		Desc:               true,
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > database.MaxUserListLimit {
+			return params, fmt.Errorf("limit must be a number between 1 and %d", database.MaxUserListLimit)
+		}
+		params.Limit = limit
+	}
+	if v := c.Query("sort"); v != "" {
+		key, desc := strings.CutPrefix(v, "-")
+		switch database.UserSort(key) {
+		case database.UserSortCreatedAt, database.UserSortEmail:
+			params.Sort, params.Desc = database.UserSort(key), desc
+		default:
+			return params, fmt.Errorf("sort must be created_at or email, optionally prefixed with -")
+		}
+	}
+	for name, dst := range map[string]**time.Time{"created_from": &params.CreatedFrom, "created_to": &params.CreatedTo} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, v); err != nil {
+				return params, fmt.Errorf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", name)
+			}
+		}
+		*dst = &t
+	}
+	return params, nil
 }
 
 // GetUserByIDHandler returns a user by internal UUID
 func (h *UserHandler) GetUserByIDHandler(c *gin.Context) {
 	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
 	user, err := h.Service.GetUserByID(c.Request.Context(), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -46,9 +110,13 @@ func (h *UserHandler) GetUserByIDHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
-// GetCustomerDetailsHandler returns user and latest subscription by user ID
+// GetCustomerDetailsHandler returns user and latest subscription by user ID, together with
+// the last invoice, a preview of the next one and the subscription's dunning state
 func (h *UserHandler) GetCustomerDetailsHandler(c *gin.Context) {
 	id := c.Param("id")
+	if !authorizeUser(c, id) {
+		return
+	}
 	user, err := h.Service.GetUserByID(c.Request.Context(), id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
@@ -57,33 +125,15 @@ func (h *UserHandler) GetCustomerDetailsHandler(c *gin.Context) {
 
 	subscription, subErr := h.SubscriptionService.GetLatestSubscriptionByUserID(c.Request.Context(), id)
 	if subErr != nil || subscription == nil {
-		// Fallback: fetch from Stripe if not found in DB
-		stripeCustomerID := user.StripeCustomerID
-		if stripeCustomerID != "" {
-			stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-			params := &stripe.SubscriptionListParams{
-				Customer: stripeCustomerID,
-			}
-			params.Filters.AddFilter("limit", "", "1")
-			params.Filters.AddFilter("status", "", "all")
-			iter := sub.List(params)
-			if iter.Next() {
-				stripeSubObj := iter.Subscription()
-				// Map Stripe subscription fields to local Subscription struct
-				subscription = &models.Subscription{
-					ID:                 user.ID, // No local ID, use user ID for placeholder
-					UserID:             user.ID,
-					StripeSubscriptionID: stripeSubObj.ID,
-					StripePriceID:      "",
-					Status:             string(stripeSubObj.Status),
-					CurrentPeriodStart: time.Unix(stripeSubObj.CurrentPeriodStart, 0),
-					CurrentPeriodEnd:   time.Unix(stripeSubObj.CurrentPeriodEnd, 0),
-					CreatedAt:          time.Unix(stripeSubObj.Created, 0),
-					UpdatedAt:          time.Now(),
-				}
-				if len(stripeSubObj.Items.Data) > 0 {
-					subscription.StripePriceID = stripeSubObj.Items.Data[0].Price.ID
-				}
+		// Fallback: users who subscribed before checkout completion was persisted
+		// have no local row yet, so mirror their latest Stripe subscription now.
+		subscription = nil
+		if user.StripeCustomerID != "" {
+			synced, err := h.SubscriptionService.SyncLatestStripeSubscription(c.Request.Context(), user)
+			if err != nil {
+				log.Printf("[GetCustomerDetailsHandler] No subscription synced for user %s: %v", user.ID, err)
+			} else {
+				subscription = synced
 			}
 		}
 	}
@@ -91,7 +141,7 @@ func (h *UserHandler) GetCustomerDetailsHandler(c *gin.Context) {
 	// If we have a StripePriceID, fetch price details from Stripe
 	var plan map[string]interface{} = nil
 	if subscription != nil && subscription.StripePriceID != "" {
-		p, err := price.Get(subscription.StripePriceID, nil)
+		p, err := h.ProductService.GetPrice(c.Request.Context(), subscription.StripePriceID)
 		if err == nil {
 			plan = map[string]interface{}{
 				"id":      p.ID,
@@ -106,6 +156,30 @@ func (h *UserHandler) GetCustomerDetailsHandler(c *gin.Context) {
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"user": user, "subscription": subscription, "plan": plan})
+	lastInvoice, err := h.InvoiceService.LatestInvoice(c.Request.Context(), id)
+	if err != nil {
+		log.Printf("[GetCustomerDetailsHandler] Failed to load last invoice of user %s: %v", user.ID, err)
+	}
+	upcomingInvoice, err := h.InvoiceService.UpcomingInvoice(c.Request.Context(), subscription)
+	if err != nil {
+		// Stripe has no upcoming invoice e.g. for subscriptions that end with the current period.
+		log.Printf("[GetCustomerDetailsHandler] No upcoming invoice for user %s: %v", user.ID, err)
+	}
+	var dunningState *models.DunningState
+	var discount *models.SubscriptionDiscount
+	if subscription != nil {
+		dunningState = h.DunningService.GetDunningState(c.Request.Context(), subscription.ID.String())
+		discount = subscription.Discount
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":             user,
+		"subscription":     subscription,
+		"plan":             plan,
+		"last_invoice":     lastInvoice,
+		"upcoming_invoice": upcomingInvoice,
+		"dunning_state":    dunningState,
+		"discount":         discount,
+	})
 }
 
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"sy-stripe-service/internal/app/services"
+	"sy-stripe-service/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// maxWebhookBodyBytes bounds the payload read from a webhook request. Stripe's 64 KB example is a
+// floor: invoice events with many lines are larger.
+const maxWebhookBodyBytes = int64(1 << 20)
+
+// WebhookHandler verifies, deduplicates and dispatches Stripe webhook events.
+type WebhookHandler struct {
+	Secret              string
+	EventService        *services.StripeEventService
+	UserService         *services.UserService
+	SubscriptionService *services.SubscriptionService
+	InvoiceService      *services.InvoiceService
+	DunningService      *services.DunningService
+	ProductService      *services.ProductService
+	TrialService        *services.TrialService
+}
+
+func NewWebhookHandler(secret string, eventService *services.StripeEventService, userService *services.UserService, subscriptionService *services.SubscriptionService, invoiceService *services.InvoiceService, dunningService *services.DunningService, productService *services.ProductService, trialService *services.TrialService) *WebhookHandler {
+	return &WebhookHandler{Secret: secret, EventService: eventService, UserService: userService, SubscriptionService: subscriptionService, InvoiceService: invoiceService, DunningService: dunningService, ProductService: productService, TrialService: trialService}
+}
+
+// POST /api/v1/webhooks/stripe
+func (h *WebhookHandler) HandleStripeWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Printf("[HandleStripeWebhook] Payload exceeds %d bytes", tooLarge.Limit)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("payload exceeds %d bytes", tooLarge.Limit)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to read request body"})
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, c.GetHeader("Stripe-Signature"), h.Secret)
+	if err != nil {
+		log.Printf("[HandleStripeWebhook] Signature verification failed: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid signature"})
+		return
+	}
+	log.Printf("[HandleStripeWebhook] Received event %s (%s)", event.ID, event.Type)
+
+	process, err := h.EventService.BeginEvent(c.Request.Context(), event, payload)
+	if errors.Is(err, services.ErrEventInProgress) {
+		// Answer non-2xx so Stripe retries in case the other delivery fails.
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("[HandleStripeWebhook] ERROR recording %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !process {
+		c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+		return
+	}
+
+	status := models.StripeEventStatusProcessed
+	err = h.dispatch(c, event)
+	switch {
+	case errors.Is(err, errUnhandledEvent):
+		status, err = models.StripeEventStatusIgnored, nil
+	case errors.Is(err, services.ErrStaleEvent):
+		status, err = models.StripeEventStatusSkipped, nil
+	case err != nil:
+		status = models.StripeEventStatusFailed
+	}
+	if finishErr := h.EventService.FinishEvent(c.Request.Context(), event.ID, status, err); finishErr != nil {
+		log.Printf("[HandleStripeWebhook] ERROR storing result of %s: %v", event.ID, finishErr)
+	}
+	if err != nil {
+		log.Printf("[HandleStripeWebhook] ERROR handling %s (%s): %v", event.ID, event.Type, err)
+		// A non-2xx response makes Stripe retry the delivery later.
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true, "status": status})
+}
+
+// errUnhandledEvent marks event types the service does not act on.
+var errUnhandledEvent = errors.New("unhandled event type")
+
+// dispatch routes an event to the typed handler for its type.
+func (h *WebhookHandler) dispatch(c *gin.Context, event stripe.Event) error {
+	switch event.Type {
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var s stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+			return fmt.Errorf("failed to parse subscription: %w", err)
+		}
+		return h.handleSubscriptionEvent(c, &s, time.Unix(event.Created, 0))
+	case "customer.subscription.trial_will_end":
+		var s stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+			return fmt.Errorf("failed to parse subscription: %w", err)
+		}
+		return h.TrialService.HandleTrialWillEnd(c.Request.Context(), &s, time.Unix(event.Created, 0))
+	case "checkout.session.completed":
+		var sess stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &sess); err != nil {
+			return fmt.Errorf("failed to parse checkout session: %w", err)
+		}
+		return h.handleCheckoutSessionCompleted(c, &sess)
+	case "invoice.created", "invoice.finalized", "invoice.paid", "invoice.payment_succeeded",
+		"invoice.payment_failed", "invoice.payment_action_required", "invoice.upcoming",
+		"invoice.voided", "invoice.marked_uncollectible":
+		var inv stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+			return fmt.Errorf("failed to parse invoice: %w", err)
+		}
+		return h.handleInvoiceEvent(c, event.Type, &inv, time.Unix(event.Created, 0))
+	case "product.created", "product.updated", "product.deleted",
+		"price.created", "price.updated", "price.deleted":
+		// The catalog is refetched as a whole, so the event payload is not needed.
+		h.ProductService.InvalidateCatalog()
+		return nil
+	default:
+		log.Printf("[HandleStripeWebhook] Ignoring unhandled event type: %s", event.Type)
+		return errUnhandledEvent
+	}
+}
+
+func (h *WebhookHandler) handleSubscriptionEvent(c *gin.Context, s *stripe.Subscription, created time.Time) error {
+	_, err := h.SubscriptionService.SyncStripeSubscription(c.Request.Context(), s, created)
+	return err
+}
+
+func (h *WebhookHandler) handleCheckoutSessionCompleted(c *gin.Context, sess *stripe.CheckoutSession) error {
+	if sess.Customer == nil || sess.Customer.ID == "" {
+		log.Printf("[HandleStripeWebhook] Checkout session %s has no customer, skipping", sess.ID)
+		return nil
+	}
+	_, _, err := h.SubscriptionService.CompleteCheckout(c.Request.Context(), sess)
+	return err
+}
+
+func (h *WebhookHandler) handleInvoiceEvent(c *gin.Context, eventType string, inv *stripe.Invoice, created time.Time) error {
+	// Upcoming invoices are previews without an ID; they are not stored.
+	if inv.ID != "" {
+		if _, err := h.InvoiceService.SyncStripeInvoice(c.Request.Context(), inv, created); err != nil {
+			return err
+		}
+	}
+	if inv.Subscription == nil || inv.Subscription.ID == "" {
+		log.Printf("[HandleStripeWebhook] Invoice %s (%s) is not tied to a subscription, skipping", inv.ID, eventType)
+		return nil
+	}
+	// The invoice only carries the subscription ID; the subscription status
+	// (e.g. past_due after a failed payment) has to be fetched from Stripe.
+	if _, err := h.SubscriptionService.SyncStripeSubscriptionByID(c.Request.Context(), inv.Subscription.ID); err != nil {
+		return err
+	}
+	var err error
+	switch eventType {
+	case "invoice.payment_failed":
+		_, err = h.DunningService.HandlePaymentFailed(c.Request.Context(), inv, created)
+	case "invoice.paid":
+		_, err = h.DunningService.HandleInvoicePaid(c.Request.Context(), inv, created)
+	}
+	return err
+}
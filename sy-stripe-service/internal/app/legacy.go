@@ -0,0 +1,105 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+)
+
+// NewLegacyHandler wraps the API handler with the request and response shapes of the
+// original net/http server (root main.go), so its clients keep working:
+//
+//   - GET / answers with a plain greeting
+//   - POST /api/v1/customers/create returns the bare Stripe customer; name is optional
+//   - POST /api/v1/subscriptions/create takes {"customerId","priceId"} and returns the bare Stripe subscription
+//   - errors are plain text instead of {"error": ...}
+//
+// Every other request is served by api unchanged.
+func NewLegacyHandler(api http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello, Go Stripe Backend!")
+	})
+	mux.HandleFunc("/api/v1/customers/create", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+			Name  string `json:"name"`
+		}
+		if !decodeLegacyRequest(w, r, &req) {
+			return
+		}
+		if req.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			req.Name = req.Email
+		}
+		serveLegacy(w, r, api, req, "stripe_customer")
+	})
+	mux.HandleFunc("/api/v1/subscriptions/create", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CustomerID string `json:"customerId"`
+			PriceID    string `json:"priceId"`
+		}
+		if !decodeLegacyRequest(w, r, &req) {
+			return
+		}
+		if req.CustomerID == "" || req.PriceID == "" {
+			http.Error(w, "Customer ID and Price ID are required", http.StatusBadRequest)
+			return
+		}
+		body := map[string]string{"customer_id": req.CustomerID, "price_id": req.PriceID}
+		serveLegacy(w, r, api, body, "stripe_subscription")
+	})
+	return mux
+}
+
+func decodeLegacyRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// serveLegacy forwards body to api and writes the response field named by field,
+// or the API error as plain text.
+func serveLegacy(w http.ResponseWriter, r *http.Request, api http.Handler, body interface{}, field string) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		http.Error(w, rec.Body.String(), rec.Code)
+		return
+	}
+	if rec.Code != http.StatusOK {
+		var msg string
+		if err := json.Unmarshal(resp["error"], &msg); err != nil {
+			msg = rec.Body.String()
+		}
+		http.Error(w, msg, rec.Code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp[field])
+}
@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject is the internal user ID for customers, or the credential name for admins.
+	Subject string
+	Admin   bool
+}
+
+// CanAccessUser reports whether the principal may read or change data owned by userID.
+func (p *Principal) CanAccessUser(userID string) bool {
+	return p.Admin || (p.Subject != "" && p.Subject == userID)
+}
+
+const principalKey = "auth.principal"
+
+// PrincipalFromContext returns the principal stored by Auth.
+func PrincipalFromContext(c *gin.Context) (*Principal, bool) {
+	v, ok := c.Get(principalKey)
+	if !ok {
+		return nil, false
+	}
+	p, ok := v.(*Principal)
+	return p, ok
+}
+
+// ErrNoCredentials is returned by an Authenticator when the request carries no credentials it understands.
+// Auth then tries the next authenticator.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator resolves the principal of a request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Auth authenticates every request with the first authenticator that recognizes its credentials
+// and stores the principal in the context. Requests without valid credentials are rejected with 401.
+func Auth(authenticators ...Authenticator) gin.HandlerFunc {
+	return authenticate(true, authenticators)
+}
+
+// OptionalAuth is Auth for endpoints that anonymous callers may use: requests without credentials
+// pass without a principal, while invalid credentials are still rejected with 401.
+func OptionalAuth(authenticators ...Authenticator) gin.HandlerFunc {
+	return authenticate(false, authenticators)
+}
+
+func authenticate(required bool, authenticators []Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, a := range authenticators {
+			p, err := a.Authenticate(c.Request)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			c.Set(principalKey, p)
+			c.Next()
+			return
+		}
+		if !required {
+			c.Next()
+			return
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="sy-stripe-service"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+	}
+}
+
+// RequireAdmin rejects requests whose principal is not an admin with 403.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := PrincipalFromContext(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			return
+		}
+		if !p.Admin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AllowAll authenticates every request as an admin. It is used when authentication is disabled.
+type AllowAll struct{}
+
+func (AllowAll) Authenticate(r *http.Request) (*Principal, error) {
+	return &Principal{Subject: "anonymous", Admin: true}, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// APIKeyAuthenticator accepts static admin API keys sent as "X-API-Key" or as a bearer token.
+type APIKeyAuthenticator struct {
+	keys []string
+}
+
+func NewAPIKeyAuthenticator(keys []string) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	explicit := key != ""
+	if !explicit {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	for i, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return &Principal{Subject: fmt.Sprintf("api-key-%d", i+1), Admin: true}, nil
+		}
+	}
+	if explicit {
+		return nil, errors.New("invalid API key")
+	}
+	// Bearer tokens that are not API keys may be JWTs.
+	return nil, ErrNoCredentials
+}
+
+// JWTConfig holds the locally configured keys and expected claims for JWT validation.
+type JWTConfig struct {
+	HS256Secret    []byte
+	RS256PublicKey *rsa.PublicKey
+	Issuer         string
+	Audience       string
+}
+
+// JWTAuthenticator accepts HS256 or RS256 signed bearer tokens.
+// The sub claim is the internal user ID; a role claim of "admin" grants admin access.
+type JWTAuthenticator struct {
+	cfg     JWTConfig
+	methods []string
+}
+
+func NewJWTAuthenticator(cfg JWTConfig) *JWTAuthenticator {
+	a := &JWTAuthenticator{cfg: cfg}
+	if len(cfg.HS256Secret) > 0 {
+		a.methods = append(a.methods, jwt.SigningMethodHS256.Alg())
+	}
+	if cfg.RS256PublicKey != nil {
+		a.methods = append(a.methods, jwt.SigningMethodRS256.Alg())
+	}
+	return a
+}
+
+type claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return nil, ErrNoCredentials
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods(a.methods), jwt.WithExpirationRequired()}
+	if a.cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.cfg.Issuer))
+	}
+	if a.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.cfg.Audience))
+	}
+	var c claims
+	_, err := jwt.ParseWithClaims(raw, &c, a.key, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if c.Subject == "" {
+		return nil, errors.New("invalid token: missing sub claim")
+	}
+	return &Principal{Subject: c.Subject, Admin: c.Role == "admin"}, nil
+}
+
+// key selects the verification key for the token's signing method.
+func (a *JWTAuthenticator) key(t *jwt.Token) (interface{}, error) {
+	switch t.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return a.cfg.HS256Secret, nil
+	case jwt.SigningMethodRS256.Alg():
+		return a.cfg.RS256PublicKey, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+}
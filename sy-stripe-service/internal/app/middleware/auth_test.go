@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testSecret   = "test-jwt-secret"
+	testAPIKey   = "test-admin-key"
+	testIssuer   = "https://auth.example.com"
+	testAudience = "sy-stripe-service"
+)
+
+// newAuthRouter serves /me to any authenticated caller and /admin to admins only.
+// Both respond with the subject of the principal.
+func newAuthRouter(t *testing.T, rsaKey *rsa.PrivateKey) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	jwtAuth := NewJWTAuthenticator(JWTConfig{
+		HS256Secret:    []byte(testSecret),
+		RS256PublicKey: &rsaKey.PublicKey,
+		Issuer:         testIssuer,
+		Audience:       testAudience,
+	})
+	r := gin.New()
+	api := r.Group("/", Auth(NewAPIKeyAuthenticator([]string{"other-key", testAPIKey}), jwtAuth))
+	subject := func(c *gin.Context) {
+		p, _ := PrincipalFromContext(c)
+		c.String(http.StatusOK, p.Subject)
+	}
+	api.GET("/me", subject)
+	api.GET("/admin", RequireAdmin(), subject)
+	r.GET("/public", OptionalAuth(jwtAuth), func(c *gin.Context) {
+		if p, ok := PrincipalFromContext(c); ok {
+			c.String(http.StatusOK, p.Subject)
+			return
+		}
+		c.String(http.StatusOK, "anonymous")
+	})
+	return r
+}
+
+// sign returns a token for the claims; key is the secret or private key matching method.
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, c jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, c).SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+// validClaims returns claims accepted by the test router, changed by edit.
+func validClaims(edit func(jwt.MapClaims)) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"sub": "user-1",
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	if edit != nil {
+		edit(c)
+	}
+	return c
+}
+
+func TestAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode RSA public key: %v", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	router := newAuthRouter(t, rsaKey)
+
+	hs256 := func(edit func(jwt.MapClaims)) string {
+		return sign(t, jwt.SigningMethodHS256, []byte(testSecret), validClaims(edit))
+	}
+	admin := func(c jwt.MapClaims) { c["role"] = "admin" }
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		subject string
+	}{
+		{"HS256 user token", "/me", map[string]string{"Authorization": "Bearer " + hs256(nil)}, http.StatusOK, "user-1"},
+		{"RS256 user token", "/me", map[string]string{"Authorization": "Bearer " + sign(t, jwt.SigningMethodRS256, rsaKey, validClaims(nil))}, http.StatusOK, "user-1"},
+		{"lowercase bearer scheme", "/me", map[string]string{"Authorization": "bearer " + hs256(nil)}, http.StatusOK, "user-1"},
+		{"no credentials", "/me", nil, http.StatusUnauthorized, ""},
+
+		// Algorithms other than the configured HS256 and RS256 are rejected.
+		{"HS384 token", "/me", map[string]string{"Authorization": "Bearer " + sign(t, jwt.SigningMethodHS384, []byte(testSecret), validClaims(nil))}, http.StatusUnauthorized, ""},
+		{"unsigned token", "/me", map[string]string{"Authorization": "Bearer " + sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, validClaims(nil))}, http.StatusUnauthorized, ""},
+		{"HS256 token signed with the RSA public key", "/me", map[string]string{"Authorization": "Bearer " + sign(t, jwt.SigningMethodHS256, pubPEM, validClaims(nil))}, http.StatusUnauthorized, ""},
+		{"RS256 token signed with another key", "/me", map[string]string{"Authorization": "Bearer " + sign(t, jwt.SigningMethodRS256, otherKey, validClaims(nil))}, http.StatusUnauthorized, ""},
+		{"HS256 token signed with another secret", "/me", map[string]string{"Authorization": "Bearer " + sign(t, jwt.SigningMethodHS256, []byte("other-secret"), validClaims(nil))}, http.StatusUnauthorized, ""},
+
+		// Registered claims.
+		{"missing exp", "/me", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { delete(c, "exp") })}, http.StatusUnauthorized, ""},
+		{"expired token", "/me", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })}, http.StatusUnauthorized, ""},
+		{"wrong audience", "/me", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { c["aud"] = "other-service" })}, http.StatusUnauthorized, ""},
+		{"missing audience", "/me", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { delete(c, "aud") })}, http.StatusUnauthorized, ""},
+		{"wrong issuer", "/me", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })}, http.StatusUnauthorized, ""},
+		{"missing sub", "/me", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { delete(c, "sub") })}, http.StatusUnauthorized, ""},
+
+		// Admin routes.
+		{"user token on admin route", "/admin", map[string]string{"Authorization": "Bearer " + hs256(nil)}, http.StatusForbidden, ""},
+		{"other role on admin route", "/admin", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { c["role"] = "Admin" })}, http.StatusForbidden, ""},
+		{"admin token on admin route", "/admin", map[string]string{"Authorization": "Bearer " + hs256(admin)}, http.StatusOK, "user-1"},
+		{"API key header", "/admin", map[string]string{"X-API-Key": testAPIKey}, http.StatusOK, "api-key-2"},
+		{"API key as bearer token", "/admin", map[string]string{"Authorization": "Bearer " + testAPIKey}, http.StatusOK, "api-key-2"},
+		{"wrong API key header", "/admin", map[string]string{"X-API-Key": "wrong-key"}, http.StatusUnauthorized, ""},
+		{"API key prefix", "/admin", map[string]string{"X-API-Key": testAPIKey[:len(testAPIKey)-1]}, http.StatusUnauthorized, ""},
+		{"API key with suffix", "/admin", map[string]string{"X-API-Key": testAPIKey + "x"}, http.StatusUnauthorized, ""},
+		{"wrong API key as bearer token", "/admin", map[string]string{"Authorization": "Bearer wrong-key"}, http.StatusUnauthorized, ""},
+		{"wrong API key header with valid token", "/me", map[string]string{"X-API-Key": "wrong-key", "Authorization": "Bearer " + hs256(nil)}, http.StatusUnauthorized, ""},
+
+		// Optional authentication.
+		{"anonymous on optional route", "/public", nil, http.StatusOK, "anonymous"},
+		{"token on optional route", "/public", map[string]string{"Authorization": "Bearer " + hs256(nil)}, http.StatusOK, "user-1"},
+		{"invalid token on optional route", "/public", map[string]string{"Authorization": "Bearer " + hs256(func(c jwt.MapClaims) { delete(c, "exp") })}, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status code %d, got %d %q", tt.status, w.Code, w.Body.String())
+			}
+			if tt.subject != "" && w.Body.String() != tt.subject {
+				t.Errorf("Expected subject %q, got %q", tt.subject, w.Body.String())
+			}
+		})
+	}
+}
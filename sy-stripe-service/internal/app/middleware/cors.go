@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig describes which cross-origin requests are allowed.
+type CORSConfig struct {
+	// AllowedOrigins are exact origins ("https://app.example.com"), wildcard subdomains
+	// ("https://*.example.com") or "*" for any origin.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS answers preflight requests and adds CORS headers to cross-origin requests from allowed origins.
+// Preflights for a disallowed origin, method or header are rejected with 403 and an error naming the reason.
+func CORS(cfg CORSConfig) gin.HandlerFunc {
+	methods := make(map[string]bool)
+	for _, m := range cfg.AllowedMethods {
+		methods[strings.ToUpper(m)] = true
+	}
+	headers := make(map[string]bool)
+	for _, h := range cfg.AllowedHeaders {
+		headers[http.CanonicalHeaderKey(h)] = true
+	}
+	allowMethods := strings.Join(cfg.AllowedMethods, ", ")
+	allowHeaders := strings.Join(cfg.AllowedHeaders, ", ")
+	exposeHeaders := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			// Not a cross-origin request.
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if preflight {
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowOrigin, ok := matchOrigin(cfg, origin)
+		if !ok {
+			if preflight {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CORS: origin " + origin + " is not allowed"})
+				return
+			}
+			// Browsers block the response without CORS headers; same-origin tools still work.
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", allowOrigin)
+		if cfg.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if exposeHeaders != "" {
+				c.Header("Access-Control-Expose-Headers", exposeHeaders)
+			}
+			c.Next()
+			return
+		}
+
+		method := strings.ToUpper(c.GetHeader("Access-Control-Request-Method"))
+		if !methods[method] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CORS: method " + method + " is not allowed"})
+			return
+		}
+		var rejected []string
+		for _, h := range strings.Split(c.GetHeader("Access-Control-Request-Headers"), ",") {
+			h = strings.TrimSpace(h)
+			if h != "" && !headers[http.CanonicalHeaderKey(h)] {
+				rejected = append(rejected, h)
+			}
+		}
+		if len(rejected) > 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CORS: header(s) " + strings.Join(rejected, ", ") + " not allowed"})
+			return
+		}
+
+		c.Header("Access-Control-Allow-Methods", allowMethods)
+		if allowHeaders != "" {
+			c.Header("Access-Control-Allow-Headers", allowHeaders)
+		}
+		if cfg.MaxAge > 0 {
+			c.Header("Access-Control-Max-Age", maxAge)
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// matchOrigin returns the Access-Control-Allow-Origin value for an allowed origin.
+func matchOrigin(cfg CORSConfig, origin string) (string, bool) {
+	for _, pattern := range cfg.AllowedOrigins {
+		switch {
+		case pattern == "*":
+			if cfg.AllowCredentials {
+				// Credentialed responses must name the origin.
+				return origin, true
+			}
+			return "*", true
+		case strings.EqualFold(pattern, origin):
+			return origin, true
+		case strings.Contains(pattern, "://*."):
+			// https://*.example.com matches https://app.example.com but not https://example.com.
+			scheme, suffix, _ := strings.Cut(pattern, "://*")
+			rest, ok := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://")
+			if ok && strings.HasSuffix(rest, strings.ToLower(suffix)) && len(rest) > len(suffix) {
+				return origin, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newCORSRouter(cfg CORSConfig) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(CORS(cfg))
+	r.GET("/ping", func(c *gin.Context) { c.String(http.StatusOK, "pong") })
+	return r
+}
+
+func TestCORS(t *testing.T) {
+	cfg := CORSConfig{
+		AllowedOrigins:   []string{"http://localhost:3000", "https://*.example.com"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		ExposedHeaders:   []string{"ETag"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	anyOrigin := CORSConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}
+	anyOriginWithCredentials := anyOrigin
+	anyOriginWithCredentials.AllowCredentials = true
+
+	tests := []struct {
+		name    string
+		cfg     CORSConfig
+		method  string
+		headers map[string]string
+		status  int
+		// allowOrigin is the expected Access-Control-Allow-Origin header; empty means none.
+		allowOrigin string
+		credentials bool
+	}{
+		{"same-origin request", cfg, http.MethodGet, nil, http.StatusOK, "", false},
+		{"exact origin", cfg, http.MethodGet, map[string]string{"Origin": "http://localhost:3000"}, http.StatusOK, "http://localhost:3000", true},
+		{"unknown origin", cfg, http.MethodGet, map[string]string{"Origin": "https://evil.com"}, http.StatusOK, "", false},
+
+		// Wildcard subdomains.
+		{"wildcard subdomain", cfg, http.MethodGet, map[string]string{"Origin": "https://app.example.com"}, http.StatusOK, "https://app.example.com", true},
+		{"nested wildcard subdomain", cfg, http.MethodGet, map[string]string{"Origin": "https://eu.app.example.com"}, http.StatusOK, "https://eu.app.example.com", true},
+		{"wildcard subdomain in other case", cfg, http.MethodGet, map[string]string{"Origin": "https://APP.Example.com"}, http.StatusOK, "https://APP.Example.com", true},
+		{"domain sharing the suffix", cfg, http.MethodGet, map[string]string{"Origin": "https://evil-example.com"}, http.StatusOK, "", false},
+		{"bare domain of the wildcard", cfg, http.MethodGet, map[string]string{"Origin": "https://example.com"}, http.StatusOK, "", false},
+		{"wildcard with other scheme", cfg, http.MethodGet, map[string]string{"Origin": "http://app.example.com"}, http.StatusOK, "", false},
+		{"wildcard with port", cfg, http.MethodGet, map[string]string{"Origin": "https://app.example.com:8443"}, http.StatusOK, "", false},
+		{"wildcard as prefix of another domain", cfg, http.MethodGet, map[string]string{"Origin": "https://app.example.com.evil.com"}, http.StatusOK, "", false},
+
+		// Any origin.
+		{"any origin", anyOrigin, http.MethodGet, map[string]string{"Origin": "https://elsewhere.org"}, http.StatusOK, "*", false},
+		{"any origin with credentials", anyOriginWithCredentials, http.MethodGet, map[string]string{"Origin": "https://elsewhere.org"}, http.StatusOK, "https://elsewhere.org", true},
+
+		// Preflights.
+		{"preflight", cfg, http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type, authorization"}, http.StatusNoContent, "https://app.example.com", true},
+		{"preflight from unknown origin", cfg, http.MethodOptions, map[string]string{"Origin": "https://evil-example.com", "Access-Control-Request-Method": "POST"}, http.StatusForbidden, "", false},
+		{"preflight with rejected method", cfg, http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"}, http.StatusForbidden, "https://app.example.com", true},
+		{"preflight with rejected header", cfg, http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "Content-Type, X-Debug"}, http.StatusForbidden, "https://app.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/ping", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			newCORSRouter(tt.cfg).ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status code %d, got %d %q", tt.status, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tt.allowOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+				t.Errorf("Expected credentials allowed to be %v, got %v", tt.credentials, got)
+			}
+			if tt.headers["Origin"] != "" && !slices.Contains(w.Header().Values("Vary"), "Origin") {
+				t.Errorf("Expected Vary: Origin, got %v", w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSPreflightHeaders(t *testing.T) {
+	router := newCORSRouter(CORSConfig{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type"},
+		ExposedHeaders: []string{"ETag"},
+		MaxAge:         10 * time.Minute,
+	})
+
+	req := httptest.NewRequest(http.MethodOptions, "/ping", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("Expected %s %q, got %q", header, want, got)
+		}
+	}
+
+	// The rejected header is named in the error.
+	req.Header.Set("Access-Control-Request-Headers", "X-Debug")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || w.Body.String() != `{"error":"CORS: header(s) X-Debug not allowed"}` {
+		t.Errorf("Expected the rejected header to be named, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Simple requests expose headers instead of answering a preflight.
+	req = httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Expose-Headers") != "ETag" || w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("Expected exposed headers on a simple request, got %d %v", w.Code, w.Header())
+	}
+}
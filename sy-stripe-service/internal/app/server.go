@@ -1,42 +1,87 @@
 package app
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/gin-gonic/gin"
 	"sy-stripe-service/internal/config"
 	"sy-stripe-service/internal/database"
-
+	"sy-stripe-service/migrations"
 )
 
-// Server holds the Gin router and database connection
-type Server struct {
-	Router *gin.Engine
-	DB     *database.DB
-	Config *config.Config
+// MigrationsFS returns the migrations embedded in the binary, or those in dir when it is set.
+// An external directory is meant for hotfixes that cannot wait for a new build.
+func MigrationsFS(dir string) fs.FS {
+	if dir == "" {
+		return migrations.FS
+	}
+	log.Printf("Using migrations from %s instead of the embedded ones", dir)
+	return os.DirFS(dir)
+}
+
+// Migrate applies the pending SQL migrations to the database, on the connections the repositories use.
+func Migrate(db *database.DB, migrationsFS fs.FS) error {
+	m, err := db.Migrator(migrationsFS)
+	if err != nil {
+		return err
+	}
+	_, err = m.Up(context.Background())
+	return err
 }
 
-// NewServer creates a new Server instance
-func NewServer(db *database.DB, cfg *config.Config) *Server {
-	r := gin.Default()
+// Run serves handler on cfg.ServerPort and runs the workers until SIGINT or SIGTERM, then shuts
+// down gracefully.
+func Run(cfg *config.Config, handler http.Handler, workers ...Worker) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.ServerPort),
+		Handler: handler,
+	}
 
-	// Register handlers
-	// handlers.RegisterHealthRoutes(r)
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w Worker) {
+			defer wg.Done()
+			w.Run(workerCtx)
+		}(w)
+	}
+	// Let running jobs finish before returning, also when the server fails to start.
+	defer wg.Wait()
+	defer stopWorkers()
 
-	// Register checkout session handler and dependencies
-	SetupCheckoutRoutes(r, db, cfg.AppSuccessURL, cfg.AppCancelURL)
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Server is running on port %s\n", cfg.ServerPort)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
 
-	return &Server{
-		Router: r,
-		DB:     db,
-		Config: cfg,
+	// Graceful shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("listen: %w", err)
+	case <-quit:
 	}
-}
+	log.Println("Shutting down server...")
 
-// Start runs the HTTP server
-func (s *Server) Start() error {
-	addr := fmt.Sprintf(":%s", s.Config.ServerPort)
-	fmt.Printf("Server is running on port %s\n", s.Config.ServerPort)
-	return http.ListenAndServe(addr, s.Router)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+	log.Println("Server exiting")
+	return nil
 }
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+// BillingGateway is the single entry point for Stripe API calls made by the services.
+// StripeGateway talks to Stripe; InMemoryBillingGateway is a deterministic fake for dev/testing.
+type BillingGateway interface {
+	CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(ctx context.Context, id string) (*stripe.Customer, error)
+	UpdateCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	DeleteCustomer(ctx context.Context, id string) (*stripe.Customer, error)
+
+	ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error)
+	ListPrices(ctx context.Context, params *stripe.PriceListParams) ([]*stripe.Price, error)
+	GetPrice(ctx context.Context, id string) (*stripe.Price, error)
+
+	CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(ctx context.Context, id string) (*stripe.Subscription, error)
+	UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(ctx context.Context, id string) (*stripe.Subscription, error)
+	// ListSubscriptions returns the matching subscriptions of every page. Without params.Status,
+	// Stripe leaves out canceled subscriptions.
+	ListSubscriptions(ctx context.Context, params *stripe.SubscriptionListParams) ([]*stripe.Subscription, error)
+	// CreateUsageRecord reports usage of a metered subscription item. Stripe replays the original
+	// response for a repeated params.IdempotencyKey instead of counting the usage again.
+	CreateUsageRecord(ctx context.Context, params *stripe.UsageRecordParams) (*stripe.UsageRecord, error)
+
+	CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	// GetCheckoutSession returns the session with its subscription expanded.
+	GetCheckoutSession(ctx context.Context, id string) (*stripe.CheckoutSession, error)
+	// ListPromotionCodes returns promotion codes with their coupons, e.g. all codes matching params.Code.
+	ListPromotionCodes(ctx context.Context, params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error)
+
+	GetUpcomingInvoice(ctx context.Context, params *stripe.InvoiceParams) (*stripe.Invoice, error)
+	// ListInvoices returns every matching invoice, fetching all pages unless params.Single is set.
+	ListInvoices(ctx context.Context, params *stripe.InvoiceListParams) ([]*stripe.Invoice, error)
+
+	CreateBillingPortalSession(ctx context.Context, params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error)
+
+	CreateSetupIntent(ctx context.Context, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error)
+	ListPaymentMethods(ctx context.Context, params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error)
+	GetPaymentMethod(ctx context.Context, id string) (*stripe.PaymentMethod, error)
+	DetachPaymentMethod(ctx context.Context, id string) (*stripe.PaymentMethod, error)
+}
+
+// StripeGateway implements BillingGateway with a stripe-go client bound to the configured key.
+type StripeGateway struct {
+	api *client.API
+}
+
+// NewStripeGateway creates a gateway using the default Stripe backends.
+// Backends overridden with stripe.SetBackend before this call are picked up.
+func NewStripeGateway(secretKey string) *StripeGateway {
+	return &StripeGateway{api: client.New(secretKey, nil)}
+}
+
+func (g *StripeGateway) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	params.Context = ctx
+	return g.api.Customers.New(params)
+}
+
+func (g *StripeGateway) GetCustomer(ctx context.Context, id string) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	return g.api.Customers.Get(id, params)
+}
+
+func (g *StripeGateway) UpdateCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	params.Context = ctx
+	return g.api.Customers.Update(id, params)
+}
+
+func (g *StripeGateway) DeleteCustomer(ctx context.Context, id string) (*stripe.Customer, error) {
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	return g.api.Customers.Del(id, params)
+}
+
+func (g *StripeGateway) ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error) {
+	params.Context = ctx
+	iter := g.api.Products.List(params)
+	var products []*stripe.Product
+	for iter.Next() {
+		products = append(products, iter.Product())
+	}
+	return products, iter.Err()
+}
+
+func (g *StripeGateway) ListPrices(ctx context.Context, params *stripe.PriceListParams) ([]*stripe.Price, error) {
+	params.Context = ctx
+	iter := g.api.Prices.List(params)
+	var prices []*stripe.Price
+	for iter.Next() {
+		prices = append(prices, iter.Price())
+	}
+	return prices, iter.Err()
+}
+
+func (g *StripeGateway) GetPrice(ctx context.Context, id string) (*stripe.Price, error) {
+	params := &stripe.PriceParams{}
+	params.Context = ctx
+	return g.api.Prices.Get(id, params)
+}
+
+func (g *StripeGateway) CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	params.Context = ctx
+	return g.api.Subscriptions.New(params)
+}
+
+func (g *StripeGateway) GetSubscription(ctx context.Context, id string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.Context = ctx
+	return g.api.Subscriptions.Get(id, params)
+}
+
+func (g *StripeGateway) UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	params.Context = ctx
+	return g.api.Subscriptions.Update(id, params)
+}
+
+func (g *StripeGateway) CancelSubscription(ctx context.Context, id string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionCancelParams{}
+	params.Context = ctx
+	return g.api.Subscriptions.Cancel(id, params)
+}
+
+func (g *StripeGateway) ListSubscriptions(ctx context.Context, params *stripe.SubscriptionListParams) ([]*stripe.Subscription, error) {
+	params.Context = ctx
+	iter := g.api.Subscriptions.List(params)
+	var subs []*stripe.Subscription
+	for iter.Next() {
+		subs = append(subs, iter.Subscription())
+	}
+	return subs, iter.Err()
+}
+
+func (g *StripeGateway) CreateUsageRecord(ctx context.Context, params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	params.Context = ctx
+	return g.api.UsageRecords.New(params)
+}
+
+func (g *StripeGateway) CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	params.Context = ctx
+	return g.api.CheckoutSessions.New(params)
+}
+
+func (g *StripeGateway) GetCheckoutSession(ctx context.Context, id string) (*stripe.CheckoutSession, error) {
+	params := &stripe.CheckoutSessionParams{}
+	params.Context = ctx
+	params.AddExpand("subscription")
+	return g.api.CheckoutSessions.Get(id, params)
+}
+
+func (g *StripeGateway) ListPromotionCodes(ctx context.Context, params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	params.Context = ctx
+	iter := g.api.PromotionCodes.List(params)
+	var codes []*stripe.PromotionCode
+	for iter.Next() {
+		codes = append(codes, iter.PromotionCode())
+	}
+	return codes, iter.Err()
+}
+
+func (g *StripeGateway) GetUpcomingInvoice(ctx context.Context, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	params.Context = ctx
+	return g.api.Invoices.GetNext(params)
+}
+
+func (g *StripeGateway) ListInvoices(ctx context.Context, params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	params.Context = ctx
+	iter := g.api.Invoices.List(params)
+	var invoices []*stripe.Invoice
+	for iter.Next() {
+		invoices = append(invoices, iter.Invoice())
+	}
+	return invoices, iter.Err()
+}
+
+func (g *StripeGateway) CreateBillingPortalSession(ctx context.Context, params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	params.Context = ctx
+	return g.api.BillingPortalSessions.New(params)
+}
+
+func (g *StripeGateway) CreateSetupIntent(ctx context.Context, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	params.Context = ctx
+	return g.api.SetupIntents.New(params)
+}
+
+func (g *StripeGateway) ListPaymentMethods(ctx context.Context, params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	params.Context = ctx
+	iter := g.api.PaymentMethods.List(params)
+	var methods []*stripe.PaymentMethod
+	for iter.Next() {
+		methods = append(methods, iter.PaymentMethod())
+	}
+	return methods, iter.Err()
+}
+
+func (g *StripeGateway) GetPaymentMethod(ctx context.Context, id string) (*stripe.PaymentMethod, error) {
+	params := &stripe.PaymentMethodParams{}
+	params.Context = ctx
+	return g.api.PaymentMethods.Get(id, params)
+}
+
+func (g *StripeGateway) DetachPaymentMethod(ctx context.Context, id string) (*stripe.PaymentMethod, error) {
+	params := &stripe.PaymentMethodDetachParams{}
+	params.Context = ctx
+	return g.api.PaymentMethods.Detach(id, params)
+}
@@ -0,0 +1,805 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// InMemoryBillingGateway implements BillingGateway for dev/testing.
+// IDs are sequential per object type (cus_0001, sub_0001, ...) so results are deterministic.
+type InMemoryBillingGateway struct {
+	// Now returns the current time; tests can pin it for stable periods and timestamps.
+	Now func() time.Time
+
+	mu               sync.Mutex
+	seq              map[string]int
+	customers        map[string]*stripe.Customer
+	products         map[string]*stripe.Product
+	prices           map[string]*stripe.Price
+	subscriptions    map[string]*stripe.Subscription
+	checkoutSessions map[string]*stripe.CheckoutSession
+	invoices         map[string]*stripe.Invoice
+	setupIntents     map[string]*stripe.SetupIntent
+	paymentMethods   map[string]*stripe.PaymentMethod
+	promotionCodes   map[string]*stripe.PromotionCode
+	// sessionDiscounts and sessionTrialDays hold the discount and the trial a checkout session
+	// applies to its subscription.
+	sessionDiscounts map[string]*stripe.Discount
+	sessionTrialDays map[string]int64
+	// usageRecords holds the reported usage in order; usageByKey replays idempotent requests.
+	usageRecords []*stripe.UsageRecord
+	usageByKey   map[string]*stripe.UsageRecord
+}
+
+func NewInMemoryBillingGateway() *InMemoryBillingGateway {
+	return &InMemoryBillingGateway{
+		Now:              time.Now,
+		seq:              make(map[string]int),
+		customers:        make(map[string]*stripe.Customer),
+		products:         make(map[string]*stripe.Product),
+		prices:           make(map[string]*stripe.Price),
+		subscriptions:    make(map[string]*stripe.Subscription),
+		checkoutSessions: make(map[string]*stripe.CheckoutSession),
+		invoices:         make(map[string]*stripe.Invoice),
+		setupIntents:     make(map[string]*stripe.SetupIntent),
+		paymentMethods:   make(map[string]*stripe.PaymentMethod),
+		promotionCodes:   make(map[string]*stripe.PromotionCode),
+		sessionDiscounts: make(map[string]*stripe.Discount),
+		sessionTrialDays: make(map[string]int64),
+		usageByKey:       make(map[string]*stripe.UsageRecord),
+	}
+}
+
+// nextID returns the next deterministic ID for a prefix. Callers must hold g.mu.
+func (g *InMemoryBillingGateway) nextID(prefix string) string {
+	g.seq[prefix]++
+	return fmt.Sprintf("%s_%04d", prefix, g.seq[prefix])
+}
+
+// notFound mimics the error Stripe returns for unknown resources.
+func notFound(kind, id string) error {
+	return &stripe.Error{
+		HTTPStatusCode: 404,
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		Msg:            fmt.Sprintf("No such %s: '%s'", kind, id),
+	}
+}
+
+// AddProduct seeds the catalog with a product.
+func (g *InMemoryBillingGateway) AddProduct(p *stripe.Product) *stripe.Product {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p.ID == "" {
+		p.ID = g.nextID("prod")
+	}
+	if p.Created == 0 {
+		p.Created = g.Now().Unix()
+	}
+	g.products[p.ID] = p
+	return p
+}
+
+// AddPrice seeds the catalog with a price; Product must reference a seeded product.
+func (g *InMemoryBillingGateway) AddPrice(p *stripe.Price) *stripe.Price {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p.ID == "" {
+		p.ID = g.nextID("price")
+	}
+	if p.Created == 0 {
+		p.Created = g.Now().Unix()
+	}
+	if p.Type == "" {
+		p.Type = stripe.PriceTypeOneTime
+		if p.Recurring != nil {
+			p.Type = stripe.PriceTypeRecurring
+		}
+	}
+	g.prices[p.ID] = p
+	return p
+}
+
+// AddInvoice records an invoice as if Stripe had issued it; Customer must reference a known customer.
+func (g *InMemoryBillingGateway) AddInvoice(inv *stripe.Invoice) *stripe.Invoice {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if inv.ID == "" {
+		inv.ID = g.nextID("in")
+	}
+	if inv.Created == 0 {
+		inv.Created = g.Now().Unix()
+	}
+	g.invoices[inv.ID] = inv
+	return inv
+}
+
+// AddPromotionCode registers a promotion code for its Coupon, which must have an ID.
+func (g *InMemoryBillingGateway) AddPromotionCode(pc *stripe.PromotionCode) *stripe.PromotionCode {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if pc.ID == "" {
+		pc.ID = g.nextID("promo")
+	}
+	if pc.Created == 0 {
+		pc.Created = g.Now().Unix()
+	}
+	g.promotionCodes[pc.ID] = pc
+	return pc
+}
+
+// CompleteCheckoutSession simulates a customer finishing checkout: it creates the customer
+// (unless the session already has one) and the subscription, and marks the session complete.
+func (g *InMemoryBillingGateway) CompleteCheckoutSession(id, email, name string) (*stripe.CheckoutSession, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sess, ok := g.checkoutSessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	if sess.Customer == nil {
+		sess.Customer = g.newCustomer(email, name)
+	}
+	sess.CustomerDetails = &stripe.CheckoutSessionCustomerDetails{Email: email, Name: name}
+	if sess.Mode == stripe.CheckoutSessionModeSubscription && sess.LineItems != nil {
+		var items []*stripe.SubscriptionItemsParams
+		for _, li := range sess.LineItems.Data {
+			items = append(items, &stripe.SubscriptionItemsParams{Price: stripe.String(li.Price.ID)})
+		}
+		s, err := g.newSubscription(sess.Customer.ID, items, sess.Metadata, g.sessionTrialDays[sess.ID])
+		if err != nil {
+			return nil, err
+		}
+		if d := g.sessionDiscounts[sess.ID]; d != nil {
+			d.ID, d.Customer, d.Subscription, d.Start = g.nextID("di"), sess.Customer.ID, s.ID, s.Created
+			if d.Coupon.Duration == stripe.CouponDurationRepeating {
+				d.End = time.Unix(d.Start, 0).AddDate(0, int(d.Coupon.DurationInMonths), 0).Unix()
+			}
+			if d.PromotionCode != nil {
+				d.PromotionCode.TimesRedeemed++
+			}
+			d.Coupon.TimesRedeemed++
+			s.Discount = d
+		}
+		sess.Subscription = s
+	}
+	sess.Status = stripe.CheckoutSessionStatusComplete
+	sess.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	return sess, nil
+}
+
+func (g *InMemoryBillingGateway) newCustomer(email, name string) *stripe.Customer {
+	c := &stripe.Customer{
+		ID:       g.nextID("cus"),
+		Email:    email,
+		Name:     name,
+		Created:  g.Now().Unix(),
+		Metadata: map[string]string{},
+	}
+	g.customers[c.ID] = c
+	return c
+}
+
+func (g *InMemoryBillingGateway) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c := g.newCustomer(stripe.StringValue(params.Email), stripe.StringValue(params.Name))
+	for k, v := range params.Metadata {
+		c.Metadata[k] = v
+	}
+	return c, nil
+}
+
+func (g *InMemoryBillingGateway) GetCustomer(ctx context.Context, id string) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.customers[id]
+	if !ok {
+		return nil, notFound("customer", id)
+	}
+	return c, nil
+}
+
+func (g *InMemoryBillingGateway) UpdateCustomer(ctx context.Context, id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.customers[id]
+	if !ok || c.Deleted {
+		return nil, notFound("customer", id)
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	if params.Name != nil {
+		c.Name = *params.Name
+	}
+	if params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		pm, err := g.customerPaymentMethod(id, *params.InvoiceSettings.DefaultPaymentMethod)
+		if err != nil {
+			return nil, err
+		}
+		c.InvoiceSettings = &stripe.CustomerInvoiceSettings{DefaultPaymentMethod: pm}
+	}
+	for k, v := range params.Metadata {
+		c.Metadata[k] = v
+	}
+	return c, nil
+}
+
+func (g *InMemoryBillingGateway) DeleteCustomer(ctx context.Context, id string) (*stripe.Customer, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.customers[id]
+	if !ok || c.Deleted {
+		return nil, notFound("customer", id)
+	}
+	c.Deleted = true
+	return c, nil
+}
+
+func (g *InMemoryBillingGateway) ListProducts(ctx context.Context, params *stripe.ProductListParams) ([]*stripe.Product, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var products []*stripe.Product
+	for _, p := range g.products {
+		if params.Active != nil && p.Active != *params.Active {
+			continue
+		}
+		products = append(products, p)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	return products, nil
+}
+
+func (g *InMemoryBillingGateway) ListPrices(ctx context.Context, params *stripe.PriceListParams) ([]*stripe.Price, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var prices []*stripe.Price
+	for _, p := range g.prices {
+		if params.Active != nil && p.Active != *params.Active {
+			continue
+		}
+		if params.Product != nil && (p.Product == nil || p.Product.ID != *params.Product) {
+			continue
+		}
+		if params.Currency != nil && string(p.Currency) != *params.Currency {
+			continue
+		}
+		if params.Type != nil && string(p.Type) != *params.Type {
+			continue
+		}
+		prices = append(prices, p)
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].ID < prices[j].ID })
+	return prices, nil
+}
+
+func (g *InMemoryBillingGateway) GetPrice(ctx context.Context, id string) (*stripe.Price, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	p, ok := g.prices[id]
+	if !ok {
+		return nil, notFound("price", id)
+	}
+	return p, nil
+}
+
+// periodEnd adds one billing interval of the price to start.
+func periodEnd(start time.Time, p *stripe.Price) time.Time {
+	if p == nil || p.Recurring == nil {
+		return start
+	}
+	count := int(p.Recurring.IntervalCount)
+	if count == 0 {
+		count = 1
+	}
+	switch p.Recurring.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		return start.AddDate(0, 0, count)
+	case stripe.PriceRecurringIntervalWeek:
+		return start.AddDate(0, 0, 7*count)
+	case stripe.PriceRecurringIntervalYear:
+		return start.AddDate(count, 0, 0)
+	default:
+		return start.AddDate(0, count, 0)
+	}
+}
+
+// newSubscription creates an active subscription, or a trialing one if trialDays is positive.
+// Callers must hold g.mu.
+func (g *InMemoryBillingGateway) newSubscription(customerID string, items []*stripe.SubscriptionItemsParams, metadata map[string]string, trialDays int64) (*stripe.Subscription, error) {
+	c, ok := g.customers[customerID]
+	if !ok || c.Deleted {
+		return nil, notFound("customer", customerID)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("missing required param: items")
+	}
+	now := g.Now()
+	s := &stripe.Subscription{
+		ID:                 g.nextID("sub"),
+		Customer:           c,
+		Status:             stripe.SubscriptionStatusActive,
+		Created:            now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		Items:              &stripe.SubscriptionItemList{},
+		Metadata:           map[string]string{},
+	}
+	for k, v := range metadata {
+		s.Metadata[k] = v
+	}
+	for _, item := range items {
+		p, ok := g.prices[stripe.StringValue(item.Price)]
+		if !ok {
+			return nil, notFound("price", stripe.StringValue(item.Price))
+		}
+		quantity := int64(1)
+		if item.Quantity != nil {
+			quantity = *item.Quantity
+		}
+		s.Items.Data = append(s.Items.Data, &stripe.SubscriptionItem{
+			ID:           g.nextID("si"),
+			Price:        p,
+			Quantity:     quantity,
+			Subscription: s.ID,
+			Created:      now.Unix(),
+		})
+	}
+	s.CurrentPeriodEnd = periodEnd(now, s.Items.Data[0].Price).Unix()
+	if trialDays > 0 {
+		// The trial is the first billing period.
+		s.Status = stripe.SubscriptionStatusTrialing
+		s.TrialStart, s.TrialEnd = now.Unix(), now.AddDate(0, 0, int(trialDays)).Unix()
+		s.CurrentPeriodEnd = s.TrialEnd
+	}
+	g.subscriptions[s.ID] = s
+	return s, nil
+}
+
+func (g *InMemoryBillingGateway) CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.newSubscription(stripe.StringValue(params.Customer), params.Items, params.Metadata, stripe.Int64Value(params.TrialPeriodDays))
+}
+
+func (g *InMemoryBillingGateway) GetSubscription(ctx context.Context, id string) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	return s, nil
+}
+
+func (g *InMemoryBillingGateway) UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	if s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, fmt.Errorf("subscription %s is canceled", id)
+	}
+	for _, item := range params.Items {
+		if item.ID == nil || item.Price == nil {
+			continue
+		}
+		p, ok := g.prices[*item.Price]
+		if !ok {
+			return nil, notFound("price", *item.Price)
+		}
+		for _, si := range s.Items.Data {
+			if si.ID == *item.ID {
+				si.Price = p
+			}
+		}
+	}
+	if params.CancelAtPeriodEnd != nil {
+		s.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+	}
+	if params.DefaultPaymentMethod != nil {
+		pm, err := g.customerPaymentMethod(s.Customer.ID, *params.DefaultPaymentMethod)
+		if err != nil {
+			return nil, err
+		}
+		s.DefaultPaymentMethod = pm
+	}
+	for k, v := range params.Metadata {
+		s.Metadata[k] = v
+	}
+	return s, nil
+}
+
+func (g *InMemoryBillingGateway) CancelSubscription(ctx context.Context, id string) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	now := g.Now().Unix()
+	s.Status = stripe.SubscriptionStatusCanceled
+	s.CanceledAt = now
+	s.EndedAt = now
+	return s, nil
+}
+
+func (g *InMemoryBillingGateway) ListSubscriptions(ctx context.Context, params *stripe.SubscriptionListParams) ([]*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var subs []*stripe.Subscription
+	for _, s := range g.subscriptions {
+		if params.Customer != "" && s.Customer.ID != params.Customer {
+			continue
+		}
+		// Like Stripe, canceled subscriptions are only listed with status=all or status=canceled.
+		if params.Status == "" && s.Status == stripe.SubscriptionStatusCanceled {
+			continue
+		}
+		if params.Status != "" && params.Status != "all" && string(s.Status) != params.Status {
+			continue
+		}
+		subs = append(subs, s)
+	}
+	// Newest first, as returned by Stripe.
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Created != subs[j].Created {
+			return subs[i].Created > subs[j].Created
+		}
+		return subs[i].ID > subs[j].ID
+	})
+	return subs, nil
+}
+
+func (g *InMemoryBillingGateway) CreateUsageRecord(ctx context.Context, params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := stripe.StringValue(params.IdempotencyKey)
+	if rec, ok := g.usageByKey[key]; ok && key != "" {
+		return rec, nil
+	}
+	itemID := stripe.StringValue(params.SubscriptionItem)
+	var item *stripe.SubscriptionItem
+	var sub *stripe.Subscription
+	for _, s := range g.subscriptions {
+		for _, si := range s.Items.Data {
+			if si.ID == itemID {
+				item, sub = si, s
+			}
+		}
+	}
+	if item == nil {
+		return nil, notFound("subscription_item", itemID)
+	}
+	if item.Price.Recurring == nil || item.Price.Recurring.UsageType != stripe.PriceRecurringUsageTypeMetered {
+		return nil, &stripe.Error{HTTPStatusCode: 400, Type: stripe.ErrorTypeInvalidRequest, Msg: "usage records can only be created for metered prices"}
+	}
+	timestamp := stripe.Int64Value(params.Timestamp)
+	if timestamp < sub.CurrentPeriodStart || timestamp > g.Now().Unix() {
+		return nil, &stripe.Error{HTTPStatusCode: 400, Type: stripe.ErrorTypeInvalidRequest, Msg: "cannot create the usage record with this timestamp"}
+	}
+	rec := &stripe.UsageRecord{
+		ID:               g.nextID("mbur"),
+		Object:           "usage_record",
+		Quantity:         stripe.Int64Value(params.Quantity),
+		SubscriptionItem: itemID,
+		Timestamp:        timestamp,
+	}
+	g.usageRecords = append(g.usageRecords, rec)
+	if key != "" {
+		g.usageByKey[key] = rec
+	}
+	return rec, nil
+}
+
+// UsageRecords returns the usage reported for a subscription item, oldest first.
+func (g *InMemoryBillingGateway) UsageRecords(itemID string) []*stripe.UsageRecord {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var records []*stripe.UsageRecord
+	for _, rec := range g.usageRecords {
+		if rec.SubscriptionItem == itemID {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func (g *InMemoryBillingGateway) CreateCheckoutSession(ctx context.Context, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sess := &stripe.CheckoutSession{
+		ID:         g.nextID("cs_test"),
+		Mode:       stripe.CheckoutSessionMode(stripe.StringValue(params.Mode)),
+		Status:     stripe.CheckoutSessionStatusOpen,
+		SuccessURL: stripe.StringValue(params.SuccessURL),
+		CancelURL:  stripe.StringValue(params.CancelURL),
+		Metadata:   map[string]string{},
+		LineItems:  &stripe.LineItemList{},
+	}
+	sess.URL = "https://checkout.stripe.test/c/pay/" + sess.ID
+	if params.Customer != nil {
+		c, ok := g.customers[*params.Customer]
+		if !ok {
+			return nil, notFound("customer", *params.Customer)
+		}
+		sess.Customer = c
+	}
+	for k, v := range params.Metadata {
+		sess.Metadata[k] = v
+	}
+	sess.AllowPromotionCodes = stripe.BoolValue(params.AllowPromotionCodes)
+	if params.SubscriptionData != nil {
+		g.sessionTrialDays[sess.ID] = stripe.Int64Value(params.SubscriptionData.TrialPeriodDays)
+	}
+	if len(params.Discounts) > 0 {
+		if sess.AllowPromotionCodes {
+			return nil, &stripe.Error{HTTPStatusCode: 400, Type: stripe.ErrorTypeInvalidRequest, Msg: "you may only specify one of these parameters: allow_promotion_codes, discounts"}
+		}
+		id := stripe.StringValue(params.Discounts[0].PromotionCode)
+		pc, ok := g.promotionCodes[id]
+		if !ok {
+			return nil, notFound("promotion_code", id)
+		}
+		if !pc.Active {
+			return nil, &stripe.Error{HTTPStatusCode: 400, Type: stripe.ErrorTypeInvalidRequest, Msg: "this promotion code is inactive"}
+		}
+		g.sessionDiscounts[sess.ID] = &stripe.Discount{Object: "discount", Coupon: pc.Coupon, PromotionCode: pc}
+	}
+	for _, li := range params.LineItems {
+		p, ok := g.prices[stripe.StringValue(li.Price)]
+		if !ok {
+			return nil, notFound("price", stripe.StringValue(li.Price))
+		}
+		sess.LineItems.Data = append(sess.LineItems.Data, &stripe.LineItem{
+			ID:       g.nextID("li"),
+			Price:    p,
+			Quantity: stripe.Int64Value(li.Quantity),
+		})
+	}
+	g.checkoutSessions[sess.ID] = sess
+	return sess, nil
+}
+
+func (g *InMemoryBillingGateway) GetCheckoutSession(ctx context.Context, id string) (*stripe.CheckoutSession, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sess, ok := g.checkoutSessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	return sess, nil
+}
+
+// ListPromotionCodes returns the promotion codes matching params.Code (case-insensitively),
+// params.Active and params.Customer, oldest first.
+func (g *InMemoryBillingGateway) ListPromotionCodes(ctx context.Context, params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var codes []*stripe.PromotionCode
+	for _, pc := range g.promotionCodes {
+		if params.Code != nil && !strings.EqualFold(pc.Code, *params.Code) {
+			continue
+		}
+		if params.Active != nil && pc.Active != *params.Active {
+			continue
+		}
+		if params.Customer != nil && (pc.Customer == nil || pc.Customer.ID != *params.Customer) {
+			continue
+		}
+		codes = append(codes, pc)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID < codes[j].ID })
+	return codes, nil
+}
+
+// GetUpcomingInvoice previews the next invoice of a subscription, applying any
+// price swap from params.SubscriptionItems with a flat full-period proration.
+func (g *InMemoryBillingGateway) GetUpcomingInvoice(ctx context.Context, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	subID := stripe.StringValue(params.Subscription)
+	s, ok := g.subscriptions[subID]
+	if !ok {
+		return nil, notFound("subscription", subID)
+	}
+	inv := &stripe.Invoice{
+		Customer:           s.Customer,
+		Subscription:       s,
+		Lines:              &stripe.InvoiceLineList{},
+		NextPaymentAttempt: s.CurrentPeriodEnd,
+		PeriodStart:        s.CurrentPeriodStart,
+		PeriodEnd:          s.CurrentPeriodEnd,
+		Status:             stripe.InvoiceStatusDraft,
+	}
+	for _, si := range s.Items.Data {
+		next := si.Price
+		for _, item := range params.SubscriptionItems {
+			if stripe.StringValue(item.ID) == si.ID && item.Price != nil {
+				p, ok := g.prices[*item.Price]
+				if !ok {
+					return nil, notFound("price", *item.Price)
+				}
+				next = p
+			}
+		}
+		if next.ID != si.Price.ID && stripe.StringValue(params.SubscriptionProrationBehavior) != ProrationNone {
+			inv.Lines.Data = append(inv.Lines.Data, &stripe.InvoiceLine{
+				Amount:    (next.UnitAmount - si.Price.UnitAmount) * si.Quantity,
+				Currency:  next.Currency,
+				Price:     next,
+				Proration: true,
+			})
+		}
+		inv.Lines.Data = append(inv.Lines.Data, &stripe.InvoiceLine{
+			Amount:   next.UnitAmount * si.Quantity,
+			Currency: next.Currency,
+			Price:    next,
+		})
+		inv.Currency = next.Currency
+	}
+	for _, line := range inv.Lines.Data {
+		inv.Subtotal += line.Amount
+	}
+	inv.Total = inv.Subtotal
+	inv.AmountDue = inv.Total
+	if inv.AmountDue < 0 {
+		inv.AmountDue = 0
+	}
+	return inv, nil
+}
+
+func (g *InMemoryBillingGateway) ListInvoices(ctx context.Context, params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var invoices []*stripe.Invoice
+	for _, inv := range g.invoices {
+		if params.Customer != nil && (inv.Customer == nil || inv.Customer.ID != *params.Customer) {
+			continue
+		}
+		if params.Subscription != nil && (inv.Subscription == nil || inv.Subscription.ID != *params.Subscription) {
+			continue
+		}
+		invoices = append(invoices, inv)
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].ID > invoices[j].ID })
+	return invoices, nil
+}
+
+func (g *InMemoryBillingGateway) CreateBillingPortalSession(ctx context.Context, params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	customerID := stripe.StringValue(params.Customer)
+	if c, ok := g.customers[customerID]; !ok || c.Deleted {
+		return nil, notFound("customer", customerID)
+	}
+	id := g.nextID("bps")
+	return &stripe.BillingPortalSession{
+		ID:        id,
+		Customer:  customerID,
+		ReturnURL: stripe.StringValue(params.ReturnURL),
+		URL:       "https://billing.stripe.test/p/session/" + id,
+		Created:   g.Now().Unix(),
+	}, nil
+}
+
+// ConfirmSetupIntent simulates a customer confirming a SetupIntent with a card, as Stripe.js does:
+// it attaches a new card payment method to the intent's customer and marks the intent succeeded.
+func (g *InMemoryBillingGateway) ConfirmSetupIntent(id string, card *stripe.PaymentMethodCard) (*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	si, ok := g.setupIntents[id]
+	if !ok {
+		return nil, notFound("setup_intent", id)
+	}
+	c, ok := g.customers[si.Customer.ID]
+	if !ok || c.Deleted {
+		return nil, notFound("customer", si.Customer.ID)
+	}
+	pm := &stripe.PaymentMethod{
+		ID:       g.nextID("pm"),
+		Type:     stripe.PaymentMethodTypeCard,
+		Card:     card,
+		Customer: c,
+		Created:  g.Now().Unix(),
+	}
+	g.paymentMethods[pm.ID] = pm
+	si.PaymentMethod = &stripe.PaymentMethod{ID: pm.ID}
+	si.Status = stripe.SetupIntentStatusSucceeded
+	return pm, nil
+}
+
+// customerPaymentMethod returns an unexpanded reference to a payment method attached to the
+// customer, as Stripe embeds it in customers and subscriptions. Callers must hold g.mu.
+func (g *InMemoryBillingGateway) customerPaymentMethod(customerID, id string) (*stripe.PaymentMethod, error) {
+	if id == "" {
+		return nil, nil
+	}
+	pm, ok := g.paymentMethods[id]
+	if !ok || pm.Customer == nil || pm.Customer.ID != customerID {
+		return nil, notFound("payment_method", id)
+	}
+	return &stripe.PaymentMethod{ID: pm.ID}, nil
+}
+
+func (g *InMemoryBillingGateway) CreateSetupIntent(ctx context.Context, params *stripe.SetupIntentParams) (*stripe.SetupIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	customerID := stripe.StringValue(params.Customer)
+	c, ok := g.customers[customerID]
+	if !ok || c.Deleted {
+		return nil, notFound("customer", customerID)
+	}
+	id := g.nextID("seti")
+	si := &stripe.SetupIntent{
+		ID:           id,
+		ClientSecret: id + "_secret_test",
+		Customer:     c,
+		Status:       stripe.SetupIntentStatusRequiresPaymentMethod,
+		Usage:        stripe.SetupIntentUsage(stripe.StringValue(params.Usage)),
+		Created:      g.Now().Unix(),
+	}
+	for _, t := range params.PaymentMethodTypes {
+		si.PaymentMethodTypes = append(si.PaymentMethodTypes, *t)
+	}
+	g.setupIntents[id] = si
+	return si, nil
+}
+
+func (g *InMemoryBillingGateway) ListPaymentMethods(ctx context.Context, params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var methods []*stripe.PaymentMethod
+	for _, pm := range g.paymentMethods {
+		if pm.Customer == nil || (params.Customer != nil && pm.Customer.ID != *params.Customer) {
+			continue
+		}
+		if params.Type != nil && string(pm.Type) != *params.Type {
+			continue
+		}
+		methods = append(methods, pm)
+	}
+	// Newest first, as returned by Stripe.
+	sort.Slice(methods, func(i, j int) bool { return methods[i].ID > methods[j].ID })
+	return methods, nil
+}
+
+func (g *InMemoryBillingGateway) GetPaymentMethod(ctx context.Context, id string) (*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pm, ok := g.paymentMethods[id]
+	if !ok {
+		return nil, notFound("payment_method", id)
+	}
+	return pm, nil
+}
+
+// DetachPaymentMethod detaches a payment method from its customer. Like Stripe, it also stops
+// being the default of the customer and its subscriptions.
+func (g *InMemoryBillingGateway) DetachPaymentMethod(ctx context.Context, id string) (*stripe.PaymentMethod, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pm, ok := g.paymentMethods[id]
+	if !ok || pm.Customer == nil {
+		return nil, notFound("payment_method", id)
+	}
+	c := pm.Customer
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil && c.InvoiceSettings.DefaultPaymentMethod.ID == id {
+		c.InvoiceSettings.DefaultPaymentMethod = nil
+	}
+	for _, s := range g.subscriptions {
+		if s.DefaultPaymentMethod != nil && s.DefaultPaymentMethod.ID == id {
+			s.DefaultPaymentMethod = nil
+		}
+	}
+	pm.Customer = nil
+	return pm, nil
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"sy-stripe-service/internal/models"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ErrNoStripeCustomer is returned for operations that need a Stripe customer the user does not have.
+var ErrNoStripeCustomer = errors.New("user has no stripe customer")
+
+// BillingPortalService opens Stripe billing portal sessions, where customers manage their
+// payment methods and invoices themselves.
+type BillingPortalService struct {
+	Users   *UserService
+	Gateway BillingGateway
+	// ReturnURL is where the portal sends the customer back to; empty uses the portal's default.
+	ReturnURL string
+}
+
+func NewBillingPortalService(users *UserService, gateway BillingGateway, returnURL string) *BillingPortalService {
+	return &BillingPortalService{Users: users, Gateway: gateway, ReturnURL: returnURL}
+}
+
+// CreateSession creates a billing portal session for the user's Stripe customer.
+func (s *BillingPortalService) CreateSession(ctx context.Context, userID string) (*stripe.BillingPortalSession, error) {
+	user, err := stripeCustomerUser(ctx, s.Users, userID)
+	if err != nil {
+		return nil, err
+	}
+	params := &stripe.BillingPortalSessionParams{Customer: stripe.String(user.StripeCustomerID)}
+	if s.ReturnURL != "" {
+		params.ReturnURL = stripe.String(s.ReturnURL)
+	}
+	log.Printf("[CreateSession] Creating billing portal session for %s", user.StripeCustomerID)
+	sess, err := s.Gateway.CreateBillingPortalSession(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create billing portal session for %s: %w", user.StripeCustomerID, err)
+	}
+	return sess, nil
+}
+
+// stripeCustomerUser loads a user that must be linked to a Stripe customer.
+func stripeCustomerUser(ctx context.Context, users *UserService, userID string) (*models.User, error) {
+	user, err := users.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, userID)
+	}
+	if user.StripeCustomerID == "" {
+		return nil, ErrNoStripeCustomer
+	}
+	return user, nil
+}
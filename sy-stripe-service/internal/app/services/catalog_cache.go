@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"sy-stripe-service/internal/models"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// catalogFetchTimeout bounds one refresh of the catalog from Stripe.
+const catalogFetchTimeout = 30 * time.Second
+
+// ProductCatalog is a snapshot of the products on sale. ETag identifies its content.
+type ProductCatalog struct {
+	Products  []models.ProductResponse
+	ETag      string
+	FetchedAt time.Time
+}
+
+// catalogCache keeps the last fetched catalog. It is served as is for ttl and, for another staleTTL,
+// while a background refresh replaces it; older catalogs make callers wait for a refresh. Concurrent
+// refreshes share one Stripe round trip.
+type catalogCache struct {
+	ttl      time.Duration
+	staleTTL time.Duration
+	now      func() time.Time
+	load     func(ctx context.Context) (*ProductCatalog, error)
+
+	mu      sync.Mutex
+	catalog *ProductCatalog
+	// generation changes on every invalidation, so that refreshes started before it are not stored.
+	generation uint64
+	group      singleflight.Group
+}
+
+func (c *catalogCache) get(ctx context.Context) (*ProductCatalog, error) {
+	if c.ttl <= 0 {
+		return c.load(ctx)
+	}
+	c.mu.Lock()
+	catalog, generation := c.catalog, c.generation
+	c.mu.Unlock()
+
+	if catalog != nil {
+		age := c.now().Sub(catalog.FetchedAt)
+		if age < c.ttl {
+			return catalog, nil
+		}
+		if age < c.ttl+c.staleTTL {
+			c.refresh(ctx, generation)
+			return catalog, nil
+		}
+	}
+	select {
+	case res := <-c.refresh(ctx, generation):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*ProductCatalog), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh fetches the catalog unless a fetch for the same generation is already running.
+// The fetch outlives ctx, so that callers giving up do not fail the others.
+func (c *catalogCache) refresh(ctx context.Context, generation uint64) <-chan singleflight.Result {
+	fetchCtx := context.WithoutCancel(ctx)
+	return c.group.DoChan(strconv.FormatUint(generation, 10), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(fetchCtx, catalogFetchTimeout)
+		defer cancel()
+		catalog, err := c.load(ctx)
+		if err != nil {
+			log.Printf("[refresh] ERROR fetching the product catalog: %v", err)
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.generation == generation {
+			c.catalog = catalog
+		}
+		return catalog, nil
+	})
+}
+
+// invalidate drops the cached catalog; the next request fetches it again.
+func (c *catalogCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.catalog = nil
+}
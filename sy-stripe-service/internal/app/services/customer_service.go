@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+var (
+	ErrCustomerNotFound      = errors.New("customer not found")
+	ErrInvalidCustomerUpdate = errors.New("name and email must not be empty")
+)
+
+// CustomerService manages the lifecycle of a customer across the local users table and Stripe.
+type CustomerService struct {
+	Users         database.UserRepository
+	Subscriptions *SubscriptionService
+	// UoW groups the local writes that follow the Stripe calls.
+	UoW     database.UnitOfWork
+	Gateway BillingGateway
+}
+
+func NewCustomerService(users database.UserRepository, subscriptions *SubscriptionService, uow database.UnitOfWork, gateway BillingGateway) *CustomerService {
+	return &CustomerService{Users: users, Subscriptions: subscriptions, UoW: uow, Gateway: gateway}
+}
+
+// CustomerDeletion summarizes what DeleteCustomer did.
+type CustomerDeletion struct {
+	CanceledSubscriptions []string `json:"canceled_subscriptions"`
+	StripeCustomerDeleted bool     `json:"stripe_customer_deleted"`
+}
+
+// UpdateCustomer changes the name and/or email of a customer, on the Stripe customer and locally.
+// Nil fields are left unchanged. An email taken by another user returns database.ErrDuplicateUser.
+func (s *CustomerService) UpdateCustomer(ctx context.Context, id string, name, email *string) (*models.User, error) {
+	user, err := s.Users.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, id)
+	}
+	params := &stripe.CustomerParams{}
+	if name != nil {
+		trimmed := strings.TrimSpace(*name)
+		if trimmed == "" {
+			return nil, ErrInvalidCustomerUpdate
+		}
+		params.Name = stripe.String(trimmed)
+	}
+	if email != nil {
+		trimmed := strings.TrimSpace(*email)
+		if trimmed == "" {
+			return nil, ErrInvalidCustomerUpdate
+		}
+		params.Email = stripe.String(trimmed)
+	}
+
+	// Talk to Stripe before the transaction is opened, so a slow call does not hold the write lock.
+	if user.StripeCustomerID != "" {
+		log.Printf("[UpdateCustomer] Updating Stripe customer %s", user.StripeCustomerID)
+		if _, err := s.Gateway.UpdateCustomer(ctx, user.StripeCustomerID, params); err != nil {
+			return nil, fmt.Errorf("failed to update stripe customer %s: %w", user.StripeCustomerID, err)
+		}
+	}
+	var updated *models.User
+	err = s.UoW.WithTx(ctx, func(repos database.Repos) error {
+		current, err := repos.Users.GetUserByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCustomerNotFound, id)
+		}
+		changes := *current
+		if params.Name != nil {
+			changes.Name = *params.Name
+		}
+		if params.Email != nil {
+			changes.Email = *params.Email
+		}
+		changes.UpdatedAt = time.Now()
+		updated, err = repos.Users.UpdateUser(ctx, &changes)
+		return err
+	})
+	if err != nil {
+		if user.StripeCustomerID != "" {
+			s.restoreStripeCustomer(ctx, user)
+		}
+		return nil, err
+	}
+	return updated, nil
+}
+
+// restoreStripeCustomer puts the name and email of user back on its Stripe customer after the local
+// update failed. A failure is only logged: the local row is what the service reads.
+func (s *CustomerService) restoreStripeCustomer(ctx context.Context, user *models.User) {
+	params := &stripe.CustomerParams{Name: stripe.String(user.Name), Email: stripe.String(user.Email)}
+	if _, err := s.Gateway.UpdateCustomer(ctx, user.StripeCustomerID, params); err != nil {
+		log.Printf("[UpdateCustomer] ERROR restoring Stripe customer %s after the local update failed: %v", user.StripeCustomerID, err)
+	}
+}
+
+// DeleteCustomer cancels the customer's open Stripe subscriptions, optionally deletes the Stripe
+// customer and soft-deletes the user. The deleted user releases its email for new customers.
+// The canceled subscriptions and the deletion are stored in one unit of work after the Stripe calls.
+func (s *CustomerService) DeleteCustomer(ctx context.Context, id string, deleteStripeCustomer bool) (*CustomerDeletion, error) {
+	user, err := s.Users.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, id)
+	}
+	deletion := &CustomerDeletion{CanceledSubscriptions: []string{}}
+	var canceled []*stripe.Subscription
+	if user.StripeCustomerID != "" {
+		// Only open subscriptions are listed, so a long history of canceled ones is not walked.
+		subs, err := s.Gateway.ListSubscriptions(ctx, &stripe.SubscriptionListParams{Customer: user.StripeCustomerID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stripe subscriptions of %s: %w", user.StripeCustomerID, err)
+		}
+		for _, sub := range subs {
+			if sub.Status == stripe.SubscriptionStatusCanceled || sub.Status == stripe.SubscriptionStatusIncompleteExpired {
+				continue
+			}
+			log.Printf("[DeleteCustomer] Canceling subscription %s of user %s", sub.ID, user.ID)
+			stripeSub, err := s.Gateway.CancelSubscription(ctx, sub.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to cancel subscription %s: %w", sub.ID, err)
+			}
+			canceled = append(canceled, stripeSub)
+			deletion.CanceledSubscriptions = append(deletion.CanceledSubscriptions, sub.ID)
+		}
+		if deleteStripeCustomer {
+			log.Printf("[DeleteCustomer] Deleting Stripe customer %s", user.StripeCustomerID)
+			if _, err := s.Gateway.DeleteCustomer(ctx, user.StripeCustomerID); err != nil {
+				return nil, fmt.Errorf("failed to delete stripe customer %s: %w", user.StripeCustomerID, err)
+			}
+			deletion.StripeCustomerDeleted = true
+		}
+	}
+
+	err = s.UoW.WithTx(ctx, func(repos database.Repos) error {
+		for _, stripeSub := range canceled {
+			sub, err := repos.Subscriptions.GetSubscriptionByStripeSubscriptionID(ctx, stripeSub.ID)
+			if err != nil {
+				// Subscriptions that were never recorded locally have nothing to update.
+				continue
+			}
+			applyStripeSubscription(sub, stripeSub)
+			sub.UpdatedAt = time.Now()
+			if _, err := repos.Subscriptions.UpdateSubscription(ctx, sub); err != nil {
+				return fmt.Errorf("failed to store canceled subscription %s: %w", stripeSub.ID, err)
+			}
+		}
+		return repos.Users.SoftDeleteUser(ctx, id, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	// dunningBatchSize limits how many due states one ProcessDue call handles.
+	dunningBatchSize = 100
+	// dunningRetryDelay is how long a failed step waits before it is tried again.
+	dunningRetryDelay = 10 * time.Minute
+)
+
+// DunningService recovers subscriptions whose renewal payment failed. invoice.payment_failed opens
+// (or updates) the subscription's dunning state and invoice.paid closes it; in between, ProcessDue
+// runs the configured steps as they become due.
+type DunningService struct {
+	Repo          database.DunningRepository
+	Users         database.UserRepository
+	Subscriptions *SubscriptionService
+	Notifier      Notifier
+	// Steps run in order, each After the first failed payment.
+	Steps []models.DunningStep
+	// Now returns the current time; tests can pin it.
+	Now func() time.Time
+}
+
+func NewDunningService(repo database.DunningRepository, users database.UserRepository, subscriptions *SubscriptionService, notifier Notifier, steps []models.DunningStep) *DunningService {
+	return &DunningService{Repo: repo, Users: users, Subscriptions: subscriptions, Notifier: notifier, Steps: steps, Now: time.Now}
+}
+
+// HandlePaymentFailed records a failed payment of a subscription invoice. The first failure opens a
+// dunning state and schedules the first step; later failures update the attempt count and the next
+// retry. asOf is the event creation time; events older than the last one applied return ErrStaleEvent.
+func (s *DunningService) HandlePaymentFailed(ctx context.Context, inv *stripe.Invoice, asOf time.Time) (*models.DunningState, error) {
+	sub, existing, err := s.load(ctx, inv)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && asOf.Before(existing.LastEventAt) {
+		return existing, ErrStaleEvent
+	}
+
+	state := existing
+	if existing == nil || !existing.Status.Open() {
+		if sub.Status == models.SubscriptionStatusCanceled {
+			log.Printf("[HandlePaymentFailed] Subscription %s is canceled, not starting dunning", sub.StripeSubscriptionID)
+			return existing, nil
+		}
+		state = &models.DunningState{
+			ID:             uuid.New(),
+			SubscriptionID: sub.ID,
+			UserID:         sub.UserID,
+			Status:         models.DunningStatusPastDue,
+			FirstFailedAt:  asOf,
+			CreatedAt:      s.Now(),
+		}
+		state.NextStepAt = s.stepAt(state, 0)
+		state.GracePeriodEndsAt = s.gracePeriodEnd(state)
+	}
+	state.StripeInvoiceID = inv.ID
+	state.AttemptCount = inv.AttemptCount
+	state.NextRetryAt = nil
+	if inv.NextPaymentAttempt > 0 {
+		next := time.Unix(inv.NextPaymentAttempt, 0)
+		state.NextRetryAt = &next
+	}
+	state.LastEventAt = asOf
+	state.UpdatedAt = s.Now()
+	stored, err := s.Repo.UpsertDunningState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	if stored.LastEventAt.After(asOf) {
+		return stored, ErrStaleEvent
+	}
+	log.Printf("[HandlePaymentFailed] Subscription %s is %s after %d failed attempts of %s", sub.StripeSubscriptionID, stored.Status, stored.AttemptCount, inv.ID)
+	return stored, nil
+}
+
+// HandleInvoicePaid closes an open dunning state of the invoice's subscription.
+func (s *DunningService) HandleInvoicePaid(ctx context.Context, inv *stripe.Invoice, asOf time.Time) (*models.DunningState, error) {
+	sub, state, err := s.load(ctx, inv)
+	if err != nil || state == nil || !state.Status.Open() {
+		return state, err
+	}
+	if asOf.Before(state.LastEventAt) {
+		return state, ErrStaleEvent
+	}
+	wasNotified := s.notified(state)
+	state.Status = models.DunningStatusRecovered
+	state.NextRetryAt, state.NextStepAt = nil, nil
+	state.ResolvedAt = &asOf
+	state.LastEventAt = asOf
+	state.UpdatedAt = s.Now()
+	stored, err := s.Repo.UpsertDunningState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	if stored.LastEventAt.After(asOf) {
+		return stored, ErrStaleEvent
+	}
+	log.Printf("[HandleInvoicePaid] Subscription %s recovered with %s", sub.StripeSubscriptionID, inv.ID)
+	if wasNotified {
+		if err := s.notify(ctx, NotificationPaymentRecovered, stored, sub); err != nil {
+			log.Printf("[HandleInvoicePaid] ERROR notifying recovery of %s: %v", sub.StripeSubscriptionID, err)
+		}
+	}
+	return stored, nil
+}
+
+// GetDunningState returns the dunning state of a subscription, or nil if its payments never failed.
+func (s *DunningService) GetDunningState(ctx context.Context, subscriptionID string) *models.DunningState {
+	state, err := s.Repo.GetDunningStateBySubscriptionID(ctx, subscriptionID)
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+// ProcessDue runs the dunning steps that are due and returns how many ran. A step that fails is
+// retried after dunningRetryDelay; the remaining steps still run.
+func (s *DunningService) ProcessDue(ctx context.Context) (int, error) {
+	now := s.Now()
+	states, err := s.Repo.ListDueDunningStates(ctx, now, dunningBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	ran := 0
+	var firstErr error
+	for _, state := range states {
+		ok, err := s.runStep(ctx, state, now)
+		if err != nil {
+			log.Printf("[ProcessDue] ERROR running dunning step %d of subscription %s: %v", state.StepsDone+1, state.SubscriptionID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if ok {
+			ran++
+		}
+	}
+	return ran, firstErr
+}
+
+// runStep claims the next step of a state and runs it. It reports false when another worker or a
+// webhook changed the state first.
+func (s *DunningService) runStep(ctx context.Context, state *models.DunningState, now time.Time) (bool, error) {
+	sub, err := s.Subscriptions.GetSubscriptionByID(ctx, state.SubscriptionID.String())
+	if err != nil {
+		return false, fmt.Errorf("failed to load subscription: %w", err)
+	}
+	next := *state
+	next.StepsDone++
+	next.NextStepAt = s.stepAt(state, next.StepsDone)
+	next.UpdatedAt = now
+
+	var step *models.DunningStep
+	switch {
+	case sub.Status == models.SubscriptionStatusCanceled:
+		// Canceled elsewhere, e.g. by Stripe's own retry settings.
+		next.Status = models.DunningStatusCanceled
+	case state.StepsDone >= len(s.Steps):
+		// The configuration lost steps since this state was scheduled.
+		next.StepsDone, next.NextStepAt = state.StepsDone, nil
+	default:
+		step = &s.Steps[state.StepsDone]
+		switch step.Action {
+		case models.DunningActionRestrict:
+			next.Status = models.DunningStatusRestricted
+		case models.DunningActionCancel:
+			next.Status = models.DunningStatusCanceled
+		}
+	}
+	if next.Status == models.DunningStatusCanceled {
+		next.NextStepAt, next.ResolvedAt = nil, &now
+	}
+
+	claimed, err := s.Repo.TransitionDunningState(ctx, &next, state.Status, state.StepsDone)
+	if err != nil || !claimed || step == nil {
+		return claimed && step != nil, err
+	}
+	if err := s.runAction(ctx, step.Action, &next, sub); err != nil {
+		// Give the step back so that it is retried.
+		retryAt := now.Add(dunningRetryDelay)
+		retry := *state
+		retry.NextStepAt, retry.UpdatedAt = &retryAt, now
+		if _, revertErr := s.Repo.TransitionDunningState(ctx, &retry, next.Status, next.StepsDone); revertErr != nil {
+			log.Printf("[runStep] ERROR rescheduling dunning step of subscription %s: %v", sub.StripeSubscriptionID, revertErr)
+		}
+		return false, fmt.Errorf("%s: %w", step.Action, err)
+	}
+	log.Printf("[runStep] Ran dunning step %d (%s) of subscription %s", next.StepsDone, step.Action, sub.StripeSubscriptionID)
+	return true, nil
+}
+
+func (s *DunningService) runAction(ctx context.Context, action models.DunningAction, state *models.DunningState, sub *models.Subscription) error {
+	switch action {
+	case models.DunningActionNotify:
+		return s.notify(ctx, NotificationPaymentFailed, state, sub)
+	case models.DunningActionCancel:
+		return s.Subscriptions.CancelSubscription(ctx, sub.StripeSubscriptionID)
+	default:
+		// Restricting only changes the status, which clients read from the customer details.
+		return nil
+	}
+}
+
+func (s *DunningService) notify(ctx context.Context, t NotificationType, state *models.DunningState, sub *models.Subscription) error {
+	user, err := s.Users.GetUserByID(ctx, state.UserID.String())
+	if err != nil {
+		return fmt.Errorf("failed to load user %s: %w", state.UserID, err)
+	}
+	return s.Notifier.Notify(ctx, Notification{Type: t, User: user, Subscription: sub, Dunning: state})
+}
+
+// load returns the local subscription of an invoice and its dunning state, if any.
+func (s *DunningService) load(ctx context.Context, inv *stripe.Invoice) (*models.Subscription, *models.DunningState, error) {
+	if inv.Subscription == nil || inv.Subscription.ID == "" {
+		return nil, nil, fmt.Errorf("invoice %s is not tied to a subscription", inv.ID)
+	}
+	sub, err := s.Subscriptions.SubRepo.GetSubscriptionByStripeSubscriptionID(ctx, inv.Subscription.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no local subscription %s: %w", inv.Subscription.ID, err)
+	}
+	return sub, s.GetDunningState(ctx, sub.ID.String()), nil
+}
+
+// stepAt returns when step i of a state is due, or nil if there is no such step.
+func (s *DunningService) stepAt(state *models.DunningState, i int) *time.Time {
+	if i >= len(s.Steps) {
+		return nil
+	}
+	t := state.FirstFailedAt.Add(s.Steps[i].After)
+	return &t
+}
+
+// gracePeriodEnd returns when the first step that restricts or cancels the subscription is due.
+func (s *DunningService) gracePeriodEnd(state *models.DunningState) *time.Time {
+	for i, step := range s.Steps {
+		if step.Action != models.DunningActionNotify {
+			return s.stepAt(state, i)
+		}
+	}
+	return nil
+}
+
+// notified reports whether a notify step of the state has run.
+func (s *DunningService) notified(state *models.DunningState) bool {
+	for i := 0; i < state.StepsDone && i < len(s.Steps); i++ {
+		if s.Steps[i].Action == models.DunningActionNotify {
+			return true
+		}
+	}
+	return false
+}
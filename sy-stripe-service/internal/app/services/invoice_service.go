@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// InvoiceService mirrors Stripe invoices into the local invoices table.
+type InvoiceService struct {
+	Repo    database.InvoiceRepository
+	Users   database.UserRepository
+	Gateway BillingGateway
+}
+
+func NewInvoiceService(repo database.InvoiceRepository, users database.UserRepository, gateway BillingGateway) *InvoiceService {
+	return &InvoiceService{Repo: repo, Users: users, Gateway: gateway}
+}
+
+// SyncStripeInvoice mirrors a Stripe invoice for the user owning its customer. Like
+// SyncStripeSubscription, asOf becomes the row's updated_at and snapshots older than the
+// stored row are rejected with ErrStaleEvent.
+func (s *InvoiceService) SyncStripeInvoice(ctx context.Context, inv *stripe.Invoice, asOf time.Time) (*models.Invoice, error) {
+	if inv.Customer == nil || inv.Customer.ID == "" {
+		return nil, fmt.Errorf("stripe invoice %s has no customer", inv.ID)
+	}
+	user, err := s.Users.GetUserByStripeCustomerID(ctx, inv.Customer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("no local user for stripe customer %s: %w", inv.Customer.ID, err)
+	}
+	return s.upsert(ctx, user.ID, inv, asOf)
+}
+
+func (s *InvoiceService) upsert(ctx context.Context, userID uuid.UUID, inv *stripe.Invoice, asOf time.Time) (*models.Invoice, error) {
+	// Stripe timestamps have second precision, so compare on whole seconds.
+	asOf = asOf.Truncate(time.Second)
+	start, end := invoicePeriod(inv)
+	subscriptionID := ""
+	if inv.Subscription != nil {
+		subscriptionID = inv.Subscription.ID
+	}
+	stored, err := s.Repo.UpsertInvoice(ctx, &models.Invoice{
+		ID:                   uuid.New(),
+		UserID:               userID,
+		StripeInvoiceID:      inv.ID,
+		StripeSubscriptionID: subscriptionID,
+		Number:               inv.Number,
+		Status:               string(inv.Status),
+		Currency:             string(inv.Currency),
+		AmountDue:            inv.AmountDue,
+		AmountPaid:           inv.AmountPaid,
+		HostedInvoiceURL:     inv.HostedInvoiceURL,
+		InvoicePDF:           inv.InvoicePDF,
+		PeriodStart:          start,
+		PeriodEnd:            end,
+		IssuedAt:             time.Unix(inv.Created, 0),
+		CreatedAt:            time.Now(),
+		UpdatedAt:            asOf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stored.UpdatedAt.After(asOf) {
+		log.Printf("[SyncStripeInvoice] Ignoring stale snapshot of %s (as of %s, stored %s)", inv.ID, asOf, stored.UpdatedAt)
+		return stored, ErrStaleEvent
+	}
+	return stored, nil
+}
+
+// invoicePeriod returns the service period of an invoice. For subscription invoices this is the
+// period of the first regular line; the invoice's own period covers the pending items it collected.
+func invoicePeriod(inv *stripe.Invoice) (time.Time, time.Time) {
+	if inv.Lines != nil {
+		for _, line := range inv.Lines.Data {
+			if !line.Proration && line.Period != nil && line.Period.Start > 0 {
+				return time.Unix(line.Period.Start, 0), time.Unix(line.Period.End, 0)
+			}
+		}
+	}
+	return time.Unix(inv.PeriodStart, 0), time.Unix(inv.PeriodEnd, 0)
+}
+
+// SyncInvoices mirrors every invoice of the user's Stripe customer and returns how many were stored.
+func (s *InvoiceService) SyncInvoices(ctx context.Context, user *models.User) (int, error) {
+	if user.StripeCustomerID == "" {
+		return 0, fmt.Errorf("user %s has no stripe customer", user.ID)
+	}
+	// ListInvoices follows has_more through every page; the largest page size keeps the requests few.
+	params := &stripe.InvoiceListParams{Customer: stripe.String(user.StripeCustomerID)}
+	params.Filters.AddFilter("limit", "", "100")
+	invoices, err := s.Gateway.ListInvoices(ctx, params)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list stripe invoices of %s: %w", user.StripeCustomerID, err)
+	}
+	// A freshly fetched invoice is always the latest state.
+	now := time.Now()
+	for _, inv := range invoices {
+		if _, err := s.upsert(ctx, user.ID, inv, now); err != nil && !errors.Is(err, ErrStaleEvent) {
+			return 0, fmt.Errorf("failed to store invoice %s: %w", inv.ID, err)
+		}
+	}
+	log.Printf("[SyncInvoices] Synced %d invoices of user %s", len(invoices), user.ID)
+	return len(invoices), nil
+}
+
+// ListInvoices returns one page of the user's invoices, newest first.
+func (s *InvoiceService) ListInvoices(ctx context.Context, userID string, params database.InvoiceListParams) (*database.InvoicePage, error) {
+	return s.Repo.ListInvoicesByUserID(ctx, userID, params)
+}
+
+// LatestInvoice returns the user's most recent invoice, or nil if there is none.
+func (s *InvoiceService) LatestInvoice(ctx context.Context, userID string) (*models.Invoice, error) {
+	page, err := s.Repo.ListInvoicesByUserID(ctx, userID, database.InvoiceListParams{Limit: 1})
+	if err != nil || len(page.Invoices) == 0 {
+		return nil, err
+	}
+	return page.Invoices[0], nil
+}
+
+// UpcomingInvoice previews the next invoice of a subscription. It returns nil for subscriptions
+// that will not be invoiced again.
+func (s *InvoiceService) UpcomingInvoice(ctx context.Context, sub *models.Subscription) (*models.UpcomingInvoice, error) {
+	if sub == nil || sub.StripeSubscriptionID == "" || sub.CancelAtPeriodEnd || sub.Status == "canceled" || sub.Status == "incomplete_expired" {
+		return nil, nil
+	}
+	inv, err := s.Gateway.GetUpcomingInvoice(ctx, &stripe.InvoiceParams{Subscription: stripe.String(sub.StripeSubscriptionID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to preview upcoming invoice of %s: %w", sub.StripeSubscriptionID, err)
+	}
+	start, end := invoicePeriod(inv)
+	return &models.UpcomingInvoice{
+		AmountDue:     inv.AmountDue,
+		Total:         inv.Total,
+		Currency:      string(inv.Currency),
+		PeriodStart:   start,
+		PeriodEnd:     end,
+		NextPaymentAt: time.Unix(inv.NextPaymentAttempt, 0),
+	}, nil
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"log"
+
+	"sy-stripe-service/internal/models"
+)
+
+// NotificationType identifies the message a customer is sent.
+type NotificationType string
+
+const (
+	// NotificationPaymentFailed asks the customer to update their payment method after a failed renewal.
+	NotificationPaymentFailed NotificationType = "payment_failed"
+	// NotificationPaymentRecovered confirms that an overdue invoice has been paid.
+	NotificationPaymentRecovered NotificationType = "payment_recovered"
+	// NotificationTrialWillEnd reminds the customer that their free trial ends at Subscription.TrialEnd.
+	NotificationTrialWillEnd NotificationType = "trial_will_end"
+)
+
+// Notification is a message about a customer's subscription.
+type Notification struct {
+	Type         NotificationType
+	User         *models.User
+	Subscription *models.Subscription
+	// Dunning is the dunning state the payment notifications refer to.
+	Dunning *models.DunningState
+}
+
+// Notifier delivers notifications to customers, e.g. by email.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// LogNotifier is the default Notifier; it only writes notifications to the log.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, n Notification) error {
+	log.Printf("[LogNotifier] %s for user %s (%s), subscription %s", n.Type, n.User.ID, n.User.Email, n.Subscription.StripeSubscriptionID)
+	return nil
+}
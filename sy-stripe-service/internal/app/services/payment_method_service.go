@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"sy-stripe-service/internal/models"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ErrPaymentMethodNotFound is returned for payment methods that are not attached to the user's Stripe customer.
+var ErrPaymentMethodNotFound = errors.New("payment method not found")
+
+// PaymentMethodService manages the cards of a user's Stripe customer. New cards are collected
+// by the client with the SetupIntent returned by CreateSetupIntent.
+type PaymentMethodService struct {
+	Users   *UserService
+	Gateway BillingGateway
+}
+
+func NewPaymentMethodService(users *UserService, gateway BillingGateway) *PaymentMethodService {
+	return &PaymentMethodService{Users: users, Gateway: gateway}
+}
+
+// CreateSetupIntent creates a SetupIntent that saves a card on the user's Stripe customer for
+// future off-session payments.
+func (s *PaymentMethodService) CreateSetupIntent(ctx context.Context, userID string) (*stripe.SetupIntent, error) {
+	user, err := stripeCustomerUser(ctx, s.Users, userID)
+	if err != nil {
+		return nil, err
+	}
+	si, err := s.Gateway.CreateSetupIntent(ctx, &stripe.SetupIntentParams{
+		Customer:           stripe.String(user.StripeCustomerID),
+		PaymentMethodTypes: stripe.StringSlice([]string{string(stripe.PaymentMethodTypeCard)}),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create setup intent for %s: %w", user.StripeCustomerID, err)
+	}
+	log.Printf("[CreateSetupIntent] Created setup intent %s for %s", si.ID, user.StripeCustomerID)
+	return si, nil
+}
+
+// ListPaymentMethods returns the cards attached to the user's Stripe customer, newest first.
+func (s *PaymentMethodService) ListPaymentMethods(ctx context.Context, userID string) ([]*models.PaymentMethod, error) {
+	user, err := stripeCustomerUser(ctx, s.Users, userID)
+	if err != nil {
+		return nil, err
+	}
+	customer, err := s.Gateway.GetCustomer(ctx, user.StripeCustomerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stripe customer %s: %w", user.StripeCustomerID, err)
+	}
+	methods, err := s.Gateway.ListPaymentMethods(ctx, &stripe.PaymentMethodListParams{
+		Customer: stripe.String(user.StripeCustomerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payment methods of %s: %w", user.StripeCustomerID, err)
+	}
+	defaultID := defaultPaymentMethodID(customer)
+	cards := make([]*models.PaymentMethod, 0, len(methods))
+	for _, pm := range methods {
+		cards = append(cards, paymentMethodModel(pm, pm.ID == defaultID))
+	}
+	return cards, nil
+}
+
+// SetDefaultPaymentMethod makes a card the default for the customer's invoices and subscriptions.
+// Subscriptions that carry their own default (as those created by Checkout do) are switched too,
+// so that the next renewal is charged to the new card.
+func (s *PaymentMethodService) SetDefaultPaymentMethod(ctx context.Context, userID, paymentMethodID string) (*models.PaymentMethod, error) {
+	user, pm, err := s.customerPaymentMethod(ctx, userID, paymentMethodID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.Gateway.UpdateCustomer(ctx, user.StripeCustomerID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{DefaultPaymentMethod: stripe.String(pm.ID)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set default payment method of %s: %w", user.StripeCustomerID, err)
+	}
+
+	subs, err := s.Gateway.ListSubscriptions(ctx, &stripe.SubscriptionListParams{Customer: user.StripeCustomerID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions of %s: %w", user.StripeCustomerID, err)
+	}
+	for _, sub := range subs {
+		if sub.DefaultPaymentMethod == nil || sub.DefaultPaymentMethod.ID == pm.ID {
+			continue
+		}
+		if _, err := s.Gateway.UpdateSubscription(ctx, sub.ID, &stripe.SubscriptionParams{DefaultPaymentMethod: stripe.String(pm.ID)}); err != nil {
+			return nil, fmt.Errorf("failed to set default payment method of subscription %s: %w", sub.ID, err)
+		}
+	}
+	log.Printf("[SetDefaultPaymentMethod] %s is now the default payment method of %s", pm.ID, user.StripeCustomerID)
+	return paymentMethodModel(pm, true), nil
+}
+
+// DetachPaymentMethod removes a card from the user's Stripe customer.
+func (s *PaymentMethodService) DetachPaymentMethod(ctx context.Context, userID, paymentMethodID string) error {
+	user, pm, err := s.customerPaymentMethod(ctx, userID, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Gateway.DetachPaymentMethod(ctx, pm.ID); err != nil {
+		return fmt.Errorf("failed to detach payment method %s: %w", pm.ID, err)
+	}
+	log.Printf("[DetachPaymentMethod] Detached %s from %s", pm.ID, user.StripeCustomerID)
+	return nil
+}
+
+// customerPaymentMethod loads a payment method and checks that it belongs to the user's Stripe customer.
+func (s *PaymentMethodService) customerPaymentMethod(ctx context.Context, userID, paymentMethodID string) (*models.User, *stripe.PaymentMethod, error) {
+	user, err := stripeCustomerUser(ctx, s.Users, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	pm, err := s.Gateway.GetPaymentMethod(ctx, paymentMethodID)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		return nil, nil, fmt.Errorf("%w: %s", ErrPaymentMethodNotFound, paymentMethodID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get payment method %s: %w", paymentMethodID, err)
+	}
+	if pm.Customer == nil || pm.Customer.ID != user.StripeCustomerID {
+		return nil, nil, fmt.Errorf("%w: %s", ErrPaymentMethodNotFound, paymentMethodID)
+	}
+	return user, pm, nil
+}
+
+func defaultPaymentMethodID(c *stripe.Customer) string {
+	if c.InvoiceSettings == nil || c.InvoiceSettings.DefaultPaymentMethod == nil {
+		return ""
+	}
+	return c.InvoiceSettings.DefaultPaymentMethod.ID
+}
+
+func paymentMethodModel(pm *stripe.PaymentMethod, isDefault bool) *models.PaymentMethod {
+	m := &models.PaymentMethod{ID: pm.ID, IsDefault: isDefault}
+	if pm.Card != nil {
+		m.Brand = string(pm.Card.Brand)
+		m.Last4 = pm.Card.Last4
+		m.ExpMonth = pm.Card.ExpMonth
+		m.ExpYear = pm.Card.ExpYear
+	}
+	return m
+}
@@ -1,60 +1,261 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"sy-stripe-service/internal/models"
 
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/product"
-	"github.com/stripe/stripe-go/v72/price"
 )
 
-type ProductService struct{}
+// ErrInvalidPriceFilter is returned for catalog filters with an unknown currency or price type.
+var ErrInvalidPriceFilter = errors.New("invalid price filter")
+
+type ProductService struct {
+	Gateway BillingGateway
+	// Now returns the current time the cached catalog's age is measured against; tests can pin it.
+	Now   func() time.Time
+	cache *catalogCache
+
+	// prices caches GetPrice for the catalog's ttl and is dropped with the catalog.
+	pricesMu sync.Mutex
+	prices   map[string]cachedPrice
+}
+
+type cachedPrice struct {
+	price     *stripe.Price
+	fetchedAt time.Time
+}
+
+// NewProductService caches the catalog for ttl, then serves it for up to staleTTL more while it is
+// refreshed in the background. A zero ttl fetches it from Stripe on every call.
+func NewProductService(gateway BillingGateway, ttl, staleTTL time.Duration) *ProductService {
+	s := &ProductService{Gateway: gateway, Now: time.Now}
+	s.cache = &catalogCache{ttl: ttl, staleTTL: staleTTL, now: func() time.Time { return s.Now() }, load: s.fetchCatalog}
+	return s
+}
+
+// PriceFilter narrows the catalog down to some prices; empty fields match every price.
+type PriceFilter struct {
+	// Currency matches prices in that currency or with it among their currency options.
+	Currency string
+	// Type is one_time or recurring.
+	Type string
+}
+
+func (f PriceFilter) matches(p models.PriceResponse) bool {
+	if f.Type != "" && p.Type != f.Type {
+		return false
+	}
+	if f.Currency != "" && p.Currency != f.Currency {
+		if _, ok := p.CurrencyOptions[f.Currency]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// GetCatalog returns the active products and prices matching filter, from the cache when possible.
+func (s *ProductService) GetCatalog(ctx context.Context, filter PriceFilter) (*ProductCatalog, error) {
+	filter.Currency = strings.ToLower(filter.Currency)
+	if filter.Currency != "" && !isCurrencyCode(filter.Currency) {
+		return nil, fmt.Errorf("%w: currency must be a three-letter ISO code", ErrInvalidPriceFilter)
+	}
+	if filter.Type != "" && filter.Type != string(stripe.PriceTypeOneTime) && filter.Type != string(stripe.PriceTypeRecurring) {
+		return nil, fmt.Errorf("%w: type must be one_time or recurring", ErrInvalidPriceFilter)
+	}
+	catalog, err := s.cache.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return filterCatalog(catalog, filter), nil
+}
+
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
 
-func NewProductService() *ProductService {
-	// Stripe key must be set by main.go via config before using ProductService
-	return &ProductService{}
+// InvalidateCatalog drops the cached catalog, e.g. after a product or price changed in Stripe.
+func (s *ProductService) InvalidateCatalog() {
+	log.Printf("[InvalidateCatalog] Dropping the cached product catalog")
+	s.cache.invalidate()
+	s.pricesMu.Lock()
+	defer s.pricesMu.Unlock()
+	s.prices = nil
 }
 
-// GetProductsWithPrices fetches all active Stripe products and their recurring prices.
-func (s *ProductService) GetProductsWithPrices() ([]models.ProductResponse, error) {
+func (s *ProductService) fetchCatalog(ctx context.Context) (*ProductCatalog, error) {
+	fetchedAt := s.Now()
+	products, err := s.GetProductsWithPrices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(products)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	return &ProductCatalog{Products: products, ETag: fmt.Sprintf("\"%x\"", sum[:16]), FetchedAt: fetchedAt}, nil
+}
+
+// GetProductsWithPrices fetches all active Stripe products and their active prices from Stripe,
+// bypassing the cache.
+func (s *ProductService) GetProductsWithPrices(ctx context.Context) ([]models.ProductResponse, error) {
 	var productsResp []models.ProductResponse
 	params := &stripe.ProductListParams{}
 	params.Active = stripe.Bool(true)
-	prodIter := product.List(params)
+	products, err := s.Gateway.ListProducts(ctx, params)
+	if err != nil {
+		return nil, err
+	}
 
-	for prodIter.Next() {
-		prod := prodIter.Product()
+	for _, prod := range products {
 		priceParams := &stripe.PriceListParams{
 			Product: stripe.String(prod.ID),
 		}
 		priceParams.Active = stripe.Bool(true)
-		priceIter := price.List(priceParams)
-		var prices []models.PriceResponse
-		for priceIter.Next() {
-			p := priceIter.Price()
-			if p.Type == "recurring" && p.Recurring != nil {
-				prices = append(prices, models.PriceResponse{
-					ID:        p.ID,
-					Nickname:  p.Nickname,
-					UnitAmount: p.UnitAmount,
-					Currency:  string(p.Currency),
-					Interval:  string(p.Recurring.Interval),
-					Created:   p.Created,
-				})
-			}
+		// Tiers and further currencies are only returned when expanded.
+		priceParams.AddExpand("data.tiers")
+		priceParams.AddExpand("data.currency_options")
+		stripePrices, err := s.Gateway.ListPrices(ctx, priceParams)
+		if err != nil {
+			return nil, err
+		}
+		prices := make([]models.PriceResponse, 0, len(stripePrices))
+		for _, p := range stripePrices {
+			prices = append(prices, priceResponse(p))
 		}
-		// Sort prices by created (oldest first)
-		// (Optional: implement if needed)
+		// Oldest first, so that the order does not depend on how Stripe pages the list.
+		sort.Slice(prices, func(i, j int) bool {
+			if prices[i].Created != prices[j].Created {
+				return prices[i].Created < prices[j].Created
+			}
+			return prices[i].ID < prices[j].ID
+		})
 		productsResp = append(productsResp, models.ProductResponse{
 			ID:          prod.ID,
 			Name:        prod.Name,
 			Description: prod.Description,
 			Active:      prod.Active,
+			Metadata:    prod.Metadata,
+			Features:    productFeatures(prod.Metadata),
 			Prices:      prices,
 		})
 	}
-	if err := prodIter.Err(); err != nil {
+	return productsResp, nil
+}
+
+func priceResponse(p *stripe.Price) models.PriceResponse {
+	resp := models.PriceResponse{
+		ID:            p.ID,
+		Nickname:      p.Nickname,
+		LookupKey:     p.LookupKey,
+		Type:          string(p.Type),
+		BillingScheme: string(p.BillingScheme),
+		UnitAmount:    p.UnitAmount,
+		Currency:      string(p.Currency),
+		TiersMode:     string(p.TiersMode),
+		TaxBehavior:   string(p.TaxBehavior),
+		Created:       p.Created,
+	}
+	if p.Recurring != nil {
+		resp.Interval = string(p.Recurring.Interval)
+		resp.IntervalCount = p.Recurring.IntervalCount
+		resp.UsageType = string(p.Recurring.UsageType)
+		resp.TrialPeriodDays = p.Recurring.TrialPeriodDays
+	}
+	for _, t := range p.Tiers {
+		tier := models.PriceTier{UnitAmount: t.UnitAmount, FlatAmount: t.FlatAmount}
+		// Stripe sends up_to as null ("inf") for the last tier, which decodes as 0.
+		if t.UpTo > 0 {
+			upTo := t.UpTo
+			tier.UpTo = &upTo
+		}
+		resp.Tiers = append(resp.Tiers, tier)
+	}
+	for currency, option := range p.CurrencyOptions {
+		if resp.CurrencyOptions == nil {
+			resp.CurrencyOptions = map[string]models.PriceCurrencyOption{}
+		}
+		resp.CurrencyOptions[currency] = models.PriceCurrencyOption{UnitAmount: option.UnitAmount, TaxBehavior: string(option.TaxBehavior)}
+	}
+	return resp
+}
+
+// productFeatures splits the "features" metadata of a product, a semicolon-separated list.
+func productFeatures(metadata map[string]string) []string {
+	var features []string
+	for _, f := range strings.Split(metadata["features"], ";") {
+		if f = strings.TrimSpace(f); f != "" {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// filterCatalog returns the products with the prices matching filter. Products without a matching
+// price are left out unless the filter is empty.
+func filterCatalog(catalog *ProductCatalog, filter PriceFilter) *ProductCatalog {
+	if filter == (PriceFilter{}) {
+		return catalog
+	}
+	filtered := &ProductCatalog{FetchedAt: catalog.FetchedAt, Products: []models.ProductResponse{}}
+	for _, product := range catalog.Products {
+		var prices []models.PriceResponse
+		for _, p := range product.Prices {
+			if filter.matches(p) {
+				prices = append(prices, p)
+			}
+		}
+		if len(prices) > 0 {
+			product.Prices = prices
+			filtered.Products = append(filtered.Products, product)
+		}
+	}
+	sum := sha256.Sum256([]byte(catalog.ETag + "\x00" + filter.Currency + "\x00" + filter.Type))
+	filtered.ETag = fmt.Sprintf("\"%x\"", sum[:16])
+	return filtered
+}
+
+// GetPrice returns a single Stripe price, from the cache when it was fetched within the catalog's ttl.
+func (s *ProductService) GetPrice(ctx context.Context, priceID string) (*stripe.Price, error) {
+	if s.cache.ttl <= 0 {
+		return s.Gateway.GetPrice(ctx, priceID)
+	}
+	s.pricesMu.Lock()
+	cached, ok := s.prices[priceID]
+	s.pricesMu.Unlock()
+	if ok && s.Now().Sub(cached.fetchedAt) < s.cache.ttl {
+		return cached.price, nil
+	}
+
+	fetchedAt := s.Now()
+	price, err := s.Gateway.GetPrice(ctx, priceID)
+	if err != nil {
 		return nil, err
 	}
-	return productsResp, nil
+	s.pricesMu.Lock()
+	defer s.pricesMu.Unlock()
+	if s.prices == nil {
+		s.prices = make(map[string]cachedPrice)
+	}
+	s.prices[priceID] = cachedPrice{price: price, fetchedAt: fetchedAt}
+	return price, nil
 }
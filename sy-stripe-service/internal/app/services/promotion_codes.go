@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+var (
+	ErrPromotionCodeInvalid    = errors.New("promotion code is invalid")
+	ErrPromotionCodeExpired    = errors.New("promotion code has expired")
+	ErrPromotionCodeIneligible = errors.New("promotion code cannot be applied to this purchase")
+)
+
+// ValidatePromotionCode looks up a customer-facing promotion code and checks that it can be applied
+// to a subscription of priceID by customerID (empty for a new customer). Stripe validates the code
+// again when the session is created; checking first gives customers a specific reason.
+func (s *SubscriptionService) ValidatePromotionCode(ctx context.Context, code, priceID, customerID string) (*stripe.PromotionCode, error) {
+	codes, err := s.Gateway.ListPromotionCodes(ctx, &stripe.PromotionCodeListParams{Code: stripe.String(code)})
+	if err != nil {
+		return nil, err
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("%w: %q does not exist", ErrPromotionCodeInvalid, code)
+	}
+	// Codes are unique among active ones; inactive codes are only reported when nothing else matches.
+	pc := codes[0]
+	for _, c := range codes {
+		if c.Active && (c.Customer == nil || c.Customer.ID == customerID) {
+			pc = c
+			break
+		}
+	}
+
+	now := time.Now().Unix()
+	coupon := pc.Coupon
+	switch {
+	case pc.ExpiresAt > 0 && now >= pc.ExpiresAt, coupon != nil && coupon.RedeemBy > 0 && now >= coupon.RedeemBy:
+		return nil, fmt.Errorf("%w: %q", ErrPromotionCodeExpired, code)
+	case pc.MaxRedemptions > 0 && pc.TimesRedeemed >= pc.MaxRedemptions, coupon != nil && coupon.MaxRedemptions > 0 && coupon.TimesRedeemed >= coupon.MaxRedemptions:
+		return nil, fmt.Errorf("%w: %q has been fully redeemed", ErrPromotionCodeExpired, code)
+	case !pc.Active || coupon == nil || !coupon.Valid:
+		return nil, fmt.Errorf("%w: %q is no longer active", ErrPromotionCodeExpired, code)
+	case pc.Customer != nil && pc.Customer.ID != customerID:
+		return nil, fmt.Errorf("%w: %q is restricted to another customer", ErrPromotionCodeIneligible, code)
+	}
+
+	price, err := s.Gateway.GetPrice(ctx, priceID)
+	if err != nil {
+		return nil, err
+	}
+	if coupon.AppliesTo != nil && len(coupon.AppliesTo.Products) > 0 && (price.Product == nil || !slices.Contains(coupon.AppliesTo.Products, price.Product.ID)) {
+		return nil, fmt.Errorf("%w: %q does not apply to this product", ErrPromotionCodeIneligible, code)
+	}
+	if coupon.AmountOff > 0 && coupon.Currency != price.Currency && coupon.CurrencyOptions[string(price.Currency)] == nil {
+		return nil, fmt.Errorf("%w: %q does not apply to prices in %s", ErrPromotionCodeIneligible, code, price.Currency)
+	}
+	if r := pc.Restrictions; r != nil {
+		if r.MinimumAmount > 0 && r.MinimumAmountCurrency == price.Currency && price.UnitAmount < r.MinimumAmount {
+			return nil, fmt.Errorf("%w: %q requires a minimum amount of %d %s", ErrPromotionCodeIneligible, code, r.MinimumAmount, r.MinimumAmountCurrency)
+		}
+		if r.FirstTimeTransaction && customerID != "" {
+			params := &stripe.SubscriptionListParams{Customer: customerID, Status: "all"}
+			params.Filters.AddFilter("limit", "", "1")
+			subs, err := s.Gateway.ListSubscriptions(ctx, params)
+			if err != nil {
+				return nil, err
+			}
+			if len(subs) > 0 {
+				return nil, fmt.Errorf("%w: %q is only valid for first-time customers", ErrPromotionCodeIneligible, code)
+			}
+		}
+	}
+	return pc, nil
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// StripeEventService keeps the webhook event ledger used for idempotent processing.
+type StripeEventService struct {
+	Repo database.StripeEventRepository
+}
+
+func NewStripeEventService(repo database.StripeEventRepository) *StripeEventService {
+	return &StripeEventService{Repo: repo}
+}
+
+// eventLockDuration bounds how long a delivery may hold an event before a retry can take it over.
+const eventLockDuration = 5 * time.Minute
+
+// ErrEventInProgress is returned when another delivery of the event is still being processed.
+var ErrEventInProgress = errors.New("stripe event is being processed by another delivery")
+
+// BeginEvent records a received event and claims it for processing. It reports false
+// for events that already reached a final state and returns ErrEventInProgress while
+// another delivery holds the claim; failed or interrupted deliveries are processed
+// again when Stripe retries them.
+func (s *StripeEventService) BeginEvent(ctx context.Context, event stripe.Event, payload []byte) (bool, error) {
+	now := time.Now()
+	inserted, err := s.Repo.RecordEvent(ctx, &models.StripeEvent{
+		ID:         event.ID,
+		Type:       event.Type,
+		Payload:    string(payload),
+		Status:     models.StripeEventStatusPending,
+		ReceivedAt: now,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := s.Repo.ClaimEvent(ctx, event.ID, now, now.Add(eventLockDuration))
+	if err != nil {
+		return false, err
+	}
+	if claimed {
+		if !inserted {
+			log.Printf("[BeginEvent] Reprocessing %s (%s)", event.ID, event.Type)
+		}
+		return true, nil
+	}
+
+	existing, err := s.Repo.GetEventByID(ctx, event.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to load stripe event %s: %w", event.ID, err)
+	}
+	if existing.Status == models.StripeEventStatusProcessing {
+		log.Printf("[BeginEvent] %s (%s) is already being processed", event.ID, event.Type)
+		return false, ErrEventInProgress
+	}
+	log.Printf("[BeginEvent] Duplicate delivery of %s (%s), already %s", event.ID, event.Type, existing.Status)
+	return false, nil
+}
+
+// FinishEvent stores the processing result of an event.
+func (s *StripeEventService) FinishEvent(ctx context.Context, eventID string, status string, processErr error) error {
+	errMsg := ""
+	if processErr != nil {
+		errMsg = processErr.Error()
+	}
+	return s.Repo.UpdateEventStatus(ctx, eventID, status, errMsg)
+}
@@ -2,7 +2,7 @@ package services
 
 import (
 	"context"
-	"os"
+	"errors"
 	"time"
 	"fmt"
 	"log"
@@ -10,35 +10,48 @@ import (
 	"sy-stripe-service/internal/database"
 	"sy-stripe-service/internal/models"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/checkout/session"
-	subpkg "github.com/stripe/stripe-go/v72/sub"
 )
 
 
 type SubscriptionService struct {
 	UserRepo database.UserRepository
 	SubRepo  database.SubscriptionRepository
+	// UoW runs operations that read and write several rows atomically.
+	UoW     database.UnitOfWork
+	Gateway BillingGateway
 }
 
-func NewSubscriptionService(userRepo database.UserRepository, subRepo database.SubscriptionRepository) *SubscriptionService {
-	return &SubscriptionService{UserRepo: userRepo, SubRepo: subRepo}
+func NewSubscriptionService(userRepo database.UserRepository, subRepo database.SubscriptionRepository, uow database.UnitOfWork, gateway BillingGateway) *SubscriptionService {
+	return &SubscriptionService{UserRepo: userRepo, SubRepo: subRepo, UoW: uow, Gateway: gateway}
 }
 
-func (s *SubscriptionService) CreateSubscription(ctx context.Context, userID string, priceID string) (*models.Subscription, error) {
-	id := uuid.New()
-	uid, err := uuid.Parse(userID)
+// CreateSubscription subscribes a Stripe customer to priceID and stores the subscription locally.
+// The trial is decided by TrialPeriodDays; an invalid trialPeriodDays fails with ErrInvalidTrialPeriod.
+func (s *SubscriptionService) CreateSubscription(ctx context.Context, customerID, priceID string, trialPeriodDays *int64) (*stripe.Subscription, *models.Subscription, error) {
+	trialDays, err := s.TrialPeriodDays(ctx, priceID, trialPeriodDays, nil, customerID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	sub := &models.Subscription{
-		ID: id,
-		UserID: uid,
-		StripePriceID: priceID,
-		Status: "created",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+	params := &stripe.SubscriptionParams{
+		Customer: stripe.String(customerID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				Price: stripe.String(priceID),
+			},
+		},
+	}
+	if trialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(trialDays)
+	}
+	stripeSub, err := s.Gateway.CreateSubscription(ctx, params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create stripe subscription: %w", err)
+	}
+	sub, err := s.SyncStripeSubscription(ctx, stripeSub, time.Now())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to persist subscription %s: %w", stripeSub.ID, err)
 	}
-	return s.SubRepo.CreateSubscription(ctx, sub)
+	return stripeSub, sub, nil
 }
 
 func (s *SubscriptionService) CancelSubscription(ctx context.Context, subscriptionID string) error {
@@ -51,8 +64,11 @@ func (s *SubscriptionService) CancelSubscription(ctx context.Context, subscripti
 			log.Printf("[CancelSubscription] Error fetching subscription by StripeSubscriptionID: %v", err)
 			// Try to cancel directly on Stripe as fallback
 			log.Printf("[CancelSubscription] WARNING: Subscription not found in DB, attempting Stripe-only cancel for: %s", subscriptionID)
-			stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-			_, stripeErr := subpkg.Cancel(subscriptionID, &stripe.SubscriptionCancelParams{})
+			_, stripeErr := s.Gateway.CancelSubscription(ctx, subscriptionID)
+			var missing *stripe.Error
+			if errors.As(stripeErr, &missing) && missing.Code == stripe.ErrorCodeResourceMissing {
+				return fmt.Errorf("%w: %s", ErrSubscriptionNotFound, subscriptionID)
+			}
 			if stripeErr != nil {
 				log.Printf("[CancelSubscription] Stripe direct cancel error: %v", stripeErr)
 				return stripeErr
@@ -62,27 +78,116 @@ func (s *SubscriptionService) CancelSubscription(ctx context.Context, subscripti
 		}
 	}
 	log.Printf("[CancelSubscription] Subscription loaded: %+v", sub)
+	if sub.Status == "canceled" || sub.Status == "incomplete_expired" {
+		return ErrSubscriptionNotCancelable
+	}
 	stripeSubID := sub.StripeSubscriptionID
 	if stripeSubID == "" {
 		log.Printf("[CancelSubscription] No StripeSubscriptionID, marking as canceled in DB only.")
-		return s.SubRepo.UpdateSubscriptionStatus(ctx, sub.ID.String(), "canceled")
+		return s.SubRepo.UpdateSubscriptionStatusByID(ctx, sub.ID.String(), "canceled")
 	}
 	// Cancel on Stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 	log.Printf("[CancelSubscription] Canceling on Stripe: %s", stripeSubID)
-	_, err = subpkg.Cancel(stripeSubID, &stripe.SubscriptionCancelParams{})
+	canceled, err := s.Gateway.CancelSubscription(ctx, stripeSubID)
 	if err != nil {
 		log.Printf("[CancelSubscription] ERROR: Stripe cancel failed, NOT updating DB. Error: %v", err)
 		return err // Do not update DB if Stripe cancel fails
 	}
 	log.Printf("[CancelSubscription] Stripe cancel success, updating DB for %s", stripeSubID)
-	return s.SubRepo.UpdateSubscriptionStatus(ctx, stripeSubID, "canceled")
+	_, err = s.saveStripeSubscription(ctx, canceled)
+	return err
 }
 
+var (
+	ErrSubscriptionNotCancelable = errors.New("subscription cannot be canceled")
+	ErrNoPendingCancellation     = errors.New("subscription has no pending cancellation")
+)
 
+// CancelSubscriptionAtPeriodEnd schedules the subscription to end with its current billing period.
+// The subscription stays active until then and can be reactivated.
+func (s *SubscriptionService) CancelSubscriptionAtPeriodEnd(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	sub, err := s.FindSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if sub.StripeSubscriptionID == "" || sub.Status == "canceled" || sub.Status == "incomplete_expired" {
+		return nil, ErrSubscriptionNotCancelable
+	}
+	if sub.CancelAtPeriodEnd {
+		return sub, nil
+	}
+	return s.setCancelAtPeriodEnd(ctx, sub, true)
+}
+
+// ReactivateSubscription undoes a pending cancel-at-period-end before the period is over.
+func (s *SubscriptionService) ReactivateSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	sub, err := s.FindSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Status == "canceled" || sub.Status == "incomplete_expired" {
+		return nil, ErrSubscriptionInactive
+	}
+	if !sub.CancelAtPeriodEnd || !sub.CurrentPeriodEnd.After(time.Now()) {
+		return nil, ErrNoPendingCancellation
+	}
+	return s.setCancelAtPeriodEnd(ctx, sub, false)
+}
+
+func (s *SubscriptionService) setCancelAtPeriodEnd(ctx context.Context, sub *models.Subscription, cancelAtPeriodEnd bool) (*models.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(cancelAtPeriodEnd),
+	}
+	log.Printf("[setCancelAtPeriodEnd] Setting cancel_at_period_end=%t on %s", cancelAtPeriodEnd, sub.StripeSubscriptionID)
+	updated, err := s.Gateway.UpdateSubscription(ctx, sub.StripeSubscriptionID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update stripe subscription %s: %w", sub.StripeSubscriptionID, err)
+	}
+	return s.saveStripeSubscription(ctx, updated)
+}
+
+// saveStripeSubscription stores the result of a Stripe call on the local row. The row is reloaded
+// inside the transaction so that changes made meanwhile (e.g. by a webhook) are not overwritten
+// with stale local fields.
+func (s *SubscriptionService) saveStripeSubscription(ctx context.Context, stripeSub *stripe.Subscription) (*models.Subscription, error) {
+	var saved *models.Subscription
+	err := s.UoW.WithTx(ctx, func(repos database.Repos) error {
+		sub, err := repos.Subscriptions.GetSubscriptionByStripeSubscriptionID(ctx, stripeSub.ID)
+		if err != nil {
+			return err
+		}
+		applyStripeSubscription(sub, stripeSub)
+		sub.UpdatedAt = time.Now()
+		saved, err = repos.Subscriptions.UpdateSubscription(ctx, sub)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// UpdateSubscriptionStatus stores a status change reported for a Stripe subscription.
+// A zero currentPeriodEnd keeps the stored period end.
 func (s *SubscriptionService) UpdateSubscriptionStatus(ctx context.Context, stripeSubscriptionID string, status string, currentPeriodEnd time.Time, cancelAtPeriodEnd bool) error {
-	// Placeholder: Update status in DB and (later) Stripe
-	return s.SubRepo.UpdateSubscriptionStatus(ctx, stripeSubscriptionID, status)
+	return s.UoW.WithTx(ctx, func(repos database.Repos) error {
+		sub, err := repos.Subscriptions.GetSubscriptionByStripeSubscriptionID(ctx, stripeSubscriptionID)
+		if err != nil {
+			return err
+		}
+		sub.Status = status
+		if !currentPeriodEnd.IsZero() {
+			sub.CurrentPeriodEnd = currentPeriodEnd
+		}
+		sub.CancelAtPeriodEnd = cancelAtPeriodEnd
+		if status == "canceled" && sub.CanceledAt == nil {
+			now := time.Now()
+			sub.CanceledAt = &now
+		}
+		sub.UpdatedAt = time.Now()
+		_, err = repos.Subscriptions.UpdateSubscription(ctx, sub)
+		return err
+	})
 }
 
 // GetSubscriptionByID retrieves a subscription by its internal UUID
@@ -99,19 +204,354 @@ func (s *SubscriptionService) UpdateSubscription(ctx context.Context, sub *model
 	return s.SubRepo.UpdateSubscription(ctx, sub)
 }
 
-// CreateCheckoutSession creates a Stripe Checkout Session for a subscription.
-func (s *SubscriptionService) CreateCheckoutSession(priceID string, userID *uuid.UUID, customerId, successURL, cancelURL string) (*stripe.CheckoutSession, error) {
-	// Cancel the user's active subscription before creating a new one (plan change)
-	if userID != nil {
-		// Find latest subscription for user
-		latestSub, err := s.GetLatestSubscriptionByUserID(context.Background(), userID.String())
-		if err == nil && latestSub != nil && latestSub.StripeSubscriptionID != "" && latestSub.Status != "canceled" {
-			cancelErr := s.CancelSubscription(context.Background(), latestSub.StripeSubscriptionID)
-			if cancelErr != nil {
-				return nil, fmt.Errorf("failed to cancel old subscription: %w", cancelErr)
+// ErrStaleEvent is returned when a Stripe event is older than the state already applied locally.
+var ErrStaleEvent = errors.New("stripe event is older than the stored subscription state")
+
+// SyncStripeSubscription mirrors a Stripe subscription into the local subscriptions table.
+// asOf is the time the snapshot was taken (the event creation time for webhooks); it becomes
+// the row's updated_at, and snapshots older than the stored updated_at are rejected with ErrStaleEvent.
+// The owning user is resolved through the Stripe customer ID.
+func (s *SubscriptionService) SyncStripeSubscription(ctx context.Context, stripeSub *stripe.Subscription, asOf time.Time) (*models.Subscription, error) {
+	var synced, stale *models.Subscription
+	err := s.UoW.WithTx(ctx, func(repos database.Repos) error {
+		existing, err := repos.Subscriptions.GetSubscriptionByStripeSubscriptionID(ctx, stripeSub.ID)
+		if err == nil && existing != nil {
+			// Stripe timestamps have second precision, so compare on whole seconds.
+			if asOf.Before(existing.UpdatedAt.Truncate(time.Second)) {
+				log.Printf("[SyncStripeSubscription] Ignoring stale snapshot of %s (as of %s, stored %s)", stripeSub.ID, asOf, existing.UpdatedAt)
+				stale = existing
+				return ErrStaleEvent
+			}
+			synced, err = upsertStripeSubscription(ctx, repos.Subscriptions, existing.UserID, stripeSub, asOf)
+			return err
+		}
+
+		if stripeSub.Customer == nil || stripeSub.Customer.ID == "" {
+			return fmt.Errorf("stripe subscription %s has no customer", stripeSub.ID)
+		}
+		user, err := repos.Users.GetUserByStripeCustomerID(ctx, stripeSub.Customer.ID)
+		if err != nil {
+			return fmt.Errorf("no local user for stripe customer %s: %w", stripeSub.Customer.ID, err)
+		}
+		synced, err = upsertStripeSubscription(ctx, repos.Subscriptions, user.ID, stripeSub, asOf)
+		return err
+	})
+	// The repository keeps a row newer than asOf, stored by a concurrent sync after it was read.
+	if err == nil && synced.UpdatedAt.Truncate(time.Second).After(asOf) {
+		log.Printf("[SyncStripeSubscription] Kept the newer stored state of %s (as of %s, stored %s)", stripeSub.ID, asOf, synced.UpdatedAt)
+		stale, err = synced, ErrStaleEvent
+	}
+	if errors.Is(err, ErrStaleEvent) {
+		return stale, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return synced, nil
+}
+
+// SyncStripeSubscriptionByID fetches a subscription from Stripe and mirrors it locally.
+func (s *SubscriptionService) SyncStripeSubscriptionByID(ctx context.Context, stripeSubscriptionID string) (*models.Subscription, error) {
+	stripeSub, err := s.Gateway.GetSubscription(ctx, stripeSubscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch stripe subscription %s: %w", stripeSubscriptionID, err)
+	}
+	// A freshly fetched subscription is always the latest state.
+	return s.SyncStripeSubscription(ctx, stripeSub, time.Now())
+}
+
+// SyncLatestStripeSubscription mirrors the user's most recent Stripe subscription, if any.
+// It is used for users whose subscription was never recorded locally.
+func (s *SubscriptionService) SyncLatestStripeSubscription(ctx context.Context, user *models.User) (*models.Subscription, error) {
+	if user.StripeCustomerID == "" {
+		return nil, fmt.Errorf("user %s has no stripe customer", user.ID)
+	}
+	params := &stripe.SubscriptionListParams{
+		Customer: user.StripeCustomerID,
+		Status:   "all",
+	}
+	params.Single = true
+	params.Filters.AddFilter("limit", "", "1")
+	subs, err := s.Gateway.ListSubscriptions(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("no stripe subscription for customer %s", user.StripeCustomerID)
+	}
+	return upsertStripeSubscription(ctx, s.SubRepo, user.ID, subs[0], time.Now())
+}
+
+// GetCheckoutSession fetches a Checkout Session with its subscription expanded.
+func (s *SubscriptionService) GetCheckoutSession(ctx context.Context, sessionID string) (*stripe.CheckoutSession, error) {
+	return s.Gateway.GetCheckoutSession(ctx, sessionID)
+}
+
+// CompleteCheckout persists the user and the subscription of a Checkout Session in one transaction.
+// The user is looked up by the session's Stripe customer and created from its customer details if needed.
+// The subscription is nil when the session is not complete or did not create one.
+func (s *SubscriptionService) CompleteCheckout(ctx context.Context, sess *stripe.CheckoutSession) (*models.User, *models.Subscription, error) {
+	if sess.Customer == nil || sess.Customer.ID == "" {
+		return nil, nil, fmt.Errorf("checkout session %s has no customer", sess.ID)
+	}
+	email, name := "", ""
+	if sess.CustomerDetails != nil {
+		email, name = sess.CustomerDetails.Email, sess.CustomerDetails.Name
+	}
+	// Talk to Stripe before the transaction is opened.
+	stripeSub, err := s.checkoutSubscription(ctx, sess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user *models.User
+	var sub *models.Subscription
+	err = s.UoW.WithTx(ctx, func(repos database.Repos) error {
+		var err error
+		user, err = NewUserService(repos.Users).UpsertUserByStripeCustomer(ctx, email, name, sess.Customer.ID)
+		if err != nil {
+			return fmt.Errorf("failed to persist user: %w", err)
+		}
+		if stripeSub == nil {
+			return nil
+		}
+		sub, err = upsertStripeSubscription(ctx, repos.Subscriptions, user.ID, stripeSub, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to persist subscription: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, sub, nil
+}
+
+// checkoutSubscription returns the subscription created by a completed Checkout Session,
+// or nil when the session is not complete or did not create one.
+func (s *SubscriptionService) checkoutSubscription(ctx context.Context, sess *stripe.CheckoutSession) (*stripe.Subscription, error) {
+	if sess.Status != stripe.CheckoutSessionStatusComplete || sess.Subscription == nil || sess.Subscription.ID == "" {
+		return nil, nil
+	}
+	stripeSub := sess.Subscription
+	if stripeSub.Items == nil {
+		// Subscription was not expanded; load it to get the price and billing period.
+		var err error
+		stripeSub, err = s.Gateway.GetSubscription(ctx, sess.Subscription.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch stripe subscription %s: %w", sess.Subscription.ID, err)
+		}
+	}
+	return stripeSub, nil
+}
+
+// upsertStripeSubscription writes a Stripe subscription for the given user, keyed by its Stripe ID.
+func upsertStripeSubscription(ctx context.Context, repo database.SubscriptionRepository, userID uuid.UUID, stripeSub *stripe.Subscription, asOf time.Time) (*models.Subscription, error) {
+	sub := &models.Subscription{
+		ID:        uuid.New(),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		UpdatedAt: asOf,
+	}
+	applyStripeSubscription(sub, stripeSub)
+	return repo.UpsertSubscription(ctx, sub)
+}
+
+// applyStripeSubscription copies the Stripe-owned fields onto a local subscription.
+func applyStripeSubscription(sub *models.Subscription, stripeSub *stripe.Subscription) {
+	sub.StripeSubscriptionID = stripeSub.ID
+	sub.Status = string(stripeSub.Status)
+	sub.CurrentPeriodStart = time.Unix(stripeSub.CurrentPeriodStart, 0)
+	sub.CurrentPeriodEnd = time.Unix(stripeSub.CurrentPeriodEnd, 0)
+	sub.CancelAtPeriodEnd = stripeSub.CancelAtPeriodEnd
+	sub.CanceledAt = nil
+	if stripeSub.CanceledAt > 0 {
+		canceledAt := time.Unix(stripeSub.CanceledAt, 0)
+		sub.CanceledAt = &canceledAt
+	}
+	if stripeSub.Items != nil && len(stripeSub.Items.Data) > 0 && stripeSub.Items.Data[0].Price != nil {
+		sub.StripePriceID = stripeSub.Items.Data[0].Price.ID
+	}
+	sub.Discount = subscriptionDiscount(stripeSub.Discount)
+	sub.TrialStart, sub.TrialEnd = nil, nil
+	if stripeSub.TrialStart > 0 {
+		trialStart := time.Unix(stripeSub.TrialStart, 0)
+		sub.TrialStart = &trialStart
+	}
+	if stripeSub.TrialEnd > 0 {
+		trialEnd := time.Unix(stripeSub.TrialEnd, 0)
+		sub.TrialEnd = &trialEnd
+	}
+}
+
+// subscriptionDiscount converts the discount of a Stripe subscription; nil if none is applied.
+func subscriptionDiscount(d *stripe.Discount) *models.SubscriptionDiscount {
+	if d == nil || d.Coupon == nil || d.Coupon.ID == "" {
+		return nil
+	}
+	discount := &models.SubscriptionDiscount{
+		CouponID:   d.Coupon.ID,
+		CouponName: d.Coupon.Name,
+		PercentOff: d.Coupon.PercentOff,
+		AmountOff:  d.Coupon.AmountOff,
+		Currency:   string(d.Coupon.Currency),
+		Duration:   string(d.Coupon.Duration),
+	}
+	if d.PromotionCode != nil {
+		discount.PromotionCodeID = d.PromotionCode.ID
+	}
+	if d.End > 0 {
+		end := time.Unix(d.End, 0)
+		discount.EndsAt = &end
+	}
+	return discount
+}
+
+// Proration behaviors accepted for plan changes.
+const (
+	ProrationCreateProrations = "create_prorations"
+	ProrationAlwaysInvoice    = "always_invoice"
+	ProrationNone             = "none"
+)
+
+var (
+	ErrSubscriptionNotFound     = errors.New("subscription not found")
+	ErrSubscriptionInactive     = errors.New("subscription is not active")
+	ErrInvalidProrationBehavior = errors.New("proration behavior must be one of create_prorations, always_invoice, none")
+	ErrSamePlan                 = errors.New("subscription is already on this price")
+	ErrActiveSubscription       = errors.New("user already has an active subscription")
+)
+
+// FindSubscription looks a subscription up by internal UUID or Stripe subscription ID.
+func (s *SubscriptionService) FindSubscription(ctx context.Context, id string) (*models.Subscription, error) {
+	sub, err := s.SubRepo.GetSubscriptionByID(ctx, id)
+	if err == nil {
+		return sub, nil
+	}
+	sub, err = s.SubRepo.GetSubscriptionByStripeSubscriptionID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSubscriptionNotFound, id)
+	}
+	return sub, nil
+}
+
+// planChangeTarget loads the local and Stripe subscription for a plan change and validates the request.
+func (s *SubscriptionService) planChangeTarget(ctx context.Context, subscriptionID, priceID, prorationBehavior string) (*models.Subscription, *stripe.Subscription, *stripe.SubscriptionItem, error) {
+	switch prorationBehavior {
+	case ProrationCreateProrations, ProrationAlwaysInvoice, ProrationNone:
+	default:
+		return nil, nil, nil, ErrInvalidProrationBehavior
+	}
+	sub, err := s.FindSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if sub.StripeSubscriptionID == "" || sub.Status == "canceled" || sub.Status == "incomplete_expired" {
+		return nil, nil, nil, ErrSubscriptionInactive
+	}
+	if sub.StripePriceID == priceID {
+		return nil, nil, nil, ErrSamePlan
+	}
+	stripeSub, err := s.Gateway.GetSubscription(ctx, sub.StripeSubscriptionID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to fetch stripe subscription %s: %w", sub.StripeSubscriptionID, err)
+	}
+	if stripeSub.Items == nil || len(stripeSub.Items.Data) == 0 {
+		return nil, nil, nil, fmt.Errorf("stripe subscription %s has no items", stripeSub.ID)
+	}
+	return sub, stripeSub, stripeSub.Items.Data[0], nil
+}
+
+// ChangePlan swaps the subscription's price on Stripe using the given proration behavior
+// and stores the new price locally.
+func (s *SubscriptionService) ChangePlan(ctx context.Context, subscriptionID, priceID, prorationBehavior string) (*models.Subscription, error) {
+	sub, stripeSub, item, err := s.planChangeTarget(ctx, subscriptionID, priceID, prorationBehavior)
+	if err != nil {
+		return nil, err
+	}
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(item.ID),
+				Price: stripe.String(priceID),
+			},
+		},
+		ProrationBehavior: stripe.String(prorationBehavior),
+	}
+	log.Printf("[ChangePlan] Updating %s from %s to %s (%s)", stripeSub.ID, sub.StripePriceID, priceID, prorationBehavior)
+	updated, err := s.Gateway.UpdateSubscription(ctx, stripeSub.ID, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update stripe subscription %s: %w", stripeSub.ID, err)
+	}
+	return s.saveStripeSubscription(ctx, updated)
+}
+
+// PreviewPlanChange returns the upcoming invoice for a plan change without applying it.
+func (s *SubscriptionService) PreviewPlanChange(ctx context.Context, subscriptionID, priceID, prorationBehavior string) (*models.PlanChangePreview, error) {
+	_, stripeSub, item, err := s.planChangeTarget(ctx, subscriptionID, priceID, prorationBehavior)
+	if err != nil {
+		return nil, err
+	}
+	params := &stripe.InvoiceParams{
+		Customer:     stripe.String(stripeSub.Customer.ID),
+		Subscription: stripe.String(stripeSub.ID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(item.ID),
+				Price: stripe.String(priceID),
+			},
+		},
+		SubscriptionProrationBehavior: stripe.String(prorationBehavior),
+		SubscriptionProrationDate:     stripe.Int64(time.Now().Unix()),
+	}
+	inv, err := s.Gateway.GetUpcomingInvoice(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preview upcoming invoice: %w", err)
+	}
+	preview := &models.PlanChangePreview{
+		SubscriptionID: stripeSub.ID,
+		PriceID:        priceID,
+		AmountDue:      inv.AmountDue,
+		Total:          inv.Total,
+		Currency:       string(inv.Currency),
+		NextPaymentAt:  time.Unix(inv.NextPaymentAttempt, 0),
+	}
+	if inv.Lines != nil {
+		for _, line := range inv.Lines.Data {
+			if line.Proration {
+				preview.ProrationAmount += line.Amount
 			}
 		}
 	}
+	return preview, nil
+}
+
+// CheckoutOptions are the optional settings of a Checkout Session.
+type CheckoutOptions struct {
+	// PromotionCode is the customer-facing code to apply, validated before the session is created.
+	PromotionCode string
+	// AllowPromotionCodes lets the customer enter a code on the Checkout page instead.
+	AllowPromotionCodes bool
+	// TrialPeriodDays overrides the trial of the price; nil uses the price's default, 0 skips the trial.
+	TrialPeriodDays *int64
+	// Guest marks a checkout started without credentials, for a customer Stripe creates on the Checkout page.
+	Guest bool
+}
+
+// guestCheckoutMetadata marks guest checkouts in the session metadata.
+const guestCheckoutMetadata = "guest_checkout"
+
+// IsGuestCheckout reports whether sess was started as a guest checkout, which may be read back without credentials.
+func IsGuestCheckout(sess *stripe.CheckoutSession) bool {
+	return sess.Metadata[guestCheckoutMetadata] == "true"
+}
+
+// CreateCheckoutSession creates a Stripe Checkout Session for a subscription.
+// A promotion code in opts is validated first and fails with ErrPromotionCodeInvalid,
+// ErrPromotionCodeExpired or ErrPromotionCodeIneligible; an invalid trial fails with ErrInvalidTrialPeriod.
+// Without a trial in opts, only customers who never subscribed get the trial of the price.
+// Users who are already subscribed get ErrActiveSubscription and change plans with ChangePlan instead.
+func (s *SubscriptionService) CreateCheckoutSession(ctx context.Context, priceID string, userID *uuid.UUID, customerId, successURL, cancelURL string, opts CheckoutOptions) (*stripe.CheckoutSession, error) {
 	params := &stripe.CheckoutSessionParams{
 		Mode: stripe.String(string(stripe.CheckoutSessionModeSubscription)),
 		SuccessURL: stripe.String(successURL),
@@ -128,17 +568,44 @@ func (s *SubscriptionService) CreateCheckoutSession(priceID string, userID *uuid
 	if customerId != "" {
 		params.Customer = stripe.String(customerId)
 	} else if userID != nil {
-		user, err := s.UserRepo.GetUserByStripeCustomerID(context.Background(), userID.String())
+		user, err := s.UserRepo.GetUserByID(ctx, userID.String())
 		if err == nil && user.StripeCustomerID != "" {
 			params.Customer = stripe.String(user.StripeCustomerID)
 		}
-		if params.Metadata == nil {
-			params.Metadata = make(map[string]string)
+	}
+	// The user ID ties the session to its owner when it is retrieved later.
+	if userID != nil {
+		params.Metadata = map[string]string{"user_id": userID.String()}
+	} else if opts.Guest {
+		params.Metadata = map[string]string{guestCheckoutMetadata: "true"}
+	}
+	// Stripe accepts either a discount or the promotion code field on the Checkout page, not both.
+	if opts.PromotionCode != "" {
+		pc, err := s.ValidatePromotionCode(ctx, opts.PromotionCode, priceID, stripe.StringValue(params.Customer))
+		if err != nil {
+			return nil, err
+		}
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{{PromotionCode: stripe.String(pc.ID)}}
+	} else if opts.AllowPromotionCodes {
+		params.AllowPromotionCodes = stripe.Bool(true)
+	}
+	trialDays, err := s.TrialPeriodDays(ctx, priceID, opts.TrialPeriodDays, userID, stripe.StringValue(params.Customer))
+	if err != nil {
+		return nil, err
+	}
+	if trialDays > 0 {
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{TrialPeriodDays: stripe.Int64(trialDays)}
+	}
+
+	// Plan changes go through ChangePlan, which prorates and keeps the customer subscribed if they abandon checkout.
+	if userID != nil {
+		latestSub, err := s.GetLatestSubscriptionByUserID(ctx, userID.String())
+		if err == nil && latestSub != nil && latestSub.StripeSubscriptionID != "" && latestSub.Status != "canceled" && latestSub.Status != "incomplete_expired" {
+			return nil, fmt.Errorf("%w; change its plan with POST /api/v1/subscriptions/%s/update-plan", ErrActiveSubscription, latestSub.ID)
 		}
-		params.Metadata["user_id"] = userID.String()
 	}
 
-	sess, err := session.New(params)
+	sess, err := s.Gateway.CreateCheckoutSession(ctx, params)
 	if err != nil {
 		return nil, err
 	}
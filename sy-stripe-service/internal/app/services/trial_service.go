@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// maxTrialPeriodDays is the longest trial Stripe accepts.
+const maxTrialPeriodDays = 730
+
+var ErrInvalidTrialPeriod = errors.New("trial_period_days must be between 0 and 730")
+
+// TrialPeriodDays returns the trial a new subscription of priceID gets: requested if set, otherwise
+// the trial_period_days default of the price. The default is for new customers only; a subscriber
+// (userID and/or customerID, either may be empty) who subscribed before would otherwise chain free trials.
+// Every way of subscribing decides the trial here.
+func (s *SubscriptionService) TrialPeriodDays(ctx context.Context, priceID string, requested *int64, userID *uuid.UUID, customerID string) (int64, error) {
+	if requested != nil {
+		if *requested < 0 || *requested > maxTrialPeriodDays {
+			return 0, ErrInvalidTrialPeriod
+		}
+		return *requested, nil
+	}
+	price, err := s.Gateway.GetPrice(ctx, priceID)
+	if err != nil {
+		return 0, err
+	}
+	if price.Recurring == nil || price.Recurring.TrialPeriodDays == 0 {
+		return 0, nil
+	}
+	returning, err := s.hadSubscription(ctx, userID, customerID)
+	if err != nil {
+		return 0, err
+	}
+	if returning {
+		return 0, nil
+	}
+	return price.Recurring.TrialPeriodDays, nil
+}
+
+// hadSubscription reports whether the user or the Stripe customer has subscribed before,
+// including subscriptions that have since been canceled.
+func (s *SubscriptionService) hadSubscription(ctx context.Context, userID *uuid.UUID, customerID string) (bool, error) {
+	if userID != nil {
+		if sub, err := s.GetLatestSubscriptionByUserID(ctx, userID.String()); err == nil && sub != nil {
+			return true, nil
+		}
+	}
+	if customerID == "" {
+		return false, nil
+	}
+	params := &stripe.SubscriptionListParams{
+		Customer: customerID,
+		Status:   "all",
+	}
+	params.Single = true
+	params.Filters.AddFilter("limit", "", "1")
+	subs, err := s.Gateway.ListSubscriptions(ctx, params)
+	if err != nil {
+		return false, err
+	}
+	return len(subs) > 0, nil
+}
+
+// TrialService tells customers that their free trial is about to end. Stripe sends
+// customer.subscription.trial_will_end three days before; the scheduler in NotifyTrialsEnding
+// covers missed webhooks and other lead times. Each trial end is notified once, whichever comes first.
+type TrialService struct {
+	Subscriptions *SubscriptionService
+	Users         database.UserRepository
+	Notifier      Notifier
+	// Lead is how long before the end of a trial the customer is notified.
+	Lead time.Duration
+	// Now returns the current time; tests can pin it.
+	Now func() time.Time
+}
+
+func NewTrialService(subscriptions *SubscriptionService, users database.UserRepository, notifier Notifier, lead time.Duration) *TrialService {
+	return &TrialService{Subscriptions: subscriptions, Users: users, Notifier: notifier, Lead: lead, Now: time.Now}
+}
+
+// HandleTrialWillEnd mirrors the subscription of a customer.subscription.trial_will_end event and
+// notifies the customer, unless that trial end was already notified.
+func (s *TrialService) HandleTrialWillEnd(ctx context.Context, stripeSub *stripe.Subscription, created time.Time) error {
+	sub, err := s.Subscriptions.SyncStripeSubscription(ctx, stripeSub, created)
+	if err != nil && !errors.Is(err, ErrStaleEvent) {
+		return err
+	}
+	// A stale event still announces the trial end, as long as the stored subscription is trialing.
+	if sub == nil || sub.Status != models.SubscriptionStatusTrialing || sub.TrialEnd == nil {
+		log.Printf("[HandleTrialWillEnd] Subscription %s is not trialing, skipping", stripeSub.ID)
+		return nil
+	}
+	_, err = s.notify(ctx, sub)
+	return err
+}
+
+// NotifyTrialsEnding notifies the customers whose trial ends within Lead and returns how many were notified.
+func (s *TrialService) NotifyTrialsEnding(ctx context.Context) (int, error) {
+	now := s.Now()
+	subs, err := s.Subscriptions.SubRepo.ListTrialsEndingBetween(ctx, now, now.Add(s.Lead))
+	if err != nil {
+		return 0, err
+	}
+	notified := 0
+	var firstErr error
+	for _, sub := range subs {
+		ok, err := s.notify(ctx, sub)
+		if err != nil {
+			log.Printf("[NotifyTrialsEnding] ERROR notifying the trial end of %s: %v", sub.StripeSubscriptionID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if ok {
+			notified++
+		}
+	}
+	return notified, firstErr
+}
+
+// notify claims the current trial end of sub and sends the notification. It reports false if
+// the trial end was already notified.
+func (s *TrialService) notify(ctx context.Context, sub *models.Subscription) (bool, error) {
+	user, err := s.Users.GetUserByID(ctx, sub.UserID.String())
+	if err != nil {
+		return false, fmt.Errorf("failed to load user %s: %w", sub.UserID, err)
+	}
+	claimed, err := s.Subscriptions.SubRepo.ClaimTrialEndNotification(ctx, sub.ID.String())
+	if err != nil || !claimed {
+		return false, err
+	}
+	// The claim is not released on failure: a missed reminder is preferable to a repeated one.
+	if err := s.Notifier.Notify(ctx, Notification{Type: NotificationTrialWillEnd, User: user, Subscription: sub}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
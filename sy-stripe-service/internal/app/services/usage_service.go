@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"sy-stripe-service/internal/database"
+	"sy-stripe-service/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	// usageBatchSize limits how many due records one FlushUsage call reports.
+	usageBatchSize = 500
+	// usageReportLease is how long a claimed record is left to the flusher reporting it. A flusher
+	// that dies mid-report leaves the record to be picked up again once the lease expires.
+	usageReportLease = 5 * time.Minute
+	// usageMaxBackoff caps the delay between attempts of a record Stripe could not take.
+	usageMaxBackoff = time.Hour
+	// usageClockSkew is how far in the future a usage timestamp may lie.
+	usageClockSkew = 5 * time.Minute
+	// maxIdempotencyKeyLength matches the limit of the idempotency_key column.
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	ErrInvalidUsage = errors.New("invalid usage record")
+	// ErrIdempotencyKeyReused is returned when an idempotency key is sent again with different usage.
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for different usage")
+)
+
+// UsageService buffers metered usage in the usage_records table and reports it to Stripe from a
+// background flusher, so that recording usage never waits for Stripe.
+type UsageService struct {
+	Repo          database.UsageRepository
+	Subscriptions *SubscriptionService
+	Products      *ProductService
+	Gateway       BillingGateway
+	// Now returns the current time; tests can pin it.
+	Now func() time.Time
+}
+
+func NewUsageService(repo database.UsageRepository, subscriptions *SubscriptionService, products *ProductService, gateway BillingGateway) *UsageService {
+	return &UsageService{Repo: repo, Subscriptions: subscriptions, Products: products, Gateway: gateway, Now: time.Now}
+}
+
+// RecordUsage buffers quantity units of usage of a subscription at timestamp (now if nil). A request
+// repeating the idempotency key of a stored record returns that record and false instead of
+// counting the usage again; without a key every call is recorded.
+func (s *UsageService) RecordUsage(ctx context.Context, subscriptionID string, quantity int64, timestamp *time.Time, idempotencyKey string) (*models.UsageRecord, bool, error) {
+	sub, err := s.Subscriptions.FindSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, false, err
+	}
+	if sub.Status == models.SubscriptionStatusCanceled || sub.Status == "incomplete_expired" {
+		return nil, false, ErrSubscriptionInactive
+	}
+	now := s.Now()
+	at := now
+	if timestamp != nil {
+		at = *timestamp
+	}
+	switch {
+	case quantity <= 0:
+		return nil, false, fmt.Errorf("%w: quantity must be positive", ErrInvalidUsage)
+	case at.After(now.Add(usageClockSkew)):
+		return nil, false, fmt.Errorf("%w: timestamp must not be in the future", ErrInvalidUsage)
+	case at.Before(sub.CurrentPeriodStart):
+		return nil, false, fmt.Errorf("%w: timestamp must be within the current billing period", ErrInvalidUsage)
+	case len(idempotencyKey) > maxIdempotencyKeyLength:
+		return nil, false, fmt.Errorf("%w: idempotency key must be at most %d characters", ErrInvalidUsage, maxIdempotencyKeyLength)
+	}
+	if err := s.checkMetered(ctx, sub); err != nil {
+		return nil, false, err
+	}
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.NewString()
+	}
+
+	rec := &models.UsageRecord{
+		ID:             uuid.New(),
+		SubscriptionID: sub.ID,
+		IdempotencyKey: idempotencyKey,
+		Quantity:       quantity,
+		Timestamp:      at,
+		Status:         models.UsageRecordStatusPending,
+		NextAttemptAt:  &now,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	stored, created, err := s.Repo.CreateUsageRecord(ctx, rec)
+	if err != nil {
+		return nil, false, err
+	}
+	if !created && (stored.Quantity != quantity || (timestamp != nil && !stored.Timestamp.Equal(at.Truncate(time.Microsecond)))) {
+		return nil, false, ErrIdempotencyKeyReused
+	}
+	return stored, created, nil
+}
+
+// checkMetered rejects usage for a subscription whose price is not metered, which Stripe would
+// refuse when the usage is flushed.
+func (s *UsageService) checkMetered(ctx context.Context, sub *models.Subscription) error {
+	if sub.StripePriceID == "" {
+		return fmt.Errorf("%w: subscription has no price", ErrInvalidUsage)
+	}
+	price, err := s.Products.GetPrice(ctx, sub.StripePriceID)
+	if err != nil {
+		return fmt.Errorf("failed to load price %s: %w", sub.StripePriceID, err)
+	}
+	if price.Recurring == nil || price.Recurring.UsageType != stripe.PriceRecurringUsageTypeMetered {
+		return fmt.Errorf("%w: price %s of the subscription is not metered", ErrInvalidUsage, sub.StripePriceID)
+	}
+	return nil
+}
+
+// GetUsageSummary totals the usage recorded for the current billing period of a subscription.
+func (s *UsageService) GetUsageSummary(ctx context.Context, subscriptionID string) (*models.UsageSummary, error) {
+	sub, err := s.Subscriptions.FindSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := s.Repo.SummarizeUsage(ctx, sub.ID.String(), sub.CurrentPeriodStart, sub.CurrentPeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+	summary.SubscriptionID, summary.PeriodStart, summary.PeriodEnd = sub.ID, sub.CurrentPeriodStart, sub.CurrentPeriodEnd
+	return summary, nil
+}
+
+// FlushUsage reports the due usage records to Stripe and returns how many were reported. Records
+// Stripe rejects are marked failed; other errors are retried with an exponential backoff.
+func (s *UsageService) FlushUsage(ctx context.Context) (int, error) {
+	now := s.Now()
+	records, err := s.Repo.ListDueUsageRecords(ctx, now, usageBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	items := map[uuid.UUID]meteredItem{}
+	reported := 0
+	var firstErr error
+	for _, rec := range records {
+		item, ok := items[rec.SubscriptionID]
+		if !ok {
+			item = s.meteredItem(ctx, rec.SubscriptionID)
+			items[rec.SubscriptionID] = item
+			if item.err != nil && !item.permanent {
+				log.Printf("[FlushUsage] ERROR finding the metered item of subscription %s: %v", rec.SubscriptionID, item.err)
+				if firstErr == nil {
+					firstErr = item.err
+				}
+			}
+		}
+		if item.err != nil && !item.permanent {
+			// The records stay due and are tried again by the next flush.
+			continue
+		}
+		ok, err := s.report(ctx, rec, item, now)
+		if err != nil {
+			log.Printf("[FlushUsage] ERROR reporting usage record %s: %v", rec.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if ok {
+			reported++
+		}
+	}
+	return reported, firstErr
+}
+
+// meteredItem is the subscription item usage of a subscription is reported to. err is set when
+// it could not be determined; permanent tells whether retrying can help.
+type meteredItem struct {
+	id        string
+	err       error
+	permanent bool
+}
+
+func (s *UsageService) meteredItem(ctx context.Context, subscriptionID uuid.UUID) meteredItem {
+	sub, err := s.Subscriptions.GetSubscriptionByID(ctx, subscriptionID.String())
+	if err != nil {
+		return meteredItem{err: fmt.Errorf("failed to load subscription: %w", err)}
+	}
+	stripeSub, err := s.Gateway.GetSubscription(ctx, sub.StripeSubscriptionID)
+	if err != nil {
+		return meteredItem{err: err, permanent: permanentStripeError(err)}
+	}
+	var found []string
+	if stripeSub.Items != nil {
+		for _, item := range stripeSub.Items.Data {
+			if item.Price != nil && item.Price.Recurring != nil && item.Price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+				found = append(found, item.ID)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return meteredItem{err: fmt.Errorf("subscription %s has no metered price", sub.StripeSubscriptionID), permanent: true}
+	case 1:
+		return meteredItem{id: found[0]}
+	default:
+		return meteredItem{err: fmt.Errorf("subscription %s has %d metered prices", sub.StripeSubscriptionID, len(found)), permanent: true}
+	}
+}
+
+// report claims a record and sends it to Stripe, or marks it failed if item has a permanent error.
+// It reports false when the record was claimed by another flusher or could not be reported.
+func (s *UsageService) report(ctx context.Context, rec *models.UsageRecord, item meteredItem, now time.Time) (bool, error) {
+	claimed, err := s.Repo.ClaimUsageRecord(ctx, rec.ID, *rec.NextAttemptAt, now.Add(usageReportLease))
+	if err != nil || !claimed {
+		return false, err
+	}
+	rec.Attempts++
+
+	var usage *stripe.UsageRecord
+	err = item.err
+	if err == nil {
+		params := &stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String(item.id),
+			Quantity:         stripe.Int64(rec.Quantity),
+			Timestamp:        stripe.Int64(rec.Timestamp.Unix()),
+			Action:           stripe.String(stripe.UsageRecordActionIncrement),
+		}
+		// Derived from the record, so that Stripe recognizes a report that is sent again after a
+		// crash or a lost response and does not count it twice.
+		params.SetIdempotencyKey("usage-record-" + rec.ID.String())
+		usage, err = s.Gateway.CreateUsageRecord(ctx, params)
+		rec.StripeSubscriptionItemID = item.id
+	}
+
+	rec.UpdatedAt = s.Now()
+	switch {
+	case err == nil:
+		rec.Status, rec.NextAttemptAt, rec.LastError = models.UsageRecordStatusReported, nil, ""
+		rec.StripeUsageRecordID, rec.ReportedAt = usage.ID, &rec.UpdatedAt
+	case item.permanent || permanentStripeError(err):
+		rec.Status, rec.NextAttemptAt, rec.LastError = models.UsageRecordStatusFailed, nil, err.Error()
+	default:
+		retryAt := now.Add(usageBackoff(rec.Attempts))
+		rec.NextAttemptAt, rec.LastError = &retryAt, err.Error()
+	}
+	if updateErr := s.Repo.UpdateUsageRecord(ctx, rec); updateErr != nil {
+		// The claim expires and the record is reported again, under the same idempotency key.
+		return false, updateErr
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// usageBackoff returns the delay before attempt n+1: one minute, doubled per attempt, capped at usageMaxBackoff.
+func usageBackoff(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < usageMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, usageMaxBackoff)
+}
+
+// permanentStripeError reports whether Stripe rejected a request in a way retrying cannot fix.
+// Rate limits and idempotency conflicts of concurrent requests are worth retrying.
+func permanentStripeError(err error) bool {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		return false
+	}
+	code := stripeErr.HTTPStatusCode
+	return code >= 400 && code < 500 && code != http.StatusTooManyRequests && code != http.StatusConflict
+}
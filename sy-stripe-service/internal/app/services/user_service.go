@@ -29,6 +29,11 @@ func (s *UserService) GetAllUsers(ctx context.Context) ([]*models.User, error) {
 	return repo.GetAllUsers(ctx)
 }
 
+// ListUsers returns one page of users matching params.
+func (s *UserService) ListUsers(ctx context.Context, params database.UserListParams) (*database.UserPage, error) {
+	return s.Repo.ListUsers(ctx, params)
+}
+
 func NewUserService(repo database.UserRepository) *UserService {
 	return &UserService{Repo: repo}
 }
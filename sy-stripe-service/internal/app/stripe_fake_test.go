@@ -0,0 +1,352 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"sy-stripe-service/internal/app/services"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// fakeStripe is a minimal stand-in for the Stripe API. It serves the endpoints used by the
+// service from an InMemoryBillingGateway, so the real stripe-go client and its JSON decoding
+// are exercised end to end.
+type fakeStripe struct {
+	*services.InMemoryBillingGateway
+	server *httptest.Server
+
+	mu    sync.Mutex
+	calls map[string]int
+	// failures makes the next requests to a route fail with a server error.
+	failures map[string]int
+	// holds makes the next request to a route wait until the test releases it.
+	holds map[string]*fakeHold
+}
+
+type fakeHold struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+// newFakeStripe starts the fake API and points the global stripe-go API backend at it
+// for the duration of the test.
+func newFakeStripe(t *testing.T) *fakeStripe {
+	t.Helper()
+	f := &fakeStripe{InMemoryBillingGateway: services.NewInMemoryBillingGateway(), calls: map[string]int{}, failures: map[string]int{}, holds: map[string]*fakeHold{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+
+	backend := stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:           stripe.String(f.server.URL),
+		LeveledLogger: &stripe.LeveledLogger{Level: stripe.LevelNull},
+	})
+	stripe.SetBackend(stripe.APIBackend, backend)
+	t.Cleanup(func() { stripe.SetBackend(stripe.APIBackend, nil) })
+	return f
+}
+
+func (f *fakeStripe) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeStripeError(w, &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Type: stripe.ErrorTypeInvalidRequest, Msg: err.Error()})
+		return
+	}
+	ctx := r.Context()
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+	route := r.Method + " " + parts[0]
+	id := ""
+	if len(parts) > 1 {
+		id = parts[len(parts)-1]
+		route += "/:id"
+	}
+	if parts[0] == "checkout" || parts[0] == "billing_portal" {
+		route = r.Method + " " + parts[0] + "/sessions"
+		if len(parts) > 2 {
+			route += "/:id"
+		}
+	}
+	if (parts[0] == "payment_methods" || parts[0] == "subscription_items") && len(parts) == 3 {
+		id, route = parts[1], r.Method+" "+parts[0]+"/:id/"+parts[2]
+	}
+	f.mu.Lock()
+	f.calls[route]++
+	fail := f.failures[route] > 0
+	if fail {
+		f.failures[route]--
+	}
+	hold := f.holds[route]
+	delete(f.holds, route)
+	f.mu.Unlock()
+	if hold != nil {
+		close(hold.entered)
+		<-hold.release
+	}
+	if fail {
+		writeStripeError(w, &stripe.Error{HTTPStatusCode: http.StatusInternalServerError, Type: stripe.ErrorTypeAPI, Msg: "injected failure"})
+		return
+	}
+
+	var (
+		v   interface{}
+		err error
+	)
+	switch route {
+	case "POST customers":
+		v, err = f.CreateCustomer(ctx, &stripe.CustomerParams{
+			Email: formString(r, "email"),
+			Name:  formString(r, "name"),
+		})
+	case "GET customers/:id":
+		v, err = f.GetCustomer(ctx, id)
+	case "POST customers/:id":
+		params := &stripe.CustomerParams{
+			Email: formString(r, "email"),
+			Name:  formString(r, "name"),
+		}
+		if pm := formString(r, "invoice_settings[default_payment_method]"); pm != nil {
+			params.InvoiceSettings = &stripe.CustomerInvoiceSettingsParams{DefaultPaymentMethod: pm}
+		}
+		v, err = f.UpdateCustomer(ctx, id, params)
+	case "DELETE customers/:id":
+		v, err = f.DeleteCustomer(ctx, id)
+	case "GET products":
+		params := &stripe.ProductListParams{}
+		params.Active = formBool(r, "active")
+		v, err = listOf(f.ListProducts(ctx, params))
+	case "GET prices":
+		params := &stripe.PriceListParams{Product: formString(r, "product")}
+		params.Active = formBool(r, "active")
+		v, err = listOf(f.ListPrices(ctx, params))
+	case "GET prices/:id":
+		v, err = f.GetPrice(ctx, id)
+	case "POST subscriptions":
+		params := &stripe.SubscriptionParams{
+			Customer: formString(r, "customer"),
+			Items:    formItems(r, "items"),
+		}
+		if days, err := strconv.ParseInt(r.Form.Get("trial_period_days"), 10, 64); err == nil {
+			params.TrialPeriodDays = stripe.Int64(days)
+		}
+		v, err = f.CreateSubscription(ctx, params)
+	case "GET subscriptions":
+		var subs []*stripe.Subscription
+		subs, err = f.ListSubscriptions(ctx, &stripe.SubscriptionListParams{
+			Customer: r.Form.Get("customer"),
+			Status:   r.Form.Get("status"),
+		})
+		v = pageOf(r, subs, func(s *stripe.Subscription) string { return s.ID })
+	case "GET subscriptions/:id":
+		v, err = f.GetSubscription(ctx, id)
+	case "POST subscriptions/:id":
+		v, err = f.UpdateSubscription(ctx, id, &stripe.SubscriptionParams{
+			Items:                formItems(r, "items"),
+			CancelAtPeriodEnd:    formBool(r, "cancel_at_period_end"),
+			ProrationBehavior:    formString(r, "proration_behavior"),
+			DefaultPaymentMethod: formString(r, "default_payment_method"),
+		})
+	case "DELETE subscriptions/:id":
+		v, err = f.CancelSubscription(ctx, id)
+	case "POST subscription_items/:id/usage_records":
+		params := &stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String(id),
+			Action:           formString(r, "action"),
+		}
+		if q, err := strconv.ParseInt(r.Form.Get("quantity"), 10, 64); err == nil {
+			params.Quantity = stripe.Int64(q)
+		}
+		if ts, err := strconv.ParseInt(r.Form.Get("timestamp"), 10, 64); err == nil {
+			params.Timestamp = stripe.Int64(ts)
+		}
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			params.SetIdempotencyKey(key)
+		}
+		v, err = f.CreateUsageRecord(ctx, params)
+	case "GET invoices":
+		var invoices []*stripe.Invoice
+		invoices, err = f.ListInvoices(ctx, &stripe.InvoiceListParams{Customer: formString(r, "customer")})
+		v = pageOf(r, invoices, func(inv *stripe.Invoice) string { return inv.ID })
+	case "GET invoices/:id":
+		if id != "upcoming" {
+			err = &stripe.Error{HTTPStatusCode: http.StatusNotFound, Type: stripe.ErrorTypeInvalidRequest, Msg: "unrecognized request URL " + r.Method + " " + r.URL.Path}
+			break
+		}
+		v, err = f.GetUpcomingInvoice(ctx, &stripe.InvoiceParams{Subscription: formString(r, "subscription")})
+	case "POST checkout/sessions":
+		params := &stripe.CheckoutSessionParams{
+			Mode:       formString(r, "mode"),
+			SuccessURL: formString(r, "success_url"),
+			CancelURL:  formString(r, "cancel_url"),
+			Customer:   formString(r, "customer"),
+		}
+		params.Metadata = formMap(r, "metadata")
+		params.AllowPromotionCodes = formBool(r, "allow_promotion_codes")
+		if pc := formString(r, "discounts[0][promotion_code]"); pc != nil {
+			params.Discounts = []*stripe.CheckoutSessionDiscountParams{{PromotionCode: pc}}
+		}
+		if days, err := strconv.ParseInt(r.Form.Get("subscription_data[trial_period_days]"), 10, 64); err == nil {
+			params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{TrialPeriodDays: stripe.Int64(days)}
+		}
+		for _, item := range formItems(r, "line_items") {
+			params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{Price: item.Price, Quantity: item.Quantity})
+		}
+		v, err = f.CreateCheckoutSession(ctx, params)
+	case "GET checkout/sessions/:id":
+		v, err = f.GetCheckoutSession(ctx, id)
+	case "GET promotion_codes":
+		params := &stripe.PromotionCodeListParams{
+			Code:     formString(r, "code"),
+			Active:   formBool(r, "active"),
+			Customer: formString(r, "customer"),
+		}
+		v, err = listOf(f.ListPromotionCodes(ctx, params))
+	case "POST billing_portal/sessions":
+		v, err = f.CreateBillingPortalSession(ctx, &stripe.BillingPortalSessionParams{
+			Customer:  formString(r, "customer"),
+			ReturnURL: formString(r, "return_url"),
+		})
+	case "POST setup_intents":
+		params := &stripe.SetupIntentParams{
+			Customer: formString(r, "customer"),
+			Usage:    formString(r, "usage"),
+		}
+		if t := formString(r, "payment_method_types[0]"); t != nil {
+			params.PaymentMethodTypes = []*string{t}
+		}
+		v, err = f.CreateSetupIntent(ctx, params)
+	case "GET payment_methods":
+		v, err = listOf(f.ListPaymentMethods(ctx, &stripe.PaymentMethodListParams{
+			Customer: formString(r, "customer"),
+			Type:     formString(r, "type"),
+		}))
+	case "GET payment_methods/:id":
+		v, err = f.GetPaymentMethod(ctx, id)
+	case "POST payment_methods/:id/detach":
+		v, err = f.DetachPaymentMethod(ctx, id)
+	default:
+		err = &stripe.Error{HTTPStatusCode: http.StatusNotFound, Type: stripe.ErrorTypeInvalidRequest, Msg: "unrecognized request URL " + r.Method + " " + r.URL.Path}
+	}
+	if err != nil {
+		writeStripeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// callCount returns how often a route such as "GET products" was requested.
+func (f *fakeStripe) callCount(route string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[route]
+}
+
+// failNext makes the next n requests to a route such as "GET products" fail with a server error.
+func (f *fakeStripe) failNext(route string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[route] = n
+}
+
+// holdNext makes the next request to a route wait until release is called; entered is
+// closed once that request arrives.
+func (f *fakeStripe) holdNext(route string) (entered <-chan struct{}, release func()) {
+	h := &fakeHold{entered: make(chan struct{}), release: make(chan struct{})}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.holds[route] = h
+	return h.entered, func() { close(h.release) }
+}
+
+func writeStripeError(w http.ResponseWriter, err error) {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		stripeErr = &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Type: stripe.ErrorTypeInvalidRequest, Msg: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(stripeErr.HTTPStatusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": stripeErr})
+}
+
+// listOf wraps a slice in Stripe's list envelope.
+func listOf[T any](data []T, err error) (interface{}, error) {
+	if data == nil {
+		data = []T{}
+	}
+	return map[string]interface{}{"object": "list", "data": data, "has_more": false}, err
+}
+
+// pageOf returns one page of data like Stripe's list endpoints: up to limit (default 10) items
+// after the item whose ID is starting_after.
+func pageOf[T any](r *http.Request, data []T, id func(T) string) interface{} {
+	if after := r.Form.Get("starting_after"); after != "" {
+		for i, item := range data {
+			if id(item) == after {
+				data = data[i+1:]
+				break
+			}
+		}
+	}
+	limit := 10
+	if l, err := strconv.Atoi(r.Form.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	hasMore := len(data) > limit
+	if hasMore {
+		data = data[:limit]
+	}
+	if data == nil {
+		data = []T{}
+	}
+	return map[string]interface{}{"object": "list", "data": data, "has_more": hasMore}
+}
+
+func formString(r *http.Request, key string) *string {
+	if _, ok := r.Form[key]; !ok {
+		return nil
+	}
+	return stripe.String(r.Form.Get(key))
+}
+
+func formBool(r *http.Request, key string) *bool {
+	if _, ok := r.Form[key]; !ok {
+		return nil
+	}
+	return stripe.Bool(r.Form.Get(key) == "true")
+}
+
+// formMap decodes a form-encoded hash such as metadata[user_id]=... .
+func formMap(r *http.Request, key string) map[string]string {
+	m := map[string]string{}
+	for k := range r.Form {
+		if strings.HasPrefix(k, key+"[") && strings.HasSuffix(k, "]") {
+			m[strings.TrimSuffix(strings.TrimPrefix(k, key+"["), "]")] = r.Form.Get(k)
+		}
+	}
+	return m
+}
+
+// formItems decodes a form-encoded array of items such as items[0][price]=... .
+func formItems(r *http.Request, key string) []*stripe.SubscriptionItemsParams {
+	var items []*stripe.SubscriptionItemsParams
+	for i := 0; ; i++ {
+		prefix := key + "[" + strconv.Itoa(i) + "]"
+		item := &stripe.SubscriptionItemsParams{
+			ID:    formString(r, prefix+"[id]"),
+			Price: formString(r, prefix+"[price]"),
+		}
+		if q := r.Form.Get(prefix + "[quantity]"); q != "" {
+			n, _ := strconv.ParseInt(q, 10, 64)
+			item.Quantity = stripe.Int64(n)
+		}
+		if item.ID == nil && item.Price == nil {
+			return items
+		}
+		items = append(items, item)
+	}
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Worker runs a background job every Interval until its context is canceled.
+type Worker struct {
+	Name     string
+	Interval time.Duration
+	Job      func(ctx context.Context) error
+}
+
+// Run calls Job on every tick; errors are logged and the job runs again on the next tick.
+func (w Worker) Run(ctx context.Context) {
+	log.Printf("[Worker] %s runs every %s", w.Name, w.Interval)
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Job(ctx); err != nil {
+				log.Printf("[Worker] ERROR in %s: %v", w.Name, err)
+			}
+		}
+	}
+}
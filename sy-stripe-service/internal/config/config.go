@@ -2,11 +2,24 @@ package config
 
 import (
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"sy-stripe-service/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 )
 
+// DefaultDunningSteps notifies on the first failure and after three days, restricts access after
+// a week and cancels the subscription after two weeks.
+const DefaultDunningSteps = "notify:0s,notify:72h,restrict:168h,cancel:336h"
+
 // Config holds the application configuration
 type Config struct {
 	ServerPort         string
@@ -15,14 +28,64 @@ type Config struct {
 	StripeWebhookSecret string
 	AppSuccessURL      string
 	AppCancelURL       string
+	// AppPortalReturnURL is where the Stripe billing portal sends customers back to. When empty,
+	// the default return URL of the portal configuration in Stripe is used.
+	AppPortalReturnURL string
+
+	// AuthDisabled turns authentication off; every request acts as an admin. For local development only.
+	AuthDisabled          bool
+	// AuthAdminAPIKeys are static keys granting admin access.
+	AuthAdminAPIKeys      []string
+	// AuthJWTHS256Secret verifies HS256-signed JWTs.
+	AuthJWTHS256Secret    string
+	// AuthJWTRS256PublicKey is the PEM-encoded RSA public key verifying RS256-signed JWTs.
+	AuthJWTRS256PublicKey string
+	// AuthJWTIssuer and AuthJWTAudience, when set, must match the iss and aud claims.
+	AuthJWTIssuer         string
+	AuthJWTAudience       string
+
+	// CORS policy for browser clients. Origins may be exact, "*" or wildcard subdomains ("https://*.example.com").
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           time.Duration
+
+	// DunningSteps run after a renewal payment failed, in order, until an invoice is paid.
+	DunningSteps    []models.DunningStep
+	// DunningInterval is how often the dunning worker looks for due steps; zero disables it.
+	DunningInterval time.Duration
+
+	// UsageFlushInterval is how often buffered usage records are reported to Stripe; zero disables the flusher.
+	UsageFlushInterval time.Duration
+
+	// TrialReminderLead is how long before the end of a free trial the customer is reminded.
+	TrialReminderLead time.Duration
+	// TrialReminderInterval is how often the trial reminder worker looks for ending trials; zero disables it.
+	TrialReminderInterval time.Duration
+
+	// ProductCacheTTL is how long the product catalog is served without asking Stripe; zero disables the cache.
+	ProductCacheTTL      time.Duration
+	// ProductCacheStaleTTL is how long an expired catalog is still served while it is refreshed in the background.
+	ProductCacheStaleTTL time.Duration
+}
+
+var dotEnvOnce sync.Once
+
+// loadDotEnv loads the .env file into the environment if it exists. It runs once per process,
+// so the loaders can share it without repeating the notice.
+func loadDotEnv() {
+	dotEnvOnce.Do(func() {
+		if err := godotenv.Load(); err != nil {
+			log.Println("No .env file found, loading from environment variables.")
+		}
+	})
 }
 
 // LoadConfig loads configuration from environment variables or .env file
 func LoadConfig() (*Config, error) {
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		fmt.Println("No .env file found, loading from environment variables.")
-	}
+	loadDotEnv()
 
 	cfg := &Config{
 		ServerPort:           getEnv("SERVER_PORT", "8080"),
@@ -31,6 +94,51 @@ func LoadConfig() (*Config, error) {
 		StripeWebhookSecret:  os.Getenv("STRIPE_WEBHOOK_SECRET"),
 		AppSuccessURL:        os.Getenv("APP_SUCCESS_URL"),
 		AppCancelURL:         os.Getenv("APP_CANCEL_URL"),
+		AppPortalReturnURL:   os.Getenv("APP_PORTAL_RETURN_URL"),
+		AuthDisabled:          os.Getenv("AUTH_DISABLED") == "true",
+		AuthAdminAPIKeys:      splitList(os.Getenv("AUTH_ADMIN_API_KEYS")),
+		AuthJWTHS256Secret:    os.Getenv("AUTH_JWT_HS256_SECRET"),
+		AuthJWTRS256PublicKey: os.Getenv("AUTH_JWT_RS256_PUBLIC_KEY"),
+		AuthJWTIssuer:         os.Getenv("AUTH_JWT_ISSUER"),
+		AuthJWTAudience:       os.Getenv("AUTH_JWT_AUDIENCE"),
+		CORSAllowedOrigins:    splitList(getEnv("CORS_ALLOWED_ORIGINS", "http://localhost:3000")),
+		CORSAllowedMethods:    splitList(getEnv("CORS_ALLOWED_METHODS", "GET,POST,PUT,PATCH,DELETE,OPTIONS")),
+		CORSAllowedHeaders:    splitList(getEnv("CORS_ALLOWED_HEADERS", "Content-Type,Authorization,X-API-Key")),
+		CORSExposedHeaders:    splitList(os.Getenv("CORS_EXPOSED_HEADERS")),
+		CORSAllowCredentials:  getEnv("CORS_ALLOW_CREDENTIALS", "true") == "true",
+	}
+	maxAge, err := strconv.Atoi(getEnv("CORS_MAX_AGE", "600"))
+	if err != nil || maxAge < 0 {
+		return nil, fmt.Errorf("CORS_MAX_AGE must be a non-negative number of seconds")
+	}
+	cfg.CORSMaxAge = time.Duration(maxAge) * time.Second
+	if cfg.DunningSteps, err = ParseDunningSteps(getEnv("DUNNING_STEPS", DefaultDunningSteps)); err != nil {
+		return nil, fmt.Errorf("invalid DUNNING_STEPS: %w", err)
+	}
+	if cfg.DunningInterval, err = time.ParseDuration(getEnv("DUNNING_INTERVAL", "1m")); err != nil || cfg.DunningInterval < 0 {
+		return nil, fmt.Errorf("DUNNING_INTERVAL must be a non-negative duration such as 1m")
+	}
+	if cfg.UsageFlushInterval, err = time.ParseDuration(getEnv("USAGE_FLUSH_INTERVAL", "10s")); err != nil || cfg.UsageFlushInterval < 0 {
+		return nil, fmt.Errorf("USAGE_FLUSH_INTERVAL must be a non-negative duration such as 10s")
+	}
+	if cfg.TrialReminderLead, err = time.ParseDuration(getEnv("TRIAL_REMINDER_LEAD", "72h")); err != nil || cfg.TrialReminderLead < 0 {
+		return nil, fmt.Errorf("TRIAL_REMINDER_LEAD must be a non-negative duration such as 72h")
+	}
+	if cfg.TrialReminderInterval, err = time.ParseDuration(getEnv("TRIAL_REMINDER_INTERVAL", "1h")); err != nil || cfg.TrialReminderInterval < 0 {
+		return nil, fmt.Errorf("TRIAL_REMINDER_INTERVAL must be a non-negative duration such as 1h")
+	}
+	if cfg.ProductCacheTTL, err = time.ParseDuration(getEnv("PRODUCT_CACHE_TTL", "5m")); err != nil || cfg.ProductCacheTTL < 0 {
+		return nil, fmt.Errorf("PRODUCT_CACHE_TTL must be a non-negative duration such as 5m")
+	}
+	if cfg.ProductCacheStaleTTL, err = time.ParseDuration(getEnv("PRODUCT_CACHE_STALE_TTL", "1h")); err != nil || cfg.ProductCacheStaleTTL < 0 {
+		return nil, fmt.Errorf("PRODUCT_CACHE_STALE_TTL must be a non-negative duration such as 1h")
+	}
+	if path := os.Getenv("AUTH_JWT_RS256_PUBLIC_KEY_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AUTH_JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+		}
+		cfg.AuthJWTRS256PublicKey = string(pem)
 	}
 
 	// Basic validation
@@ -43,10 +151,37 @@ func LoadConfig() (*Config, error) {
 	if cfg.StripeWebhookSecret == "" {
 		return nil, fmt.Errorf("STRIPE_WEBHOOK_SECRET not set in environment")
 	}
+	for _, origin := range cfg.CORSAllowedOrigins {
+		if err := validateCORSOrigin(origin); err != nil {
+			return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS entry %q: %w", origin, err)
+		}
+		if origin == "*" && cfg.CORSAllowCredentials {
+			return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS=* cannot be combined with CORS_ALLOW_CREDENTIALS=true; list the origins explicitly")
+		}
+	}
+	if cfg.AuthJWTRS256PublicKey != "" {
+		if _, err := jwt.ParseRSAPublicKeyFromPEM([]byte(cfg.AuthJWTRS256PublicKey)); err != nil {
+			return nil, fmt.Errorf("invalid RS256 public key: %w", err)
+		}
+	}
+	if !cfg.AuthDisabled && len(cfg.AuthAdminAPIKeys) == 0 && cfg.AuthJWTHS256Secret == "" && cfg.AuthJWTRS256PublicKey == "" {
+		return nil, fmt.Errorf("no authentication configured: set AUTH_ADMIN_API_KEYS, AUTH_JWT_HS256_SECRET or AUTH_JWT_RS256_PUBLIC_KEY(_FILE), or AUTH_DISABLED=true for local development")
+	}
 
 	return cfg, nil
 }
 
+// LoadDatabaseConfig loads only the settings needed to reach the database,
+// for tooling such as the migrate command that does not talk to Stripe.
+func LoadDatabaseConfig() (*Config, error) {
+	loadDotEnv()
+	cfg := &Config{DatabaseURL: os.Getenv("DATABASE_URL")}
+	if cfg.DatabaseURL == "" {
+		return nil, fmt.Errorf("DATABASE_URL not set in environment")
+	}
+	return cfg, nil
+}
+
 // getEnv retrieves an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -54,3 +189,70 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// splitList parses a comma-separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateCORSOrigin checks that an allowed origin is "*" or scheme://host[:port],
+// where the host may start with "*." to allow all subdomains.
+func validateCORSOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("must be scheme://host[:port] without path")
+	}
+	if strings.Contains(strings.Replace(origin, "://*.", "", 1), "*") {
+		return fmt.Errorf("wildcards are only allowed as the first host label")
+	}
+	return nil
+}
+
+// ParseDunningSteps parses a comma-separated list of action:delay steps such as
+// "notify:0s,restrict:168h,cancel:336h". Delays count from the first failed payment and must not
+// decrease, and cancel can only be the last step.
+func ParseDunningSteps(value string) ([]models.DunningStep, error) {
+	var steps []models.DunningStep
+	for _, item := range splitList(value) {
+		action, after, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("step %q must be action:delay", item)
+		}
+		step := models.DunningStep{Action: models.DunningAction(strings.TrimSpace(action))}
+		switch step.Action {
+		case models.DunningActionNotify, models.DunningActionRestrict, models.DunningActionCancel:
+		default:
+			return nil, fmt.Errorf("step %q: action must be notify, restrict or cancel", item)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(after))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("step %q: delay must be a non-negative duration", item)
+		}
+		step.After = d
+		if n := len(steps); n > 0 {
+			if steps[n-1].Action == models.DunningActionCancel {
+				return nil, fmt.Errorf("step %q follows cancel", item)
+			}
+			if d < steps[n-1].After {
+				return nil, fmt.Errorf("step %q runs before the previous step", item)
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
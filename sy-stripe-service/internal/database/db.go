@@ -4,14 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io/fs"
 	"log"
-	"os"
-	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 )
 
@@ -19,15 +18,20 @@ import (
 type DB struct {
 	Postgres *pgxpool.Pool
 	SQLite   *sql.DB
+
+	// pgSQL exposes the Postgres pool through database/sql for the migrator.
+	pgSQL *sql.DB
 }
 
 // NewDB creates a new database connection based on the provided configuration.
+// postgres:// and postgresql:// URLs select PostgreSQL (through pgx); file: URLs and
+// :memory: select SQLite.
 func NewDB(databaseURL string) (*DB, error) {
 	if databaseURL == "" {
 		return nil, fmt.Errorf("database URL cannot be empty")
 	}
 
-	if strings.HasPrefix(databaseURL, "postgres") {
+	if strings.HasPrefix(databaseURL, "postgres://") || strings.HasPrefix(databaseURL, "postgresql://") {
 		// PostgreSQL connection
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -50,13 +54,20 @@ func NewDB(databaseURL string) (*DB, error) {
 		}
 
 		log.Println("Successfully connected to PostgreSQL database!")
-		return &DB{Postgres: pool}, nil
+		return &DB{Postgres: pool, pgSQL: stdlib.OpenDBFromPool(pool)}, nil
 	} else if strings.HasPrefix(databaseURL, "file:") || strings.HasPrefix(databaseURL, ":memory:") {
 		// SQLite connection
 		db, err := sql.Open("sqlite3", databaseURL)
 		if err != nil {
 			return nil, fmt.Errorf("unable to open SQLite database: %w", err)
 		}
+		if isPrivateSQLiteMemory(databaseURL) {
+			// Every connection to a private in-memory database gets its own empty
+			// database, so the migrated schema would vanish with the first connection.
+			db.SetMaxOpenConns(1)
+			db.SetConnMaxLifetime(0)
+			db.SetConnMaxIdleTime(0)
+		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -74,9 +85,50 @@ func NewDB(databaseURL string) (*DB, error) {
 	return nil, fmt.Errorf("unsupported database URL scheme: %s", databaseURL)
 }
 
+// isPrivateSQLiteMemory reports whether a SQLite URL names an in-memory database
+// that is not shared between connections.
+func isPrivateSQLiteMemory(databaseURL string) bool {
+	path, query, _ := strings.Cut(strings.TrimPrefix(databaseURL, "file:"), "?")
+	memory := path == ":memory:" || strings.Contains("&"+query+"&", "&mode=memory&")
+	return memory && !strings.Contains("&"+query+"&", "&cache=shared&")
+}
+
+// Dialect returns the SQL dialect of the connection. A DB without a connection reports an empty dialect.
+func (db *DB) Dialect() Dialect {
+	switch {
+	case db.Postgres != nil:
+		return DialectPostgres
+	case db.SQLite != nil:
+		return DialectSQLite
+	}
+	return ""
+}
+
+// SQL returns a database/sql handle on the same connections the repositories use.
+func (db *DB) SQL() *sql.DB {
+	if db.Postgres != nil {
+		if db.pgSQL == nil {
+			db.pgSQL = stdlib.OpenDBFromPool(db.Postgres)
+		}
+		return db.pgSQL
+	}
+	return db.SQLite
+}
+
+// Migrator returns a migrator for the connection that loads its migrations from fsys.
+func (db *DB) Migrator(fsys fs.FS) (*Migrator, error) {
+	if db.Dialect() == "" {
+		return nil, fmt.Errorf("no database connection available")
+	}
+	return NewMigrator(db.SQL(), db.Dialect(), fsys)
+}
+
 // Close closes the database connection.
 func (db *DB) Close() {
 	if db.Postgres != nil {
+		if db.pgSQL != nil {
+			db.pgSQL.Close()
+		}
 		db.Postgres.Close()
 		log.Println("PostgreSQL database connection pool closed.")
 	} else if db.SQLite != nil {
@@ -104,103 +156,3 @@ func (db *DB) GetSQLDB() *sql.DB {
 func (db *DB) GetPgxPool() *pgxpool.Pool {
 	return db.Postgres
 }
-
-// ApplyMigrations applies SQL migrations from a directory to the connected database (SQLite or Postgres).
-func ApplyMigrations(db *sql.DB, migrationsDir string) error {
-	if db == nil {
-		return fmt.Errorf("database connection is nil")
-	}
-
-	driverName := "unknown"
-	if db != nil {
-		// Try to detect driver from db object
-		// Unfortunately, sql.DB does not expose the driver name directly
-		// so we rely on the DSN sniffing via the connection string
-		// or fallback to running a version query
-		// This is a best-effort approach
-		// If you ever pass a custom driver, update this logic accordingly
-		// For now, default to Postgres if it can execute 'SELECT version()'
-		row := db.QueryRow("SELECT version()")
-		var version string
-		if err := row.Scan(&version); err == nil && strings.Contains(strings.ToLower(version), "postgres") {
-			driverName = "postgres"
-		} else {
-			// Try SQLite version
-			row := db.QueryRow("SELECT sqlite_version()")
-			var sqliteVersion string
-			if err := row.Scan(&sqliteVersion); err == nil {
-				driverName = "sqlite3"
-			}
-		}
-	}
-	log.Printf("ApplyMigrations detected driver: %s", driverName)
-
-	var pattern string
-	switch driverName {
-	case "sqlite3":
-		pattern = "*.sqlite.sql"
-	case "postgres":
-		pattern = "*.postgres.sql"
-	default:
-		pattern = "*.sql"
-	}
-
-	files, err := filepath.Glob(filepath.Join(migrationsDir, pattern))
-	if err != nil {
-		log.Printf("Migration file glob error: %v", err)
-		return fmt.Errorf("failed to read migration files: %w", err)
-	}
-
-	// Fallback: If no driver-specific files, try generic *.sql, but NEVER run the other DB's files
-	if len(files) == 0 {
-		log.Printf("No %s files found, falling back to *.sql", pattern)
-		files, err = filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
-		if err != nil {
-			log.Printf("Migration file glob error: %v", err)
-			return fmt.Errorf("failed to read migration files: %w", err)
-		}
-	}
-
-	// Filter out any *.postgres.sql or *.sqlite.sql files from the fallback list
-	if driverName == "sqlite3" {
-		var filtered []string
-		for _, f := range files {
-			if !strings.HasSuffix(f, ".postgres.sql") {
-				filtered = append(filtered, f)
-			}
-		}
-		files = filtered
-	} else if driverName == "postgres" {
-		var filtered []string
-		for _, f := range files {
-			if !strings.HasSuffix(f, ".sqlite.sql") {
-				filtered = append(filtered, f)
-			}
-		}
-		files = filtered
-	}
-
-	sort.Strings(files)
-
-	if len(files) == 0 {
-		log.Printf("No migration files found for driver: %s", driverName)
-		return nil
-	}
-
-	for _, file := range files {
-		log.Printf("Applying migration: %s", file)
-		content, err := os.ReadFile(file)
-		if err != nil {
-			log.Printf("Migration read error: %v", err)
-			return fmt.Errorf("failed to read migration file %s: %w", file, err)
-		}
-		_, err = db.Exec(string(content))
-		if err != nil {
-			log.Printf("Migration exec error: %v", err)
-			return fmt.Errorf("failed to execute migration %s: %w", file, err)
-		}
-	}
-
-	log.Println("All migrations applied successfully")
-	return nil
-}
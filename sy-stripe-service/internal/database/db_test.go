@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"sy-stripe-service/migrations"
+)
+
+func TestNewDBSQLiteURLs(t *testing.T) {
+	for _, url := range []string{
+		":memory:",
+		"file::memory:",
+		"file:private?mode=memory",
+		"file:shared?mode=memory&cache=shared",
+		"file:" + t.TempDir() + "/service.db",
+	} {
+		t.Run(url, func(t *testing.T) {
+			db, err := NewDB(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if db.Dialect() != DialectSQLite {
+				t.Fatalf("Dialect() = %q", db.Dialect())
+			}
+			m, err := db.Migrator(migrations.FS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Up(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// The schema must be visible to the repositories, on whichever connection they get.
+			repo := NewSQLiteUserRepository(db.SQLite)
+			for i := 0; i < 3; i++ {
+				if _, err := repo.GetAllUsers(context.Background()); err != nil {
+					t.Fatalf("query after migrating: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewDBRejectsUnknownURLs(t *testing.T) {
+	for _, url := range []string{"", "mysql://localhost/db", "postgresfoo"} {
+		if _, err := NewDB(url); err == nil {
+			t.Errorf("NewDB(%q) succeeded", url)
+		}
+	}
+}
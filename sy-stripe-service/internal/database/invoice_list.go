@@ -0,0 +1,122 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"sy-stripe-service/internal/models"
+)
+
+const (
+	DefaultInvoiceListLimit = 20
+	MaxInvoiceListLimit     = 100
+)
+
+// InvoiceListParams selects one page of a user's invoices, newest (by IssuedAt, then id) first.
+type InvoiceListParams struct {
+	// Limit is the page size; zero selects DefaultInvoiceListLimit.
+	Limit int
+	// After is the NextCursor of the previous page.
+	After string
+}
+
+// InvoicePage is one page of an invoice listing.
+type InvoicePage struct {
+	Invoices []*models.Invoice
+	// NextCursor continues the listing; it is empty on the last page.
+	NextCursor string
+	HasMore    bool
+}
+
+// invoiceCursor is the position after the last invoice of a page.
+type invoiceCursor struct {
+	IssuedAt time.Time `json:"t"`
+	ID       string    `json:"id"`
+}
+
+// invoiceColumns lists the invoice columns in the order the scan functions expect.
+const invoiceColumns = `id, user_id, stripe_invoice_id, stripe_subscription_id, number, status, currency, amount_due, amount_paid, hosted_invoice_url, invoice_pdf, period_start, period_end, issued_at, created_at, updated_at`
+
+// invoiceUpsertSet updates the Stripe-owned columns of an existing invoice, unless the stored
+// row is newer than the one being written.
+const invoiceUpsertSet = `ON CONFLICT (stripe_invoice_id) DO UPDATE SET stripe_subscription_id = excluded.stripe_subscription_id, number = excluded.number, status = excluded.status, currency = excluded.currency, amount_due = excluded.amount_due, amount_paid = excluded.amount_paid, hosted_invoice_url = excluded.hosted_invoice_url, invoice_pdf = excluded.invoice_pdf, period_start = excluded.period_start, period_end = excluded.period_end, issued_at = excluded.issued_at, updated_at = excluded.updated_at
+		WHERE invoices.updated_at <= excluded.updated_at`
+
+func (p *InvoiceListParams) normalize() error {
+	switch {
+	case p.Limit == 0:
+		p.Limit = DefaultInvoiceListLimit
+	case p.Limit < 0 || p.Limit > MaxInvoiceListLimit:
+		return fmt.Errorf("limit must be between 1 and %d", MaxInvoiceListLimit)
+	}
+	return nil
+}
+
+// cursor decodes After; it returns nil for the first page.
+func (p *InvoiceListParams) cursor() (*invoiceCursor, error) {
+	if p.After == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(p.After)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c invoiceCursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	c.IssuedAt = dbTime(c.IssuedAt)
+	return &c, nil
+}
+
+// page trims the extra row fetched to detect a next page and builds the cursor.
+func (p *InvoiceListParams) page(invoices []*models.Invoice) *InvoicePage {
+	page := &InvoicePage{Invoices: invoices}
+	if len(invoices) > p.Limit {
+		page.Invoices, page.HasMore = invoices[:p.Limit], true
+		last := page.Invoices[p.Limit-1]
+		raw, _ := json.Marshal(invoiceCursor{IssuedAt: dbTime(last.IssuedAt), ID: last.ID.String()})
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if page.Invoices == nil {
+		page.Invoices = []*models.Invoice{}
+	}
+	return page
+}
+
+// compareInvoices orders two invoices newest first, like the listing.
+func compareInvoices(a, b *models.Invoice) int {
+	if c := dbTime(b.IssuedAt).Compare(dbTime(a.IssuedAt)); c != 0 {
+		return c
+	}
+	return strings.Compare(b.ID.String(), a.ID.String())
+}
+
+// listInvoicesQuery builds the keyset query of an invoice listing for a SQL dialect.
+// It selects Limit+1 rows so that the caller can tell whether there is a next page.
+func listInvoicesQuery(dialect Dialect, userID string, p *InvoiceListParams, c *invoiceCursor) (string, []any) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		if dialect == DialectPostgres {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	}
+	timeArg := func(t time.Time) string {
+		if dialect == DialectSQLite {
+			return arg(sqliteTime(t))
+		}
+		return arg(dbTime(t))
+	}
+
+	query := `SELECT ` + invoiceColumns + ` FROM invoices WHERE user_id = ` + arg(userID)
+	if c != nil {
+		query += fmt.Sprintf(" AND (issued_at < %s OR (issued_at = %s AND id < %s))", timeArg(c.IssuedAt), timeArg(c.IssuedAt), arg(c.ID))
+	}
+	query += " ORDER BY issued_at DESC, id DESC LIMIT " + arg(p.Limit+1)
+	return query, args
+}
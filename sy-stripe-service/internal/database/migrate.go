@@ -0,0 +1,502 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect identifies the SQL flavor of a database.
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+// Migration is a versioned schema change with its optional rollback.
+//
+// Files are named NNN_name.sql (SQLite) and NNN_name.postgres.sql (Postgres);
+// the matching rollbacks are NNN_name.down.sql and NNN_name.down.postgres.sql.
+// A SQLite file starting with "-- migrate:foreign_keys=off" runs with foreign keys off.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus describes a known or applied migration.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+	// Modified is set when the file no longer matches the checksum recorded when it was applied.
+	Modified bool
+	// Missing is set when an applied version has no migration file.
+	Missing bool
+}
+
+// ErrMigrationChanged is returned when an applied migration file has been edited.
+var ErrMigrationChanged = errors.New("applied migration has been modified")
+
+// legacyBaselineVersion is the last migration applied by the previous, unversioned runner.
+// Databases created by it have the tables but no schema_migrations; the versions whose
+// changes are present are recorded as applied.
+const legacyBaselineVersion = 4
+
+// foreignKeysOffDirective starts a SQLite migration that rebuilds a table other tables reference.
+// SQLite ignores PRAGMA foreign_keys inside a transaction, so the migrator turns foreign keys off
+// on the connection before BEGIN; with them on, dropping the old table would cascade to the rows
+// referencing it.
+const foreignKeysOffDirective = "-- migrate:foreign_keys=off"
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(.+?)(\.down)?(\.postgres)?\.sql$`)
+
+// Migrator applies and rolls back versioned migrations, recording them in schema_migrations.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// NewMigrator loads the migrations for dialect from the root of migrations.
+func NewMigrator(db *sql.DB, dialect Dialect, migrations fs.FS) (*Migrator, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	loaded, err := loadMigrations(migrations, dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: loaded}, nil
+}
+
+// ApplyMigrations applies all pending migrations from migrations.
+func ApplyMigrations(db *sql.DB, dialect Dialect, migrations fs.FS) error {
+	m, err := NewMigrator(db, dialect, migrations)
+	if err != nil {
+		return err
+	}
+	_, err = m.Up(context.Background())
+	return err
+}
+
+// loadMigrations reads and pairs the up and down files of a dialect, ordered by version.
+func loadMigrations(fsys fs.FS, dialect Dialect) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		match := migrationFileRe.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		if (match[4] != "") != (dialect == DialectPostgres) {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file %s: %w", e.Name(), err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] != "" {
+			m.Down = string(content)
+		} else {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %03d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// placeholder returns the n-th (1-based) bind parameter of the dialect.
+func (m *Migrator) placeholder(n int) string {
+	if m.dialect == DialectPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// ensureTable creates schema_migrations and adopts databases set up by the previous runner.
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	exists, err := m.tableExists(ctx, "schema_migrations")
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	// Inspect the schema before the transaction takes the write lock.
+	var baseline []Migration
+	for _, mig := range m.migrations {
+		if mig.Version > legacyBaselineVersion {
+			break
+		}
+		present, err := m.legacyApplied(ctx, mig.Version)
+		if err != nil {
+			return err
+		}
+		if present {
+			baseline = append(baseline, mig)
+		}
+	}
+
+	ddl := `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at TEXT NOT NULL
+)`
+	if m.dialect == DialectPostgres {
+		ddl = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL
+)`
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, ddl); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	for _, mig := range baseline {
+		log.Printf("[Migrator] Recording pre-existing migration %03d_%s as applied", mig.Version, mig.Name)
+		if err := m.record(ctx, tx, mig); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// legacyApplied reports whether the unversioned runner already applied a baseline migration.
+func (m *Migrator) legacyApplied(ctx context.Context, version int) (bool, error) {
+	switch version {
+	case 1:
+		return m.tableExists(ctx, "users")
+	case 2:
+		return m.tableExists(ctx, "subscriptions")
+	case 3:
+		return m.tableExists(ctx, "stripe_events")
+	case 4:
+		return m.columnExists(ctx, "subscriptions", "canceled_at")
+	}
+	return false, nil
+}
+
+func (m *Migrator) columnExists(ctx context.Context, table, column string) (bool, error) {
+	query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+	if m.dialect == DialectPostgres {
+		query = `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`
+	}
+	var n int
+	if err := m.db.QueryRowContext(ctx, query, table, column).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (m *Migrator) tableExists(ctx context.Context, table string) (bool, error) {
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if m.dialect == DialectPostgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1`
+	}
+	var n int
+	if err := m.db.QueryRowContext(ctx, query, table).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (m *Migrator) record(ctx context.Context, tx *sql.Tx, mig Migration) error {
+	query := fmt.Sprintf(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (%s, %s, %s, %s)`,
+		m.placeholder(1), m.placeholder(2), m.placeholder(3), m.placeholder(4))
+	var appliedAt interface{} = time.Now().UTC()
+	if m.dialect == DialectSQLite {
+		appliedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, err := tx.ExecContext(ctx, query, mig.Version, mig.Name, mig.Checksum, appliedAt); err != nil {
+		return fmt.Errorf("failed to record migration %03d: %w", mig.Version, err)
+	}
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) ([]appliedMigration, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	var applied []appliedMigration
+	for rows.Next() {
+		var a appliedMigration
+		if m.dialect == DialectSQLite {
+			var appliedAt string
+			if err := rows.Scan(&a.version, &a.name, &a.checksum, &appliedAt); err != nil {
+				return nil, err
+			}
+			if a.appliedAt, err = parseAnyTime(appliedAt); err != nil {
+				return nil, fmt.Errorf("parse applied_at: %w", err)
+			}
+		} else if err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) find(version int) (Migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return mig, true
+		}
+	}
+	return Migration{}, false
+}
+
+// verify fails when an applied migration was changed or removed after it was applied.
+func (m *Migrator) verify(applied []appliedMigration) error {
+	for _, a := range applied {
+		mig, ok := m.find(a.version)
+		if !ok {
+			return fmt.Errorf("applied migration %03d_%s is missing from the migrations directory", a.version, a.name)
+		}
+		if mig.Checksum != a.checksum {
+			return fmt.Errorf("%w: %03d_%s (recorded checksum %s, file checksum %s)", ErrMigrationChanged, a.version, a.name, a.checksum, mig.Checksum)
+		}
+	}
+	return nil
+}
+
+// Up applies all pending migrations in version order, each in its own transaction,
+// and returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	return m.up(ctx, -1)
+}
+
+// up applies at most limit pending migrations; a negative limit applies all of them.
+func (m *Migrator) up(ctx context.Context, limit int) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.verify(applied); err != nil {
+		return 0, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.version] = true
+	}
+
+	count := 0
+	for _, mig := range m.migrations {
+		if done[mig.Version] {
+			continue
+		}
+		if limit >= 0 && count >= limit {
+			break
+		}
+		log.Printf("[Migrator] Applying migration %03d_%s", mig.Version, mig.Name)
+		if err := m.inTx(ctx, mig.Up, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+				return err
+			}
+			return m.record(ctx, tx, mig)
+		}); err != nil {
+			return count, fmt.Errorf("failed to apply migration %03d_%s: %w", mig.Version, mig.Name, err)
+		}
+		count++
+	}
+	if count == 0 {
+		log.Println("[Migrator] Database schema is up to date")
+	}
+	return count, nil
+}
+
+// Down rolls back the n most recently applied migrations, newest first, and returns how many were rolled back.
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.verify(applied); err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := len(applied) - 1; i >= 0 && count < n; i-- {
+		mig, _ := m.find(applied[i].version)
+		if mig.Down == "" {
+			return count, fmt.Errorf("migration %03d_%s has no down file", mig.Version, mig.Name)
+		}
+		log.Printf("[Migrator] Rolling back migration %03d_%s", mig.Version, mig.Name)
+		if err := m.inTx(ctx, mig.Down, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = `+m.placeholder(1), mig.Version)
+			return err
+		}); err != nil {
+			return count, fmt.Errorf("failed to roll back migration %03d_%s: %w", mig.Version, mig.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Redo rolls back the most recently applied migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) error {
+	n, err := m.Down(ctx, 1)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no applied migration to redo")
+	}
+	_, err = m.up(ctx, 1)
+	return err
+}
+
+// Status lists every migration file and every applied version in version order.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]appliedMigration, len(applied))
+	for _, a := range applied {
+		byVersion[a.version] = a
+	}
+	var statuses []MigrationStatus
+	for _, mig := range m.migrations {
+		st := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if a, ok := byVersion[mig.Version]; ok {
+			appliedAt := a.appliedAt
+			st.Applied, st.AppliedAt, st.Modified = true, &appliedAt, a.checksum != mig.Checksum
+			delete(byVersion, mig.Version)
+		}
+		statuses = append(statuses, st)
+	}
+	for _, a := range byVersion {
+		appliedAt := a.appliedAt
+		statuses = append(statuses, MigrationStatus{Version: a.version, Name: a.name, Applied: true, AppliedAt: &appliedAt, Missing: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// inTx runs fn, which executes script, in a transaction. A SQLite script starting with
+// foreignKeysOffDirective runs on a connection with foreign keys off, and the transaction
+// only commits when the foreign keys still hold afterwards.
+func (m *Migrator) inTx(ctx context.Context, script string, fn func(tx *sql.Tx) error) error {
+	if m.dialect != DialectSQLite || !strings.HasPrefix(strings.TrimSpace(script), foreignKeysOffDirective) {
+		tx, err := m.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// PRAGMA foreign_keys applies to one connection, so the whole migration runs on the same one.
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	enabled, err := foreignKeysEnabled(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+			return fmt.Errorf("failed to turn off foreign keys: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+		if enabled, err = foreignKeysEnabled(ctx, conn); err != nil {
+			return err
+		}
+		if enabled {
+			return fmt.Errorf("refusing to rebuild a table while foreign keys are on")
+		}
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var table string
+	switch err := tx.QueryRowContext(ctx, `PRAGMA foreign_key_check`).Scan(&table, new(interface{}), new(interface{}), new(interface{})); {
+	case err == nil:
+		tx.Rollback()
+		return fmt.Errorf("migration leaves rows in %s violating a foreign key", table)
+	case !errors.Is(err, sql.ErrNoRows):
+		tx.Rollback()
+		return fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	return tx.Commit()
+}
+
+func foreignKeysEnabled(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var enabled int
+	if err := conn.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("failed to read foreign_keys: %w", err)
+	}
+	return enabled == 1, nil
+}
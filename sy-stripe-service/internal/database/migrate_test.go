@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sy-stripe-service/migrations"
+)
+
+// copyMigrations copies the repository migrations into a temporary directory the test may modify.
+func copyMigrations(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	entries, err := os.ReadDir("../../migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		content, err := os.ReadFile(filepath.Join("../../migrations", e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, e.Name()), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	dir := copyMigrations(t)
+	db := openSQLite(t)
+
+	m, err := NewMigrator(db, DialectSQLite, os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := len(m.migrations)
+
+	if n, err := m.Up(ctx); err != nil || n != total {
+		t.Fatalf("Up = %d, %v; want %d", n, err, total)
+	}
+	if n, err := m.Up(ctx); err != nil || n != 0 {
+		t.Fatalf("second Up = %d, %v; want 0", n, err)
+	}
+
+	if err := m.Redo(ctx); err != nil {
+		t.Fatalf("Redo: %v", err)
+	}
+	if n, err := m.Down(ctx, 2); err != nil || n != 2 {
+		t.Fatalf("Down(2) = %d, %v", n, err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range statuses {
+		if want := i < total-2; s.Applied != want {
+			t.Errorf("migration %03d applied = %v, want %v", s.Version, s.Applied, want)
+		}
+	}
+	if n, err := m.Down(ctx, total); err != nil || n != total-2 {
+		t.Fatalf("Down(all) = %d, %v", n, err)
+	}
+	if n, err := m.Up(ctx); err != nil || n != total {
+		t.Fatalf("Up after full rollback = %d, %v", n, err)
+	}
+
+	// Editing an applied migration must stop the migrator.
+	path := filepath.Join(dir, "001_create_users_table.sql")
+	content, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, append(content, []byte("\n-- edited\n")...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = NewMigrator(db, DialectSQLite, os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx); !errors.Is(err, ErrMigrationChanged) {
+		t.Fatalf("Up with an edited migration = %v, want ErrMigrationChanged", err)
+	}
+	statuses, _ = m.Status(ctx)
+	if !statuses[0].Modified {
+		t.Errorf("status of the edited migration is not modified")
+	}
+}
+
+func TestMigratorFailedMigrationRollsBack(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "001_ok.sql"), []byte("CREATE TABLE a (id INTEGER);"), 0o644)
+	os.WriteFile(filepath.Join(dir, "002_broken.sql"), []byte("CREATE TABLE b (id INTEGER);\nNOT SQL;"), 0o644)
+	db := openSQLite(t)
+
+	m, err := NewMigrator(db, DialectSQLite, os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.Up(ctx); err == nil || n != 1 {
+		t.Fatalf("Up = %d, %v; want 1 and an error", n, err)
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'b'`).Scan(&count)
+	if count != 0 {
+		t.Errorf("table of the failed migration was left behind")
+	}
+	db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count)
+	if count != 1 {
+		t.Errorf("schema_migrations has %d rows, want 1", count)
+	}
+}
+
+func TestMigratorAdoptsLegacyDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	// The previous runner applied 001-003 but not 004 and left no bookkeeping.
+	for _, f := range []string{"001_create_users_table.sql", "002_create_subscriptions_table.sql", "003_create_stripe_events_table.sql"} {
+		content, err := os.ReadFile(filepath.Join("../../migrations", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewMigrator(db, DialectSQLite, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.Up(ctx); err != nil || n != len(m.migrations)-3 {
+		t.Fatalf("Up = %d, %v; want %d", n, err, len(m.migrations)-3)
+	}
+}
+
+func TestMigratorRebuildKeepsReferencingRows(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "migrate.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := NewMigrator(db, DialectSQLite, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 012 rebuilds users, which subscriptions reference with ON DELETE CASCADE.
+	if _, err := m.up(ctx, 11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, stripe_customer_id, email, name) VALUES ('u1', 'cus_1', 'a@example.com', 'A')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO subscriptions (id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end)
+VALUES ('s1', 'u1', 'sub_1', 'price_1', 'active', '2024-01-01', '2024-02-01')`); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(step string) {
+		t.Helper()
+		var subs, enabled int
+		db.QueryRow(`SELECT COUNT(*) FROM subscriptions`).Scan(&subs)
+		if subs != 1 {
+			t.Errorf("%s: %d subscriptions, want 1", step, subs)
+		}
+		db.QueryRow(`PRAGMA foreign_keys`).Scan(&enabled)
+		if enabled != 1 {
+			t.Errorf("%s: foreign keys are not turned back on", step)
+		}
+	}
+	if n, err := m.Up(ctx); err != nil || n != len(m.migrations)-11 {
+		t.Fatalf("Up = %d, %v", n, err)
+	}
+	check("up")
+	if _, err := m.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	check("down")
+}
@@ -2,20 +2,32 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/lib/pq"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"sy-stripe-service/internal/models"
 )
 
+// ErrDuplicateUser is returned when a user's email or Stripe customer ID is already taken.
+var ErrDuplicateUser = errors.New("duplicate user")
+
 // UserRepository defines DB operations for users.
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *models.User) (*models.User, error)
 	GetUserByStripeCustomerID(ctx context.Context, customerID string) (*models.User, error)
 	GetUserByID(ctx context.Context, id string) (*models.User, error)
 	GetAllUsers(ctx context.Context) ([]*models.User, error)
+	// UpdateUser stores the email and name of an existing user. A taken email returns ErrDuplicateUser.
+	UpdateUser(ctx context.Context, user *models.User) (*models.User, error)
+	// SoftDeleteUser marks the user as deleted; deleted users are hidden from every read.
+	SoftDeleteUser(ctx context.Context, id string, deletedAt time.Time) error
+	// ListUsers returns one page of users; see UserListParams.
+	ListUsers(ctx context.Context, params UserListParams) (*UserPage, error)
 }
 
 // SubscriptionRepository defines DB operations for subscriptions.
@@ -24,13 +36,81 @@ type SubscriptionRepository interface {
 	GetSubscriptionByStripeSubscriptionID(ctx context.Context, subID string) (*models.Subscription, error)
 	GetSubscriptionByID(ctx context.Context, id string) (*models.Subscription, error)
 	UpdateSubscriptionStatus(ctx context.Context, subID string, status string) error
+	// UpdateSubscriptionStatusByID sets the status of the subscription with the given internal ID,
+	// for rows that have no Stripe subscription to match on.
+	UpdateSubscriptionStatusByID(ctx context.Context, id string, status string) error
 	UpdateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error)
+	// UpsertSubscription inserts or updates a subscription keyed by stripe_subscription_id.
+	// The ID, user and created_at of an existing row are kept. An existing row newer than
+	// sub.UpdatedAt (on whole seconds) may be left unchanged; the stored row is returned.
+	UpsertSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error)
 	// NEW: Get the latest subscription by user ID
 	GetLatestSubscriptionByUserID(ctx context.Context, userID string) (*models.Subscription, error)
+	// ListTrialsEndingBetween returns the trialing subscriptions whose trial ends after from and no
+	// later than to and whose customer has not been notified of that trial end yet, soonest first.
+	ListTrialsEndingBetween(ctx context.Context, from, to time.Time) ([]*models.Subscription, error)
+	// ClaimTrialEndNotification records that the customer is notified of the current trial end of
+	// a subscription. It returns false if that was already claimed, e.g. by another instance.
+	ClaimTrialEndNotification(ctx context.Context, id string) (bool, error)
+}
+
+// InvoiceRepository defines DB operations for invoices.
+type InvoiceRepository interface {
+	// UpsertInvoice inserts or updates an invoice keyed by stripe_invoice_id and returns the stored row.
+	// The ID, user and created_at of an existing row are kept, and a row with a newer updated_at
+	// is left unchanged.
+	UpsertInvoice(ctx context.Context, inv *models.Invoice) (*models.Invoice, error)
+	GetInvoiceByStripeInvoiceID(ctx context.Context, stripeInvoiceID string) (*models.Invoice, error)
+	// ListInvoicesByUserID returns one page of a user's invoices; see InvoiceListParams.
+	ListInvoicesByUserID(ctx context.Context, userID string, params InvoiceListParams) (*InvoicePage, error)
+}
+
+// DunningRepository defines DB operations for dunning states, one per subscription.
+type DunningRepository interface {
+	// UpsertDunningState inserts or replaces the dunning state of a subscription, keyed by
+	// subscription_id, and returns the stored row. The ID and created_at of an existing row are kept,
+	// and a row with a newer last_event_at is left unchanged.
+	UpsertDunningState(ctx context.Context, state *models.DunningState) (*models.DunningState, error)
+	GetDunningStateBySubscriptionID(ctx context.Context, subscriptionID string) (*models.DunningState, error)
+	// ListDueDunningStates returns up to limit open states whose next step is due at now, earliest first.
+	ListDueDunningStates(ctx context.Context, now time.Time, limit int) ([]*models.DunningState, error)
+	// TransitionDunningState stores the status, steps_done, next_step_at, resolved_at and updated_at
+	// of a state if the stored row still has the given status and steps_done. It reports whether
+	// the row was updated, so that concurrent workers and webhooks never run a step twice.
+	TransitionDunningState(ctx context.Context, state *models.DunningState, fromStatus models.DunningStatus, fromSteps int) (bool, error)
+}
+
+// UsageRepository defines DB operations for metered usage records buffered for Stripe.
+type UsageRepository interface {
+	// CreateUsageRecord inserts a record unless its subscription already has one with the same
+	// idempotency key. It returns the stored record and whether it was inserted.
+	CreateUsageRecord(ctx context.Context, rec *models.UsageRecord) (*models.UsageRecord, bool, error)
+	// ListDueUsageRecords returns up to limit pending records whose next attempt is due at now, earliest first.
+	ListDueUsageRecords(ctx context.Context, now time.Time, limit int) ([]*models.UsageRecord, error)
+	// ClaimUsageRecord moves the next attempt of a pending record from "from" to "until" and counts
+	// the attempt, if the stored row still has next_attempt_at = from. It reports whether the row was
+	// updated, so that concurrent flushers never report the same record at the same time.
+	ClaimUsageRecord(ctx context.Context, id uuid.UUID, from, until time.Time) (bool, error)
+	// UpdateUsageRecord stores the outcome of an attempt: status, next_attempt_at, last_error,
+	// the Stripe IDs, reported_at and updated_at.
+	UpdateUsageRecord(ctx context.Context, rec *models.UsageRecord) error
+	// SummarizeUsage totals the records of a subscription with a timestamp in [from, to).
+	SummarizeUsage(ctx context.Context, subscriptionID string, from, to time.Time) (*models.UsageSummary, error)
+}
+
+// StripeEventRepository defines DB operations for the webhook event ledger.
+type StripeEventRepository interface {
+	// RecordEvent inserts the event unless its ID is already known; it reports whether a row was inserted.
+	RecordEvent(ctx context.Context, event *models.StripeEvent) (bool, error)
+	GetEventByID(ctx context.Context, id string) (*models.StripeEvent, error)
+	// ClaimEvent marks the event as processing until the given time. It succeeds only for
+	// pending or failed events and for processing events whose claim expired before now.
+	ClaimEvent(ctx context.Context, id string, now, until time.Time) (bool, error)
+	UpdateEventStatus(ctx context.Context, id string, status string, errMsg string) error
 }
 
 func (r *PostgresUserRepository) GetAllUsers(ctx context.Context) ([]*models.User, error) {
-	rows, err := r.pool.Query(ctx, `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users`)
+	rows, err := r.pool.Query(ctx, `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE deleted_at IS NULL`)
 	if err != nil {
 		return nil, err
 	}
@@ -47,13 +127,23 @@ func (r *PostgresUserRepository) GetAllUsers(ctx context.Context) ([]*models.Use
 	return users, nil
 }
 
+// pgUniqueViolation is the SQLSTATE of a unique constraint violation.
+const pgUniqueViolation = "23505"
+
+// pgQuerier is satisfied by *pgxpool.Pool and pgx.Tx, so repositories can run inside a transaction.
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 // PostgresUserRepository implements UserRepository.
 type PostgresUserRepository struct {
-	pool *pgxpool.Pool
+	pool pgQuerier
 }
 
 func (r *PostgresUserRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
-	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE id = $1`
+	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE id = $1 AND deleted_at IS NULL`
 	row := r.pool.QueryRow(ctx, query, id)
 	var u models.User
 	err := row.Scan(&u.ID, &u.StripeCustomerID, &u.Email, &u.Name, &u.CreatedAt, &u.UpdatedAt)
@@ -68,21 +158,78 @@ func NewPostgresUserRepository(pool *pgxpool.Pool) *PostgresUserRepository {
 }
 
 func (r *PostgresUserRepository) CreateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	user.CreatedAt, user.UpdatedAt = dbTime(user.CreatedAt), dbTime(user.UpdatedAt)
 	query := `INSERT INTO users (id, stripe_customer_id, email, name, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, stripe_customer_id, email, name, created_at, updated_at`
 	row := r.pool.QueryRow(ctx, query, user.ID, user.StripeCustomerID, user.Email, user.Name, user.CreatedAt, user.UpdatedAt)
 	var u models.User
 	err := row.Scan(&u.ID, &u.StripeCustomerID, &u.Email, &u.Name, &u.CreatedAt, &u.UpdatedAt)
 	if err != nil {
-		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
-			return nil, fmt.Errorf("duplicate user: %w", err)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			return nil, fmt.Errorf("%w: %w", ErrDuplicateUser, err)
 		}
 		return nil, fmt.Errorf("failed to insert user: %w", err)
 	}
 	return &u, nil
 }
 
+func (r *PostgresUserRepository) UpdateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	user.UpdatedAt = dbTime(user.UpdatedAt)
+	query := `UPDATE users SET email = $1, name = $2, updated_at = $3 WHERE id = $4 AND deleted_at IS NULL RETURNING id, stripe_customer_id, email, name, created_at, updated_at`
+	row := r.pool.QueryRow(ctx, query, user.Email, user.Name, user.UpdatedAt, user.ID)
+	var u models.User
+	err := row.Scan(&u.ID, &u.StripeCustomerID, &u.Email, &u.Name, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			return nil, fmt.Errorf("%w: %w", ErrDuplicateUser, err)
+		}
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	return &u, nil
+}
+
+func (r *PostgresUserRepository) SoftDeleteUser(ctx context.Context, id string, deletedAt time.Time) error {
+	tag, err := r.pool.Exec(ctx, `UPDATE users SET deleted_at = $1, updated_at = $1 WHERE id = $2 AND deleted_at IS NULL`, dbTime(deletedAt), id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("user not found: %s", id)
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) ListUsers(ctx context.Context, params UserListParams) (*UserPage, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := params.cursor()
+	if err != nil {
+		return nil, err
+	}
+	query, args := listUsersQuery(DialectPostgres, &params, cursor)
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+	var users []*models.User
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.StripeCustomerID, &u.Email, &u.Name, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	return params.page(users), nil
+}
+
 func (r *PostgresUserRepository) GetUserByStripeCustomerID(ctx context.Context, customerID string) (*models.User, error) {
-	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE stripe_customer_id = $1`
+	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE stripe_customer_id = $1 AND deleted_at IS NULL`
 	row := r.pool.QueryRow(ctx, query, customerID)
 	var u models.User
 	err := row.Scan(&u.ID, &u.StripeCustomerID, &u.Email, &u.Name, &u.CreatedAt, &u.UpdatedAt)
@@ -94,31 +241,65 @@ func (r *PostgresUserRepository) GetUserByStripeCustomerID(ctx context.Context,
 
 // PostgresSubscriptionRepository implements SubscriptionRepository.
 type PostgresSubscriptionRepository struct {
-	pool *pgxpool.Pool
+	pool pgQuerier
+}
+
+// subscriptionColumns lists the subscription columns in the order scanSubscription expects.
+const subscriptionColumns = `id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, cancel_at_period_end, canceled_at, created_at, updated_at, ` + subscriptionDiscountColumns + `, trial_start, trial_end`
+
+// subscriptionDiscountColumns hold models.SubscriptionDiscount, in the order of subscriptionDiscountArgs.
+const subscriptionDiscountColumns = `discount_coupon_id, discount_coupon_name, discount_promotion_code_id, discount_percent_off, discount_amount_off, discount_currency, discount_duration, discount_ends_at`
+
+// subscriptionDiscountUpdate sets the discount columns of an upsert from the excluded row.
+const subscriptionDiscountUpdate = `discount_coupon_id = excluded.discount_coupon_id, discount_coupon_name = excluded.discount_coupon_name, discount_promotion_code_id = excluded.discount_promotion_code_id, discount_percent_off = excluded.discount_percent_off, discount_amount_off = excluded.discount_amount_off, discount_currency = excluded.discount_currency, discount_duration = excluded.discount_duration, discount_ends_at = excluded.discount_ends_at`
+
+// subscriptionDiscountArgs returns the values of the discount columns; a nil discount clears them.
+func subscriptionDiscountArgs(d *models.SubscriptionDiscount) []interface{} {
+	if d == nil {
+		d = &models.SubscriptionDiscount{}
+	}
+	return []interface{}{d.CouponID, d.CouponName, d.PromotionCodeID, d.PercentOff, d.AmountOff, d.Currency, d.Duration, d.EndsAt}
+}
+
+// subscriptionDiscount returns the discount scanned from the discount columns, or nil if there is none.
+func subscriptionDiscount(d models.SubscriptionDiscount) *models.SubscriptionDiscount {
+	if d.CouponID == "" {
+		return nil
+	}
+	return &d
+}
+
+// scanSubscription scans a row selected with subscriptionColumns.
+func scanSubscription(row pgx.Row) (*models.Subscription, error) {
+	var s models.Subscription
+	var d models.SubscriptionDiscount
+	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CancelAtPeriodEnd, &s.CanceledAt, &s.CreatedAt, &s.UpdatedAt,
+		&d.CouponID, &d.CouponName, &d.PromotionCodeID, &d.PercentOff, &d.AmountOff, &d.Currency, &d.Duration, &d.EndsAt, &s.TrialStart, &s.TrialEnd)
+	if err != nil {
+		return nil, err
+	}
+	s.Discount = subscriptionDiscount(d)
+	return &s, nil
 }
 
 // GetLatestSubscriptionByUserID returns the latest subscription (by created_at) for a user
 func (r *PostgresSubscriptionRepository) GetLatestSubscriptionByUserID(ctx context.Context, userID string) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at
+	query := `SELECT ` + subscriptionColumns + `
 		FROM subscriptions WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1`
-	row := r.pool.QueryRow(ctx, query, userID)
-	var s models.Subscription
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CreatedAt, &s.UpdatedAt)
+	s, err := scanSubscription(r.pool.QueryRow(ctx, query, userID))
 	if err != nil {
 		return nil, fmt.Errorf("subscription not found: %w", err)
 	}
-	return &s, nil
+	return s, nil
 }
 
 func (r *PostgresSubscriptionRepository) GetSubscriptionByID(ctx context.Context, id string) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at FROM subscriptions WHERE id = $1`
-	row := r.pool.QueryRow(ctx, query, id)
-	var s models.Subscription
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CreatedAt, &s.UpdatedAt)
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE id = $1`
+	s, err := scanSubscription(r.pool.QueryRow(ctx, query, id))
 	if err != nil {
 		return nil, fmt.Errorf("subscription not found: %w", err)
 	}
-	return &s, nil
+	return s, nil
 }
 
 func NewPostgresSubscriptionRepository(pool *pgxpool.Pool) *PostgresSubscriptionRepository {
@@ -126,25 +307,24 @@ func NewPostgresSubscriptionRepository(pool *pgxpool.Pool) *PostgresSubscription
 }
 
 func (r *PostgresSubscriptionRepository) CreateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
-	query := `INSERT INTO subscriptions (id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at`
-	row := r.pool.QueryRow(ctx, query, sub.ID, sub.UserID, sub.StripeSubscriptionID, sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CreatedAt, sub.UpdatedAt)
-	var s models.Subscription
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CreatedAt, &s.UpdatedAt)
+	query := `INSERT INTO subscriptions (` + subscriptionColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21) RETURNING ` + subscriptionColumns
+	args := append([]interface{}{sub.ID, sub.UserID, sub.StripeSubscriptionID, sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd, sub.CanceledAt, sub.CreatedAt, sub.UpdatedAt}, subscriptionDiscountArgs(sub.Discount)...)
+	args = append(args, dbNullTime(sub.TrialStart), dbNullTime(sub.TrialEnd))
+	row := r.pool.QueryRow(ctx, query, args...)
+	s, err := scanSubscription(row)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert subscription: %w", err)
 	}
-	return &s, nil
+	return s, nil
 }
 
 func (r *PostgresSubscriptionRepository) GetSubscriptionByStripeSubscriptionID(ctx context.Context, subID string) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at FROM subscriptions WHERE stripe_subscription_id = $1`
-	row := r.pool.QueryRow(ctx, query, subID)
-	var s models.Subscription
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CreatedAt, &s.UpdatedAt)
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE stripe_subscription_id = $1`
+	s, err := scanSubscription(r.pool.QueryRow(ctx, query, subID))
 	if err != nil {
 		return nil, fmt.Errorf("subscription not found: %w", err)
 	}
-	return &s, nil
+	return s, nil
 }
 
 func (r *PostgresSubscriptionRepository) UpdateSubscriptionStatus(ctx context.Context, subID string, status string) error {
@@ -156,13 +336,392 @@ func (r *PostgresSubscriptionRepository) UpdateSubscriptionStatus(ctx context.Co
 	return nil
 }
 
+func (r *PostgresSubscriptionRepository) UpdateSubscriptionStatusByID(ctx context.Context, id string, status string) error {
+	query := `UPDATE subscriptions SET status = $1, updated_at = $2 WHERE id = $3`
+	tag, err := r.pool.Exec(ctx, query, status, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update subscription status: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("subscription not found")
+	}
+	return nil
+}
+
 func (r *PostgresSubscriptionRepository) UpdateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
-	query := `UPDATE subscriptions SET status = $1, current_period_start = $2, current_period_end = $3, updated_at = $4 WHERE stripe_subscription_id = $5 RETURNING id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at`
-	row := r.pool.QueryRow(ctx, query, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.UpdatedAt, sub.StripeSubscriptionID)
-	var s models.Subscription
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &s.CurrentPeriodStart, &s.CurrentPeriodEnd, &s.CreatedAt, &s.UpdatedAt)
+	query := `UPDATE subscriptions SET stripe_price_id = $1, status = $2, current_period_start = $3, current_period_end = $4, cancel_at_period_end = $5, canceled_at = $6, updated_at = $7,
+		discount_coupon_id = $9, discount_coupon_name = $10, discount_promotion_code_id = $11, discount_percent_off = $12, discount_amount_off = $13, discount_currency = $14, discount_duration = $15, discount_ends_at = $16,
+		trial_start = $17, trial_end = $18
+		WHERE stripe_subscription_id = $8 RETURNING ` + subscriptionColumns
+	args := append([]interface{}{sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd, sub.CanceledAt, sub.UpdatedAt, sub.StripeSubscriptionID}, subscriptionDiscountArgs(sub.Discount)...)
+	args = append(args, dbNullTime(sub.TrialStart), dbNullTime(sub.TrialEnd))
+	row := r.pool.QueryRow(ctx, query, args...)
+	s, err := scanSubscription(row)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update subscription: %w", err)
 	}
-	return &s, nil
+	return s, nil
+}
+
+// UpsertSubscription keeps a row that is newer than sub: two webhooks for a subscription may be
+// processed at the same time, and READ COMMITTED does not stop the older one from writing last.
+func (r *PostgresSubscriptionRepository) UpsertSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
+	query := `INSERT INTO subscriptions (` + subscriptionColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21)
+		ON CONFLICT (stripe_subscription_id) DO UPDATE SET stripe_price_id = EXCLUDED.stripe_price_id, status = EXCLUDED.status, current_period_start = EXCLUDED.current_period_start, current_period_end = EXCLUDED.current_period_end, cancel_at_period_end = EXCLUDED.cancel_at_period_end, canceled_at = EXCLUDED.canceled_at, updated_at = EXCLUDED.updated_at, ` + subscriptionDiscountUpdate + `,
+			trial_start = EXCLUDED.trial_start, trial_end = EXCLUDED.trial_end
+		WHERE date_trunc('second', subscriptions.updated_at) <= EXCLUDED.updated_at`
+	args := append([]interface{}{sub.ID, sub.UserID, sub.StripeSubscriptionID, sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd, sub.CanceledAt, sub.CreatedAt, sub.UpdatedAt}, subscriptionDiscountArgs(sub.Discount)...)
+	args = append(args, dbNullTime(sub.TrialStart), dbNullTime(sub.TrialEnd))
+	if _, err := r.pool.Exec(ctx, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to upsert subscription: %w", err)
+	}
+	return r.GetSubscriptionByStripeSubscriptionID(ctx, sub.StripeSubscriptionID)
+}
+
+func (r *PostgresSubscriptionRepository) ListTrialsEndingBetween(ctx context.Context, from, to time.Time) ([]*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions
+		WHERE status = $1 AND trial_end > $2 AND trial_end <= $3 AND trial_end_notified IS DISTINCT FROM trial_end
+		ORDER BY trial_end`
+	rows, err := r.pool.Query(ctx, query, models.SubscriptionStatusTrialing, dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ending trials: %w", err)
+	}
+	defer rows.Close()
+	var subs []*models.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func (r *PostgresSubscriptionRepository) ClaimTrialEndNotification(ctx context.Context, id string) (bool, error) {
+	query := `UPDATE subscriptions SET trial_end_notified = trial_end
+		WHERE id = $1 AND trial_end IS NOT NULL AND trial_end_notified IS DISTINCT FROM trial_end`
+	tag, err := r.pool.Exec(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim trial end notification: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PostgresInvoiceRepository implements InvoiceRepository.
+type PostgresInvoiceRepository struct {
+	pool pgQuerier
+}
+
+func NewPostgresInvoiceRepository(pool *pgxpool.Pool) *PostgresInvoiceRepository {
+	return &PostgresInvoiceRepository{pool: pool}
+}
+
+// scanInvoice scans a row selected with invoiceColumns.
+func scanInvoice(row pgx.Row) (*models.Invoice, error) {
+	var i models.Invoice
+	err := row.Scan(&i.ID, &i.UserID, &i.StripeInvoiceID, &i.StripeSubscriptionID, &i.Number, &i.Status, &i.Currency, &i.AmountDue, &i.AmountPaid, &i.HostedInvoiceURL, &i.InvoicePDF, &i.PeriodStart, &i.PeriodEnd, &i.IssuedAt, &i.CreatedAt, &i.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func (r *PostgresInvoiceRepository) UpsertInvoice(ctx context.Context, inv *models.Invoice) (*models.Invoice, error) {
+	query := `INSERT INTO invoices (` + invoiceColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)
+		` + invoiceUpsertSet
+	_, err := r.pool.Exec(ctx, query, inv.ID, inv.UserID, inv.StripeInvoiceID, inv.StripeSubscriptionID, inv.Number, inv.Status, inv.Currency, inv.AmountDue, inv.AmountPaid, inv.HostedInvoiceURL, inv.InvoicePDF,
+		dbTime(inv.PeriodStart), dbTime(inv.PeriodEnd), dbTime(inv.IssuedAt), dbTime(inv.CreatedAt), dbTime(inv.UpdatedAt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert invoice: %w", err)
+	}
+	return r.GetInvoiceByStripeInvoiceID(ctx, inv.StripeInvoiceID)
+}
+
+func (r *PostgresInvoiceRepository) GetInvoiceByStripeInvoiceID(ctx context.Context, stripeInvoiceID string) (*models.Invoice, error) {
+	query := `SELECT ` + invoiceColumns + ` FROM invoices WHERE stripe_invoice_id = $1`
+	i, err := scanInvoice(r.pool.QueryRow(ctx, query, stripeInvoiceID))
+	if err != nil {
+		return nil, fmt.Errorf("invoice not found: %w", err)
+	}
+	return i, nil
+}
+
+func (r *PostgresInvoiceRepository) ListInvoicesByUserID(ctx context.Context, userID string, params InvoiceListParams) (*InvoicePage, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := params.cursor()
+	if err != nil {
+		return nil, err
+	}
+	query, args := listInvoicesQuery(DialectPostgres, userID, &params, cursor)
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	defer rows.Close()
+	var invoices []*models.Invoice
+	for rows.Next() {
+		i, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	return params.page(invoices), nil
+}
+
+// dunningColumns lists the dunning state columns in the order the scan functions expect.
+const dunningColumns = `id, subscription_id, user_id, stripe_invoice_id, status, attempt_count, next_retry_at, first_failed_at, grace_period_ends_at, steps_done, next_step_at, resolved_at, last_event_at, created_at, updated_at`
+
+// dunningUpsertSet replaces an existing dunning state unless it reflects a newer invoice event.
+const dunningUpsertSet = `ON CONFLICT (subscription_id) DO UPDATE SET user_id = excluded.user_id, stripe_invoice_id = excluded.stripe_invoice_id, status = excluded.status, attempt_count = excluded.attempt_count, next_retry_at = excluded.next_retry_at, first_failed_at = excluded.first_failed_at, grace_period_ends_at = excluded.grace_period_ends_at, steps_done = excluded.steps_done, next_step_at = excluded.next_step_at, resolved_at = excluded.resolved_at, last_event_at = excluded.last_event_at, updated_at = excluded.updated_at
+		WHERE dunning_states.last_event_at <= excluded.last_event_at`
+
+// dunningOpenStatuses is the SQL list of statuses in which dunning steps may run.
+var dunningOpenStatuses = fmt.Sprintf("('%s', '%s')", models.DunningStatusPastDue, models.DunningStatusRestricted)
+
+// PostgresDunningRepository implements DunningRepository.
+type PostgresDunningRepository struct {
+	pool pgQuerier
+}
+
+func NewPostgresDunningRepository(pool *pgxpool.Pool) *PostgresDunningRepository {
+	return &PostgresDunningRepository{pool: pool}
+}
+
+// scanDunningState scans a row selected with dunningColumns.
+func scanDunningState(row pgx.Row) (*models.DunningState, error) {
+	var d models.DunningState
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.UserID, &d.StripeInvoiceID, &d.Status, &d.AttemptCount, &d.NextRetryAt, &d.FirstFailedAt, &d.GracePeriodEndsAt, &d.StepsDone, &d.NextStepAt, &d.ResolvedAt, &d.LastEventAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// dbNullTime is dbTime for optional timestamps.
+func dbNullTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	v := dbTime(*t)
+	return &v
+}
+
+func (r *PostgresDunningRepository) UpsertDunningState(ctx context.Context, state *models.DunningState) (*models.DunningState, error) {
+	query := `INSERT INTO dunning_states (` + dunningColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15)
+		` + dunningUpsertSet
+	_, err := r.pool.Exec(ctx, query, state.ID, state.SubscriptionID, state.UserID, state.StripeInvoiceID, state.Status, state.AttemptCount, dbNullTime(state.NextRetryAt), dbTime(state.FirstFailedAt),
+		dbNullTime(state.GracePeriodEndsAt), state.StepsDone, dbNullTime(state.NextStepAt), dbNullTime(state.ResolvedAt), dbTime(state.LastEventAt), dbTime(state.CreatedAt), dbTime(state.UpdatedAt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert dunning state: %w", err)
+	}
+	return r.GetDunningStateBySubscriptionID(ctx, state.SubscriptionID.String())
+}
+
+func (r *PostgresDunningRepository) GetDunningStateBySubscriptionID(ctx context.Context, subscriptionID string) (*models.DunningState, error) {
+	query := `SELECT ` + dunningColumns + ` FROM dunning_states WHERE subscription_id = $1`
+	d, err := scanDunningState(r.pool.QueryRow(ctx, query, subscriptionID))
+	if err != nil {
+		return nil, fmt.Errorf("dunning state not found: %w", err)
+	}
+	return d, nil
+}
+
+func (r *PostgresDunningRepository) ListDueDunningStates(ctx context.Context, now time.Time, limit int) ([]*models.DunningState, error) {
+	query := `SELECT ` + dunningColumns + ` FROM dunning_states WHERE status IN ` + dunningOpenStatuses + ` AND next_step_at <= $1 ORDER BY next_step_at, id LIMIT $2`
+	rows, err := r.pool.Query(ctx, query, dbTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list due dunning states: %w", err)
+	}
+	defer rows.Close()
+	var states []*models.DunningState
+	for rows.Next() {
+		d, err := scanDunningState(rows)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list due dunning states: %w", err)
+	}
+	return states, nil
+}
+
+func (r *PostgresDunningRepository) TransitionDunningState(ctx context.Context, state *models.DunningState, fromStatus models.DunningStatus, fromSteps int) (bool, error) {
+	query := `UPDATE dunning_states SET status = $1, steps_done = $2, next_step_at = $3, resolved_at = $4, updated_at = $5 WHERE id = $6 AND status = $7 AND steps_done = $8`
+	tag, err := r.pool.Exec(ctx, query, state.Status, state.StepsDone, dbNullTime(state.NextStepAt), dbNullTime(state.ResolvedAt), dbTime(state.UpdatedAt), state.ID, fromStatus, fromSteps)
+	if err != nil {
+		return false, fmt.Errorf("failed to update dunning state: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// usageColumns lists the usage record columns in the order the scan functions expect.
+const usageColumns = `id, subscription_id, idempotency_key, quantity, timestamp, status, attempts, next_attempt_at, last_error, stripe_subscription_item_id, stripe_usage_record_id, reported_at, created_at, updated_at`
+
+// usageSummarySelect totals quantities per status; the placeholders are subscription_id, from and to.
+const usageSummarySelect = `SELECT status, COALESCE(SUM(quantity), 0), COUNT(*) FROM usage_records WHERE subscription_id = %s AND timestamp >= %s AND timestamp < %s GROUP BY status`
+
+// addUsageTotal adds the total of one status to a summary.
+func addUsageTotal(summary *models.UsageSummary, status models.UsageRecordStatus, quantity, records int64) {
+	summary.TotalQuantity += quantity
+	summary.Records += records
+	switch status {
+	case models.UsageRecordStatusReported:
+		summary.ReportedQuantity += quantity
+	case models.UsageRecordStatusFailed:
+		summary.FailedQuantity += quantity
+	default:
+		summary.PendingQuantity += quantity
+	}
+}
+
+// PostgresUsageRepository implements UsageRepository.
+type PostgresUsageRepository struct {
+	pool pgQuerier
+}
+
+func NewPostgresUsageRepository(pool *pgxpool.Pool) *PostgresUsageRepository {
+	return &PostgresUsageRepository{pool: pool}
+}
+
+// scanUsageRecord scans a row selected with usageColumns.
+func scanUsageRecord(row pgx.Row) (*models.UsageRecord, error) {
+	var u models.UsageRecord
+	err := row.Scan(&u.ID, &u.SubscriptionID, &u.IdempotencyKey, &u.Quantity, &u.Timestamp, &u.Status, &u.Attempts, &u.NextAttemptAt, &u.LastError, &u.StripeSubscriptionItemID, &u.StripeUsageRecordID, &u.ReportedAt, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *PostgresUsageRepository) CreateUsageRecord(ctx context.Context, rec *models.UsageRecord) (*models.UsageRecord, bool, error) {
+	query := `INSERT INTO usage_records (` + usageColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14)
+		ON CONFLICT (subscription_id, idempotency_key) DO NOTHING`
+	tag, err := r.pool.Exec(ctx, query, rec.ID, rec.SubscriptionID, rec.IdempotencyKey, rec.Quantity, dbTime(rec.Timestamp), rec.Status, rec.Attempts, dbNullTime(rec.NextAttemptAt),
+		rec.LastError, rec.StripeSubscriptionItemID, rec.StripeUsageRecordID, dbNullTime(rec.ReportedAt), dbTime(rec.CreatedAt), dbTime(rec.UpdatedAt))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create usage record: %w", err)
+	}
+	query = `SELECT ` + usageColumns + ` FROM usage_records WHERE subscription_id = $1 AND idempotency_key = $2`
+	stored, err := scanUsageRecord(r.pool.QueryRow(ctx, query, rec.SubscriptionID, rec.IdempotencyKey))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load usage record: %w", err)
+	}
+	return stored, tag.RowsAffected() == 1, nil
+}
+
+func (r *PostgresUsageRepository) ListDueUsageRecords(ctx context.Context, now time.Time, limit int) ([]*models.UsageRecord, error) {
+	query := `SELECT ` + usageColumns + ` FROM usage_records WHERE status = $1 AND next_attempt_at <= $2 ORDER BY next_attempt_at, id LIMIT $3`
+	rows, err := r.pool.Query(ctx, query, models.UsageRecordStatusPending, dbTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list due usage records: %w", err)
+	}
+	defer rows.Close()
+	var records []*models.UsageRecord
+	for rows.Next() {
+		u, err := scanUsageRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list due usage records: %w", err)
+	}
+	return records, nil
+}
+
+func (r *PostgresUsageRepository) ClaimUsageRecord(ctx context.Context, id uuid.UUID, from, until time.Time) (bool, error) {
+	query := `UPDATE usage_records SET next_attempt_at = $1, attempts = attempts + 1 WHERE id = $2 AND status = $3 AND next_attempt_at = $4`
+	tag, err := r.pool.Exec(ctx, query, dbTime(until), id, models.UsageRecordStatusPending, dbTime(from))
+	if err != nil {
+		return false, fmt.Errorf("failed to claim usage record: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PostgresUsageRepository) UpdateUsageRecord(ctx context.Context, rec *models.UsageRecord) error {
+	query := `UPDATE usage_records SET status = $1, next_attempt_at = $2, last_error = $3, stripe_subscription_item_id = $4, stripe_usage_record_id = $5, reported_at = $6, updated_at = $7 WHERE id = $8`
+	_, err := r.pool.Exec(ctx, query, rec.Status, dbNullTime(rec.NextAttemptAt), rec.LastError, rec.StripeSubscriptionItemID, rec.StripeUsageRecordID, dbNullTime(rec.ReportedAt), dbTime(rec.UpdatedAt), rec.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update usage record: %w", err)
+	}
+	return nil
+}
+
+func (r *PostgresUsageRepository) SummarizeUsage(ctx context.Context, subscriptionID string, from, to time.Time) (*models.UsageSummary, error) {
+	rows, err := r.pool.Query(ctx, fmt.Sprintf(usageSummarySelect, "$1", "$2", "$3"), subscriptionID, dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize usage: %w", err)
+	}
+	defer rows.Close()
+	summary := &models.UsageSummary{}
+	for rows.Next() {
+		var status models.UsageRecordStatus
+		var quantity, records int64
+		if err := rows.Scan(&status, &quantity, &records); err != nil {
+			return nil, fmt.Errorf("failed to summarize usage: %w", err)
+		}
+		addUsageTotal(summary, status, quantity, records)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to summarize usage: %w", err)
+	}
+	return summary, nil
+}
+
+// PostgresStripeEventRepository implements StripeEventRepository.
+type PostgresStripeEventRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStripeEventRepository(pool *pgxpool.Pool) *PostgresStripeEventRepository {
+	return &PostgresStripeEventRepository{pool: pool}
+}
+
+func (r *PostgresStripeEventRepository) RecordEvent(ctx context.Context, event *models.StripeEvent) (bool, error) {
+	query := `INSERT INTO stripe_events (id, type, payload, status, error, received_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING`
+	tag, err := r.pool.Exec(ctx, query, event.ID, event.Type, event.Payload, event.Status, event.Error, event.ReceivedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record stripe event: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PostgresStripeEventRepository) GetEventByID(ctx context.Context, id string) (*models.StripeEvent, error) {
+	query := `SELECT id, type, payload, status, error, received_at, processed_at FROM stripe_events WHERE id = $1`
+	row := r.pool.QueryRow(ctx, query, id)
+	var e models.StripeEvent
+	err := row.Scan(&e.ID, &e.Type, &e.Payload, &e.Status, &e.Error, &e.ReceivedAt, &e.ProcessedAt)
+	if err != nil {
+		return nil, fmt.Errorf("stripe event not found: %w", err)
+	}
+	return &e, nil
+}
+
+func (r *PostgresStripeEventRepository) ClaimEvent(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	query := `UPDATE stripe_events SET status = 'processing', locked_until = $1
+		WHERE id = $2 AND (status IN ('pending', 'failed') OR (status = 'processing' AND (locked_until IS NULL OR locked_until < $3)))`
+	tag, err := r.pool.Exec(ctx, query, until, id, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim stripe event: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r *PostgresStripeEventRepository) UpdateEventStatus(ctx context.Context, id string, status string, errMsg string) error {
+	query := `UPDATE stripe_events SET status = $1, error = $2, processed_at = $3, locked_until = NULL WHERE id = $4`
+	_, err := r.pool.Exec(ctx, query, status, errMsg, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update stripe event status: %w", err)
+	}
+	return nil
 }
@@ -3,9 +3,12 @@ package database
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"sy-stripe-service/internal/models"
 )
 
@@ -13,13 +16,15 @@ import (
 type InMemoryUserRepository struct {
 	mu    sync.RWMutex
 	users map[string]*models.User // key: StripeCustomerID
+	// subs backs the subscription status filter of ListUsers.
+	subs *InMemorySubscriptionRepository
 }
 
 func (r *InMemoryUserRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	for _, user := range r.users {
-		if user.ID.String() == id {
+		if user.ID.String() == id && user.DeletedAt == nil {
 			return user, nil
 		}
 	}
@@ -31,7 +36,9 @@ func (r *InMemoryUserRepository) GetAllUsers(ctx context.Context) ([]*models.Use
 	defer r.mu.RUnlock()
 	users := make([]*models.User, 0, len(r.users))
 	for _, u := range r.users {
-		users = append(users, u)
+		if u.DeletedAt == nil {
+			users = append(users, u)
+		}
 	}
 	return users, nil
 }
@@ -42,11 +49,73 @@ func NewInMemoryUserRepository() *InMemoryUserRepository {
 	}
 }
 
+// JoinSubscriptions lets ListUsers filter by the status of the users' subscriptions in subs.
+func (r *InMemoryUserRepository) JoinSubscriptions(subs *InMemorySubscriptionRepository) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs = subs
+}
+
+func (r *InMemoryUserRepository) ListUsers(ctx context.Context, params UserListParams) (*UserPage, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := params.cursor()
+	if err != nil {
+		return nil, err
+	}
+	var withStatus map[uuid.UUID]bool
+	if params.SubscriptionStatus != "" {
+		if r.subs == nil {
+			return nil, fmt.Errorf("subscription status filter requires JoinSubscriptions")
+		}
+		withStatus = r.subs.userIDsWithStatus(params.SubscriptionStatus)
+	}
+
+	r.mu.RLock()
+	var users []*models.User
+	for _, u := range r.users {
+		switch {
+		case u.DeletedAt != nil:
+		case params.Email != "" && !strings.Contains(strings.ToLower(u.Email), strings.ToLower(params.Email)):
+		case params.Name != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(params.Name)):
+		case params.CreatedFrom != nil && dbTime(u.CreatedAt).Before(*params.CreatedFrom):
+		case params.CreatedTo != nil && !dbTime(u.CreatedAt).Before(*params.CreatedTo):
+		case withStatus != nil && !withStatus[u.ID]:
+		default:
+			users = append(users, u)
+		}
+	}
+	r.mu.RUnlock()
+
+	compare := func(a, b *models.User) int {
+		if params.Desc {
+			return -compareUsers(params.Sort, a, b)
+		}
+		return compareUsers(params.Sort, a, b)
+	}
+	sort.Slice(users, func(i, j int) bool { return compare(users[i], users[j]) < 0 })
+	if cursor != nil {
+		last := &models.User{Email: cursor.Key, CreatedAt: cursor.createdAt()}
+		last.ID, _ = uuid.Parse(cursor.ID)
+		start := sort.Search(len(users), func(i int) bool { return compare(users[i], last) > 0 })
+		users = users[start:]
+	}
+	if len(users) > params.Limit+1 {
+		users = users[:params.Limit+1]
+	}
+	return params.page(users), nil
+}
+
 func (r *InMemoryUserRepository) CreateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	user.CreatedAt, user.UpdatedAt = dbTime(user.CreatedAt), dbTime(user.UpdatedAt)
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if _, exists := r.users[user.StripeCustomerID]; exists {
-		return nil, fmt.Errorf("user already exists")
+	for _, u := range r.users {
+		// Like the partial unique index of the SQL backends, deleted users release their email.
+		if u.StripeCustomerID == user.StripeCustomerID || (u.Email == user.Email && u.DeletedAt == nil) {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateUser, user.Email)
+		}
 	}
 	// Ensure name is set (should already be, but for safety)
 	if user.Name == "" {
@@ -60,16 +129,52 @@ func (r *InMemoryUserRepository) GetUserByStripeCustomerID(ctx context.Context,
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	user, exists := r.users[customerID]
-	if !exists {
+	if !exists || user.DeletedAt != nil {
 		return nil, fmt.Errorf("user not found")
 	}
 	return user, nil
 }
 
+func (r *InMemoryUserRepository) UpdateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var stored *models.User
+	for _, u := range r.users {
+		if u.ID == user.ID && u.DeletedAt == nil {
+			stored = u
+		} else if u.ID != user.ID && u.Email == user.Email && u.DeletedAt == nil {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateUser, user.Email)
+		}
+	}
+	if stored == nil {
+		return nil, fmt.Errorf("user not found: %s", user.ID)
+	}
+	stored.Email = user.Email
+	stored.Name = user.Name
+	stored.UpdatedAt = dbTime(user.UpdatedAt)
+	return stored, nil
+}
+
+func (r *InMemoryUserRepository) SoftDeleteUser(ctx context.Context, id string, deletedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.ID.String() == id && u.DeletedAt == nil {
+			at := dbTime(deletedAt)
+			u.DeletedAt = &at
+			u.UpdatedAt = at
+			return nil
+		}
+	}
+	return fmt.Errorf("user not found: %s", id)
+}
+
 // InMemorySubscriptionRepository implements SubscriptionRepository for dev/testing.
 type InMemorySubscriptionRepository struct {
-	mu             sync.RWMutex
-	subscriptions  map[string]*models.Subscription // key: StripeSubscriptionID
+	mu            sync.RWMutex
+	subscriptions map[string]*models.Subscription // key: StripeSubscriptionID
+	// trialEndNotified is the trial end each subscription's customer was last notified of.
+	trialEndNotified map[uuid.UUID]time.Time
 }
 
 // GetLatestSubscriptionByUserID returns the latest subscription (by created_at) for a user (in-memory)
@@ -102,9 +207,23 @@ func (r *InMemorySubscriptionRepository) GetSubscriptionByID(ctx context.Context
 	return nil, fmt.Errorf("subscription not found")
 }
 
+// userIDsWithStatus returns the users owning a subscription in the given status.
+func (r *InMemorySubscriptionRepository) userIDsWithStatus(status string) map[uuid.UUID]bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make(map[uuid.UUID]bool)
+	for _, sub := range r.subscriptions {
+		if sub.Status == status {
+			ids[sub.UserID] = true
+		}
+	}
+	return ids
+}
+
 func NewInMemorySubscriptionRepository() *InMemorySubscriptionRepository {
 	return &InMemorySubscriptionRepository{
-		subscriptions: make(map[string]*models.Subscription),
+		subscriptions:    make(map[string]*models.Subscription),
+		trialEndNotified: make(map[uuid.UUID]time.Time),
 	}
 }
 
@@ -140,6 +259,19 @@ func (r *InMemorySubscriptionRepository) UpdateSubscriptionStatus(ctx context.Co
 	return nil
 }
 
+func (r *InMemorySubscriptionRepository) UpdateSubscriptionStatusByID(ctx context.Context, id string, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sub := range r.subscriptions {
+		if sub.ID.String() == id {
+			sub.Status = status
+			sub.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return fmt.Errorf("subscription not found")
+}
+
 func (r *InMemorySubscriptionRepository) UpdateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -147,3 +279,383 @@ func (r *InMemorySubscriptionRepository) UpdateSubscription(ctx context.Context,
 	sub.UpdatedAt = time.Now()
 	return sub, nil
 }
+
+func (r *InMemorySubscriptionRepository) UpsertSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, exists := r.subscriptions[sub.StripeSubscriptionID]; exists {
+		existing.StripePriceID = sub.StripePriceID
+		existing.Status = sub.Status
+		existing.CurrentPeriodStart = sub.CurrentPeriodStart
+		existing.CurrentPeriodEnd = sub.CurrentPeriodEnd
+		existing.CancelAtPeriodEnd = sub.CancelAtPeriodEnd
+		existing.CanceledAt = sub.CanceledAt
+		existing.Discount = sub.Discount
+		existing.TrialStart = sub.TrialStart
+		existing.TrialEnd = sub.TrialEnd
+		existing.UpdatedAt = sub.UpdatedAt
+		return existing, nil
+	}
+	r.subscriptions[sub.StripeSubscriptionID] = sub
+	return sub, nil
+}
+
+func (r *InMemorySubscriptionRepository) ListTrialsEndingBetween(ctx context.Context, from, to time.Time) ([]*models.Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var subs []*models.Subscription
+	for _, sub := range r.subscriptions {
+		if sub.Status != models.SubscriptionStatusTrialing || sub.TrialEnd == nil || !sub.TrialEnd.After(from) || sub.TrialEnd.After(to) {
+			continue
+		}
+		if notified, ok := r.trialEndNotified[sub.ID]; ok && notified.Equal(*sub.TrialEnd) {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].TrialEnd.Before(*subs[j].TrialEnd) })
+	return subs, nil
+}
+
+func (r *InMemorySubscriptionRepository) ClaimTrialEndNotification(ctx context.Context, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sub := range r.subscriptions {
+		if sub.ID.String() != id || sub.TrialEnd == nil {
+			continue
+		}
+		if notified, ok := r.trialEndNotified[sub.ID]; ok && notified.Equal(*sub.TrialEnd) {
+			return false, nil
+		}
+		r.trialEndNotified[sub.ID] = *sub.TrialEnd
+		return true, nil
+	}
+	return false, nil
+}
+
+// InMemoryInvoiceRepository implements InvoiceRepository for dev/testing.
+type InMemoryInvoiceRepository struct {
+	mu       sync.RWMutex
+	invoices map[string]*models.Invoice // key: StripeInvoiceID
+}
+
+func NewInMemoryInvoiceRepository() *InMemoryInvoiceRepository {
+	return &InMemoryInvoiceRepository{
+		invoices: make(map[string]*models.Invoice),
+	}
+}
+
+func (r *InMemoryInvoiceRepository) UpsertInvoice(ctx context.Context, inv *models.Invoice) (*models.Invoice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *inv
+	for _, t := range []*time.Time{&stored.PeriodStart, &stored.PeriodEnd, &stored.IssuedAt, &stored.CreatedAt, &stored.UpdatedAt} {
+		*t = dbTime(*t)
+	}
+	if existing, exists := r.invoices[inv.StripeInvoiceID]; exists {
+		if existing.UpdatedAt.After(stored.UpdatedAt) {
+			copied := *existing
+			return &copied, nil
+		}
+		stored.ID, stored.UserID, stored.CreatedAt = existing.ID, existing.UserID, existing.CreatedAt
+	}
+	r.invoices[inv.StripeInvoiceID] = &stored
+	copied := stored
+	return &copied, nil
+}
+
+func (r *InMemoryInvoiceRepository) GetInvoiceByStripeInvoiceID(ctx context.Context, stripeInvoiceID string) (*models.Invoice, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	inv, exists := r.invoices[stripeInvoiceID]
+	if !exists {
+		return nil, fmt.Errorf("invoice not found")
+	}
+	copied := *inv
+	return &copied, nil
+}
+
+func (r *InMemoryInvoiceRepository) ListInvoicesByUserID(ctx context.Context, userID string, params InvoiceListParams) (*InvoicePage, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := params.cursor()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	var invoices []*models.Invoice
+	for _, inv := range r.invoices {
+		if inv.UserID.String() == userID {
+			copied := *inv
+			invoices = append(invoices, &copied)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(invoices, func(i, j int) bool { return compareInvoices(invoices[i], invoices[j]) < 0 })
+	if cursor != nil {
+		last := &models.Invoice{IssuedAt: cursor.IssuedAt}
+		last.ID, _ = uuid.Parse(cursor.ID)
+		start := sort.Search(len(invoices), func(i int) bool { return compareInvoices(invoices[i], last) > 0 })
+		invoices = invoices[start:]
+	}
+	if len(invoices) > params.Limit+1 {
+		invoices = invoices[:params.Limit+1]
+	}
+	return params.page(invoices), nil
+}
+
+// InMemoryDunningRepository implements DunningRepository for dev/testing.
+type InMemoryDunningRepository struct {
+	mu     sync.RWMutex
+	states map[uuid.UUID]*models.DunningState // key: SubscriptionID
+}
+
+func NewInMemoryDunningRepository() *InMemoryDunningRepository {
+	return &InMemoryDunningRepository{
+		states: make(map[uuid.UUID]*models.DunningState),
+	}
+}
+
+// copyDunningState copies a state, including the optional timestamps it points to.
+func copyDunningState(d *models.DunningState) *models.DunningState {
+	copied := *d
+	for _, t := range []**time.Time{&copied.NextRetryAt, &copied.GracePeriodEndsAt, &copied.NextStepAt, &copied.ResolvedAt} {
+		*t = dbNullTime(*t)
+	}
+	return &copied
+}
+
+func (r *InMemoryDunningRepository) UpsertDunningState(ctx context.Context, state *models.DunningState) (*models.DunningState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := copyDunningState(state)
+	for _, t := range []*time.Time{&stored.FirstFailedAt, &stored.LastEventAt, &stored.CreatedAt, &stored.UpdatedAt} {
+		*t = dbTime(*t)
+	}
+	if existing, exists := r.states[state.SubscriptionID]; exists {
+		if existing.LastEventAt.After(stored.LastEventAt) {
+			return copyDunningState(existing), nil
+		}
+		stored.ID, stored.CreatedAt = existing.ID, existing.CreatedAt
+	}
+	r.states[state.SubscriptionID] = stored
+	return copyDunningState(stored), nil
+}
+
+func (r *InMemoryDunningRepository) GetDunningStateBySubscriptionID(ctx context.Context, subscriptionID string) (*models.DunningState, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, err := uuid.Parse(subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("dunning state not found")
+	}
+	d, exists := r.states[id]
+	if !exists {
+		return nil, fmt.Errorf("dunning state not found")
+	}
+	return copyDunningState(d), nil
+}
+
+func (r *InMemoryDunningRepository) ListDueDunningStates(ctx context.Context, now time.Time, limit int) ([]*models.DunningState, error) {
+	r.mu.RLock()
+	var states []*models.DunningState
+	for _, d := range r.states {
+		if d.Status.Open() && d.NextStepAt != nil && !d.NextStepAt.After(now) {
+			states = append(states, copyDunningState(d))
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		if !states[i].NextStepAt.Equal(*states[j].NextStepAt) {
+			return states[i].NextStepAt.Before(*states[j].NextStepAt)
+		}
+		return states[i].ID.String() < states[j].ID.String()
+	})
+	if len(states) > limit {
+		states = states[:limit]
+	}
+	return states, nil
+}
+
+func (r *InMemoryDunningRepository) TransitionDunningState(ctx context.Context, state *models.DunningState, fromStatus models.DunningStatus, fromSteps int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, exists := r.states[state.SubscriptionID]
+	if !exists || d.ID != state.ID || d.Status != fromStatus || d.StepsDone != fromSteps {
+		return false, nil
+	}
+	d.Status, d.StepsDone = state.Status, state.StepsDone
+	d.NextStepAt, d.ResolvedAt = dbNullTime(state.NextStepAt), dbNullTime(state.ResolvedAt)
+	d.UpdatedAt = dbTime(state.UpdatedAt)
+	return true, nil
+}
+
+// InMemoryUsageRepository implements UsageRepository for dev/testing.
+type InMemoryUsageRepository struct {
+	mu      sync.RWMutex
+	records map[uuid.UUID]*models.UsageRecord
+}
+
+func NewInMemoryUsageRepository() *InMemoryUsageRepository {
+	return &InMemoryUsageRepository{
+		records: make(map[uuid.UUID]*models.UsageRecord),
+	}
+}
+
+// copyUsageRecord copies a record, including the optional timestamps it points to.
+func copyUsageRecord(u *models.UsageRecord) *models.UsageRecord {
+	copied := *u
+	copied.NextAttemptAt, copied.ReportedAt = dbNullTime(u.NextAttemptAt), dbNullTime(u.ReportedAt)
+	return &copied
+}
+
+func (r *InMemoryUsageRepository) CreateUsageRecord(ctx context.Context, rec *models.UsageRecord) (*models.UsageRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.records {
+		if u.SubscriptionID == rec.SubscriptionID && u.IdempotencyKey == rec.IdempotencyKey {
+			return copyUsageRecord(u), false, nil
+		}
+	}
+	stored := copyUsageRecord(rec)
+	for _, t := range []*time.Time{&stored.Timestamp, &stored.CreatedAt, &stored.UpdatedAt} {
+		*t = dbTime(*t)
+	}
+	r.records[stored.ID] = stored
+	return copyUsageRecord(stored), true, nil
+}
+
+func (r *InMemoryUsageRepository) ListDueUsageRecords(ctx context.Context, now time.Time, limit int) ([]*models.UsageRecord, error) {
+	r.mu.RLock()
+	var records []*models.UsageRecord
+	for _, u := range r.records {
+		if u.Status == models.UsageRecordStatusPending && u.NextAttemptAt != nil && !u.NextAttemptAt.After(now) {
+			records = append(records, copyUsageRecord(u))
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].NextAttemptAt.Equal(*records[j].NextAttemptAt) {
+			return records[i].NextAttemptAt.Before(*records[j].NextAttemptAt)
+		}
+		return records[i].ID.String() < records[j].ID.String()
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+func (r *InMemoryUsageRepository) ClaimUsageRecord(ctx context.Context, id uuid.UUID, from, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, exists := r.records[id]
+	if !exists || u.Status != models.UsageRecordStatusPending || u.NextAttemptAt == nil || !u.NextAttemptAt.Equal(dbTime(from)) {
+		return false, nil
+	}
+	u.NextAttemptAt = dbNullTime(&until)
+	u.Attempts++
+	return true, nil
+}
+
+func (r *InMemoryUsageRepository) UpdateUsageRecord(ctx context.Context, rec *models.UsageRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, exists := r.records[rec.ID]
+	if !exists {
+		return fmt.Errorf("usage record %s not found", rec.ID)
+	}
+	u.Status, u.LastError = rec.Status, rec.LastError
+	u.StripeSubscriptionItemID, u.StripeUsageRecordID = rec.StripeSubscriptionItemID, rec.StripeUsageRecordID
+	u.NextAttemptAt, u.ReportedAt = dbNullTime(rec.NextAttemptAt), dbNullTime(rec.ReportedAt)
+	u.UpdatedAt = dbTime(rec.UpdatedAt)
+	return nil
+}
+
+func (r *InMemoryUsageRepository) SummarizeUsage(ctx context.Context, subscriptionID string, from, to time.Time) (*models.UsageSummary, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	summary := &models.UsageSummary{}
+	for _, u := range r.records {
+		if u.SubscriptionID.String() == subscriptionID && !u.Timestamp.Before(from) && u.Timestamp.Before(to) {
+			addUsageTotal(summary, u.Status, u.Quantity, 1)
+		}
+	}
+	return summary, nil
+}
+
+// InMemoryStripeEventRepository implements StripeEventRepository for dev/testing.
+type InMemoryStripeEventRepository struct {
+	mu     sync.RWMutex
+	events map[string]*models.StripeEvent // key: Stripe event ID
+	locks  map[string]time.Time           // key: Stripe event ID, value: claim expiry
+}
+
+func NewInMemoryStripeEventRepository() *InMemoryStripeEventRepository {
+	return &InMemoryStripeEventRepository{
+		events: make(map[string]*models.StripeEvent),
+		locks:  make(map[string]time.Time),
+	}
+}
+
+func (r *InMemoryStripeEventRepository) RecordEvent(ctx context.Context, event *models.StripeEvent) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.events[event.ID]; exists {
+		return false, nil
+	}
+	e := *event
+	r.events[event.ID] = &e
+	return true, nil
+}
+
+func (r *InMemoryStripeEventRepository) GetEventByID(ctx context.Context, id string) (*models.StripeEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, exists := r.events[id]
+	if !exists {
+		return nil, fmt.Errorf("stripe event not found")
+	}
+	copied := *e
+	return &copied, nil
+}
+
+func (r *InMemoryStripeEventRepository) ClaimEvent(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, exists := r.events[id]
+	if !exists {
+		return false, nil
+	}
+	switch e.Status {
+	case models.StripeEventStatusPending, models.StripeEventStatusFailed:
+	case models.StripeEventStatusProcessing:
+		if lockedUntil, locked := r.locks[id]; locked && !lockedUntil.Before(now) {
+			return false, nil
+		}
+	default:
+		return false, nil
+	}
+	e.Status = models.StripeEventStatusProcessing
+	r.locks[id] = until
+	return true, nil
+}
+
+func (r *InMemoryStripeEventRepository) UpdateEventStatus(ctx context.Context, id string, status string, errMsg string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, exists := r.events[id]
+	if !exists {
+		return fmt.Errorf("stripe event not found")
+	}
+	now := time.Now()
+	e.Status = status
+	e.Error = errMsg
+	e.ProcessedAt = &now
+	delete(r.locks, id)
+	return nil
+}
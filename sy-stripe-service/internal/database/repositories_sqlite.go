@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"sy-stripe-service/internal/models"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
 )
 
 // parseAnyTime tries multiple layouts for SQLite time fields
@@ -26,12 +29,19 @@ func parseAnyTime(s string) (time.Time, error) {
 	return t, err
 }
 
+// sqlQuerier is satisfied by *sql.DB and *sql.Tx, so repositories can run inside a transaction.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type SQLiteUserRepository struct {
-	db *sql.DB
+	db sqlQuerier
 }
 
 func (r *SQLiteUserRepository) GetUserByID(ctx context.Context, id string) (*models.User, error) {
-	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE id = ?`
+	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE id = ? AND deleted_at IS NULL`
 	row := r.db.QueryRowContext(ctx, query, id)
 	var u models.User
 	var createdAtStr, updatedAtStr string
@@ -55,16 +65,20 @@ func NewSQLiteUserRepository(db *sql.DB) *SQLiteUserRepository {
 }
 
 func (r *SQLiteUserRepository) CreateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	user.CreatedAt, user.UpdatedAt = dbTime(user.CreatedAt), dbTime(user.UpdatedAt)
 	query := `INSERT INTO users (id, stripe_customer_id, email, name, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`
-	_, err := r.db.ExecContext(ctx, query, user.ID, user.StripeCustomerID, user.Email, user.Name, user.CreatedAt, user.UpdatedAt)
+	_, err := r.db.ExecContext(ctx, query, user.ID, user.StripeCustomerID, user.Email, user.Name, sqliteTime(user.CreatedAt), sqliteTime(user.UpdatedAt))
 	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return nil, fmt.Errorf("%w: %w", ErrDuplicateUser, err)
+		}
 		return nil, fmt.Errorf("failed to insert user: %w", err)
 	}
 	return user, nil
 }
 
 func (r *SQLiteUserRepository) GetUserByStripeCustomerID(ctx context.Context, customerID string) (*models.User, error) {
-	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE stripe_customer_id = ?`
+	query := `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE stripe_customer_id = ? AND deleted_at IS NULL`
 	row := r.db.QueryRowContext(ctx, query, customerID)
 	var u models.User
 	var createdAtStr, updatedAtStr string
@@ -84,7 +98,7 @@ func (r *SQLiteUserRepository) GetUserByStripeCustomerID(ctx context.Context, cu
 }
 
 func (r *SQLiteUserRepository) GetAllUsers(ctx context.Context) ([]*models.User, error) {
-	rows, err := r.db.QueryContext(ctx, `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users`)
+	rows, err := r.db.QueryContext(ctx, `SELECT id, stripe_customer_id, email, name, created_at, updated_at FROM users WHERE deleted_at IS NULL`)
 	if err != nil {
 		return nil, err
 	}
@@ -110,49 +124,108 @@ func (r *SQLiteUserRepository) GetAllUsers(ctx context.Context) ([]*models.User,
 	return users, nil
 }
 
-type SQLiteSubscriptionRepository struct {
-	db *sql.DB
+func (r *SQLiteUserRepository) UpdateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	user.UpdatedAt = dbTime(user.UpdatedAt)
+	query := `UPDATE users SET email = ?, name = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL`
+	res, err := r.db.ExecContext(ctx, query, user.Email, user.Name, sqliteTime(user.UpdatedAt), user.ID)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return nil, fmt.Errorf("%w: %w", ErrDuplicateUser, err)
+		}
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("user not found: %s", user.ID)
+	}
+	return r.GetUserByID(ctx, user.ID.String())
 }
 
-// GetLatestSubscriptionByUserID returns the latest subscription (by created_at) for a user (SQLite)
-func (r *SQLiteSubscriptionRepository) GetLatestSubscriptionByUserID(ctx context.Context, userID string) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at FROM subscriptions WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`
-	row := r.db.QueryRowContext(ctx, query, userID)
-	var s models.Subscription
-	var currentPeriodStartStr, currentPeriodEndStr, createdAtStr, updatedAtStr string
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &currentPeriodStartStr, &currentPeriodEndStr, &createdAtStr, &updatedAtStr)
+func (r *SQLiteUserRepository) SoftDeleteUser(ctx context.Context, id string, deletedAt time.Time) error {
+	at := sqliteTime(deletedAt)
+	res, err := r.db.ExecContext(ctx, `UPDATE users SET deleted_at = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL`, at, at, id)
 	if err != nil {
-		return nil, fmt.Errorf("subscription not found: %w", err)
+		return fmt.Errorf("failed to delete user: %w", err)
 	}
-	s.CurrentPeriodStart, err = parseAnyTime(currentPeriodStartStr)
-	if err != nil {
-		return nil, fmt.Errorf("parse current_period_start: %w", err)
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user not found: %s", id)
 	}
-	s.CurrentPeriodEnd, err = parseAnyTime(currentPeriodEndStr)
-	if err != nil {
-		return nil, fmt.Errorf("parse current_period_end: %w", err)
+	return nil
+}
+
+func (r *SQLiteUserRepository) ListUsers(ctx context.Context, params UserListParams) (*UserPage, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
 	}
-	s.CreatedAt, err = parseAnyTime(createdAtStr)
+	cursor, err := params.cursor()
 	if err != nil {
-		return nil, fmt.Errorf("parse created_at: %w", err)
+		return nil, err
 	}
-	s.UpdatedAt, err = parseAnyTime(updatedAtStr)
+	query, args := listUsersQuery(DialectSQLite, &params, cursor)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("parse updated_at: %w", err)
+		return nil, fmt.Errorf("failed to list users: %w", err)
 	}
-	return &s, nil
+	defer rows.Close()
+	var users []*models.User
+	for rows.Next() {
+		var u models.User
+		var createdAtStr, updatedAtStr string
+		if err := rows.Scan(&u.ID, &u.StripeCustomerID, &u.Email, &u.Name, &createdAtStr, &updatedAtStr); err != nil {
+			return nil, err
+		}
+		if u.CreatedAt, err = parseAnyTime(createdAtStr); err != nil {
+			return nil, fmt.Errorf("parse created_at: %w", err)
+		}
+		if u.UpdatedAt, err = parseAnyTime(updatedAtStr); err != nil {
+			return nil, fmt.Errorf("parse updated_at: %w", err)
+		}
+		users = append(users, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	return params.page(users), nil
 }
 
+type SQLiteSubscriptionRepository struct {
+	db sqlQuerier
+}
 
-func (r *SQLiteSubscriptionRepository) GetSubscriptionByID(ctx context.Context, id string) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at FROM subscriptions WHERE id = ?`
-	row := r.db.QueryRowContext(ctx, query, id)
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSQLiteSubscription scans a row selected with subscriptionColumns, parsing the TEXT timestamps.
+func scanSQLiteSubscription(row rowScanner) (*models.Subscription, error) {
 	var s models.Subscription
 	var currentPeriodStartStr, currentPeriodEndStr, createdAtStr, updatedAtStr string
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &currentPeriodStartStr, &currentPeriodEndStr, &createdAtStr, &updatedAtStr)
+	var canceledAtStr, discountEndsAtStr, trialStartStr, trialEndStr sql.NullString
+	var d models.SubscriptionDiscount
+	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &currentPeriodStartStr, &currentPeriodEndStr, &s.CancelAtPeriodEnd, &canceledAtStr, &createdAtStr, &updatedAtStr,
+		&d.CouponID, &d.CouponName, &d.PromotionCodeID, &d.PercentOff, &d.AmountOff, &d.Currency, &d.Duration, &discountEndsAtStr, &trialStartStr, &trialEndStr)
 	if err != nil {
-		return nil, fmt.Errorf("subscription not found: %w", err)
+		return nil, err
 	}
+	for _, f := range []struct {
+		name string
+		src  sql.NullString
+		dst  **time.Time
+	}{
+		{"discount_ends_at", discountEndsAtStr, &d.EndsAt},
+		{"trial_start", trialStartStr, &s.TrialStart},
+		{"trial_end", trialEndStr, &s.TrialEnd},
+	} {
+		if !f.src.Valid {
+			continue
+		}
+		t, err := parseAnyTime(f.src.String)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
+		}
+		*f.dst = &t
+	}
+	s.Discount = subscriptionDiscount(d)
 	s.CurrentPeriodStart, err = parseAnyTime(currentPeriodStartStr)
 	if err != nil {
 		return nil, fmt.Errorf("parse current_period_start: %w", err)
@@ -161,6 +234,13 @@ func (r *SQLiteSubscriptionRepository) GetSubscriptionByID(ctx context.Context,
 	if err != nil {
 		return nil, fmt.Errorf("parse current_period_end: %w", err)
 	}
+	if canceledAtStr.Valid {
+		canceledAt, err := parseAnyTime(canceledAtStr.String)
+		if err != nil {
+			return nil, fmt.Errorf("parse canceled_at: %w", err)
+		}
+		s.CanceledAt = &canceledAt
+	}
 	s.CreatedAt, err = parseAnyTime(createdAtStr)
 	if err != nil {
 		return nil, fmt.Errorf("parse created_at: %w", err)
@@ -172,13 +252,35 @@ func (r *SQLiteSubscriptionRepository) GetSubscriptionByID(ctx context.Context,
 	return &s, nil
 }
 
+// GetLatestSubscriptionByUserID returns the latest subscription (by created_at) for a user (SQLite)
+func (r *SQLiteSubscriptionRepository) GetLatestSubscriptionByUserID(ctx context.Context, userID string) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`
+	s, err := scanSQLiteSubscription(r.db.QueryRowContext(ctx, query, userID))
+	if err != nil {
+		return nil, fmt.Errorf("subscription not found: %w", err)
+	}
+	return s, nil
+}
+
+
+func (r *SQLiteSubscriptionRepository) GetSubscriptionByID(ctx context.Context, id string) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE id = ?`
+	s, err := scanSQLiteSubscription(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, fmt.Errorf("subscription not found: %w", err)
+	}
+	return s, nil
+}
+
 func NewSQLiteSubscriptionRepository(db *sql.DB) *SQLiteSubscriptionRepository {
 	return &SQLiteSubscriptionRepository{db: db}
 }
 
 func (r *SQLiteSubscriptionRepository) CreateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
-	query := `INSERT INTO subscriptions (id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
-	_, err := r.db.ExecContext(ctx, query, sub.ID, sub.UserID, sub.StripeSubscriptionID, sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CreatedAt, sub.UpdatedAt)
+	query := `INSERT INTO subscriptions (` + subscriptionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	args := append([]interface{}{sub.ID, sub.UserID, sub.StripeSubscriptionID, sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd, sub.CanceledAt, sub.CreatedAt, sub.UpdatedAt}, subscriptionDiscountArgs(sub.Discount)...)
+	args = append(args, sqliteNullTime(sub.TrialStart), sqliteNullTime(sub.TrialEnd))
+	_, err := r.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert subscription: %w", err)
 	}
@@ -186,31 +288,12 @@ func (r *SQLiteSubscriptionRepository) CreateSubscription(ctx context.Context, s
 }
 
 func (r *SQLiteSubscriptionRepository) GetSubscriptionByStripeSubscriptionID(ctx context.Context, subID string) (*models.Subscription, error) {
-	query := `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at FROM subscriptions WHERE stripe_subscription_id = ?`
-	row := r.db.QueryRowContext(ctx, query, subID)
-	var s models.Subscription
-	var currentPeriodStartStr, currentPeriodEndStr, createdAtStr, updatedAtStr string
-	err := row.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &currentPeriodStartStr, &currentPeriodEndStr, &createdAtStr, &updatedAtStr)
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE stripe_subscription_id = ?`
+	s, err := scanSQLiteSubscription(r.db.QueryRowContext(ctx, query, subID))
 	if err != nil {
 		return nil, fmt.Errorf("subscription not found: %w", err)
 	}
-	s.CurrentPeriodStart, err = parseAnyTime(currentPeriodStartStr)
-	if err != nil {
-		return nil, fmt.Errorf("parse current_period_start: %w", err)
-	}
-	s.CurrentPeriodEnd, err = parseAnyTime(currentPeriodEndStr)
-	if err != nil {
-		return nil, fmt.Errorf("parse current_period_end: %w", err)
-	}
-	s.CreatedAt, err = parseAnyTime(createdAtStr)
-	if err != nil {
-		return nil, fmt.Errorf("parse created_at: %w", err)
-	}
-	s.UpdatedAt, err = parseAnyTime(updatedAtStr)
-	if err != nil {
-		return nil, fmt.Errorf("parse updated_at: %w", err)
-	}
-	return &s, nil
+	return s, nil
 }
 
 func (r *SQLiteSubscriptionRepository) UpdateSubscriptionStatus(ctx context.Context, subID string, status string) error {
@@ -223,46 +306,497 @@ func (r *SQLiteSubscriptionRepository) UpdateSubscriptionStatus(ctx context.Cont
 	return nil
 }
 
+func (r *SQLiteSubscriptionRepository) UpdateSubscriptionStatusByID(ctx context.Context, id string, status string) error {
+	query := `UPDATE subscriptions SET status = ?, updated_at = ? WHERE id = ?`
+	updatedAt := sqliteTime(time.Now())
+	res, err := r.db.ExecContext(ctx, query, status, updatedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update subscription status: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update subscription status: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("subscription not found")
+	}
+	return nil
+}
+
 func (r *SQLiteSubscriptionRepository) UpdateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
-	query := `UPDATE subscriptions SET status = ?, current_period_start = ?, current_period_end = ?, updated_at = ? WHERE stripe_subscription_id = ?`
-	_, err := r.db.ExecContext(ctx, query, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.UpdatedAt, sub.StripeSubscriptionID)
+	query := `UPDATE subscriptions SET stripe_price_id = ?, status = ?, current_period_start = ?, current_period_end = ?, cancel_at_period_end = ?, canceled_at = ?, updated_at = ?,
+		discount_coupon_id = ?, discount_coupon_name = ?, discount_promotion_code_id = ?, discount_percent_off = ?, discount_amount_off = ?, discount_currency = ?, discount_duration = ?, discount_ends_at = ?,
+		trial_start = ?, trial_end = ?
+		WHERE stripe_subscription_id = ?`
+	args := append([]interface{}{sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd, sub.CanceledAt, sub.UpdatedAt}, subscriptionDiscountArgs(sub.Discount)...)
+	args = append(args, sqliteNullTime(sub.TrialStart), sqliteNullTime(sub.TrialEnd))
+	_, err := r.db.ExecContext(ctx, query, append(args, sub.StripeSubscriptionID)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update subscription: %w", err)
 	}
 	return sub, nil
 }
 
+func (r *SQLiteSubscriptionRepository) UpsertSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
+	query := `INSERT INTO subscriptions (` + subscriptionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (stripe_subscription_id) DO UPDATE SET stripe_price_id = excluded.stripe_price_id, status = excluded.status, current_period_start = excluded.current_period_start, current_period_end = excluded.current_period_end, cancel_at_period_end = excluded.cancel_at_period_end, canceled_at = excluded.canceled_at, updated_at = excluded.updated_at, ` + subscriptionDiscountUpdate + `,
+			trial_start = excluded.trial_start, trial_end = excluded.trial_end`
+	args := append([]interface{}{sub.ID, sub.UserID, sub.StripeSubscriptionID, sub.StripePriceID, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAtPeriodEnd, sub.CanceledAt, sub.CreatedAt, sub.UpdatedAt}, subscriptionDiscountArgs(sub.Discount)...)
+	args = append(args, sqliteNullTime(sub.TrialStart), sqliteNullTime(sub.TrialEnd))
+	_, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert subscription: %w", err)
+	}
+	return r.GetSubscriptionByStripeSubscriptionID(ctx, sub.StripeSubscriptionID)
+}
+
+func (r *SQLiteSubscriptionRepository) ListTrialsEndingBetween(ctx context.Context, from, to time.Time) ([]*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions
+		WHERE status = ? AND trial_end > ? AND trial_end <= ? AND trial_end_notified IS NOT trial_end
+		ORDER BY trial_end`
+	rows, err := r.db.QueryContext(ctx, query, models.SubscriptionStatusTrialing, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ending trials: %w", err)
+	}
+	defer rows.Close()
+	var subs []*models.Subscription
+	for rows.Next() {
+		s, err := scanSQLiteSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func (r *SQLiteSubscriptionRepository) ClaimTrialEndNotification(ctx context.Context, id string) (bool, error) {
+	query := `UPDATE subscriptions SET trial_end_notified = trial_end
+		WHERE id = ? AND trial_end IS NOT NULL AND trial_end_notified IS NOT trial_end`
+	res, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim trial end notification: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
 func (r *SQLiteSubscriptionRepository) GetAllSubscriptions(ctx context.Context) ([]*models.Subscription, error) {
-	rows, err := r.db.QueryContext(ctx, `SELECT id, user_id, stripe_subscription_id, stripe_price_id, status, current_period_start, current_period_end, created_at, updated_at FROM subscriptions`)
+	rows, err := r.db.QueryContext(ctx, `SELECT `+subscriptionColumns+` FROM subscriptions`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var subs []*models.Subscription
 	for rows.Next() {
-		var s models.Subscription
-		var currentPeriodStartStr, currentPeriodEndStr, createdAtStr, updatedAtStr string
-		err := rows.Scan(&s.ID, &s.UserID, &s.StripeSubscriptionID, &s.StripePriceID, &s.Status, &currentPeriodStartStr, &currentPeriodEndStr, &createdAtStr, &updatedAtStr)
+		s, err := scanSQLiteSubscription(rows)
 		if err != nil {
 			return nil, err
 		}
-		s.CurrentPeriodStart, err = parseAnyTime(currentPeriodStartStr)
+		subs = append(subs, s)
+	}
+	return subs, nil
+}
+
+type SQLiteInvoiceRepository struct {
+	db sqlQuerier
+}
+
+func NewSQLiteInvoiceRepository(db *sql.DB) *SQLiteInvoiceRepository {
+	return &SQLiteInvoiceRepository{db: db}
+}
+
+// scanSQLiteInvoice scans a row selected with invoiceColumns, parsing the TEXT timestamps.
+func scanSQLiteInvoice(row rowScanner) (*models.Invoice, error) {
+	var i models.Invoice
+	var periodStartStr, periodEndStr, issuedAtStr, createdAtStr, updatedAtStr string
+	err := row.Scan(&i.ID, &i.UserID, &i.StripeInvoiceID, &i.StripeSubscriptionID, &i.Number, &i.Status, &i.Currency, &i.AmountDue, &i.AmountPaid, &i.HostedInvoiceURL, &i.InvoicePDF, &periodStartStr, &periodEndStr, &issuedAtStr, &createdAtStr, &updatedAtStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		name string
+		src  string
+		dst  *time.Time
+	}{
+		{"period_start", periodStartStr, &i.PeriodStart},
+		{"period_end", periodEndStr, &i.PeriodEnd},
+		{"issued_at", issuedAtStr, &i.IssuedAt},
+		{"created_at", createdAtStr, &i.CreatedAt},
+		{"updated_at", updatedAtStr, &i.UpdatedAt},
+	} {
+		if *f.dst, err = parseAnyTime(f.src); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
+		}
+	}
+	return &i, nil
+}
+
+func (r *SQLiteInvoiceRepository) UpsertInvoice(ctx context.Context, inv *models.Invoice) (*models.Invoice, error) {
+	query := `INSERT INTO invoices (` + invoiceColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		` + invoiceUpsertSet
+	_, err := r.db.ExecContext(ctx, query, inv.ID, inv.UserID, inv.StripeInvoiceID, inv.StripeSubscriptionID, inv.Number, inv.Status, inv.Currency, inv.AmountDue, inv.AmountPaid, inv.HostedInvoiceURL, inv.InvoicePDF,
+		sqliteTime(inv.PeriodStart), sqliteTime(inv.PeriodEnd), sqliteTime(inv.IssuedAt), sqliteTime(inv.CreatedAt), sqliteTime(inv.UpdatedAt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert invoice: %w", err)
+	}
+	return r.GetInvoiceByStripeInvoiceID(ctx, inv.StripeInvoiceID)
+}
+
+func (r *SQLiteInvoiceRepository) GetInvoiceByStripeInvoiceID(ctx context.Context, stripeInvoiceID string) (*models.Invoice, error) {
+	query := `SELECT ` + invoiceColumns + ` FROM invoices WHERE stripe_invoice_id = ?`
+	i, err := scanSQLiteInvoice(r.db.QueryRowContext(ctx, query, stripeInvoiceID))
+	if err != nil {
+		return nil, fmt.Errorf("invoice not found: %w", err)
+	}
+	return i, nil
+}
+
+func (r *SQLiteInvoiceRepository) ListInvoicesByUserID(ctx context.Context, userID string, params InvoiceListParams) (*InvoicePage, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := params.cursor()
+	if err != nil {
+		return nil, err
+	}
+	query, args := listInvoicesQuery(DialectSQLite, userID, &params, cursor)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	defer rows.Close()
+	var invoices []*models.Invoice
+	for rows.Next() {
+		i, err := scanSQLiteInvoice(rows)
 		if err != nil {
-			return nil, fmt.Errorf("parse current_period_start: %w", err)
+			return nil, err
+		}
+		invoices = append(invoices, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	return params.page(invoices), nil
+}
+
+type SQLiteDunningRepository struct {
+	db sqlQuerier
+}
+
+func NewSQLiteDunningRepository(db *sql.DB) *SQLiteDunningRepository {
+	return &SQLiteDunningRepository{db: db}
+}
+
+// sqliteNullTime is sqliteTime for optional timestamps.
+func sqliteNullTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return sqliteTime(*t)
+}
+
+// scanSQLiteDunningState scans a row selected with dunningColumns, parsing the TEXT timestamps.
+func scanSQLiteDunningState(row rowScanner) (*models.DunningState, error) {
+	var d models.DunningState
+	var firstFailedAtStr, lastEventAtStr, createdAtStr, updatedAtStr string
+	var nextRetryAtStr, gracePeriodEndsAtStr, nextStepAtStr, resolvedAtStr sql.NullString
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.UserID, &d.StripeInvoiceID, &d.Status, &d.AttemptCount, &nextRetryAtStr, &firstFailedAtStr, &gracePeriodEndsAtStr, &d.StepsDone, &nextStepAtStr, &resolvedAtStr, &lastEventAtStr, &createdAtStr, &updatedAtStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		name string
+		src  string
+		dst  *time.Time
+	}{
+		{"first_failed_at", firstFailedAtStr, &d.FirstFailedAt},
+		{"last_event_at", lastEventAtStr, &d.LastEventAt},
+		{"created_at", createdAtStr, &d.CreatedAt},
+		{"updated_at", updatedAtStr, &d.UpdatedAt},
+	} {
+		if *f.dst, err = parseAnyTime(f.src); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
 		}
-		s.CurrentPeriodEnd, err = parseAnyTime(currentPeriodEndStr)
+	}
+	for _, f := range []struct {
+		name string
+		src  sql.NullString
+		dst  **time.Time
+	}{
+		{"next_retry_at", nextRetryAtStr, &d.NextRetryAt},
+		{"grace_period_ends_at", gracePeriodEndsAtStr, &d.GracePeriodEndsAt},
+		{"next_step_at", nextStepAtStr, &d.NextStepAt},
+		{"resolved_at", resolvedAtStr, &d.ResolvedAt},
+	} {
+		if !f.src.Valid {
+			continue
+		}
+		t, err := parseAnyTime(f.src.String)
 		if err != nil {
-			return nil, fmt.Errorf("parse current_period_end: %w", err)
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
 		}
-		s.CreatedAt, err = parseAnyTime(createdAtStr)
+		*f.dst = &t
+	}
+	return &d, nil
+}
+
+func (r *SQLiteDunningRepository) UpsertDunningState(ctx context.Context, state *models.DunningState) (*models.DunningState, error) {
+	query := `INSERT INTO dunning_states (` + dunningColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		` + dunningUpsertSet
+	_, err := r.db.ExecContext(ctx, query, state.ID, state.SubscriptionID, state.UserID, state.StripeInvoiceID, state.Status, state.AttemptCount, sqliteNullTime(state.NextRetryAt), sqliteTime(state.FirstFailedAt),
+		sqliteNullTime(state.GracePeriodEndsAt), state.StepsDone, sqliteNullTime(state.NextStepAt), sqliteNullTime(state.ResolvedAt), sqliteTime(state.LastEventAt), sqliteTime(state.CreatedAt), sqliteTime(state.UpdatedAt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert dunning state: %w", err)
+	}
+	return r.GetDunningStateBySubscriptionID(ctx, state.SubscriptionID.String())
+}
+
+func (r *SQLiteDunningRepository) GetDunningStateBySubscriptionID(ctx context.Context, subscriptionID string) (*models.DunningState, error) {
+	query := `SELECT ` + dunningColumns + ` FROM dunning_states WHERE subscription_id = ?`
+	d, err := scanSQLiteDunningState(r.db.QueryRowContext(ctx, query, subscriptionID))
+	if err != nil {
+		return nil, fmt.Errorf("dunning state not found: %w", err)
+	}
+	return d, nil
+}
+
+func (r *SQLiteDunningRepository) ListDueDunningStates(ctx context.Context, now time.Time, limit int) ([]*models.DunningState, error) {
+	query := `SELECT ` + dunningColumns + ` FROM dunning_states WHERE status IN ` + dunningOpenStatuses + ` AND next_step_at <= ? ORDER BY next_step_at, id LIMIT ?`
+	rows, err := r.db.QueryContext(ctx, query, sqliteTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list due dunning states: %w", err)
+	}
+	defer rows.Close()
+	var states []*models.DunningState
+	for rows.Next() {
+		d, err := scanSQLiteDunningState(rows)
 		if err != nil {
-			return nil, fmt.Errorf("parse created_at: %w", err)
+			return nil, err
 		}
-		s.UpdatedAt, err = parseAnyTime(updatedAtStr)
+		states = append(states, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list due dunning states: %w", err)
+	}
+	return states, nil
+}
+
+func (r *SQLiteDunningRepository) TransitionDunningState(ctx context.Context, state *models.DunningState, fromStatus models.DunningStatus, fromSteps int) (bool, error) {
+	query := `UPDATE dunning_states SET status = ?, steps_done = ?, next_step_at = ?, resolved_at = ?, updated_at = ? WHERE id = ? AND status = ? AND steps_done = ?`
+	res, err := r.db.ExecContext(ctx, query, state.Status, state.StepsDone, sqliteNullTime(state.NextStepAt), sqliteNullTime(state.ResolvedAt), sqliteTime(state.UpdatedAt), state.ID, fromStatus, fromSteps)
+	if err != nil {
+		return false, fmt.Errorf("failed to update dunning state: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update dunning state: %w", err)
+	}
+	return n == 1, nil
+}
+
+type SQLiteUsageRepository struct {
+	db sqlQuerier
+}
+
+func NewSQLiteUsageRepository(db *sql.DB) *SQLiteUsageRepository {
+	return &SQLiteUsageRepository{db: db}
+}
+
+// scanSQLiteUsageRecord scans a row selected with usageColumns, parsing the TEXT timestamps.
+func scanSQLiteUsageRecord(row rowScanner) (*models.UsageRecord, error) {
+	var u models.UsageRecord
+	var timestampStr, createdAtStr, updatedAtStr string
+	var nextAttemptAtStr, reportedAtStr sql.NullString
+	err := row.Scan(&u.ID, &u.SubscriptionID, &u.IdempotencyKey, &u.Quantity, &timestampStr, &u.Status, &u.Attempts, &nextAttemptAtStr, &u.LastError, &u.StripeSubscriptionItemID, &u.StripeUsageRecordID, &reportedAtStr, &createdAtStr, &updatedAtStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		name string
+		src  string
+		dst  *time.Time
+	}{
+		{"timestamp", timestampStr, &u.Timestamp},
+		{"created_at", createdAtStr, &u.CreatedAt},
+		{"updated_at", updatedAtStr, &u.UpdatedAt},
+	} {
+		if *f.dst, err = parseAnyTime(f.src); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		src  sql.NullString
+		dst  **time.Time
+	}{
+		{"next_attempt_at", nextAttemptAtStr, &u.NextAttemptAt},
+		{"reported_at", reportedAtStr, &u.ReportedAt},
+	} {
+		if !f.src.Valid {
+			continue
+		}
+		t, err := parseAnyTime(f.src.String)
 		if err != nil {
-			return nil, fmt.Errorf("parse updated_at: %w", err)
+			return nil, fmt.Errorf("parse %s: %w", f.name, err)
 		}
-		subs = append(subs, &s)
+		*f.dst = &t
 	}
-	return subs, nil
+	return &u, nil
+}
+
+func (r *SQLiteUsageRepository) CreateUsageRecord(ctx context.Context, rec *models.UsageRecord) (*models.UsageRecord, bool, error) {
+	query := `INSERT INTO usage_records (` + usageColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (subscription_id, idempotency_key) DO NOTHING`
+	res, err := r.db.ExecContext(ctx, query, rec.ID, rec.SubscriptionID, rec.IdempotencyKey, rec.Quantity, sqliteTime(rec.Timestamp), rec.Status, rec.Attempts, sqliteNullTime(rec.NextAttemptAt),
+		rec.LastError, rec.StripeSubscriptionItemID, rec.StripeUsageRecordID, sqliteNullTime(rec.ReportedAt), sqliteTime(rec.CreatedAt), sqliteTime(rec.UpdatedAt))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create usage record: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create usage record: %w", err)
+	}
+	query = `SELECT ` + usageColumns + ` FROM usage_records WHERE subscription_id = ? AND idempotency_key = ?`
+	stored, err := scanSQLiteUsageRecord(r.db.QueryRowContext(ctx, query, rec.SubscriptionID, rec.IdempotencyKey))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load usage record: %w", err)
+	}
+	return stored, n == 1, nil
+}
+
+func (r *SQLiteUsageRepository) ListDueUsageRecords(ctx context.Context, now time.Time, limit int) ([]*models.UsageRecord, error) {
+	query := `SELECT ` + usageColumns + ` FROM usage_records WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?`
+	rows, err := r.db.QueryContext(ctx, query, models.UsageRecordStatusPending, sqliteTime(now), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list due usage records: %w", err)
+	}
+	defer rows.Close()
+	var records []*models.UsageRecord
+	for rows.Next() {
+		u, err := scanSQLiteUsageRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list due usage records: %w", err)
+	}
+	return records, nil
+}
+
+func (r *SQLiteUsageRepository) ClaimUsageRecord(ctx context.Context, id uuid.UUID, from, until time.Time) (bool, error) {
+	query := `UPDATE usage_records SET next_attempt_at = ?, attempts = attempts + 1 WHERE id = ? AND status = ? AND next_attempt_at = ?`
+	res, err := r.db.ExecContext(ctx, query, sqliteTime(until), id, models.UsageRecordStatusPending, sqliteTime(from))
+	if err != nil {
+		return false, fmt.Errorf("failed to claim usage record: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim usage record: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (r *SQLiteUsageRepository) UpdateUsageRecord(ctx context.Context, rec *models.UsageRecord) error {
+	query := `UPDATE usage_records SET status = ?, next_attempt_at = ?, last_error = ?, stripe_subscription_item_id = ?, stripe_usage_record_id = ?, reported_at = ?, updated_at = ? WHERE id = ?`
+	_, err := r.db.ExecContext(ctx, query, rec.Status, sqliteNullTime(rec.NextAttemptAt), rec.LastError, rec.StripeSubscriptionItemID, rec.StripeUsageRecordID, sqliteNullTime(rec.ReportedAt), sqliteTime(rec.UpdatedAt), rec.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update usage record: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteUsageRepository) SummarizeUsage(ctx context.Context, subscriptionID string, from, to time.Time) (*models.UsageSummary, error) {
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf(usageSummarySelect, "?", "?", "?"), subscriptionID, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize usage: %w", err)
+	}
+	defer rows.Close()
+	summary := &models.UsageSummary{}
+	for rows.Next() {
+		var status models.UsageRecordStatus
+		var quantity, records int64
+		if err := rows.Scan(&status, &quantity, &records); err != nil {
+			return nil, fmt.Errorf("failed to summarize usage: %w", err)
+		}
+		addUsageTotal(summary, status, quantity, records)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to summarize usage: %w", err)
+	}
+	return summary, nil
+}
+
+type SQLiteStripeEventRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteStripeEventRepository(db *sql.DB) *SQLiteStripeEventRepository {
+	return &SQLiteStripeEventRepository{db: db}
+}
+
+func (r *SQLiteStripeEventRepository) RecordEvent(ctx context.Context, event *models.StripeEvent) (bool, error) {
+	query := `INSERT INTO stripe_events (id, type, payload, status, error, received_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`
+	res, err := r.db.ExecContext(ctx, query, event.ID, event.Type, event.Payload, event.Status, event.Error, event.ReceivedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record stripe event: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record stripe event: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (r *SQLiteStripeEventRepository) GetEventByID(ctx context.Context, id string) (*models.StripeEvent, error) {
+	query := `SELECT id, type, payload, status, error, received_at, processed_at FROM stripe_events WHERE id = ?`
+	row := r.db.QueryRowContext(ctx, query, id)
+	var e models.StripeEvent
+	var receivedAtStr string
+	var processedAtStr sql.NullString
+	err := row.Scan(&e.ID, &e.Type, &e.Payload, &e.Status, &e.Error, &receivedAtStr, &processedAtStr)
+	if err != nil {
+		return nil, fmt.Errorf("stripe event not found: %w", err)
+	}
+	e.ReceivedAt, err = parseAnyTime(receivedAtStr)
+	if err != nil {
+		return nil, fmt.Errorf("parse received_at: %w", err)
+	}
+	if processedAtStr.Valid {
+		processedAt, err := parseAnyTime(processedAtStr.String)
+		if err != nil {
+			return nil, fmt.Errorf("parse processed_at: %w", err)
+		}
+		e.ProcessedAt = &processedAt
+	}
+	return &e, nil
+}
+
+func (r *SQLiteStripeEventRepository) ClaimEvent(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	query := `UPDATE stripe_events SET status = 'processing', locked_until = ?
+		WHERE id = ? AND (status IN ('pending', 'failed') OR (status = 'processing' AND (locked_until IS NULL OR locked_until < ?)))`
+	res, err := r.db.ExecContext(ctx, query, sqliteTime(until), id, sqliteTime(now))
+	if err != nil {
+		return false, fmt.Errorf("failed to claim stripe event: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim stripe event: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (r *SQLiteStripeEventRepository) UpdateEventStatus(ctx context.Context, id string, status string, errMsg string) error {
+	query := `UPDATE stripe_events SET status = ?, error = ?, processed_at = ?, locked_until = NULL WHERE id = ?`
+	processedAt := time.Now().Format(time.RFC3339)
+	_, err := r.db.ExecContext(ctx, query, status, errMsg, processedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update stripe event status: %w", err)
+	}
+	return nil
 }
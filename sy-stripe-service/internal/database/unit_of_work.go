@@ -0,0 +1,281 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sy-stripe-service/internal/models"
+)
+
+// Repos are the repositories bound to one unit of work.
+type Repos struct {
+	Users         UserRepository
+	Subscriptions SubscriptionRepository
+}
+
+// UnitOfWork runs a group of repository writes atomically.
+type UnitOfWork interface {
+	// WithTx calls fn with repositories bound to a new transaction. The transaction is committed
+	// when fn returns nil and rolled back when it returns an error or panics.
+	// fn must only use the repositories it is given.
+	WithTx(ctx context.Context, fn func(repos Repos) error) error
+}
+
+// PostgresUnitOfWork implements UnitOfWork with a pgx transaction.
+type PostgresUnitOfWork struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresUnitOfWork(pool *pgxpool.Pool) *PostgresUnitOfWork {
+	return &PostgresUnitOfWork{pool: pool}
+}
+
+func (u *PostgresUnitOfWork) WithTx(ctx context.Context, fn func(repos Repos) error) error {
+	tx, err := u.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Rolling back a committed transaction is a no-op.
+	defer tx.Rollback(ctx)
+	if err := fn(Repos{
+		Users:         &PostgresUserRepository{pool: tx},
+		Subscriptions: &PostgresSubscriptionRepository{pool: tx},
+	}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// SQLiteUnitOfWork implements UnitOfWork with a database/sql transaction.
+type SQLiteUnitOfWork struct {
+	db *sql.DB
+}
+
+func NewSQLiteUnitOfWork(db *sql.DB) *SQLiteUnitOfWork {
+	return &SQLiteUnitOfWork{db: db}
+}
+
+func (u *SQLiteUnitOfWork) WithTx(ctx context.Context, fn func(repos Repos) error) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Rolling back a committed transaction is a no-op.
+	defer tx.Rollback()
+	if err := fn(Repos{
+		Users:         &SQLiteUserRepository{db: tx},
+		Subscriptions: &SQLiteSubscriptionRepository{db: tx},
+	}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// InMemoryUnitOfWork implements UnitOfWork for the in-memory repositories. fn gets repositories
+// that record the state of every row before its first change, and a failed unit of work restores
+// just those rows, so writes made to other rows in the meantime are kept. Units of work are serialized.
+type InMemoryUnitOfWork struct {
+	mu    sync.Mutex
+	users *InMemoryUserRepository
+	subs  *InMemorySubscriptionRepository
+}
+
+func NewInMemoryUnitOfWork(users *InMemoryUserRepository, subs *InMemorySubscriptionRepository) *InMemoryUnitOfWork {
+	return &InMemoryUnitOfWork{users: users, subs: subs}
+}
+
+func (u *InMemoryUnitOfWork) WithTx(ctx context.Context, fn func(repos Repos) error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	undo := &inMemoryUndoLog{
+		users:     make(map[string]*models.User),
+		subs:      make(map[string]*models.Subscription),
+		trialEnds: make(map[uuid.UUID]*time.Time),
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			undo.rollback(u.users, u.subs)
+		}
+	}()
+	if err := fn(Repos{
+		Users:         &inMemoryTxUsers{InMemoryUserRepository: u.users, undo: undo},
+		Subscriptions: &inMemoryTxSubscriptions{InMemorySubscriptionRepository: u.subs, undo: undo},
+	}); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// inMemoryUndoLog holds the rows changed by one unit of work as they were before its first change;
+// nil marks a row that did not exist.
+type inMemoryUndoLog struct {
+	users     map[string]*models.User         // key: StripeCustomerID
+	subs      map[string]*models.Subscription // key: StripeSubscriptionID
+	trialEnds map[uuid.UUID]*time.Time        // the notified trial ends
+}
+
+func (l *inMemoryUndoLog) saveUser(r *InMemoryUserRepository, key string) {
+	if _, saved := l.users[key]; saved {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l.users[key] = nil
+	if u, ok := r.users[key]; ok {
+		before := *u
+		l.users[key] = &before
+	}
+}
+
+func (l *inMemoryUndoLog) saveSubscription(r *InMemorySubscriptionRepository, key string) {
+	if _, saved := l.subs[key]; saved {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l.subs[key] = nil
+	if s, ok := r.subscriptions[key]; ok {
+		before := *s
+		l.subs[key] = &before
+	}
+}
+
+func (l *inMemoryUndoLog) saveTrialEnd(r *InMemorySubscriptionRepository, id string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.subscriptions {
+		if s.ID.String() != id {
+			continue
+		}
+		if _, saved := l.trialEnds[s.ID]; !saved {
+			l.trialEnds[s.ID] = nil
+			if notified, ok := r.trialEndNotified[s.ID]; ok {
+				l.trialEnds[s.ID] = &notified
+			}
+		}
+		return
+	}
+}
+
+// rollback restores the saved rows. Rows are restored in place because callers may hold them.
+func (l *inMemoryUndoLog) rollback(users *InMemoryUserRepository, subs *InMemorySubscriptionRepository) {
+	users.mu.Lock()
+	for key, before := range l.users {
+		switch current, ok := users.users[key]; {
+		case before == nil:
+			delete(users.users, key)
+		case ok:
+			*current = *before
+		default:
+			users.users[key] = before
+		}
+	}
+	users.mu.Unlock()
+
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	for key, before := range l.subs {
+		switch current, ok := subs.subscriptions[key]; {
+		case before == nil:
+			delete(subs.subscriptions, key)
+		case ok:
+			*current = *before
+		default:
+			subs.subscriptions[key] = before
+		}
+	}
+	for id, before := range l.trialEnds {
+		if before == nil {
+			delete(subs.trialEndNotified, id)
+		} else {
+			subs.trialEndNotified[id] = *before
+		}
+	}
+}
+
+// inMemoryTxUsers records the users a unit of work changes before changing them.
+type inMemoryTxUsers struct {
+	*InMemoryUserRepository
+	undo *inMemoryUndoLog
+}
+
+func (r *inMemoryTxUsers) CreateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	r.undo.saveUser(r.InMemoryUserRepository, user.StripeCustomerID)
+	return r.InMemoryUserRepository.CreateUser(ctx, user)
+}
+
+func (r *inMemoryTxUsers) UpdateUser(ctx context.Context, user *models.User) (*models.User, error) {
+	r.saveUserByID(user.ID.String())
+	return r.InMemoryUserRepository.UpdateUser(ctx, user)
+}
+
+func (r *inMemoryTxUsers) SoftDeleteUser(ctx context.Context, id string, deletedAt time.Time) error {
+	r.saveUserByID(id)
+	return r.InMemoryUserRepository.SoftDeleteUser(ctx, id, deletedAt)
+}
+
+func (r *inMemoryTxUsers) saveUserByID(id string) {
+	r.mu.RLock()
+	key, found := "", false
+	for k, u := range r.users {
+		if u.ID.String() == id {
+			key, found = k, true
+			break
+		}
+	}
+	r.mu.RUnlock()
+	if found {
+		r.undo.saveUser(r.InMemoryUserRepository, key)
+	}
+}
+
+// inMemoryTxSubscriptions records the subscriptions a unit of work changes before changing them.
+type inMemoryTxSubscriptions struct {
+	*InMemorySubscriptionRepository
+	undo *inMemoryUndoLog
+}
+
+func (r *inMemoryTxSubscriptions) CreateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
+	r.undo.saveSubscription(r.InMemorySubscriptionRepository, sub.StripeSubscriptionID)
+	return r.InMemorySubscriptionRepository.CreateSubscription(ctx, sub)
+}
+
+func (r *inMemoryTxSubscriptions) UpdateSubscriptionStatus(ctx context.Context, subID string, status string) error {
+	r.undo.saveSubscription(r.InMemorySubscriptionRepository, subID)
+	return r.InMemorySubscriptionRepository.UpdateSubscriptionStatus(ctx, subID, status)
+}
+
+func (r *inMemoryTxSubscriptions) UpdateSubscriptionStatusByID(ctx context.Context, id string, status string) error {
+	if sub, err := r.InMemorySubscriptionRepository.GetSubscriptionByID(ctx, id); err == nil {
+		r.undo.saveSubscription(r.InMemorySubscriptionRepository, sub.StripeSubscriptionID)
+	}
+	return r.InMemorySubscriptionRepository.UpdateSubscriptionStatusByID(ctx, id, status)
+}
+
+func (r *inMemoryTxSubscriptions) UpdateSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
+	r.undo.saveSubscription(r.InMemorySubscriptionRepository, sub.StripeSubscriptionID)
+	return r.InMemorySubscriptionRepository.UpdateSubscription(ctx, sub)
+}
+
+func (r *inMemoryTxSubscriptions) UpsertSubscription(ctx context.Context, sub *models.Subscription) (*models.Subscription, error) {
+	r.undo.saveSubscription(r.InMemorySubscriptionRepository, sub.StripeSubscriptionID)
+	return r.InMemorySubscriptionRepository.UpsertSubscription(ctx, sub)
+}
+
+func (r *inMemoryTxSubscriptions) ClaimTrialEndNotification(ctx context.Context, id string) (bool, error) {
+	r.undo.saveTrialEnd(r.InMemorySubscriptionRepository, id)
+	return r.InMemorySubscriptionRepository.ClaimTrialEndNotification(ctx, id)
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"sy-stripe-service/internal/models"
+	"sy-stripe-service/migrations"
+)
+
+func TestUnitOfWork(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := ApplyMigrations(db.SQLite, DialectSQLite, migrations.FS); err != nil {
+		t.Fatal(err)
+	}
+	users, subs := NewInMemoryUserRepository(), NewInMemorySubscriptionRepository()
+
+	backends := []struct {
+		name  string
+		uow   UnitOfWork
+		users UserRepository
+		subs  SubscriptionRepository
+	}{
+		{"inmemory", NewInMemoryUnitOfWork(users, subs), users, subs},
+		{"sqlite", NewSQLiteUnitOfWork(db.SQLite), NewSQLiteUserRepository(db.SQLite), NewSQLiteSubscriptionRepository(db.SQLite)},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now().UTC().Truncate(time.Second)
+			user := &models.User{ID: uuid.New(), StripeCustomerID: "cus_1", Email: "a@example.com", Name: "A", CreatedAt: now, UpdatedAt: now}
+			sub := &models.Subscription{ID: uuid.New(), UserID: user.ID, StripeSubscriptionID: "sub_1", StripePriceID: "price_1", Status: "active",
+				CurrentPeriodStart: now, CurrentPeriodEnd: now.AddDate(0, 1, 0), CreatedAt: now, UpdatedAt: now}
+
+			err := b.uow.WithTx(ctx, func(repos Repos) error {
+				if _, err := repos.Users.CreateUser(ctx, user); err != nil {
+					return err
+				}
+				_, err := repos.Subscriptions.CreateSubscription(ctx, sub)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("committed unit of work: %v", err)
+			}
+
+			// A failing unit of work must leave no trace of its writes.
+			errBoom := errors.New("boom")
+			err = b.uow.WithTx(ctx, func(repos Repos) error {
+				if _, err := repos.Users.CreateUser(ctx, &models.User{ID: uuid.New(), StripeCustomerID: "cus_2", Email: "b@example.com", Name: "B", CreatedAt: now, UpdatedAt: now}); err != nil {
+					return err
+				}
+				if err := repos.Subscriptions.UpdateSubscriptionStatus(ctx, "sub_1", "canceled"); err != nil {
+					return err
+				}
+				return errBoom
+			})
+			if !errors.Is(err, errBoom) {
+				t.Fatalf("WithTx = %v, want errBoom", err)
+			}
+			if _, err := b.users.GetUserByStripeCustomerID(ctx, "cus_2"); err == nil {
+				t.Errorf("user of the rolled back unit of work was kept")
+			}
+			got, err := b.subs.GetSubscriptionByStripeSubscriptionID(ctx, "sub_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != "active" {
+				t.Errorf("status = %q after rollback, want active", got.Status)
+			}
+			if _, err := b.users.GetUserByStripeCustomerID(ctx, "cus_1"); err != nil {
+				t.Errorf("committed user missing: %v", err)
+			}
+		})
+	}
+}
+
+func TestInMemoryUnitOfWorkKeepsOtherWrites(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	users, subs := NewInMemoryUserRepository(), NewInMemorySubscriptionRepository()
+	uow := NewInMemoryUnitOfWork(users, subs)
+	ada := &models.User{ID: uuid.New(), StripeCustomerID: "cus_1", Email: "a@example.com", Name: "A", CreatedAt: now, UpdatedAt: now}
+	if _, err := users.CreateUser(ctx, ada); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes made outside the unit of work while it runs survive its rollback.
+	errBoom := errors.New("boom")
+	err := uow.WithTx(ctx, func(repos Repos) error {
+		if _, err := repos.Users.UpdateUser(ctx, &models.User{ID: ada.ID, Email: "changed@example.com", Name: "Changed", UpdatedAt: now}); err != nil {
+			return err
+		}
+		if _, err := users.CreateUser(ctx, &models.User{ID: uuid.New(), StripeCustomerID: "cus_2", Email: "b@example.com", Name: "B", CreatedAt: now, UpdatedAt: now}); err != nil {
+			return err
+		}
+		sub := &models.Subscription{ID: uuid.New(), UserID: ada.ID, StripeSubscriptionID: "sub_2", Status: "active", CreatedAt: now, UpdatedAt: now}
+		if _, err := subs.UpsertSubscription(ctx, sub); err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("WithTx = %v, want errBoom", err)
+	}
+	if got, err := users.GetUserByStripeCustomerID(ctx, "cus_1"); err != nil || got.Email != "a@example.com" || got.Name != "A" {
+		t.Errorf("user changed by the unit of work = %+v (%v), want it restored", got, err)
+	}
+	if _, err := users.GetUserByStripeCustomerID(ctx, "cus_2"); err != nil {
+		t.Errorf("user created outside the unit of work was lost: %v", err)
+	}
+	if _, err := subs.GetSubscriptionByStripeSubscriptionID(ctx, "sub_2"); err != nil {
+		t.Errorf("subscription created outside the unit of work was lost: %v", err)
+	}
+}
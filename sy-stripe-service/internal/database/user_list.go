@@ -0,0 +1,239 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sy-stripe-service/internal/models"
+)
+
+// UserSort is a sort key for ListUsers.
+type UserSort string
+
+const (
+	UserSortCreatedAt UserSort = "created_at"
+	UserSortEmail     UserSort = "email"
+)
+
+const (
+	DefaultUserListLimit = 50
+	MaxUserListLimit     = 200
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+// or was issued for a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// UserListParams selects one page of users.
+//
+// Every backend returns the same order: created_at is compared as UTC with microsecond precision,
+// emails are compared bytewise, and ties are broken by id in the same direction.
+type UserListParams struct {
+	// Limit is the page size; zero selects DefaultUserListLimit.
+	Limit int
+	// After is the NextCursor of the previous page.
+	After string
+	// Email matches users whose email contains it, ignoring case.
+	Email string
+	// Name matches users whose name contains it, ignoring case.
+	Name string
+	// CreatedFrom (inclusive) and CreatedTo (exclusive) bound created_at.
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// SubscriptionStatus matches users with at least one subscription in this status.
+	SubscriptionStatus string
+	Sort               UserSort
+	Desc               bool
+}
+
+// UserPage is one page of a user listing.
+type UserPage struct {
+	Users []*models.User
+	// NextCursor continues the listing; it is empty on the last page.
+	NextCursor string
+	HasMore    bool
+}
+
+// userCursor is the position after the last user of a page.
+type userCursor struct {
+	Sort UserSort `json:"s"`
+	Desc bool     `json:"d"`
+	// Key is the sort value of the last user: an RFC 3339 time or an email.
+	Key string `json:"k"`
+	ID  string `json:"id"`
+}
+
+// dbTime normalizes a timestamp before it is stored or compared, so that all backends
+// hold and order the same value.
+func dbTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// sqliteTimeLayout stores timestamps as fixed-width UTC text, which sorts chronologically.
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000+00:00"
+
+func sqliteTime(t time.Time) string {
+	return dbTime(t).Format(sqliteTimeLayout)
+}
+
+// normalize validates the params and fills in the defaults.
+func (p *UserListParams) normalize() error {
+	switch {
+	case p.Limit == 0:
+		p.Limit = DefaultUserListLimit
+	case p.Limit < 0 || p.Limit > MaxUserListLimit:
+		return fmt.Errorf("limit must be between 1 and %d", MaxUserListLimit)
+	}
+	switch p.Sort {
+	case "":
+		p.Sort = UserSortCreatedAt
+	case UserSortCreatedAt, UserSortEmail:
+	default:
+		return fmt.Errorf("unsupported sort %q", p.Sort)
+	}
+	if p.CreatedFrom != nil {
+		t := dbTime(*p.CreatedFrom)
+		p.CreatedFrom = &t
+	}
+	if p.CreatedTo != nil {
+		t := dbTime(*p.CreatedTo)
+		p.CreatedTo = &t
+	}
+	return nil
+}
+
+// cursor decodes After; it returns nil for the first page.
+func (p *UserListParams) cursor() (*userCursor, error) {
+	if p.After == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(p.After)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c userCursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != p.Sort || c.Desc != p.Desc {
+		return nil, fmt.Errorf("%w: it was issued for a different sort order", ErrInvalidCursor)
+	}
+	if c.Sort == UserSortCreatedAt {
+		if _, err := time.Parse(time.RFC3339Nano, c.Key); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return &c, nil
+}
+
+func (c *userCursor) createdAt() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, c.Key)
+	return dbTime(t)
+}
+
+// page trims the extra row fetched to detect a next page and builds the cursor.
+func (p *UserListParams) page(users []*models.User) *UserPage {
+	page := &UserPage{Users: users}
+	if len(users) > p.Limit {
+		page.Users, page.HasMore = users[:p.Limit], true
+		last := page.Users[p.Limit-1]
+		c := userCursor{Sort: p.Sort, Desc: p.Desc, ID: last.ID.String(), Key: last.Email}
+		if p.Sort == UserSortCreatedAt {
+			c.Key = dbTime(last.CreatedAt).Format(time.RFC3339Nano)
+		}
+		raw, _ := json.Marshal(c)
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if page.Users == nil {
+		page.Users = []*models.User{}
+	}
+	return page
+}
+
+// compareUsers orders two users by the listing's sort key and id, ascending.
+func compareUsers(sortKey UserSort, a, b *models.User) int {
+	if sortKey == UserSortEmail {
+		if c := strings.Compare(a.Email, b.Email); c != 0 {
+			return c
+		}
+	} else if c := dbTime(a.CreatedAt).Compare(dbTime(b.CreatedAt)); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID.String(), b.ID.String())
+}
+
+// escapeLike escapes the LIKE wildcards in a user-supplied substring; the queries use ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// listUsersQuery builds the keyset query of a user listing for a SQL dialect.
+// It selects Limit+1 rows so that the caller can tell whether there is a next page.
+func listUsersQuery(dialect Dialect, p *UserListParams, c *userCursor) (string, []any) {
+	where := []string{"u.deleted_at IS NULL"}
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		if dialect == DialectPostgres {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	}
+	timeArg := func(t time.Time) string {
+		if dialect == DialectSQLite {
+			return arg(sqliteTime(t))
+		}
+		return arg(dbTime(t))
+	}
+	like := "LIKE"
+	if dialect == DialectPostgres {
+		like = "ILIKE"
+	}
+
+	if p.Email != "" {
+		where = append(where, fmt.Sprintf(`u.email %s %s ESCAPE '\'`, like, arg("%"+escapeLike(p.Email)+"%")))
+	}
+	if p.Name != "" {
+		where = append(where, fmt.Sprintf(`u.name %s %s ESCAPE '\'`, like, arg("%"+escapeLike(p.Name)+"%")))
+	}
+	if p.CreatedFrom != nil {
+		where = append(where, "u.created_at >= "+timeArg(*p.CreatedFrom))
+	}
+	if p.CreatedTo != nil {
+		where = append(where, "u.created_at < "+timeArg(*p.CreatedTo))
+	}
+	if p.SubscriptionStatus != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = u.id AND s.status = "+arg(p.SubscriptionStatus)+")")
+	}
+
+	key := "u.created_at"
+	if p.Sort == UserSortEmail {
+		key = "u.email"
+		if dialect == DialectPostgres {
+			key = `u.email COLLATE "C"`
+		}
+	}
+	// SQLite stores ids as text; Postgres compares its uuid type in the same order as the text form.
+	id := "u.id"
+	op, dir := ">", "ASC"
+	if p.Desc {
+		op, dir = "<", "DESC"
+	}
+	if c != nil {
+		cursorKey := func() string {
+			if p.Sort == UserSortEmail {
+				return arg(c.Key)
+			}
+			return timeArg(c.createdAt())
+		}
+		where = append(where, fmt.Sprintf("(%s %s %s OR (%s = %s AND %s %s %s))", key, op, cursorKey(), key, cursorKey(), id, op, arg(c.ID)))
+	}
+
+	query := `SELECT u.id, u.stripe_customer_id, u.email, u.name, u.created_at, u.updated_at FROM users u WHERE ` + strings.Join(where, " AND ")
+	query += fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT %s", key, dir, id, dir, arg(p.Limit+1))
+	return query, args
+}
@@ -17,6 +17,8 @@ type User struct {
 	Name           string    `json:"name" db:"name"`
 	CreatedAt      time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+	// DeletedAt is set when the user has been soft-deleted; repositories hide such users.
+	DeletedAt      *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
 // Subscription represents a user's subscription.
@@ -28,27 +30,270 @@ type Subscription struct {
 	Status             string    `json:"status" db:"status"`
 	CurrentPeriodStart time.Time `json:"current_period_start" db:"current_period_start"`
 	CurrentPeriodEnd   time.Time `json:"current_period_end" db:"current_period_end"`
+	CancelAtPeriodEnd  bool       `json:"cancel_at_period_end" db:"cancel_at_period_end"`
+	CanceledAt         *time.Time `json:"canceled_at" db:"canceled_at"`
+	// TrialStart and TrialEnd bound the free trial; the status is trialing until TrialEnd.
+	TrialStart         *time.Time `json:"trial_start" db:"trial_start"`
+	TrialEnd           *time.Time `json:"trial_end" db:"trial_end"`
 	CreatedAt          time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
+	// Discount is the coupon applied to the subscription, stored in the discount_* columns; nil without one.
+	Discount           *SubscriptionDiscount `json:"discount" db:"-"`
 }
 
-// PriceResponse represents a Stripe price in the API response.
+// SubscriptionDiscount is a coupon applied to a subscription, directly or through a promotion code.
+// Either PercentOff or AmountOff (in Currency) is set.
+type SubscriptionDiscount struct {
+	CouponID        string     `json:"coupon_id"`
+	CouponName      string     `json:"coupon_name"`
+	PromotionCodeID string     `json:"promotion_code_id,omitempty"`
+	PercentOff      float64    `json:"percent_off,omitempty"`
+	AmountOff       int64      `json:"amount_off,omitempty"`
+	Currency        string     `json:"currency,omitempty"`
+	// Duration is once, repeating or forever; EndsAt is set for repeating coupons.
+	Duration        string     `json:"duration"`
+	EndsAt          *time.Time `json:"ends_at"`
+}
+
+// Subscription statuses reported by Stripe that the service acts on.
+const (
+	SubscriptionStatusActive   = "active"
+	SubscriptionStatusTrialing = "trialing"
+	SubscriptionStatusPastDue  = "past_due"
+	SubscriptionStatusUnpaid   = "unpaid"
+	SubscriptionStatusCanceled = "canceled"
+)
+
+// DunningStatus is the state of a subscription's failed-payment recovery.
+type DunningStatus string
+
+const (
+	// DunningStatusPastDue: a renewal payment failed and the dunning steps are running.
+	DunningStatusPastDue DunningStatus = "past_due"
+	// DunningStatusRestricted: the grace period is over and access to the subscription is restricted.
+	DunningStatusRestricted DunningStatus = "restricted"
+	// DunningStatusRecovered: an invoice was paid after the failure.
+	DunningStatusRecovered DunningStatus = "recovered"
+	// DunningStatusCanceled: the subscription was canceled by the last dunning step.
+	DunningStatusCanceled DunningStatus = "canceled"
+)
+
+// Open reports whether dunning steps may still run.
+func (s DunningStatus) Open() bool {
+	return s == DunningStatusPastDue || s == DunningStatusRestricted
+}
+
+// DunningAction is what a dunning step does.
+type DunningAction string
+
+const (
+	// DunningActionNotify sends the customer a payment failure notification.
+	DunningActionNotify DunningAction = "notify"
+	// DunningActionRestrict moves the state to DunningStatusRestricted.
+	DunningActionRestrict DunningAction = "restrict"
+	// DunningActionCancel cancels the subscription and ends dunning.
+	DunningActionCancel DunningAction = "cancel"
+)
+
+// DunningStep is an action taken a fixed time after a subscription's renewal payment first failed.
+type DunningStep struct {
+	Action DunningAction
+	After  time.Duration
+}
+
+// DunningState tracks the recovery of a subscription whose renewal payment failed.
+type DunningState struct {
+	ID                uuid.UUID     `json:"id" db:"id"`
+	SubscriptionID    uuid.UUID     `json:"subscription_id" db:"subscription_id"`
+	UserID            uuid.UUID     `json:"user_id" db:"user_id"`
+	// StripeInvoiceID is the invoice whose payment failed most recently.
+	StripeInvoiceID   string        `json:"stripe_invoice_id" db:"stripe_invoice_id"`
+	Status            DunningStatus `json:"status" db:"status"`
+	// AttemptCount is the number of failed payment attempts of that invoice.
+	AttemptCount      int64         `json:"attempt_count" db:"attempt_count"`
+	// NextRetryAt is Stripe's next automatic payment attempt; nil when Stripe stopped retrying.
+	NextRetryAt       *time.Time    `json:"next_retry_at" db:"next_retry_at"`
+	FirstFailedAt     time.Time     `json:"first_failed_at" db:"first_failed_at"`
+	// GracePeriodEndsAt is when the first restrict or cancel step runs; nil if none is configured.
+	GracePeriodEndsAt *time.Time    `json:"grace_period_ends_at" db:"grace_period_ends_at"`
+	// StepsDone counts the dunning steps already run; NextStepAt is when the next one is due.
+	StepsDone         int           `json:"steps_done" db:"steps_done"`
+	NextStepAt        *time.Time    `json:"next_step_at" db:"next_step_at"`
+	ResolvedAt        *time.Time    `json:"resolved_at" db:"resolved_at"`
+	// LastEventAt is the creation time of the last invoice event applied; older events are stale.
+	LastEventAt       time.Time     `json:"-" db:"last_event_at"`
+	CreatedAt         time.Time     `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time     `json:"updated_at" db:"updated_at"`
+}
+
+// UsageRecordStatus tracks a buffered usage record on its way to Stripe.
+type UsageRecordStatus string
+
+const (
+	// UsageRecordStatusPending records wait for the flusher, possibly after failed attempts.
+	UsageRecordStatusPending UsageRecordStatus = "pending"
+	// UsageRecordStatusReported records were accepted by Stripe.
+	UsageRecordStatusReported UsageRecordStatus = "reported"
+	// UsageRecordStatusFailed records were rejected by Stripe and are not retried.
+	UsageRecordStatusFailed UsageRecordStatus = "failed"
+)
+
+// UsageRecord is metered usage of a subscription, buffered locally until it is reported to Stripe.
+type UsageRecord struct {
+	ID                       uuid.UUID         `json:"id" db:"id"`
+	SubscriptionID           uuid.UUID         `json:"subscription_id" db:"subscription_id"`
+	// IdempotencyKey is unique per subscription; a record reported twice with it is stored once.
+	IdempotencyKey           string            `json:"idempotency_key" db:"idempotency_key"`
+	Quantity                 int64             `json:"quantity" db:"quantity"`
+	Timestamp                time.Time         `json:"timestamp" db:"timestamp"`
+	Status                   UsageRecordStatus `json:"status" db:"status"`
+	Attempts                 int               `json:"attempts" db:"attempts"`
+	// NextAttemptAt is when the flusher picks the record up; nil once it is reported or failed.
+	NextAttemptAt            *time.Time        `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError                string            `json:"last_error" db:"last_error"`
+	StripeSubscriptionItemID string            `json:"stripe_subscription_item_id" db:"stripe_subscription_item_id"`
+	StripeUsageRecordID      string            `json:"stripe_usage_record_id" db:"stripe_usage_record_id"`
+	ReportedAt               *time.Time        `json:"reported_at" db:"reported_at"`
+	CreatedAt                time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt                time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// UsageSummary totals the usage recorded for a subscription within a billing period.
+type UsageSummary struct {
+	SubscriptionID   uuid.UUID `json:"subscription_id"`
+	PeriodStart      time.Time `json:"period_start"`
+	PeriodEnd        time.Time `json:"period_end"`
+	TotalQuantity    int64     `json:"total_quantity"`
+	ReportedQuantity int64     `json:"reported_quantity"`
+	PendingQuantity  int64     `json:"pending_quantity"`
+	FailedQuantity   int64     `json:"failed_quantity"`
+	Records          int64     `json:"records"`
+}
+
+// Invoice is the local copy of a Stripe invoice.
+type Invoice struct {
+	ID                   uuid.UUID `json:"id" db:"id"`
+	UserID               uuid.UUID `json:"user_id" db:"user_id"`
+	StripeInvoiceID      string    `json:"stripe_invoice_id" db:"stripe_invoice_id"`
+	StripeSubscriptionID string    `json:"stripe_subscription_id" db:"stripe_subscription_id"`
+	Number               string    `json:"number" db:"number"`
+	Status               string    `json:"status" db:"status"`
+	Currency             string    `json:"currency" db:"currency"`
+	AmountDue            int64     `json:"amount_due" db:"amount_due"`
+	AmountPaid           int64     `json:"amount_paid" db:"amount_paid"`
+	HostedInvoiceURL     string    `json:"hosted_invoice_url" db:"hosted_invoice_url"`
+	InvoicePDF           string    `json:"invoice_pdf" db:"invoice_pdf"`
+	PeriodStart          time.Time `json:"period_start" db:"period_start"`
+	PeriodEnd            time.Time `json:"period_end" db:"period_end"`
+	// IssuedAt is the creation time of the invoice in Stripe; listings are ordered by it.
+	IssuedAt             time.Time `json:"issued_at" db:"issued_at"`
+	CreatedAt            time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// UpcomingInvoice previews the next invoice Stripe will issue for a subscription.
+type UpcomingInvoice struct {
+	AmountDue     int64     `json:"amount_due"`
+	Total         int64     `json:"total"`
+	Currency      string    `json:"currency"`
+	PeriodStart   time.Time `json:"period_start"`
+	PeriodEnd     time.Time `json:"period_end"`
+	NextPaymentAt time.Time `json:"next_payment_at"`
+}
+
+// PaymentMethod is a card attached to a user's Stripe customer.
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth uint64 `json:"exp_month"`
+	ExpYear  uint64 `json:"exp_year"`
+	// IsDefault marks the card used for the customer's invoices and subscriptions.
+	IsDefault bool `json:"is_default"`
+}
+
+// Processing results recorded for a Stripe webhook event.
+const (
+	StripeEventStatusPending    = "pending"
+	StripeEventStatusProcessing = "processing"
+	StripeEventStatusProcessed  = "processed"
+	StripeEventStatusIgnored    = "ignored"
+	StripeEventStatusSkipped    = "skipped"
+	StripeEventStatusFailed     = "failed"
+)
+
+// StripeEvent is a ledger entry for a received Stripe webhook event.
+type StripeEvent struct {
+	ID          string     `json:"id" db:"id"`
+	Type        string     `json:"type" db:"type"`
+	Payload     string     `json:"payload" db:"payload"`
+	Status      string     `json:"status" db:"status"`
+	Error       string     `json:"error" db:"error"`
+	ReceivedAt  time.Time  `json:"received_at" db:"received_at"`
+	ProcessedAt *time.Time `json:"processed_at" db:"processed_at"`
+}
+
+// PlanChangePreview describes the upcoming invoice a plan change would produce.
+type PlanChangePreview struct {
+	SubscriptionID  string    `json:"subscription_id"`
+	PriceID         string    `json:"price_id"`
+	ProrationAmount int64     `json:"proration_amount"`
+	AmountDue       int64     `json:"amount_due"`
+	Total           int64     `json:"total"`
+	Currency        string    `json:"currency"`
+	NextPaymentAt   time.Time `json:"next_payment_at"`
+}
+
+// PriceResponse represents a Stripe price in the API response. Interval, IntervalCount, UsageType
+// and TrialPeriodDays are only set for recurring prices; Tiers and TiersMode only for tiered ones.
 type PriceResponse struct {
-	ID        string  `json:"id"`
-	Nickname  string  `json:"nickname"`
-	UnitAmount int64   `json:"unit_amount"`
-	Currency  string  `json:"currency"`
-	Interval  string  `json:"interval"`
-	Created   int64   `json:"created"`
+	ID              string                         `json:"id"`
+	Nickname        string                         `json:"nickname"`
+	LookupKey       string                         `json:"lookup_key"`
+	// Type is one_time or recurring.
+	Type            string                         `json:"type"`
+	// BillingScheme is per_unit or tiered.
+	BillingScheme   string                         `json:"billing_scheme"`
+	UnitAmount      int64                          `json:"unit_amount"`
+	Currency        string                         `json:"currency"`
+	// CurrencyOptions holds the amounts of the price in further currencies.
+	CurrencyOptions map[string]PriceCurrencyOption `json:"currency_options,omitempty"`
+	Interval        string                         `json:"interval"`
+	IntervalCount   int64                          `json:"interval_count"`
+	// UsageType is licensed or metered.
+	UsageType       string                         `json:"usage_type"`
+	TrialPeriodDays int64                          `json:"trial_period_days"`
+	// TiersMode is graduated or volume.
+	TiersMode       string                         `json:"tiers_mode"`
+	Tiers           []PriceTier                    `json:"tiers"`
+	// TaxBehavior is inclusive, exclusive or unspecified.
+	TaxBehavior     string                         `json:"tax_behavior"`
+	Created         int64                          `json:"created"`
+}
+
+// PriceTier is one tier of a tiered price. UpTo is nil for the last, unbounded tier.
+type PriceTier struct {
+	UpTo       *int64 `json:"up_to"`
+	UnitAmount int64  `json:"unit_amount"`
+	FlatAmount int64  `json:"flat_amount"`
+}
+
+// PriceCurrencyOption is the amount of a price in one of its additional currencies.
+type PriceCurrencyOption struct {
+	UnitAmount  int64  `json:"unit_amount"`
+	TaxBehavior string `json:"tax_behavior"`
 }
 
 // ProductResponse represents a Stripe product with nested prices.
 type ProductResponse struct {
-	ID          string          `json:"id"`
-	Name        string          `json:"name"`
-	Description string          `json:"description"`
-	Active      bool            `json:"active"`
-	Prices      []PriceResponse `json:"prices"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Active      bool              `json:"active"`
+	Metadata    map[string]string `json:"metadata"`
+	// Features are the selling points listed on the product, from its "features" metadata.
+	Features    []string          `json:"features"`
+	Prices      []PriceResponse   `json:"prices"`
 }
 
 // Add other models as needed, e.g., Product, Price, Invoice, etc.
@@ -1,144 +1,38 @@
+// Command sy-stripe-service at the module root is the legacy entry point.
+// It serves the same API as cmd/api and additionally accepts the request shapes
+// of the original standalone server; see app.NewLegacyHandler.
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"flag"
 	"log"
-	"net/http"
-	"os"
 
-	"github.com/joho/godotenv"
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/product"
-	"github.com/stripe/stripe-go/v72/sub"
-	"github.com/stripe/stripe-go/v72/customer"
+	"sy-stripe-service/internal/app"
+	"sy-stripe-service/internal/config"
+	"sy-stripe-service/internal/database"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("Error loading .env file, assuming environment variables are set directly.")
-	}
-
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-
-	if stripe.Key == "" {
-		log.Fatal("STRIPE_SECRET_KEY environment variable not set")
-	}
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Hello, Go Stripe Backend!")
-	})
-
-	http.HandleFunc("/api/v1/products", getProductsHandler)
-	http.HandleFunc("/api/v1/subscriptions/create", createSubscriptionHandler)
-	http.HandleFunc("/api/v1/customers/create", createCustomerHandler)
-
-	fmt.Println("Server starting on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
-// Request body for creating a customer
-type CreateCustomerRequest struct {
-	Email string `json:"email"`
-	Name  string `json:"name"`
-}
+	migrationsDir := flag.String("migrations-dir", "", "apply migrations from this directory instead of the ones embedded in the binary")
+	flag.Parse()
 
-func createCustomerHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req CreateCustomerRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	cfg, err := config.LoadConfig()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	if req.Email == "" {
-		http.Error(w, "Email is required", http.StatusBadRequest)
-		return
-	}
-
-	params := &stripe.CustomerParams{
-		Email: stripe.String(req.Email),
-		Name:  stripe.String(req.Name),
-	}
-
-	customer, err := customer.New(params)
+	db, err := database.NewDB(cfg.DatabaseURL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Fatalf("Failed to connect to database: %v", err)
 	}
+	defer db.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(customer)
-}
-
-// Request body for creating a subscription
-type CreateSubscriptionRequest struct {
-	CustomerID string `json:"customerId"`
-	PriceID    string `json:"priceId"`
-}
-
-func createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var req CreateSubscriptionRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if req.CustomerID == "" || req.PriceID == "" {
-		http.Error(w, "Customer ID and Price ID are required", http.StatusBadRequest)
-		return
-	}
-
-	params := &stripe.SubscriptionParams{
-		Customer: stripe.String(req.CustomerID),
-		Items: []*stripe.SubscriptionItemsParams{
-			{
-				Price: stripe.String(req.PriceID),
-			},
-		},
-		// You might want to add more parameters here, e.g., payment_behavior, collection_method
-		// For example, to automatically charge the customer:
-		PaymentBehavior: stripe.String("default_incomplete"),
-		CollectionMethod: stripe.String("charge_automatically"),
-	}
-
-	sub, err := sub.New(params)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := app.Migrate(db, app.MigrationsFS(*migrationsDir)); err != nil {
+		log.Fatalf("Failed to apply migrations: %v", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sub)
-}
-
-func getProductsHandler(w http.ResponseWriter, r *http.Request) {
-	params := &stripe.ProductListParams{}
-	params.AddExpand("data.default_price") // Include default price in the product object
-
-	iter := product.List(params)
-
-	var products []stripe.Product
-	for iter.Next() {
-		products = append(products, *iter.Product())
-	}
-
-	if err := iter.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	a := app.Build(cfg, app.Deps{DB: db})
+	if err := app.Run(cfg, app.NewLegacyHandler(a.Handler), a.Workers...); err != nil {
+		log.Fatalf("Server error: %v", err)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
 }
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS stripe_events (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    received_at TEXT NOT NULL DEFAULT (datetime('now')),
+    processed_at TEXT
+);
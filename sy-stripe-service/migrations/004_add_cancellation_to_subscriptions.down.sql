@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions DROP COLUMN canceled_at;
+ALTER TABLE subscriptions DROP COLUMN cancel_at_period_end;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_users_created_at_id;
+DROP INDEX IF EXISTS idx_users_email_id;
+DROP INDEX IF EXISTS idx_subscriptions_user_id_status;
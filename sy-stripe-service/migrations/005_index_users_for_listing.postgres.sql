@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at, id);
+-- Listings sort emails bytewise so that every backend returns the same order.
+CREATE INDEX IF NOT EXISTS idx_users_email_id ON users (email COLLATE "C", id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id_status ON subscriptions (user_id, status);
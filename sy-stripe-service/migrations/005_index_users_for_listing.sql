@@ -0,0 +1,9 @@
+-- Store user timestamps in one fixed-width UTC format so that they sort correctly as text.
+UPDATE users SET created_at = strftime('%Y-%m-%d %H:%M:%f', created_at) || '000+00:00'
+WHERE strftime('%Y-%m-%d %H:%M:%f', created_at) IS NOT NULL;
+UPDATE users SET updated_at = strftime('%Y-%m-%d %H:%M:%f', updated_at) || '000+00:00'
+WHERE strftime('%Y-%m-%d %H:%M:%f', updated_at) IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at, id);
+CREATE INDEX IF NOT EXISTS idx_users_email_id ON users (email, id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id_status ON subscriptions (user_id, status);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS invoices (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stripe_invoice_id VARCHAR(255) UNIQUE NOT NULL,
+    stripe_subscription_id VARCHAR(255) NOT NULL DEFAULT '',
+    number VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(50) NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    amount_due BIGINT NOT NULL,
+    amount_paid BIGINT NOT NULL,
+    hosted_invoice_url TEXT NOT NULL DEFAULT '',
+    invoice_pdf TEXT NOT NULL DEFAULT '',
+    period_start TIMESTAMP NOT NULL,
+    period_end TIMESTAMP NOT NULL,
+    issued_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_invoices_user_id_issued_at_id ON invoices (user_id, issued_at, id);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS invoices (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stripe_invoice_id TEXT UNIQUE NOT NULL,
+    stripe_subscription_id TEXT NOT NULL DEFAULT '',
+    number TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    amount_due INTEGER NOT NULL,
+    amount_paid INTEGER NOT NULL,
+    hosted_invoice_url TEXT NOT NULL DEFAULT '',
+    invoice_pdf TEXT NOT NULL DEFAULT '',
+    period_start TEXT NOT NULL,
+    period_end TEXT NOT NULL,
+    issued_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invoices_user_id_issued_at_id ON invoices (user_id, issued_at, id);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS dunning_states;
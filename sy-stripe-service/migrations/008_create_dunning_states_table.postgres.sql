@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS dunning_states (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    subscription_id UUID UNIQUE NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stripe_invoice_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    attempt_count BIGINT NOT NULL DEFAULT 0,
+    next_retry_at TIMESTAMP,
+    first_failed_at TIMESTAMP NOT NULL,
+    grace_period_ends_at TIMESTAMP,
+    steps_done INTEGER NOT NULL DEFAULT 0,
+    next_step_at TIMESTAMP,
+    resolved_at TIMESTAMP,
+    last_event_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_dunning_states_next_step_at ON dunning_states (next_step_at);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS dunning_states (
+    id TEXT PRIMARY KEY,
+    subscription_id TEXT UNIQUE NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stripe_invoice_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempt_count INTEGER NOT NULL DEFAULT 0,
+    next_retry_at TEXT,
+    first_failed_at TEXT NOT NULL,
+    grace_period_ends_at TEXT,
+    steps_done INTEGER NOT NULL DEFAULT 0,
+    next_step_at TEXT,
+    resolved_at TEXT,
+    last_event_at TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_dunning_states_next_step_at ON dunning_states (next_step_at);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS usage_records (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(255) NOT NULL,
+    quantity BIGINT NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT '',
+    stripe_subscription_item_id VARCHAR(255) NOT NULL DEFAULT '',
+    stripe_usage_record_id VARCHAR(255) NOT NULL DEFAULT '',
+    reported_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (subscription_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_records_status_next_attempt_at ON usage_records (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_usage_records_subscription_id_timestamp ON usage_records (subscription_id, timestamp);
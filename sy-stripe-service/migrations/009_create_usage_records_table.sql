@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS usage_records (
+    id TEXT PRIMARY KEY,
+    subscription_id TEXT NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    idempotency_key TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    timestamp TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TEXT,
+    last_error TEXT NOT NULL DEFAULT '',
+    stripe_subscription_item_id TEXT NOT NULL DEFAULT '',
+    stripe_usage_record_id TEXT NOT NULL DEFAULT '',
+    reported_at TEXT,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    UNIQUE (subscription_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_records_status_next_attempt_at ON usage_records (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_usage_records_subscription_id_timestamp ON usage_records (subscription_id, timestamp);
@@ -0,0 +1,8 @@
+ALTER TABLE subscriptions DROP COLUMN discount_ends_at;
+ALTER TABLE subscriptions DROP COLUMN discount_duration;
+ALTER TABLE subscriptions DROP COLUMN discount_currency;
+ALTER TABLE subscriptions DROP COLUMN discount_amount_off;
+ALTER TABLE subscriptions DROP COLUMN discount_percent_off;
+ALTER TABLE subscriptions DROP COLUMN discount_promotion_code_id;
+ALTER TABLE subscriptions DROP COLUMN discount_coupon_name;
+ALTER TABLE subscriptions DROP COLUMN discount_coupon_id;
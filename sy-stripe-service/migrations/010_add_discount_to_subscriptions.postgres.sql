@@ -0,0 +1,8 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_coupon_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_coupon_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_promotion_code_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_percent_off DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_amount_off BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_currency VARCHAR(3) NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_duration VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount_ends_at TIMESTAMP;
@@ -0,0 +1,8 @@
+ALTER TABLE subscriptions ADD COLUMN discount_coupon_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN discount_coupon_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN discount_promotion_code_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN discount_percent_off REAL NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN discount_amount_off INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN discount_currency TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN discount_duration TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN discount_ends_at TEXT;
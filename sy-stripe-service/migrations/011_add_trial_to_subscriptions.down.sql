@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_subscriptions_status_trial_end;
+ALTER TABLE subscriptions DROP COLUMN trial_end_notified;
+ALTER TABLE subscriptions DROP COLUMN trial_end;
+ALTER TABLE subscriptions DROP COLUMN trial_start;
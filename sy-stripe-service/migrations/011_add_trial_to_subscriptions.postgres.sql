@@ -0,0 +1,6 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_start TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end TIMESTAMP;
+-- trial_end_notified is the trial end the customer was last reminded of.
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end_notified TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_status_trial_end ON subscriptions (status, trial_end);
@@ -0,0 +1,6 @@
+ALTER TABLE subscriptions ADD COLUMN trial_start TEXT;
+ALTER TABLE subscriptions ADD COLUMN trial_end TEXT;
+-- trial_end_notified is the trial end the customer was last reminded of.
+ALTER TABLE subscriptions ADD COLUMN trial_end_notified TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_status_trial_end ON subscriptions (status, trial_end);
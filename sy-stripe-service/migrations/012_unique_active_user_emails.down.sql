@@ -0,0 +1,18 @@
+-- migrate:foreign_keys=off
+-- The table is rebuilt with the UNIQUE on email again; see the up migration.
+CREATE TABLE users_old (
+    id TEXT PRIMARY KEY,
+    stripe_customer_id TEXT UNIQUE NOT NULL,
+    email TEXT UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (datetime('now')),
+    updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+    deleted_at TEXT
+);
+INSERT INTO users_old (id, stripe_customer_id, email, name, created_at, updated_at, deleted_at)
+SELECT id, stripe_customer_id, email, name, created_at, updated_at, deleted_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_old RENAME TO users;
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at, id);
+CREATE INDEX IF NOT EXISTS idx_users_email_id ON users (email, id);
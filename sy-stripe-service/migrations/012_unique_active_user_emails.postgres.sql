@@ -0,0 +1,3 @@
+-- Soft-deleted users release their email: it only has to be unique among active users.
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_active ON users (email) WHERE deleted_at IS NULL;
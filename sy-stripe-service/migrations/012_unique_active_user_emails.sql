@@ -0,0 +1,22 @@
+-- migrate:foreign_keys=off
+-- Soft-deleted users release their email: it only has to be unique among active users.
+-- SQLite cannot drop a column constraint, so the table is rebuilt without the UNIQUE on email.
+-- The directive above makes the migrator turn foreign keys off first: dropping users with them on
+-- would cascade to subscriptions, invoices, dunning states and usage records.
+CREATE TABLE users_new (
+    id TEXT PRIMARY KEY,
+    stripe_customer_id TEXT UNIQUE NOT NULL,
+    email TEXT NOT NULL,
+    name TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT (datetime('now')),
+    updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+    deleted_at TEXT
+);
+INSERT INTO users_new (id, stripe_customer_id, email, name, created_at, updated_at, deleted_at)
+SELECT id, stripe_customer_id, email, name, created_at, updated_at, deleted_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at, id);
+CREATE INDEX IF NOT EXISTS idx_users_email_id ON users (email, id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_active ON users (email) WHERE deleted_at IS NULL;
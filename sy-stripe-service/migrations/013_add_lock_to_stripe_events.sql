@@ -0,0 +1,2 @@
+-- locked_until is when the claim of the delivery that is processing the event expires.
+ALTER TABLE stripe_events ADD COLUMN locked_until TEXT;
@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL migrations so the binary does not depend on its working directory.
+package migrations
+
+import "embed"
+
+// FS holds every migration file; see database.Migrator for the naming scheme.
+//
+//go:embed *.sql
+var FS embed.FS
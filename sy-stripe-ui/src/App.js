@@ -2,6 +2,7 @@ import React from 'react';
 import logo from './logo2.png'; // Webpack will resolve and bundle this
 import FaqSection from './FaqSection';
 import CancelPage from './CancelPage'; // Import CancelPage at the top
+import { authHeaders } from './api/auth';
 
 // API-Konfiguration
 const API_BASE_URL = 'http://localhost:8080/api/v1';
@@ -184,9 +185,9 @@ const apiClient = {
         try {
             const response = await fetch(`${API_BASE_URL}/customers/create`, {
                 method: 'POST',
-                headers: {
+                headers: authHeaders({
                     'Content-Type': 'application/json',
-                },
+                }),
                 body: JSON.stringify({
                     email: email,
                     name: name
@@ -221,9 +222,9 @@ const apiClient = {
         try {
             const response = await fetch(`${API_BASE_URL}/checkout-session`, {
                 method: 'POST',
-                headers: {
+                headers: authHeaders({
                     'Content-Type': 'application/json',
-                },
+                }),
                 body: JSON.stringify({
                     priceId: priceId,
                     userId: userId,
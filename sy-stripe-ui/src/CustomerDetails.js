@@ -4,8 +4,14 @@ import SuccessModal from './SuccessModal';
 import { useParams, useNavigate } from 'react-router-dom';
 import logo from './logo2.png';
 import { createCheckoutSession, cancelSubscription } from './api/subscriptions';
+import { authHeaders } from './api/auth';
 
 const API_BASE_URL = 'http://localhost:8080/api/v1';
+const INVOICE_PAGE_SIZE = 10;
+
+function formatAmount(amount, currency) {
+  return (amount / 100).toLocaleString('de-DE', { style: 'currency', currency: currency ? currency.toUpperCase() : 'EUR' });
+}
 
 export default function CustomerDetails() {
   React.useEffect(() => {
@@ -19,15 +25,28 @@ export default function CustomerDetails() {
   const [plan, setPlan] = useState(null);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState(null);
+  const [invoices, setInvoices] = useState([]);
+  const [invoiceCursor, setInvoiceCursor] = useState('');
+
+  async function fetchInvoices(after = '') {
+    const params = new URLSearchParams({ limit: INVOICE_PAGE_SIZE });
+    if (after) params.set('after', after);
+    const res = await fetch(`${API_BASE_URL}/customers/${id}/invoices?${params}`, { headers: authHeaders() });
+    if (!res.ok) throw new Error('Fehler beim Laden der Rechnungen');
+    const data = await res.json();
+    setInvoices(prev => (after ? [...prev, ...data.data] : data.data));
+    setInvoiceCursor(data.has_more ? data.next_cursor : '');
+  }
 
   useEffect(() => {
     async function fetchDetails() {
       try {
-        const res = await fetch(`${API_BASE_URL}/customers/${id}/details`);
+        const res = await fetch(`${API_BASE_URL}/customers/${id}/details`, { headers: authHeaders() });
         if (!res.ok) throw new Error('Fehler beim Laden der Kundendaten');
         const data = await res.json();
         setCustomer(data);
         setPlan(data.plan || null);
+        await fetchInvoices();
       } catch (err) {
         setError(err.message);
       } finally {
@@ -55,6 +74,7 @@ export default function CustomerDetails() {
 
   const user = customer.user || {};
   const subscription = customer.subscription;
+  const upcomingInvoice = customer.upcoming_invoice;
 
   return (
     <div className="min-h-screen bg-gray-50">
@@ -128,6 +148,43 @@ export default function CustomerDetails() {
                 <div className="text-gray-600 text-lg">Kein aktives Abonnement.</div>
               </div>
             )}
+            {/* Invoice section */}
+            <div className="mt-8">
+              <h3 className="text-xl font-semibold text-gray-900 mb-4">Rechnungen</h3>
+              {upcomingInvoice && (
+                <div className="mb-4 text-gray-700">
+                  <span className="font-semibold">Nächste Rechnung:</span>{' '}
+                  {formatAmount(upcomingInvoice.amount_due, upcomingInvoice.currency)} am{' '}
+                  {new Date(upcomingInvoice.next_payment_at).toLocaleDateString()}
+                </div>
+              )}
+              {invoices.length === 0 ? (
+                <div className="text-gray-500">Noch keine Rechnungen.</div>
+              ) : (
+                <ul className="divide-y divide-gray-200">
+                  {invoices.map(inv => (
+                    <li key={inv.id} className="py-2 flex justify-between items-center">
+                      <span className="text-gray-800">
+                        {new Date(inv.issued_at).toLocaleDateString()} – {formatAmount(inv.amount_due, inv.currency)}{' '}
+                        <span className="capitalize text-gray-500">({inv.status})</span>
+                      </span>
+                      <span className="space-x-3">
+                        {inv.hosted_invoice_url && <a href={inv.hosted_invoice_url} target="_blank" rel="noreferrer" className="text-blue-600 hover:underline">Ansehen</a>}
+                        {inv.invoice_pdf && <a href={inv.invoice_pdf} target="_blank" rel="noreferrer" className="text-blue-600 hover:underline">PDF</a>}
+                      </span>
+                    </li>
+                  ))}
+                </ul>
+              )}
+              {invoiceCursor && (
+                <button
+                  onClick={() => fetchInvoices(invoiceCursor).catch(err => setError(err.message))}
+                  className="mt-4 text-blue-600 hover:underline font-medium"
+                >
+                  Mehr laden
+                </button>
+              )}
+            </div>
           </div>
         </div>
         {/* Actions: Logout, Cancel, Change/Re-add Plan */}
@@ -1,9 +1,11 @@
 import React, { useEffect, useState } from 'react';
 import { useNavigate } from 'react-router-dom';
 import logo from './logo2.png';
+import { authHeaders } from './api/auth';
 import './styles.css';
 
 const API_BASE_URL = 'http://localhost:8080/api/v1';
+const PAGE_SIZE = 25;
 
 export default function Customers() {
   React.useEffect(() => {
@@ -16,18 +18,48 @@ export default function Customers() {
   const [newCustomer, setNewCustomer] = useState({ name: '', email: '' });
   const [addingCustomer, setAddingCustomer] = useState(false);
   const [addError, setAddError] = useState(null);
+  const [emailFilter, setEmailFilter] = useState('');
+  const [sort, setSort] = useState('-created_at');
+  const [nextCursor, setNextCursor] = useState('');
+  const [loadingMore, setLoadingMore] = useState(false);
   const navigate = useNavigate();
 
-  useEffect(() => {
-    fetch(`${API_BASE_URL}/customers`)
+  // Loads one page of customers; `after` is the cursor returned with the previous page.
+  const fetchCustomers = (after = '') => {
+    const params = new URLSearchParams({ limit: PAGE_SIZE, sort });
+    if (emailFilter.trim()) params.set('email', emailFilter.trim());
+    if (after) params.set('after', after);
+    return fetch(`${API_BASE_URL}/customers?${params}`, { headers: authHeaders() })
       .then(res => {
         if (!res.ok) throw new Error('Failed to load users');
         return res.json();
       })
-      .then(data => setUsers(Array.isArray(data) ? data : []))
-      .catch(setError)
-      .finally(() => setLoading(false));
-  }, []);
+      .then(page => {
+        setNextCursor(page.has_more ? page.next_cursor : '');
+        return Array.isArray(page.data) ? page.data : [];
+      });
+  };
+
+  useEffect(() => {
+    setLoading(true);
+    setError(null);
+    const timer = setTimeout(() => {
+      fetchCustomers()
+        .then(setUsers)
+        .catch(e => setError(e.message))
+        .finally(() => setLoading(false));
+    }, 300);
+    return () => clearTimeout(timer);
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [emailFilter, sort]);
+
+  const handleLoadMore = () => {
+    setLoadingMore(true);
+    fetchCustomers(nextCursor)
+      .then(more => setUsers(prev => [...prev, ...more]))
+      .catch(e => setError(e.message))
+      .finally(() => setLoadingMore(false));
+  };
 
   const handleGoToProfile = (user) => {
     localStorage.setItem('user_id', user.id);
@@ -43,7 +75,7 @@ export default function Customers() {
     try {
       const res = await fetch(`${API_BASE_URL}/customers/create`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: authHeaders({ 'Content-Type': 'application/json' }),
         body: JSON.stringify({ name: newCustomer.name, email: newCustomer.email })
       });
       if (!res.ok) {
@@ -66,6 +98,21 @@ export default function Customers() {
     <div className="min-h-screen bg-gray-50 flex flex-col items-center justify-center py-12 md:py-20">
       <img src={logo} alt="Logo" className="h-16 mb-6" />
       <h2 className="text-2xl font-bold mb-2">Kundenübersicht</h2>
+      <div className="w-full max-w-4xl flex gap-4 mt-4">
+        <input
+          type="search"
+          className="flex-1 px-4 py-2 border rounded-lg"
+          placeholder="Nach E-Mail suchen"
+          value={emailFilter}
+          onChange={e => setEmailFilter(e.target.value)}
+        />
+        <select className="px-4 py-2 border rounded-lg" value={sort} onChange={e => setSort(e.target.value)}>
+          <option value="-created_at">Neueste zuerst</option>
+          <option value="created_at">Älteste zuerst</option>
+          <option value="email">E-Mail A–Z</option>
+          <option value="-email">E-Mail Z–A</option>
+        </select>
+      </div>
       {loading ? (
         <div>Lade Kunden...</div>
       ) : error ? (
@@ -101,6 +148,17 @@ export default function Customers() {
       ))}
     </tbody>
   </table>
+  {nextCursor && (
+    <div className="flex justify-center mt-6">
+      <button
+        className="px-4 py-2 bg-gray-200 text-gray-800 rounded-lg hover:bg-gray-300 transition"
+        onClick={handleLoadMore}
+        disabled={loadingMore}
+      >
+        {loadingMore ? 'Lade...' : 'Mehr laden'}
+      </button>
+    </div>
+  )}
 </div>
         </>
       )}
@@ -1,5 +1,6 @@
 import React from 'react';
 import logo from './logo2.png'; // Webpack will resolve and bundle this
+import { authHeaders } from './api/auth';
 
 /**
  * Success-Seite nach erfolgreichem Checkout
@@ -22,7 +23,7 @@ function Success() {
             return;
         }
         console.log("Fetching session:", sessionId);
-        fetch(`http://localhost:8080/api/v1/checkout-session/${sessionId}`)
+        fetch(`http://localhost:8080/api/v1/checkout-session/${sessionId}`, { headers: authHeaders() })
             .then(res => {
                 if (!res.ok) throw new Error('Fehler beim Laden der Session-Daten.');
                 return res.json();
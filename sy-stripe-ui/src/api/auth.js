@@ -0,0 +1,22 @@
+// Credentials for the backend API.
+// The token is a customer JWT, or an admin API key for the customer administration pages.
+// Without a token only the public endpoints work: the product catalog and guest checkout.
+const TOKEN_KEY = 'syApiToken';
+
+export function getToken() {
+  return window.localStorage.getItem(TOKEN_KEY) || '';
+}
+
+export function setToken(token) {
+  if (token) {
+    window.localStorage.setItem(TOKEN_KEY, token);
+  } else {
+    window.localStorage.removeItem(TOKEN_KEY);
+  }
+}
+
+// authHeaders adds the Authorization header to headers when a token is stored.
+export function authHeaders(headers = {}) {
+  const token = getToken();
+  return token ? { ...headers, Authorization: `Bearer ${token}` } : headers;
+}
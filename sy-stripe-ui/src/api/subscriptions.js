@@ -1,9 +1,12 @@
 // API helper for subscription actions
+import { authHeaders } from './auth';
+
 const API_BASE_URL = 'http://localhost:8080/api/v1';
 
 export async function cancelSubscription(subscriptionId) {
   const res = await fetch(`${API_BASE_URL}/subscriptions/${subscriptionId}/cancel`, {
     method: 'POST',
+    headers: authHeaders(),
   });
   if (!res.ok) throw new Error('Kündigung fehlgeschlagen');
   return res.json();
@@ -12,7 +15,7 @@ export async function cancelSubscription(subscriptionId) {
 export async function createCheckoutSession(priceId, userId, customerId) {
   const res = await fetch(`${API_BASE_URL}/checkout-session`, {
     method: 'POST',
-    headers: { 'Content-Type': 'application/json' },
+    headers: authHeaders({ 'Content-Type': 'application/json' }),
     body: JSON.stringify({ priceId, userId, customerId })
   });
   if (!res.ok) {